@@ -17,12 +17,252 @@ limitations under the License.
 package gubernator
 
 import (
+	"math"
+	"time"
+
 	"github.com/mailgun/gubernator/cache"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// The default max duration of a rate limit, longer than any useful rate limit yet far enough from
+// math.MaxInt64 that the expiration of a rate limit can never overflow.
+const defaultMaxDuration = time.Hour * 24 * 365 * 10
+
+// limits are the ranges of the fields of a rate limit accepted by validateRateLimitReq()
+type limits struct {
+	// The range of durations in milliseconds
+	minDuration int64
+	maxDuration int64
+	// The max limit and hits
+	maxLimit int64
+	// Remove unknown behavior flags instead of rejecting the rate limit
+	ignoreUnknownBehaviors bool
+}
+
+// defaultLimits are the limits applied when no Config is provided; IE: by the LocalClient
+var defaultLimits = newLimits(Config{MaxDuration: defaultMaxDuration, MaxLimit: math.MaxInt64})
+
+func newLimits(conf Config) limits {
+	return limits{
+		minDuration: ToTimeStamp(conf.MinDuration),
+		maxDuration: ToTimeStamp(conf.MaxDuration),
+		maxLimit:    conf.MaxLimit,
+
+		ignoreUnknownBehaviors: conf.IgnoreUnknownBehaviors,
+	}
+}
+
+// knownBehaviors are the behavior flags this server implements
+const knownBehaviors = Behavior_NO_BATCHING | Behavior_GLOBAL | Behavior_REBASE_DURATION | Behavior_DRY_RUN |
+	Behavior_NO_CLIENT_CACHE
+
+// behaviorConflicts are the pairs of behavior flags which can't be combined, and why
+var behaviorConflicts = []struct {
+	a, b   Behavior
+	reason string
+}{
+	{Behavior_GLOBAL, Behavior_NO_BATCHING, "the hits of GLOBAL rate limits are always batched"},
+}
+
+// validateBehavior returns an INVALID_ARGUMENT error if the request combines behavior flags which conflict
+// or has flags this server doesn't know. Unknown flags are removed from the request instead when the
+// limits ignore them.
+func validateBehavior(r *RateLimitReq, l limits) error {
+	if unknown := r.Behavior &^ knownBehaviors; unknown != 0 {
+		if !l.ignoreUnknownBehaviors {
+			return status.Errorf(codes.InvalidArgument, "field 'behavior' has unknown flags '%#x'; known flags are '%#x'",
+				int32(unknown), int32(knownBehaviors))
+		}
+		r.Behavior &= knownBehaviors
+	}
+	// Only the CachedClient has a use for it, remove it such that peers which don't know it never see it
+	if HasBehavior(r.Behavior, Behavior_NO_CLIENT_CACHE) {
+		r.Behavior &^= Behavior_NO_CLIENT_CACHE
+	}
+
+	for _, c := range behaviorConflicts {
+		if HasBehavior(r.Behavior, c.a) && HasBehavior(r.Behavior, c.b) {
+			return status.Errorf(codes.InvalidArgument, "behavior '%s' cannot be combined with '%s'; %s", c.a, c.b, c.reason)
+		}
+	}
+	return nil
+}
+
+// validateRateLimitReq returns an error if the request is missing required fields or a field is out of
+// range. Range errors are INVALID_ARGUMENT errors, as values out of range would overflow the algorithms.
+func validateRateLimitReq(r *RateLimitReq, l limits) error {
+	if len(r.UniqueKey) == 0 {
+		return status.Error(codes.InvalidArgument, "field 'unique_key' cannot be empty")
+	}
+
+	if len(r.Name) == 0 {
+		return status.Error(codes.InvalidArgument, "field 'namespace' cannot be empty")
+	}
+
+	if r.Duration < l.minDuration || r.Duration > l.maxDuration {
+		return status.Errorf(codes.InvalidArgument, "field 'duration' must be between '%d' and '%d'; got '%d'",
+			l.minDuration, l.maxDuration, r.Duration)
+	}
+
+	if r.Limit < 0 || r.Limit > l.maxLimit {
+		return status.Errorf(codes.InvalidArgument, "field 'limit' must be between '0' and '%d'; got '%d'",
+			l.maxLimit, r.Limit)
+	}
+
+	if r.Hits < 0 || r.Hits > l.maxLimit {
+		return status.Errorf(codes.InvalidArgument, "field 'hits' must be between '0' and '%d'; got '%d'",
+			l.maxLimit, r.Hits)
+	}
+	return validateBehavior(r, l)
+}
+
+// addTime returns `t` plus the duration `d` in milliseconds. Rather than overflowing into the past, which
+// would expire the rate limit before it was ever used, the result saturates at the bounds of an int64.
+func addTime(t, d int64) int64 {
+	switch {
+	case d > 0 && t > math.MaxInt64-d:
+		return math.MaxInt64
+	case d < 0 && t < math.MinInt64-d:
+		return math.MinInt64
+	}
+	return t + d
+}
+
+// leakRate returns the milliseconds it takes a single hit to leak out of a leaky bucket. A bucket which
+// leaks faster than a hit per millisecond leaks a hit per millisecond; the time of the cache clock is
+// only precise to the millisecond.
+func leakRate(duration, limit int64) int64 {
+	if limit <= 0 {
+		return duration
+	}
+	if rate := duration / limit; rate > 1 {
+		return rate
+	}
+	return 1
+}
+
+// applyAlgorithm applies the rate limit algorithm requested. The caller must hold the cache lock.
+func applyAlgorithm(c cache.Cache, r *RateLimitReq) (*RateLimitResp, error) {
+	return applyAlgorithmKey(c, r.HashKey(), r, cacheNow(c))
+}
+
+// applyAlgorithmKey is identical to applyAlgorithm() but accepts the hash key of the request and the
+// current time of the cache clock, such that callers which already computed the key avoid building it
+// again and every decision made for the request, including the expiration of the cached state, is
+// made against the same time; even if the clock ticks over a millisecond while the request is applied.
+func applyAlgorithmKey(c cache.Cache, key cache.Key, r *RateLimitReq, now int64) (*RateLimitResp, error) {
+	switch r.Algorithm {
+	case Algorithm_TOKEN_BUCKET:
+		return tokenBucket(c, key, r, now)
+	case Algorithm_LEAKY_BUCKET:
+		return leakyBucket(c, key, r, now)
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "invalid rate limit algorithm '%d'", r.Algorithm)
+}
+
+// cacheNow returns the current time in milliseconds by the clock of the cache if it has one, else by the system clock
+func cacheNow(c cache.Cache) int64 {
+	if clocked, ok := c.(cache.Clocked); ok {
+		return clocked.Now()
+	}
+	return cache.MillisecondNow()
+}
+
+// getAt looks up the key, checking expiration against `now` if the cache supports it
+func getAt(c cache.Cache, key cache.Key, now int64) (interface{}, bool) {
+	if g, ok := c.(cache.TimedGetter); ok {
+		return g.GetAt(key, now)
+	}
+	return c.Get(key)
+}
+
+// respCopy returns a copy of a response held by the cache. Later requests modify the cached response
+// while they hold the lock, as such the algorithms must never return it to a caller which reads it
+// after the lock is released; IE: while gRPC marshals the response.
+func respCopy(rl *RateLimitResp) *RateLimitResp {
+	cpy := *rl
+	return &cpy
+}
+
+// tokenBucketItem is the state of a token bucket held by the cache. The duration of the current window is
+// kept with its status, such that a request which changes the duration knows when the window started.
+type tokenBucketItem struct {
+	Status   RateLimitResp
+	Duration int64
+}
+
+// globalItem is the status of a GLOBAL rate limit received from its owner, held by the cache of the peers
+// which don't own the rate limit
+type globalItem struct {
+	Status RateLimitResp
+	// The generation of the rate limit the status is of, see windowStart()
+	Generation int64
+}
+
+// cachedStatus returns the status of a rate limit held by the cache; either the state of a token bucket or
+// the status of a GLOBAL rate limit received from its owner.
+func cachedStatus(item interface{}) (*RateLimitResp, bool) {
+	switch v := item.(type) {
+	case *tokenBucketItem:
+		return &v.Status, true
+	case *globalItem:
+		return &v.Status, true
+	}
+	return nil, false
+}
+
+// leakyBucketItem is the state of a leaky bucket held by the cache
+type leakyBucketItem struct {
+	Limit          int64
+	Duration       int64
+	LimitRemaining int64
+	TimeStamp      int64
+}
+
+// itemDuration returns the duration of the rate limit a token or leaky bucket held by the cache is of
+func itemDuration(item interface{}) (int64, bool) {
+	switch v := item.(type) {
+	case *tokenBucketItem:
+		return v.Duration, true
+	case *leakyBucketItem:
+		return v.Duration, true
+	}
+	return 0, false
+}
+
+// windowStart returns the time the current window of a token bucket started, which identifies the window
+// as the generation of a GLOBAL rate limit. The start of a window does not change when the window is
+// rebased to a new duration. Returns zero for any other item, as a leaky bucket has no windows.
+func windowStart(item interface{}) int64 {
+	if t, ok := item.(*tokenBucketItem); ok {
+		return addTime(t.Status.ResetTime, -t.Duration)
+	}
+	return 0
+}
+
+// superseded returns true if the window of the rate limit which GLOBAL hits were counted against has
+// ended, in which case applying the hits would count them against the next window. Hits without a
+// generation were counted before the peer received the status of the rate limit and always apply.
+func superseded(c cache.Cache, key cache.Key, r *RateLimitReq, generation, now int64) bool {
+	if generation == 0 {
+		return false
+	}
+	item, ok := getAt(c, key, now)
+	if !ok {
+		return addTime(generation, r.Duration) < now
+	}
+	start := windowStart(item)
+	return start != 0 && start > generation
+}
+
 // Implements token bucket algorithm for rate limiting. https://en.wikipedia.org/wiki/Token_bucket
-func tokenBucket(c cache.Cache, r *RateLimitReq) (*RateLimitResp, error) {
-	item, ok := c.Get(r.HashKey())
+//
+// A request which changes the duration of the rate limit does not change the current window, the new
+// duration takes effect once the window resets. Unless the request has the REBASE_DURATION behavior, then
+// the window is rebased to end at its start plus the new duration and the cache entry expires with it.
+func tokenBucket(c cache.Cache, key cache.Key, r *RateLimitReq, now int64) (*RateLimitResp, error) {
+	item, ok := getAt(c, key, now)
 	if ok {
 		// The following semantic allows for requests of more than the limit to be rejected, but subsequent
 		// requests within the same duration that are under the limit to succeed. IE: client attempts to
@@ -30,89 +270,120 @@ func tokenBucket(c cache.Cache, r *RateLimitReq) (*RateLimitResp, error) {
 		// don't store OVER_LIMIT in the cache the client can retry within the same rate limit duration with
 		// 100 emails and the request will succeed.
 
-		rl, ok := item.(*RateLimitResp)
-		if !ok {
+		var t *tokenBucketItem
+		switch v := item.(type) {
+		case *tokenBucketItem:
+			t = v
+		case *globalItem:
+			// The status of a GLOBAL rate limit received from its previous owner, which doesn't include the
+			// duration of the window. Assume the window has the duration requested.
+			t = &tokenBucketItem{Status: v.Status, Duration: r.Duration}
+			c.Add(key, t, v.Status.ResetTime)
+		default:
 			// Client switched algorithms; perhaps due to a migration?
-			c.Remove(r.HashKey())
-			return tokenBucket(c, r)
+			c.Remove(key)
+			return tokenBucket(c, key, r, now)
 		}
 
+		if r.Duration != t.Duration && HasBehavior(r.Behavior, Behavior_REBASE_DURATION) {
+			resetTime := addTime(addTime(t.Status.ResetTime, -t.Duration), r.Duration)
+			// The window shrank below the time elapsed since it started, start a new window
+			if resetTime < now {
+				c.Remove(key)
+				return tokenBucket(c, key, r, now)
+			}
+			t.Status.ResetTime = resetTime
+			t.Duration = r.Duration
+			c.UpdateExpiration(key, resetTime)
+		}
+		rl := &t.Status
+
 		// If we are already at the limit
 		if rl.Remaining == 0 {
 			rl.Status = Status_OVER_LIMIT
-			return rl, nil
+			return respCopy(rl), nil
 		}
 
 		// Client is only interested in retrieving the current status
 		if r.Hits == 0 {
-			return rl, nil
+			return respCopy(rl), nil
 		}
 
 		// If requested hits takes the remainder
 		if rl.Remaining == r.Hits {
 			rl.Remaining = 0
-			return rl, nil
+			return respCopy(rl), nil
 		}
 
 		// If requested is more than available, then return over the limit without updating the cache.
 		if r.Hits > rl.Remaining {
-			retStatus := *rl
+			retStatus := respCopy(rl)
 			retStatus.Status = Status_OVER_LIMIT
-			return &retStatus, nil
+			return retStatus, nil
 		}
 
 		rl.Remaining -= r.Hits
-		return rl, nil
+		return respCopy(rl), nil
 	}
 
 	// Add a new rate limit to the cache
-	expire := cache.MillisecondNow() + r.Duration
-	status := &RateLimitResp{
-		Status:    Status_UNDER_LIMIT,
-		Limit:     r.Limit,
-		Remaining: r.Limit - r.Hits,
-		ResetTime: expire,
+	expire := addTime(now, r.Duration)
+	t := &tokenBucketItem{
+		Status: RateLimitResp{
+			Status:    Status_UNDER_LIMIT,
+			Limit:     r.Limit,
+			Remaining: r.Limit - r.Hits,
+			ResetTime: expire,
+		},
+		Duration: r.Duration,
 	}
 
 	// Client could be requesting that we always return OVER_LIMIT
 	if r.Hits > r.Limit {
-		status.Status = Status_OVER_LIMIT
-		status.Remaining = 0
+		t.Status.Status = Status_OVER_LIMIT
+		t.Status.Remaining = 0
 	}
 
-	c.Add(r.HashKey(), status, expire)
-	return status, nil
+	c.Add(key, t, expire)
+	return respCopy(&t.Status), nil
 }
 
 // Implements leaky bucket algorithm for rate limiting https://en.wikipedia.org/wiki/Leaky_bucket
-func leakyBucket(c cache.Cache, r *RateLimitReq) (*RateLimitResp, error) {
-	type LeakyBucket struct {
-		Limit          int64
-		Duration       int64
-		LimitRemaining int64
-		TimeStamp      int64
-	}
-
-	now := cache.MillisecondNow()
-
-	item, ok := c.Get(r.HashKey())
+//
+// A request which changes the duration of the rate limit does not change the rate the bucket leaks at
+// until the bucket is empty, then the bucket leaks at the new rate. Unless the request has the
+// REBASE_DURATION behavior, then the bucket leaks at the new rate from now on and keeps the hits which
+// have not leaked out yet.
+func leakyBucket(c cache.Cache, key cache.Key, r *RateLimitReq, now int64) (*RateLimitResp, error) {
+	item, ok := getAt(c, key, now)
 	if ok {
-		b, ok := item.(*LeakyBucket)
+		b, ok := item.(*leakyBucketItem)
 		if !ok {
 			// Client switched algorithms; perhaps due to a migration?
-			c.Remove(r.HashKey())
-			return tokenBucket(c, r)
+			c.Remove(key)
+			return tokenBucket(c, key, r, now)
 		}
 
-		rate := b.Duration / r.Limit
+		rate := leakRate(b.Duration, r.Limit)
 
 		// Calculate how much leaked out of the bucket since the last hit
 		elapsed := now - b.TimeStamp
 		leak := int64(elapsed / rate)
 
-		b.LimitRemaining += leak
-		if b.LimitRemaining > b.Limit {
+		// The bucket can not hold more than the limit, check before adding such that the sum can't overflow
+		if leak >= b.Limit-b.LimitRemaining {
 			b.LimitRemaining = b.Limit
+		} else {
+			b.LimitRemaining += leak
+		}
+
+		// The hits which leaked out so far leaked at the previous rate, a hit which partially leaked
+		// starts leaking again at the new rate.
+		if r.Duration != b.Duration && (b.LimitRemaining == b.Limit || HasBehavior(r.Behavior, Behavior_REBASE_DURATION)) {
+			b.Duration = r.Duration
+			b.TimeStamp = now
+			rate = leakRate(b.Duration, r.Limit)
+			c.UpdateExpiration(key, addTime(now, b.Duration))
 		}
 
 		// Only update the TS if client is incrementing the hit
@@ -129,7 +400,7 @@ func leakyBucket(c cache.Cache, r *RateLimitReq) (*RateLimitResp, error) {
 		// If we are already at the limit
 		if b.LimitRemaining == 0 {
 			rl.Status = Status_OVER_LIMIT
-			rl.ResetTime = now + rate
+			rl.ResetTime = addTime(now, rate)
 			return rl, nil
 		}
 
@@ -143,7 +414,7 @@ func leakyBucket(c cache.Cache, r *RateLimitReq) (*RateLimitResp, error) {
 		// If requested is more than available, then return over the limit without updating the bucket.
 		if r.Hits > b.LimitRemaining {
 			rl.Status = Status_OVER_LIMIT
-			rl.ResetTime = now + rate
+			rl.ResetTime = addTime(now, rate)
 			return rl, nil
 		}
 
@@ -154,12 +425,12 @@ func leakyBucket(c cache.Cache, r *RateLimitReq) (*RateLimitResp, error) {
 
 		b.LimitRemaining -= r.Hits
 		rl.Remaining = b.LimitRemaining
-		c.UpdateExpiration(r.HashKey(), now*r.Duration)
+		c.UpdateExpiration(key, addTime(now, b.Duration))
 		return rl, nil
 	}
 
 	// Create a new leaky bucket
-	b := LeakyBucket{
+	b := leakyBucketItem{
 		LimitRemaining: r.Limit - r.Hits,
 		Limit:          r.Limit,
 		Duration:       r.Duration,
@@ -180,7 +451,7 @@ func leakyBucket(c cache.Cache, r *RateLimitReq) (*RateLimitResp, error) {
 		b.LimitRemaining = 0
 	}
 
-	c.Add(r.HashKey(), &b, now+r.Duration)
+	c.Add(key, &b, addTime(now, r.Duration))
 
 	return &rl, nil
 }
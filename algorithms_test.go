@@ -0,0 +1,370 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type algorithmStep struct {
+	// How far to advance the clock before sending the request
+	Advance time.Duration
+	Hits    int64
+	// Overrides the limit of the scenario for this request
+	Limit int64
+	// Overrides the duration of the scenario for this request
+	Duration int64
+	Behavior guber.Behavior
+
+	Status    guber.Status
+	Remaining int64
+	// The expected limit in the response if it differs from the limit of the request
+	RespLimit int64
+	// The expected reset time in milliseconds since the start of the scenario; zero expects no reset time
+	ResetTime int64
+}
+
+// Steps the frozen clock of a LocalClient through each scenario, such that the edge cases which are
+// impossible to hit reliably with real time are exercised exactly and without sleeping.
+func TestAlgorithms(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Algorithm guber.Algorithm
+		Limit     int64
+		Duration  int64
+		Steps     []algorithmStep
+	}{
+		{
+			Name:      "token bucket fill and exhaust",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 1, Status: guber.Status_UNDER_LIMIT, Remaining: 9, ResetTime: 1000},
+				{Hits: 9, Status: guber.Status_UNDER_LIMIT, Remaining: 0, ResetTime: 1000},
+				{Hits: 1, Status: guber.Status_OVER_LIMIT, Remaining: 0, ResetTime: 1000},
+				{Hits: 0, Status: guber.Status_OVER_LIMIT, Remaining: 0, ResetTime: 1000},
+			},
+		},
+		{
+			Name:      "token bucket rejects hits over the remainder without consuming them",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 5, Status: guber.Status_UNDER_LIMIT, Remaining: 5, ResetTime: 1000},
+				{Hits: 6, Status: guber.Status_OVER_LIMIT, Remaining: 5, ResetTime: 1000},
+				{Hits: 5, Status: guber.Status_UNDER_LIMIT, Remaining: 0, ResetTime: 1000},
+			},
+		},
+		{
+			Name:      "token bucket does not refill within the duration",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 10, Status: guber.Status_UNDER_LIMIT, Remaining: 0, ResetTime: 1000},
+				{Advance: 999 * time.Millisecond, Hits: 1, Status: guber.Status_OVER_LIMIT, Remaining: 0, ResetTime: 1000},
+			},
+		},
+		{
+			Name:      "token bucket rolls over after the reset time",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 10, Status: guber.Status_UNDER_LIMIT, Remaining: 0, ResetTime: 1000},
+				// The rate limit is still in effect at exactly the reset time
+				{Advance: time.Second, Hits: 1, Status: guber.Status_OVER_LIMIT, Remaining: 0, ResetTime: 1000},
+				{Advance: time.Millisecond, Hits: 1, Status: guber.Status_UNDER_LIMIT, Remaining: 9, ResetTime: 2001},
+			},
+		},
+		{
+			Name:      "token bucket keeps the limit until the reset time",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 5, Status: guber.Status_UNDER_LIMIT, Remaining: 5, ResetTime: 1000},
+				{Hits: 1, Limit: 20, Status: guber.Status_UNDER_LIMIT, Remaining: 4, RespLimit: 10, ResetTime: 1000},
+				{Advance: 1001 * time.Millisecond, Hits: 1, Limit: 20, Status: guber.Status_UNDER_LIMIT, Remaining: 19, ResetTime: 2001},
+			},
+		},
+		{
+			Name:      "token bucket reuses an expired entry",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 3, Status: guber.Status_UNDER_LIMIT, Remaining: 7, ResetTime: 1000},
+				{Advance: 5 * time.Second, Hits: 0, Status: guber.Status_UNDER_LIMIT, Remaining: 10, ResetTime: 6000},
+				{Hits: 2, Status: guber.Status_UNDER_LIMIT, Remaining: 8, ResetTime: 6000},
+			},
+		},
+		{
+			Name:      "token bucket hits spanning a reset",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 8, Status: guber.Status_UNDER_LIMIT, Remaining: 2, ResetTime: 1000},
+				{Advance: 1001 * time.Millisecond, Hits: 8, Status: guber.Status_UNDER_LIMIT, Remaining: 2, ResetTime: 2001},
+			},
+		},
+		{
+			Name:      "token bucket created over the limit",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 11, Status: guber.Status_OVER_LIMIT, Remaining: 0, ResetTime: 1000},
+				{Hits: 1, Status: guber.Status_OVER_LIMIT, Remaining: 0, ResetTime: 1000},
+				{Advance: 1001 * time.Millisecond, Hits: 1, Status: guber.Status_UNDER_LIMIT, Remaining: 9, ResetTime: 2001},
+			},
+		},
+		{
+			Name:      "token bucket changes the duration at the next window",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 5, Status: guber.Status_UNDER_LIMIT, Remaining: 5, ResetTime: 1000},
+				{Advance: 500 * time.Millisecond, Hits: 1, Duration: 2 * guber.Second, Status: guber.Status_UNDER_LIMIT, Remaining: 4, ResetTime: 1000},
+				{Advance: 501 * time.Millisecond, Hits: 1, Duration: 2 * guber.Second, Status: guber.Status_UNDER_LIMIT, Remaining: 9, ResetTime: 3001},
+			},
+		},
+		{
+			Name:      "token bucket rebase extends the window",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 5, Status: guber.Status_UNDER_LIMIT, Remaining: 5, ResetTime: 1000},
+				{Advance: 500 * time.Millisecond, Hits: 1, Duration: 2 * guber.Second, Behavior: guber.Behavior_REBASE_DURATION,
+					Status: guber.Status_UNDER_LIMIT, Remaining: 4, ResetTime: 2000},
+				// The cache entry no longer expires at the end of the previous window
+				{Advance: time.Second, Hits: 0, Duration: 2 * guber.Second, Status: guber.Status_UNDER_LIMIT, Remaining: 4, ResetTime: 2000},
+				{Advance: 501 * time.Millisecond, Hits: 1, Duration: 2 * guber.Second, Status: guber.Status_UNDER_LIMIT, Remaining: 9, ResetTime: 4001},
+			},
+		},
+		{
+			Name:      "token bucket rebase shrinks the window",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 5, Status: guber.Status_UNDER_LIMIT, Remaining: 5, ResetTime: 1000},
+				{Advance: 200 * time.Millisecond, Hits: 1, Duration: 500, Behavior: guber.Behavior_REBASE_DURATION,
+					Status: guber.Status_UNDER_LIMIT, Remaining: 4, ResetTime: 500},
+				{Advance: 301 * time.Millisecond, Hits: 1, Duration: 500, Status: guber.Status_UNDER_LIMIT, Remaining: 9, ResetTime: 1001},
+			},
+		},
+		{
+			Name:      "token bucket rebase shrinks the window below the time elapsed",
+			Algorithm: guber.Algorithm_TOKEN_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 5, Status: guber.Status_UNDER_LIMIT, Remaining: 5, ResetTime: 1000},
+				{Advance: 600 * time.Millisecond, Hits: 1, Duration: 500, Behavior: guber.Behavior_REBASE_DURATION,
+					Status: guber.Status_UNDER_LIMIT, Remaining: 9, ResetTime: 1100},
+			},
+		},
+		{
+			Name:      "leaky bucket fill and exhaust",
+			Algorithm: guber.Algorithm_LEAKY_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 1, Status: guber.Status_UNDER_LIMIT, Remaining: 9},
+				{Hits: 9, Status: guber.Status_UNDER_LIMIT, Remaining: 0},
+				// A hit leaks out of the bucket every 100ms
+				{Hits: 1, Status: guber.Status_OVER_LIMIT, Remaining: 0, ResetTime: 100},
+			},
+		},
+		{
+			Name:      "leaky bucket partial refill",
+			Algorithm: guber.Algorithm_LEAKY_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 10, Status: guber.Status_UNDER_LIMIT, Remaining: 0},
+				{Advance: 200 * time.Millisecond, Hits: 1, Status: guber.Status_UNDER_LIMIT, Remaining: 1},
+				{Advance: 100 * time.Millisecond, Hits: 1, Status: guber.Status_UNDER_LIMIT, Remaining: 1},
+				{Hits: 2, Status: guber.Status_OVER_LIMIT, Remaining: 1, ResetTime: 400},
+			},
+		},
+		{
+			Name:      "leaky bucket leaks exactly at the rate boundary",
+			Algorithm: guber.Algorithm_LEAKY_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 10, Status: guber.Status_UNDER_LIMIT, Remaining: 0},
+				{Advance: 99 * time.Millisecond, Hits: 0, Status: guber.Status_OVER_LIMIT, Remaining: 0, ResetTime: 199},
+				{Advance: time.Millisecond, Hits: 1, Status: guber.Status_UNDER_LIMIT, Remaining: 0},
+			},
+		},
+		{
+			Name:      "leaky bucket does not refill past the limit",
+			Algorithm: guber.Algorithm_LEAKY_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 5, Status: guber.Status_UNDER_LIMIT, Remaining: 5},
+				{Advance: 900 * time.Millisecond, Hits: 1, Status: guber.Status_UNDER_LIMIT, Remaining: 9},
+			},
+		},
+		{
+			Name:      "leaky bucket keeps the limit of the bucket",
+			Algorithm: guber.Algorithm_LEAKY_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 5, Status: guber.Status_UNDER_LIMIT, Remaining: 5},
+				{Hits: 1, Limit: 20, Status: guber.Status_UNDER_LIMIT, Remaining: 4, RespLimit: 10},
+				{Advance: 1001 * time.Millisecond, Hits: 1, Limit: 20, Status: guber.Status_UNDER_LIMIT, Remaining: 19},
+			},
+		},
+		{
+			Name:      "leaky bucket reuses an expired entry",
+			Algorithm: guber.Algorithm_LEAKY_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 10, Status: guber.Status_UNDER_LIMIT, Remaining: 0},
+				{Advance: 5 * time.Second, Hits: 4, Status: guber.Status_UNDER_LIMIT, Remaining: 6},
+			},
+		},
+		{
+			Name:      "leaky bucket hits spanning a reset",
+			Algorithm: guber.Algorithm_LEAKY_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 8, Status: guber.Status_UNDER_LIMIT, Remaining: 2},
+				{Advance: 600 * time.Millisecond, Hits: 1, Status: guber.Status_UNDER_LIMIT, Remaining: 7},
+				{Advance: 1000 * time.Millisecond, Hits: 8, Status: guber.Status_UNDER_LIMIT, Remaining: 2},
+			},
+		},
+		{
+			Name:      "leaky bucket created over the limit",
+			Algorithm: guber.Algorithm_LEAKY_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 11, Status: guber.Status_OVER_LIMIT, Remaining: 0},
+				{Hits: 0, Status: guber.Status_OVER_LIMIT, Remaining: 0, ResetTime: 100},
+			},
+		},
+		{
+			Name:      "leaky bucket changes the duration once empty",
+			Algorithm: guber.Algorithm_LEAKY_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 10, Status: guber.Status_UNDER_LIMIT, Remaining: 0},
+				// Still leaks a hit every 100ms
+				{Advance: 200 * time.Millisecond, Hits: 1, Duration: 2 * guber.Second, Status: guber.Status_UNDER_LIMIT, Remaining: 1},
+				{Advance: time.Second, Hits: 10, Duration: 2 * guber.Second, Status: guber.Status_UNDER_LIMIT, Remaining: 0},
+				// Leaks a hit every 200ms
+				{Advance: 100 * time.Millisecond, Hits: 1, Duration: 2 * guber.Second, Status: guber.Status_OVER_LIMIT, Remaining: 0, ResetTime: 1500},
+			},
+		},
+		{
+			Name:      "leaky bucket rebase extends the duration",
+			Algorithm: guber.Algorithm_LEAKY_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 10, Status: guber.Status_UNDER_LIMIT, Remaining: 0},
+				{Advance: 200 * time.Millisecond, Hits: 1, Duration: 2 * guber.Second, Behavior: guber.Behavior_REBASE_DURATION,
+					Status: guber.Status_UNDER_LIMIT, Remaining: 1},
+				{Advance: 100 * time.Millisecond, Hits: 2, Duration: 2 * guber.Second, Status: guber.Status_OVER_LIMIT, Remaining: 1, ResetTime: 500},
+			},
+		},
+		{
+			Name:      "leaky bucket rebase shrinks the duration",
+			Algorithm: guber.Algorithm_LEAKY_BUCKET,
+			Limit:     10,
+			Duration:  guber.Second,
+			Steps: []algorithmStep{
+				{Hits: 10, Status: guber.Status_UNDER_LIMIT, Remaining: 0},
+				{Advance: 200 * time.Millisecond, Hits: 1, Duration: 500, Behavior: guber.Behavior_REBASE_DURATION,
+					Status: guber.Status_UNDER_LIMIT, Remaining: 1},
+				{Advance: 100 * time.Millisecond, Hits: 3, Duration: 500, Status: guber.Status_UNDER_LIMIT, Remaining: 0},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client := guber.NewLocalClient()
+			start := client.Now()
+
+			for i, step := range test.Steps {
+				client.Advance(step.Advance)
+
+				limit := test.Limit
+				if step.Limit != 0 {
+					limit = step.Limit
+				}
+				duration := test.Duration
+				if step.Duration != 0 {
+					duration = step.Duration
+				}
+
+				resp, err := client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+					Requests: []*guber.RateLimitReq{
+						{
+							Name:      "test_algorithms",
+							UniqueKey: "account:1234",
+							Algorithm: test.Algorithm,
+							Duration:  duration,
+							Limit:     limit,
+							Hits:      step.Hits,
+							Behavior:  step.Behavior,
+						},
+					},
+				})
+				require.Nil(t, err)
+
+				rl := resp.Responses[0]
+				require.Empty(t, rl.Error, i)
+				assert.Equal(t, step.Status, rl.Status, "step %d status", i)
+				assert.Equal(t, step.Remaining, rl.Remaining, "step %d remaining", i)
+
+				if step.RespLimit != 0 {
+					limit = step.RespLimit
+				}
+				assert.Equal(t, limit, rl.Limit, "step %d limit", i)
+
+				if step.ResetTime == 0 {
+					assert.Equal(t, int64(0), rl.ResetTime, "step %d reset time", i)
+				} else {
+					assert.Equal(t, start+step.ResetTime, rl.ResetTime, "step %d reset time", i)
+				}
+			}
+		})
+	}
+}
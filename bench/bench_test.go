@@ -0,0 +1,204 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bench_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/mailgun/gubernator/bench"
+	"github.com/mailgun/gubernator/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// Get and Add from every CPU against a single locked cache, 90% of operations are reads
+func BenchmarkCacheContention(b *testing.B) {
+	for _, skew := range []float64{0, 1.5} {
+		b.Run(fmt.Sprintf("Skew=%.1f", skew), func(b *testing.B) {
+			c := cache.NewLRUCache(50000)
+			expire := c.Now() + int64(time.Hour/time.Millisecond)
+			var seed int64
+
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				keys := bench.NewKeyGen(100000, skew, atomic.AddInt64(&seed, 1))
+				var i int
+				for pb.Next() {
+					key := keys.Next()
+					c.Lock()
+					if i%10 == 0 {
+						c.Add(key, i, expire)
+					} else {
+						c.Get(key)
+					}
+					c.Unlock()
+					i++
+				}
+			})
+		})
+	}
+}
+
+// Evaluates each algorithm against an in-process cache without any networking
+func BenchmarkAlgorithm(b *testing.B) {
+	for _, algo := range []guber.Algorithm{guber.Algorithm_TOKEN_BUCKET, guber.Algorithm_LEAKY_BUCKET} {
+		b.Run(algo.String(), func(b *testing.B) {
+			client := guber.NewLocalClient()
+			keys := bench.NewKeyGen(10000, 1.1, 1)
+			req := guber.GetRateLimitsReq{Requests: []*guber.RateLimitReq{{
+				Name:      "bench_algorithm",
+				Algorithm: algo,
+				Limit:     1000000,
+				Duration:  guber.Minute * 60,
+				Hits:      1,
+			}}}
+
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				req.Requests[0].UniqueKey = keys.Next()
+				if _, err := client.GetRateLimits(context.Background(), &req); err != nil {
+					b.Fatalf("GetRateLimits() err: %s", err)
+				}
+			}
+		})
+	}
+}
+
+// Picks the owner of a key with the default consistent hash
+func BenchmarkPickerGet(b *testing.B) {
+	for _, size := range []int{3, 10, 100} {
+		b.Run(fmt.Sprintf("Peers=%d", size), func(b *testing.B) {
+			picker := guber.NewConsistantHash(nil)
+			for i := 0; i < size; i++ {
+				peer, err := guber.NewPeerClient(guber.BehaviorConfig{}, fmt.Sprintf("10.0.0.%d:81", i))
+				require.Nil(b, err)
+				picker.Add(peer)
+			}
+			keys := bench.NewKeyGen(10000, 0, 1)
+
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				if _, err := picker.Get(keys.Next()); err != nil {
+					b.Fatalf("Get() err: %s", err)
+				}
+			}
+		})
+	}
+}
+
+// echoPeer is a peer which responds to every rate limit without applying it, such that only the
+// cost of assembling and sending the batches is measured.
+type echoPeer struct{}
+
+func (p *echoPeer) GetPeerRateLimits(ctx context.Context, r *guber.GetPeerRateLimitsReq) (*guber.GetPeerRateLimitsResp, error) {
+	resp := guber.GetPeerRateLimitsResp{RateLimits: make([]*guber.RateLimitResp, len(r.Requests))}
+	for i, req := range r.Requests {
+		resp.RateLimits[i] = &guber.RateLimitResp{Limit: req.Limit, Remaining: req.Limit}
+	}
+	return &resp, nil
+}
+
+func (p *echoPeer) UpdatePeerGlobals(ctx context.Context, r *guber.UpdatePeerGlobalsReq) (*guber.UpdatePeerGlobalsResp, error) {
+	return &guber.UpdatePeerGlobalsResp{}, nil
+}
+
+// Many go routines forwarding single rate limits to a peer which batches them into a single request
+func BenchmarkBatchAssembly(b *testing.B) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(b, err)
+	server := grpc.NewServer()
+	guber.RegisterPeersV1Server(server, &echoPeer{})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conf := guber.Config{}
+	require.Nil(b, conf.SetDefaults())
+	client, err := guber.NewPeerClient(conf.Behaviors, listener.Addr().String())
+	require.Nil(b, err)
+
+	var seed int64
+	b.SetParallelism(100)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		keys := bench.NewKeyGen(10000, 0, atomic.AddInt64(&seed, 1))
+		for pb.Next() {
+			_, err := client.GetPeerRateLimit(context.Background(), &guber.RateLimitReq{
+				Name:      "bench_batch_assembly",
+				UniqueKey: keys.Next(),
+				Behavior:  guber.Behavior_BATCHING,
+				Limit:     10,
+				Duration:  guber.Minute,
+				Hits:      1,
+			})
+			if err != nil {
+				b.Fatalf("GetPeerRateLimit() err: %s", err)
+			}
+		}
+	})
+}
+
+func TestKeyGen(t *testing.T) {
+	// The same seed generates the same keys
+	a, b := bench.NewKeyGen(1000, 1.5, 42), bench.NewKeyGen(1000, 1.5, 42)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, a.Next(), b.Next())
+	}
+
+	// A skew concentrates the hits on the first keys
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[a.Next()]++
+	}
+	assert.True(t, counts["account:0"] > 2500, "account:0 hit '%d' times", counts["account:0"])
+	assert.True(t, len(counts) <= 1000)
+
+	uniform := bench.NewKeyGen(1000, 0, 42)
+	counts = make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[uniform.Next()]++
+	}
+	assert.True(t, counts["account:0"] < 100, "account:0 hit '%d' times", counts["account:0"])
+}
+
+func TestRunLoad(t *testing.T) {
+	report, err := bench.RunLoad(context.Background(), bench.LoadConfig{
+		Nodes:       3,
+		Cardinality: 100,
+		Skew:        1.2,
+		BatchSize:   10,
+		Behavior:    guber.Behavior_NO_BATCHING,
+		Concurrency: 3,
+		Length:      200 * time.Millisecond,
+	})
+	require.Nil(t, err)
+
+	assert.True(t, report.Requests > 0)
+	assert.Equal(t, report.Requests, len(report.Latencies))
+	assert.Equal(t, report.Requests*10, report.RateLimits)
+	assert.Equal(t, 0, report.Errors)
+	assert.Equal(t, 0, report.RateLimitErrors)
+	assert.True(t, report.Throughput() > 0)
+	assert.True(t, report.Percentile(50) <= report.Percentile(99))
+	assert.Equal(t, report.Latencies[len(report.Latencies)-1], report.Percentile(100))
+}
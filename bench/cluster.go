@@ -0,0 +1,94 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bench
+
+import (
+	"net"
+	"time"
+
+	"github.com/mailgun/gubernator"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// Cluster is a cluster of gubernator instances running in this process and listening on random
+// local ports. Unlike the `cluster` package, which gives each node a single cache such that it can be
+// kept across restarts, the instances use the worker pool as they would in production.
+type Cluster struct {
+	Addresses []string
+	Instances []*gubernator.Instance
+	servers   []*grpc.Server
+}
+
+// StartCluster starts a cluster of `size` instances. `conf` is used as the template for the config of
+// each instance, the GRPCServer and any fields which must be unique to an instance are replaced.
+func StartCluster(size int, conf gubernator.Config) (*Cluster, error) {
+	c := &Cluster{}
+	for i := 0; i < size; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			c.Stop()
+			return nil, errors.Wrap(err, "while listening on random interface")
+		}
+
+		instConf := conf
+		instConf.GRPCServer = grpc.NewServer()
+		instConf.Picker = nil
+		if conf.Picker != nil {
+			instConf.Picker = conf.Picker.New()
+		}
+
+		instance, err := gubernator.New(instConf)
+		if err != nil {
+			listener.Close()
+			c.Stop()
+			return nil, errors.Wrap(err, "while creating new gubernator instance")
+		}
+		go instConf.GRPCServer.Serve(listener)
+
+		c.Addresses = append(c.Addresses, listener.Addr().String())
+		c.Instances = append(c.Instances, instance)
+		c.servers = append(c.servers, instConf.GRPCServer)
+	}
+
+	for i, instance := range c.Instances {
+		var peers []gubernator.PeerInfo
+		for _, addr := range c.Addresses {
+			peers = append(peers, gubernator.PeerInfo{Address: addr, IsOwner: addr == c.Addresses[i]})
+		}
+		instance.SetPeers(peers)
+	}
+	return c, nil
+}
+
+// Stop stops every instance in the cluster, waiting up to a second for in flight requests to complete
+func (c *Cluster) Stop() {
+	for i, srv := range c.servers {
+		done := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			srv.Stop()
+		}
+		c.Instances[i].Close()
+	}
+	c.servers, c.Instances, c.Addresses = nil, nil, nil
+}
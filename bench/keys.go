@@ -0,0 +1,68 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bench
+
+import (
+	"math/rand"
+	"strconv"
+)
+
+// KeyGen picks keys from a fixed set of `cardinality` keys. With a skew greater than 1 the keys
+// follow a Zipf distribution, such that a few keys receive most of the hits like the accounts of
+// a real workload, else every key is equally likely.
+//
+// KeyGen is NOT safe for concurrent use, each go routine should create its own.
+type KeyGen struct {
+	keys []string
+	rand *rand.Rand
+	zipf *rand.Zipf
+}
+
+// NewKeyGen creates a KeyGen. `skew` is the `s` parameter of the Zipf distribution; IE: 1.1 is a
+// mild skew while 2 sends most of the hits to a handful of keys. Generators created with the same
+// seed return the same sequence of keys.
+func NewKeyGen(cardinality int, skew float64, seed int64) *KeyGen {
+	if cardinality < 1 {
+		cardinality = 1
+	}
+
+	g := &KeyGen{
+		keys: make([]string, cardinality),
+		rand: rand.New(rand.NewSource(seed)),
+	}
+	// Build the keys up front, such that generating a key does not allocate
+	for i := range g.keys {
+		g.keys[i] = "account:" + strconv.Itoa(i)
+	}
+	if skew > 1 {
+		g.zipf = rand.NewZipf(g.rand, skew, 1, uint64(cardinality-1))
+	}
+	return g
+}
+
+// Next returns the next key
+func (g *KeyGen) Next() string {
+	if g.zipf != nil {
+		return g.keys[g.zipf.Uint64()]
+	}
+	return g.keys[g.rand.Intn(len(g.keys))]
+}
+
+// Cardinality returns the number of distinct keys the generator picks from
+func (g *KeyGen) Cardinality() int {
+	return len(g.keys)
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bench holds the tools used to measure the performance of gubernator; microbenchmarks of the
+// hot paths and a load generator which drives an in-process cluster, see cmd/gubernator-bench.
+package bench
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mailgun/gubernator"
+	"github.com/mailgun/holster"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// LoadConfig describes the load generated by RunLoad()
+type LoadConfig struct {
+	// The number of instances in the cluster, defaults to 1
+	Nodes int
+
+	// The number of distinct rate limits, defaults to 10,000
+	Cardinality int
+
+	// The Zipf skew of the rate limits hit, values of 1 or less hit every rate limit equally.
+	// See NewKeyGen()
+	Skew float64
+
+	// The number of rate limits in each request, defaults to 1
+	BatchSize int
+
+	// The behavior and algorithm of every rate limit
+	Behavior  gubernator.Behavior
+	Algorithm gubernator.Algorithm
+
+	// The limit and duration of every rate limit, defaults to 1,000,000 per hour such that
+	// requests are not rejected for being over the limit.
+	Limit    int64
+	Duration time.Duration
+
+	// The number of clients sending requests concurrently, defaults to 10
+	Concurrency int
+
+	// How long to generate load for, defaults to 10 seconds
+	Length time.Duration
+
+	// The seed of the key generators, such that runs are repeatable
+	Seed int64
+
+	// The config used for each instance in the cluster, see StartCluster()
+	Instance gubernator.Config
+}
+
+func (c *LoadConfig) setDefaults() {
+	holster.SetDefault(&c.Nodes, 1)
+	holster.SetDefault(&c.Cardinality, 10000)
+	holster.SetDefault(&c.BatchSize, 1)
+	holster.SetDefault(&c.Limit, int64(1000000))
+	holster.SetDefault(&c.Duration, time.Hour)
+	holster.SetDefault(&c.Concurrency, 10)
+	holster.SetDefault(&c.Length, time.Second*10)
+}
+
+// Report is the result of RunLoad()
+type Report struct {
+	Config LoadConfig
+
+	// The number of requests sent and the number of rate limits they held
+	Requests   int
+	RateLimits int
+
+	// The number of requests which failed, and the number of rate limits which reported
+	// an error in an otherwise successful request
+	Errors          int
+	RateLimitErrors int
+
+	// The time spent generating load
+	Elapsed time.Duration
+
+	// The latency of each request, sorted in ascending order
+	Latencies []time.Duration
+}
+
+// Throughput returns the rate limits checked per second
+func (r *Report) Throughput() float64 {
+	if r.Elapsed == 0 {
+		return 0
+	}
+	return float64(r.RateLimits) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the latency of requests at the percentile `p`; IE: 99 for the p99
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	idx := int(float64(len(r.Latencies))*p/100+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(r.Latencies) {
+		idx = len(r.Latencies) - 1
+	}
+	return r.Latencies[idx]
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("nodes=%d keys=%d skew=%.2f batch=%d behavior=%s concurrency=%d\n"+
+		"  requests=%d rate_limits=%d errors=%d rate_limit_errors=%d elapsed=%s\n"+
+		"  throughput=%.0f/s p50=%s p90=%s p99=%s p999=%s max=%s",
+		r.Config.Nodes, r.Config.Cardinality, r.Config.Skew, r.Config.BatchSize, r.Config.Behavior,
+		r.Config.Concurrency, r.Requests, r.RateLimits, r.Errors, r.RateLimitErrors,
+		r.Elapsed.Round(time.Millisecond), r.Throughput(), r.Percentile(50), r.Percentile(90),
+		r.Percentile(99), r.Percentile(99.9), r.Percentile(100))
+}
+
+// RunLoad starts a cluster in this process and sends it requests from `conf.Concurrency` clients
+// until `conf.Length` has elapsed or the context is cancelled. Each client connects to a node of the
+// cluster in turn, such that rate limits not owned by that node are forwarded like in production.
+func RunLoad(ctx context.Context, conf LoadConfig) (*Report, error) {
+	conf.setDefaults()
+
+	c, err := StartCluster(conf.Nodes, conf.Instance)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Stop()
+
+	var clients []gubernator.V1Client
+	for _, addr := range c.Addresses {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			return nil, errors.Wrapf(err, "while dialing '%s'", addr)
+		}
+		defer conn.Close()
+		clients = append(clients, gubernator.NewV1Client(conn))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, conf.Length)
+	defer cancel()
+
+	reports := make([]Report, conf.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < conf.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			generate(ctx, conf, clients[i%len(clients)], NewKeyGen(conf.Cardinality, conf.Skew, conf.Seed+int64(i)),
+				&reports[i])
+		}(i)
+	}
+	wg.Wait()
+
+	report := Report{Config: conf, Elapsed: time.Since(start)}
+	for _, r := range reports {
+		report.Requests += r.Requests
+		report.RateLimits += r.RateLimits
+		report.Errors += r.Errors
+		report.RateLimitErrors += r.RateLimitErrors
+		report.Latencies = append(report.Latencies, r.Latencies...)
+	}
+	sort.Slice(report.Latencies, func(i, j int) bool { return report.Latencies[i] < report.Latencies[j] })
+	return &report, nil
+}
+
+// generate sends requests to the client until the context is done and records the results in `r`
+func generate(ctx context.Context, conf LoadConfig, client gubernator.V1Client, keys *KeyGen, r *Report) {
+	req := gubernator.GetRateLimitsReq{Requests: make([]*gubernator.RateLimitReq, conf.BatchSize)}
+	for i := range req.Requests {
+		req.Requests[i] = &gubernator.RateLimitReq{
+			Name:      "bench_load",
+			Behavior:  conf.Behavior,
+			Algorithm: conf.Algorithm,
+			Limit:     conf.Limit,
+			Duration:  gubernator.ToTimeStamp(conf.Duration),
+			Hits:      1,
+		}
+	}
+
+	for ctx.Err() == nil {
+		for _, rl := range req.Requests {
+			rl.UniqueKey = keys.Next()
+		}
+
+		start := time.Now()
+		resp, err := client.GetRateLimits(ctx, &req)
+		latency := time.Since(start)
+
+		// A request interrupted by the end of the run is not counted
+		if ctx.Err() != nil {
+			return
+		}
+
+		r.Requests++
+		r.Latencies = append(r.Latencies, latency)
+		if err != nil {
+			r.Errors++
+			continue
+		}
+		r.RateLimits += len(resp.Responses)
+		for _, rl := range resp.Responses {
+			if rl.Error != "" {
+				r.RateLimitErrors++
+			}
+		}
+	}
+}
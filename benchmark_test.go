@@ -18,10 +18,15 @@ package gubernator_test
 
 import (
 	"context"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
 	guber "github.com/mailgun/gubernator"
-	"github.com/mailgun/gubernator/cluster"
+	"github.com/mailgun/gubernator/cache"
 	"github.com/mailgun/holster"
-	"testing"
+	"google.golang.org/grpc"
 )
 
 func BenchmarkServer_GetPeerRateLimitNoBatching(b *testing.B) {
@@ -30,7 +35,7 @@ func BenchmarkServer_GetPeerRateLimitNoBatching(b *testing.B) {
 		b.Errorf("SetDefaults err: %s", err)
 	}
 
-	client, err := guber.NewPeerClient(conf.Behaviors, cluster.GetPeer())
+	client, err := guber.NewPeerClient(conf.Behaviors, testCluster.GetPeer())
 	if err != nil {
 		b.Errorf("NewPeerClient err: %s", err)
 	}
@@ -52,8 +57,49 @@ func BenchmarkServer_GetPeerRateLimitNoBatching(b *testing.B) {
 	})
 }
 
+// Sustained batched forwarding from many go routines; allocations per request and
+// GC cycles per op reflect the garbage generated by building and delivering batches
+func BenchmarkServer_GetPeerRateLimitBatching(b *testing.B) {
+	conf := guber.Config{}
+	if err := conf.SetDefaults(); err != nil {
+		b.Errorf("SetDefaults err: %s", err)
+	}
+
+	client, err := guber.NewPeerClient(conf.Behaviors, testCluster.GetPeer())
+	if err != nil {
+		b.Errorf("NewPeerClient err: %s", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	b.ReportAllocs()
+	b.SetParallelism(100)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req := guber.RateLimitReq{
+			Name:      "get_peer_rate_limit_batching_benchmark",
+			UniqueKey: guber.RandomString(10),
+			Behavior:  guber.Behavior_BATCHING,
+			Limit:     1000000000,
+			Duration:  guber.Minute,
+			Hits:      1,
+		}
+		for pb.Next() {
+			if _, err := client.GetPeerRateLimit(context.Background(), &req); err != nil {
+				b.Errorf("client.GetPeerRateLimit() err: %s", err)
+			}
+		}
+	})
+	b.StopTimer()
+
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+}
+
 func BenchmarkServer_GetRateLimit(b *testing.B) {
-	client, err := guber.DialV1Server(cluster.GetPeer())
+	client, err := guber.DialV1Server(testCluster.GetPeer())
 	if err != nil {
 		b.Errorf("NewV1Client err: %s", err)
 	}
@@ -78,8 +124,181 @@ func BenchmarkServer_GetRateLimit(b *testing.B) {
 	})
 }
 
+func BenchmarkServer_GetRateLimitsLocal(b *testing.B) {
+	instance, err := guber.New(guber.Config{
+		GRPCServer: grpc.NewServer(),
+		Cache:      cache.NewLRUCache(0),
+	})
+	if err != nil {
+		b.Fatalf("guber.New() err: %s", err)
+	}
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+
+	req := guber.GetRateLimitsReq{
+		Requests: []*guber.RateLimitReq{
+			{
+				Name:      "get_rate_limits_local_benchmark",
+				UniqueKey: "account:1234",
+				Behavior:  guber.Behavior_NO_BATCHING,
+				Limit:     1000000000,
+				Duration:  guber.Minute,
+				Hits:      1,
+			},
+		},
+	}
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := instance.GetRateLimits(context.Background(), &req); err != nil {
+			b.Errorf("GetRateLimits() err: %s", err)
+		}
+	}
+}
+
+// Compares a single locked cache with the worker pool when 64 clients hit a local instance concurrently
+func BenchmarkServer_GetRateLimitsConcurrent(b *testing.B) {
+	for _, mode := range []string{"SingleCache", "WorkerPool"} {
+		conf := guber.Config{GRPCServer: grpc.NewServer()}
+		if mode == "SingleCache" {
+			conf.Cache = cache.NewLRUCache(0)
+		}
+
+		instance, err := guber.New(conf)
+		if err != nil {
+			b.Fatalf("guber.New() err: %s", err)
+		}
+		instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+
+		b.Run(mode, func(b *testing.B) {
+			b.SetParallelism((64 + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+			b.RunParallel(func(pb *testing.PB) {
+				var i int
+				for pb.Next() {
+					i++
+					_, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+						Requests: []*guber.RateLimitReq{
+							{
+								Name:      "get_rate_limits_concurrent_benchmark",
+								UniqueKey: fmt.Sprintf("account:%d", i%1000),
+								Behavior:  guber.Behavior_NO_BATCHING,
+								Limit:     10,
+								Duration:  guber.Second * 5,
+								Hits:      1,
+							},
+						},
+					})
+					if err != nil {
+						b.Errorf("GetRateLimits() err: %s", err)
+					}
+				}
+			})
+		})
+		instance.Close()
+	}
+}
+
+// Forwards a 1000 item batch owned entirely by 3 other peers
+func BenchmarkServer_GetRateLimitsForwarded(b *testing.B) {
+	peers := []guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}}
+	for i := 0; i < 3; i++ {
+		addr, stop := startSlowPeer(b, 0)
+		defer stop()
+		peers = append(peers, guber.PeerInfo{Address: addr})
+	}
+
+	instance, err := guber.New(guber.Config{
+		GRPCServer: grpc.NewServer(),
+		Picker:     &modPicker{},
+	})
+	if err != nil {
+		b.Fatalf("guber.New() err: %s", err)
+	}
+	defer instance.Close()
+	instance.SetPeers(peers)
+
+	var req guber.GetRateLimitsReq
+	for i := 0; i < 1000; i++ {
+		req.Requests = append(req.Requests, &guber.RateLimitReq{
+			Name: "get_rate_limits_forwarded_benchmark",
+			// Never a multiple of 4, such that no rate limit is owned by this instance
+			UniqueKey: fmt.Sprintf("account:%d", 4*i+1+i%3),
+			Behavior:  guber.Behavior_NO_BATCHING,
+			Limit:     10,
+			Duration:  guber.Second * 5,
+			Hits:      1,
+		})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		resp, err := instance.GetRateLimits(context.Background(), &req)
+		if err != nil {
+			b.Fatalf("GetRateLimits() err: %s", err)
+		}
+		if resp.Responses[0].Error != "" {
+			b.Fatalf("GetRateLimits() err: %s", resp.Responses[0].Error)
+		}
+	}
+}
+
+// lockCountingCache counts the number of times the cache lock is acquired
+type lockCountingCache struct {
+	*cache.LRUCache
+	locks int64
+}
+
+func (c *lockCountingCache) Lock() {
+	atomic.AddInt64(&c.locks, 1)
+	c.LRUCache.Lock()
+}
+
+// Applies a 10k item batch of GLOBAL updates from the owning peer
+func BenchmarkServer_UpdatePeerGlobals(b *testing.B) {
+	req := guber.UpdatePeerGlobalsReq{}
+	for i := 0; i < 10000; i++ {
+		req.Globals = append(req.Globals, &guber.UpdatePeerGlobal{
+			Key: fmt.Sprintf("update_peer_globals_benchmark_account:%d", i),
+			Status: &guber.RateLimitResp{
+				Status:    guber.Status_UNDER_LIMIT,
+				Limit:     100,
+				Remaining: 50,
+				ResetTime: cache.MillisecondNow() + 60000,
+			},
+		})
+	}
+
+	for _, mode := range []string{"SingleCache", "WorkerPool"} {
+		conf := guber.Config{GRPCServer: grpc.NewServer(), CacheSize: 20000}
+		counter := &lockCountingCache{LRUCache: cache.NewLRUCache(20000)}
+		if mode == "SingleCache" {
+			conf.Cache = counter
+		}
+
+		instance, err := guber.New(conf)
+		if err != nil {
+			b.Fatalf("guber.New() err: %s", err)
+		}
+
+		b.Run(mode, func(b *testing.B) {
+			atomic.StoreInt64(&counter.locks, 0)
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				if _, err := instance.UpdatePeerGlobals(context.Background(), &req); err != nil {
+					b.Errorf("UpdatePeerGlobals() err: %s", err)
+				}
+			}
+			if mode == "SingleCache" {
+				b.ReportMetric(float64(atomic.LoadInt64(&counter.locks))/float64(b.N), "locks/op")
+			}
+		})
+		instance.Close()
+	}
+}
+
 func BenchmarkServer_Ping(b *testing.B) {
-	client, err := guber.DialV1Server(cluster.GetPeer())
+	client, err := guber.DialV1Server(testCluster.GetPeer())
 	if err != nil {
 		b.Errorf("NewV1Client err: %s", err)
 	}
@@ -99,7 +318,7 @@ func BenchmarkServer_Ping(b *testing.B) {
 
 /*func BenchmarkServer_GRPCGateway(b *testing.B) {
 	for n := 0; n < b.N; n++ {
-		_, err := http.Get("http://" + cluster.GetHTTPAddress() + "/v1/HealthCheck")
+		_, err := http.Get("http://" + testCluster.GetHTTPAddress() + "/v1/HealthCheck")
 		if err != nil {
 			b.Errorf("GRPCGateway() err: %s", err)
 		}
@@ -107,7 +326,7 @@ func BenchmarkServer_Ping(b *testing.B) {
 }*/
 
 func BenchmarkServer_ThunderingHeard(b *testing.B) {
-	client, err := guber.DialV1Server(cluster.GetPeer())
+	client, err := guber.DialV1Server(testCluster.GetPeer())
 	if err != nil {
 		b.Errorf("NewV1Client err: %s", err)
 	}
@@ -0,0 +1,143 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"sync/atomic"
+)
+
+// The estimated bytes held by a cache entry in addition to its key; the record, the list element,
+// the map entry and a typical rate limit value.
+const estimatedRecordBytes = 256
+
+// Budget is a memory budget in bytes shared by the consumers which hold state in memory; the caches,
+// the peer batching queues and the GLOBAL broadcast buffers. Each consumer registers its estimated
+// usage with the budget. When the budget is exceeded usage is shed in priority order; caches evict
+// their least recently used entries first, and only once the queued state alone exhausts the budget
+// are new queue entries rejected.
+//
+// Usage is an estimate, as such the budget bounds the memory held by these consumers and not the RSS
+// of the process; the runtime, connections and in flight requests are not accounted for.
+//
+// Budget is safe for concurrent use.
+type Budget struct {
+	limit  int64
+	cache  atomic.Int64
+	queued atomic.Int64
+}
+
+// NewBudget creates a Budget which holds at most `limit` bytes
+func NewBudget(limit int64) *Budget {
+	return &Budget{limit: limit}
+}
+
+// Limit returns the size of the budget in bytes
+func (b *Budget) Limit() int64 {
+	return b.limit
+}
+
+// Used returns the bytes registered with the budget by all consumers
+func (b *Budget) Used() int64 {
+	return b.cache.Load() + b.queued.Load()
+}
+
+// CacheUsed returns the bytes registered with the budget by caches
+func (b *Budget) CacheUsed() int64 {
+	return b.cache.Load()
+}
+
+// QueueUsed returns the bytes reserved by queues
+func (b *Budget) QueueUsed() int64 {
+	return b.queued.Load()
+}
+
+// Utilization returns the fraction of the budget in use, which may briefly exceed 1
+// until the caches have shed their excess.
+func (b *Budget) Utilization() float64 {
+	return float64(b.Used()) / float64(b.limit)
+}
+
+// Reserve reserves `n` bytes for a queue entry. Cache usage does not prevent a reservation, as the
+// caches shed entries to make room; false is returned only if the queues alone would exceed the
+// budget, in which case the entry must be rejected. A successful reservation must be released via
+// Release() once the entry leaves the queue.
+func (b *Budget) Reserve(n int64) bool {
+	if b.queued.Add(n) > b.limit {
+		b.queued.Add(-n)
+		return false
+	}
+	return true
+}
+
+// Release releases `n` bytes previously reserved by Reserve()
+func (b *Budget) Release(n int64) {
+	b.queued.Add(-n)
+}
+
+// over returns true if the usage registered with the budget exceeds the limit
+func (b *Budget) over() bool {
+	return b.Used() > b.limit
+}
+
+// SetBudget registers the entries of the cache with the budget, such that the cache evicts its least
+// recently used entries while the budget is exceeded in addition to when it reaches its max size. The
+// weight of an entry is estimated from the length of its key. Pass nil to stop using a budget. Like
+// Add() the caller must hold the lock.
+func (c *LRUCache) SetBudget(b *Budget) {
+	if c.budget != nil {
+		c.budget.cache.Add(-c.weight)
+		c.weight = 0
+	}
+	c.budget = b
+	c.reweigh()
+	if c.budget != nil {
+		c.shed()
+	}
+}
+
+// reweigh registers the weight of every entry in the cache with the budget
+func (c *LRUCache) reweigh() {
+	if c.budget == nil {
+		return
+	}
+	var weight int64
+	for key := range c.cache {
+		weight += weigh(key)
+	}
+	c.charge(weight - c.weight)
+}
+
+// weigh returns the estimated bytes held by the entry at `key`
+func weigh(key Key) int64 {
+	return estimatedRecordBytes + int64(len(key))
+}
+
+// charge registers a change in the weight of the cache with the budget
+func (c *LRUCache) charge(n int64) {
+	if c.budget != nil {
+		c.weight += n
+		c.budget.cache.Add(n)
+	}
+}
+
+// shed evicts the least recently used entries while the budget is exceeded. The most recently
+// used entry is always kept, such that the entry just added is not immediately evicted.
+func (c *LRUCache) shed() {
+	for c.budget.over() && c.ll.Len() > 1 {
+		c.removeOldest(RemovalBudget)
+	}
+}
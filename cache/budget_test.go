@@ -0,0 +1,151 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache_test
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudgetReserve(t *testing.T) {
+	b := cache.NewBudget(100)
+
+	assert.True(t, b.Reserve(60))
+	assert.False(t, b.Reserve(60))
+	assert.True(t, b.Reserve(40))
+	assert.Equal(t, int64(100), b.QueueUsed())
+	assert.Equal(t, 1.0, b.Utilization())
+
+	b.Release(60)
+	assert.True(t, b.Reserve(60))
+	b.Release(100)
+	assert.Equal(t, int64(0), b.Used())
+}
+
+func TestBudgetSheddingCache(t *testing.T) {
+	// Enough for roughly 10 entries
+	b := cache.NewBudget(10 * 260)
+	c := cache.NewLRUCache(0)
+	c.SetBudget(b)
+	expire := c.Now() + 10000
+
+	for i := 0; i < 100; i++ {
+		c.Add(fmt.Sprintf("key%02d", i), i, expire)
+		require.True(t, b.Used() <= b.Limit(), i)
+	}
+	assert.Equal(t, 9, c.Size())
+	assert.Equal(t, b.Used(), b.CacheUsed())
+
+	// The least recently used entries were shed
+	_, ok := c.Get("key90")
+	assert.False(t, ok)
+	_, ok = c.Get("key99")
+	assert.True(t, ok)
+
+	// Queued entries take priority, the cache sheds to make room on its next add
+	assert.True(t, b.Reserve(5*260))
+	c.Add("key100", 100, expire)
+	assert.True(t, b.Used() <= b.Limit())
+	assert.Equal(t, 4, c.Size())
+
+	// Removing entries releases their weight
+	b.Release(5 * 260)
+	used := b.CacheUsed()
+	assert.True(t, c.Delete("key100"))
+	assert.True(t, b.CacheUsed() < used)
+
+	// A cache swapped in registers its entries
+	other := cache.NewLRUCache(0)
+	for i := 0; i < 5; i++ {
+		other.Add(fmt.Sprintf("other%d", i), i, expire)
+	}
+	c.ReplaceContents(other, false)
+	assert.Equal(t, 5, c.Size())
+	assert.True(t, b.CacheUsed() > used)
+
+	// Removing the budget releases the cache
+	c.SetBudget(nil)
+	assert.Equal(t, int64(0), b.Used())
+	assert.Nil(t, c.ConsistencyCheck())
+}
+
+// Adds far more entries than the budget holds while queues concurrently reserve and release
+// their share of the budget, then asserts the heap held by the cache stays near the budget.
+func TestBudgetStress(t *testing.T) {
+	const budget = 4 << 20
+	const queueBytes = 512 << 10
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	b := cache.NewBudget(budget)
+	c := cache.NewLRUCache(0)
+	c.SetBudget(b)
+
+	// Queues which hold up to queueBytes between them
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if b.Reserve(queueBytes / 4) {
+					runtime.Gosched()
+					b.Release(queueBytes / 4)
+				}
+			}
+		}()
+	}
+
+	// Unbounded these would hold roughly 50MB
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50000; j++ {
+				c.Lock()
+				c.Add(fmt.Sprintf("stress_%d_%d", i, j), int64(j), c.Now()+60000)
+				c.Unlock()
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	held := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	assert.True(t, b.CacheUsed() <= budget)
+	assert.True(t, held < budget*5/4, "expected less than '%d' bytes held; got '%d'", budget*5/4, held)
+	assert.True(t, held > budget/2, "expected the cache to fill the budget; got '%d' bytes held", held)
+	runtime.KeepAlive(c)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCoarseClock is the coarse clock shared by every cache which is not given a clock via SetClock()
+var DefaultCoarseClock = &CoarseClock{}
+
+// CoarseNow returns the current time of DefaultCoarseClock as a unix epoch in milliseconds
+func CoarseNow() int64 {
+	return DefaultCoarseClock.Millis()
+}
+
+// CoarseClock is a holster.Clock which trades precision for speed. A background goroutine stores the
+// system time in milliseconds every millisecond and reading the clock is a single atomic load instead
+// of a call into the system clock.
+//
+// Accuracy: the time returned lags the system clock by up to one millisecond while the goroutine is
+// scheduled on time, longer if it is delayed; IE: all CPUs are saturated or the GC stopped the world.
+// The clock never runs ahead of the system clock and follows it if the system clock is adjusted.
+//
+// The zero value is ready to use; the goroutine is started by the first read of the clock and runs
+// until Stop() is called. A read after Stop() starts the goroutine again.
+type CoarseClock struct {
+	now     atomic.Int64
+	mutex   sync.Mutex
+	stop    chan struct{} // protected by mutex
+	stopped chan struct{} // protected by mutex
+}
+
+// Millis returns the current time of the clock as a unix epoch in milliseconds
+func (c *CoarseClock) Millis() int64 {
+	if now := c.now.Load(); now != 0 {
+		return now
+	}
+	return c.start()
+}
+
+// Now returns the current time of the clock truncated to the millisecond
+func (c *CoarseClock) Now() time.Time {
+	return time.Unix(0, c.Millis()*int64(time.Millisecond))
+}
+
+// Sleep pauses the current goroutine for at least the duration provided
+func (c *CoarseClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// After waits for the duration to elapse and then sends the current time on the returned channel
+func (c *CoarseClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Running returns true if the goroutine which updates the clock is running
+func (c *CoarseClock) Running() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stop != nil
+}
+
+// Stop stops the goroutine which updates the clock and waits for it to exit. It is safe to call
+// Stop() on a clock which is not running, and to keep reading the clock after it is stopped.
+func (c *CoarseClock) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	<-c.stopped
+	c.stop, c.stopped = nil, nil
+	// Readers fall through to start() until the clock is started again
+	c.now.Store(0)
+}
+
+// start starts the goroutine which updates the clock unless another reader already started it
+func (c *CoarseClock) start() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stop != nil {
+		return c.now.Load()
+	}
+
+	now := MillisecondNow()
+	c.now.Store(now)
+	c.stop, c.stopped = make(chan struct{}), make(chan struct{})
+	go c.run(c.stop, c.stopped)
+	return now
+}
+
+func (c *CoarseClock) run(stop, stopped chan struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// The time of the tick is when it was due, not when it was received
+			c.now.Store(MillisecondNow())
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ holster.Clock = &cache.CoarseClock{}
+
+func TestCoarseClock(t *testing.T) {
+	var clock cache.CoarseClock
+	defer clock.Stop()
+
+	// Not started until the first read
+	assert.False(t, clock.Running())
+
+	before := cache.MillisecondNow()
+	now := clock.Millis()
+	assert.True(t, clock.Running())
+	assert.True(t, now >= before)
+	assert.True(t, now <= cache.MillisecondNow())
+
+	// The clock advances without any further reads
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, clock.Millis() > now)
+	assert.Equal(t, int64(0), clock.Now().UnixNano()%int64(time.Millisecond))
+}
+
+func TestCoarseClockStop(t *testing.T) {
+	var clock cache.CoarseClock
+
+	// Stopping a clock which never started is a no-op
+	clock.Stop()
+	assert.False(t, clock.Running())
+
+	clock.Millis()
+	assert.True(t, clock.Running())
+
+	clock.Stop()
+	assert.False(t, clock.Running())
+	clock.Stop()
+	assert.False(t, clock.Running())
+
+	// A read after stop restarts the clock with the current time
+	time.Sleep(20 * time.Millisecond)
+	before := cache.MillisecondNow()
+	assert.True(t, clock.Millis() >= before)
+	assert.True(t, clock.Running())
+	clock.Stop()
+}
+
+func TestCoarseClockConcurrent(t *testing.T) {
+	var clock cache.CoarseClock
+	defer clock.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if clock.Millis() == 0 {
+					t.Error("expected a non zero time")
+					return
+				}
+				if i == 0 && j%100 == 0 {
+					clock.Stop()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mailgun/holster"
+)
+
+// CounterCache is an EXPERIMENTAL thread safe cache of int64 counters which supports expiration.
+//
+// Unlike LRUCache there is no global lock; counters are stored in a sync.Map and read or modified
+// with atomic operations, such that concurrent reads and increments of existing keys never wait
+// on each other. The cost is that the LRU order is approximate and maintained lazily; each counter
+// records the time it was last accessed and once the cache grows beyond its max size a single
+// goroutine sweeps the map, removing expired counters and then the least recently accessed
+// counters until the cache is back under the low water mark of 90% of the max size.
+type CounterCache struct {
+	counters sync.Map
+	size     int64
+	maxSize  int64
+	clock    holster.Clock
+
+	// Only one goroutine sweeps the cache at a time
+	sweepMutex sync.Mutex
+
+	// Stats
+	hit  int64
+	miss int64
+}
+
+type counter struct {
+	value    int64
+	accessed int64
+	// Never modified once the counter is stored, an expired counter is
+	// replaced with a new counter instead of being reset in place.
+	expireAt int64
+}
+
+// NewCounterCache creates a new CounterCache with a maximum size
+func NewCounterCache(maxSize int) *CounterCache {
+	holster.SetDefault(&maxSize, 50000)
+
+	return &CounterCache{
+		maxSize: int64(maxSize),
+		clock:   DefaultCoarseClock,
+	}
+}
+
+// SetClock sets the clock used to determine if a counter has expired; this is
+// useful for tests which need to control the passage of time. SetClock is not
+// thread safe and must be called before the cache is used.
+func (c *CounterCache) SetClock(clock holster.Clock) {
+	c.clock = clock
+}
+
+// Now returns the current time of the cache clock as a unix epoch in milliseconds
+func (c *CounterCache) Now() int64 {
+	return c.clock.Now().UnixNano() / 1000000
+}
+
+// Get returns the value of the counter at `key`. The `ok` result is false
+// if the key is not in the cache or the counter has expired.
+func (c *CounterCache) Get(key Key) (value int64, ok bool) {
+	now := c.Now()
+	if ctr := c.load(key, now); ctr != nil {
+		atomic.AddInt64(&c.hit, 1)
+		return atomic.LoadInt64(&ctr.value), true
+	}
+	atomic.AddInt64(&c.miss, 1)
+	return 0, false
+}
+
+// Increment adds `delta` to the counter at `key` and returns the new value. If the key is
+// missing or the counter has expired, a new counter starting at `delta` which expires at
+// `expireAt` is stored. An increment which races with the expiration of a counter might be
+// applied to the expired counter, in which case it is lost along with the expired counter.
+//
+// Rather than wrapping around, the counter saturates at math.MaxInt64, or math.MinInt64 for
+// a negative `delta`, in which case `saturated` is true.
+func (c *CounterCache) Increment(key Key, delta int64, expireAt int64) (value int64, saturated bool) {
+	now := c.Now()
+	for {
+		if ctr := c.load(key, now); ctr != nil {
+			atomic.AddInt64(&c.hit, 1)
+			for {
+				old := atomic.LoadInt64(&ctr.value)
+				value, saturated = saturatingAdd(old, delta)
+				if atomic.CompareAndSwapInt64(&ctr.value, old, value) {
+					return value, saturated
+				}
+			}
+		}
+		atomic.AddInt64(&c.miss, 1)
+
+		if c.store(key, &counter{value: delta, accessed: now, expireAt: expireAt}, now) {
+			return delta, false
+		}
+	}
+}
+
+// saturatingAdd returns a + b, clamped to the range of an int64 with saturated=true if the sum overflows
+func saturatingAdd(a, b int64) (sum int64, saturated bool) {
+	sum = a + b
+	switch {
+	case b > 0 && sum < a:
+		return math.MaxInt64, true
+	case b < 0 && sum > a:
+		return math.MinInt64, true
+	}
+	return sum, false
+}
+
+// TakeN consumes `n` from the quota counter at `key`. If at least `n` remains, the counter is
+// decremented and the remainder is returned with ok=true, else the counter is left untouched and
+// ok=false is returned. If the key is missing or the counter has expired, the quota is considered
+// refreshed to `quota` and stored with the provided `expireAt` before consuming `n`.
+//
+// This has the same semantics as LRUCache.TakeN() without requiring the caller to hold a lock.
+func (c *CounterCache) TakeN(key Key, n int64, quota int64, expireAt int64) (remaining int64, ok bool) {
+	now := c.Now()
+	for {
+		if ctr := c.load(key, now); ctr != nil {
+			atomic.AddInt64(&c.hit, 1)
+			for {
+				value := atomic.LoadInt64(&ctr.value)
+				if value < n {
+					return value, false
+				}
+				if atomic.CompareAndSwapInt64(&ctr.value, value, value-n) {
+					return value - n, true
+				}
+			}
+		}
+		atomic.AddInt64(&c.miss, 1)
+
+		// Start a fresh quota
+		remaining, ok = quota-n, true
+		if quota < n {
+			remaining, ok = quota, false
+		}
+		if c.store(key, &counter{value: remaining, accessed: now, expireAt: expireAt}, now) {
+			return remaining, ok
+		}
+	}
+}
+
+// Remove removes the provided key from the cache.
+func (c *CounterCache) Remove(key Key) {
+	if _, loaded := c.counters.LoadAndDelete(key); loaded {
+		atomic.AddInt64(&c.size, -1)
+	}
+}
+
+// Size returns the number of counters in the cache, including expired
+// counters which have not yet been removed by a sweep.
+func (c *CounterCache) Size() int {
+	return int(atomic.LoadInt64(&c.size))
+}
+
+// Stats returns the stats collected by the cache, if `clear` is true the counts are reset.
+// Unlike LRUCache the stats are collected atomically and no lock is required.
+func (c *CounterCache) Stats(clear bool) Stats {
+	if clear {
+		return Stats{
+			Size: atomic.LoadInt64(&c.size),
+			Hit:  atomic.SwapInt64(&c.hit, 0),
+			Miss: atomic.SwapInt64(&c.miss, 0),
+		}
+	}
+	return Stats{
+		Size: atomic.LoadInt64(&c.size),
+		Hit:  atomic.LoadInt64(&c.hit),
+		Miss: atomic.LoadInt64(&c.miss),
+	}
+}
+
+// load returns the counter at `key` and marks it as accessed, or nil if the key
+// is missing or the counter has expired.
+func (c *CounterCache) load(key Key, now int64) *counter {
+	v, ok := c.counters.Load(key)
+	if !ok {
+		return nil
+	}
+
+	ctr := v.(*counter)
+	if ctr.expireAt < now {
+		return nil
+	}
+
+	// Avoid writing to the shared counter if it was already accessed this millisecond
+	if atomic.LoadInt64(&ctr.accessed) != now {
+		atomic.StoreInt64(&ctr.accessed, now)
+	}
+	return ctr
+}
+
+// store stores a new counter at `key` if the key is missing or holds an expired counter. Returns
+// false if another goroutine stored a live counter first, in which case the caller should retry.
+func (c *CounterCache) store(key Key, ctr *counter, now int64) bool {
+	v, loaded := c.counters.LoadOrStore(key, ctr)
+	if !loaded {
+		if atomic.AddInt64(&c.size, 1) > c.maxSize {
+			c.sweep(now)
+		}
+		return true
+	}
+
+	// Replace the expired counter, unless another goroutine already replaced it
+	old := v.(*counter)
+	if old.expireAt >= now {
+		return false
+	}
+	return c.counters.CompareAndSwap(key, old, ctr)
+}
+
+// sweep removes expired counters and then the least recently accessed counters until the cache is
+// under the low water mark. If another goroutine is already sweeping, sweep returns immediately.
+func (c *CounterCache) sweep(now int64) {
+	if !c.sweepMutex.TryLock() {
+		return
+	}
+	defer c.sweepMutex.Unlock()
+
+	type entry struct {
+		key      Key
+		ctr      *counter
+		accessed int64
+	}
+
+	var live []entry
+	c.counters.Range(func(k, v interface{}) bool {
+		key, ctr := k.(Key), v.(*counter)
+		if ctr.expireAt < now {
+			c.remove(key, ctr)
+			return true
+		}
+		live = append(live, entry{key: key, ctr: ctr, accessed: atomic.LoadInt64(&ctr.accessed)})
+		return true
+	})
+
+	lowWater := c.maxSize - c.maxSize/10
+	excess := atomic.LoadInt64(&c.size) - lowWater
+	if excess <= 0 {
+		return
+	}
+
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].accessed < live[j].accessed
+	})
+	for i := 0; i < len(live) && excess > 0; i++ {
+		if c.remove(live[i].key, live[i].ctr) {
+			excess--
+		}
+	}
+}
+
+// remove removes the counter at `key` only if it has not been replaced since it was loaded
+func (c *CounterCache) remove(key Key, ctr *counter) bool {
+	if c.counters.CompareAndDelete(key, ctr) {
+		atomic.AddInt64(&c.size, -1)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache_test
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterCache(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewCounterCache(0)
+	c.SetClock(clock)
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+
+	v, _ := c.Increment("a", 1, c.Now()+1000)
+	assert.Equal(t, int64(1), v)
+	v, _ = c.Increment("a", 2, c.Now()+1000)
+	assert.Equal(t, int64(3), v)
+	v, ok = c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), v)
+
+	// An expired counter starts over
+	clock.Sleep(time.Second * 2)
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+	v, _ = c.Increment("a", 5, c.Now()+1000)
+	assert.Equal(t, int64(5), v)
+	assert.Equal(t, 1, c.Size())
+
+	c.Remove("a")
+	assert.Equal(t, 0, c.Size())
+
+	stats := c.Stats(true)
+	assert.Equal(t, int64(2), stats.Hit)
+	assert.Equal(t, int64(4), stats.Miss)
+	assert.Equal(t, int64(0), c.Stats(false).Hit)
+}
+
+func TestCounterCacheTakeN(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewCounterCache(0)
+	c.SetClock(clock)
+
+	remaining, ok := c.TakeN("q", 3, 5, c.Now()+1000)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), remaining)
+
+	// Not enough remains, the quota is left untouched
+	remaining, ok = c.TakeN("q", 3, 5, c.Now()+1000)
+	assert.False(t, ok)
+	assert.Equal(t, int64(2), remaining)
+
+	// The quota is refreshed once expired
+	clock.Sleep(time.Second * 2)
+	remaining, ok = c.TakeN("q", 3, 5, c.Now()+1000)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), remaining)
+
+	// A request larger than the quota is never allowed
+	remaining, ok = c.TakeN("big", 10, 5, c.Now()+1000)
+	assert.False(t, ok)
+	assert.Equal(t, int64(5), remaining)
+}
+
+func TestCounterCacheConcurrent(t *testing.T) {
+	c := cache.NewCounterCache(0)
+	expireAt := c.Now() + int64(time.Hour/time.Millisecond)
+
+	var wg sync.WaitGroup
+	var taken [10]int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Increment("count", 1, expireAt)
+				if _, ok := c.TakeN("quota", 1, 5000, expireAt); ok {
+					taken[i]++
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	v, _ := c.Get("count")
+	assert.Equal(t, int64(10000), v)
+
+	var total int64
+	for _, n := range taken {
+		total += n
+	}
+	assert.Equal(t, int64(5000), total)
+}
+
+func TestCounterCacheSweep(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewCounterCache(100)
+	c.SetClock(clock)
+
+	for i := 0; i < 100; i++ {
+		c.Increment(strconv.Itoa(i), 1, c.Now()+10000)
+		clock.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 100, c.Size())
+
+	// Touch the oldest key such that it survives the sweep
+	c.Get("0")
+
+	// Exceeding the max size sweeps the least recently accessed counters down to the low water mark
+	c.Increment("new", 1, c.Now()+10000)
+	assert.Equal(t, 90, c.Size())
+
+	_, ok := c.Get("0")
+	assert.True(t, ok)
+	_, ok = c.Get("new")
+	assert.True(t, ok)
+	_, ok = c.Get("1")
+	assert.False(t, ok)
+}
+
+// The read/increment mix which dominates our workload; 9 increments of an existing counter for
+// every read. The LRUCache benchmarks are the baseline the CounterCache benchmarks compare against.
+const benchKeys = 1000
+
+func benchKeyNames() []string {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = "key_" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func BenchmarkLRUCacheIncrement(b *testing.B) {
+	keys := benchKeyNames()
+	c := cache.NewLRUCache(0)
+	expireAt := c.Now() + int64(time.Hour/time.Millisecond)
+	for _, key := range keys {
+		c.Add(key, int64(0), expireAt)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			key := keys[i%benchKeys]
+			c.Lock()
+			if i%10 == 0 {
+				c.Get(key)
+			} else {
+				c.TakeN(key, -1, 0, expireAt)
+			}
+			c.Unlock()
+			i++
+		}
+	})
+}
+
+func BenchmarkCounterCacheIncrement(b *testing.B) {
+	keys := benchKeyNames()
+	c := cache.NewCounterCache(0)
+	expireAt := c.Now() + int64(time.Hour/time.Millisecond)
+	for _, key := range keys {
+		c.Increment(key, 0, expireAt)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			key := keys[i%benchKeys]
+			if i%10 == 0 {
+				c.Get(key)
+			} else {
+				c.Increment(key, 1, expireAt)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkLRUCacheTakeN(b *testing.B) {
+	keys := benchKeyNames()
+	c := cache.NewLRUCache(0)
+	expireAt := c.Now() + int64(time.Hour/time.Millisecond)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			c.Lock()
+			c.TakeN(keys[i%benchKeys], 1, int64(b.N), expireAt)
+			c.Unlock()
+			i++
+		}
+	})
+}
+
+func BenchmarkCounterCacheTakeN(b *testing.B) {
+	keys := benchKeyNames()
+	c := cache.NewCounterCache(0)
+	expireAt := c.Now() + int64(time.Hour/time.Millisecond)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			c.TakeN(keys[i%benchKeys], 1, int64(b.N), expireAt)
+			i++
+		}
+	})
+}
+
+func TestCounterCacheOverflow(t *testing.T) {
+	c := cache.NewCounterCache(0)
+	expireAt := c.Now() + 10000
+
+	v, saturated := c.Increment("a", math.MaxInt64-1, expireAt)
+	assert.Equal(t, int64(math.MaxInt64-1), v)
+	assert.False(t, saturated)
+
+	// Reaching the max is not an overflow
+	v, saturated = c.Increment("a", 1, expireAt)
+	assert.Equal(t, int64(math.MaxInt64), v)
+	assert.False(t, saturated)
+
+	// Going past it saturates instead of wrapping to a negative value
+	v, saturated = c.Increment("a", 1, expireAt)
+	assert.Equal(t, int64(math.MaxInt64), v)
+	assert.True(t, saturated)
+	v, _ = c.Get("a")
+	assert.Equal(t, int64(math.MaxInt64), v)
+
+	// The counter can still be decremented once saturated
+	v, saturated = c.Increment("a", -1, expireAt)
+	assert.Equal(t, int64(math.MaxInt64-1), v)
+	assert.False(t, saturated)
+
+	// Likewise for negative deltas at the min
+	c.Increment("b", math.MinInt64+1, expireAt)
+	v, saturated = c.Increment("b", -1, expireAt)
+	assert.Equal(t, int64(math.MinInt64), v)
+	assert.False(t, saturated)
+	v, saturated = c.Increment("b", math.MinInt64, expireAt)
+	assert.Equal(t, int64(math.MinInt64), v)
+	assert.True(t, saturated)
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+)
+
+// Expiration is decided by the cache clock, so a frozen clock makes expiry deterministic; time
+// only passes when the test says so and no real sleep or millisecond boundary is involved.
+func ExampleLRUCache_SetClock() {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewLRUCache(0)
+	c.SetClock(clock)
+
+	// Expire exactly one second from the current time of the clock
+	c.Add("key", "value", c.Now()+1000)
+
+	clock.Sleep(time.Second)
+	_, ok := c.Get("key")
+	fmt.Println("at expiry:", ok)
+
+	clock.Sleep(time.Millisecond)
+	_, ok = c.Get("key")
+	fmt.Println("after expiry:", ok)
+
+	// Output:
+	// at expiry: true
+	// after expiry: false
+}
@@ -21,28 +21,173 @@ package cache
 import (
 	"container/list"
 	"github.com/mailgun/holster"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
-// Cache is an thread unsafe LRU cache that supports expiration
+// The max number of removed records kept for reuse
+const maxFreeRecords = 128
+
+// The max number of entries considered for eviction when entries are vetoed, see SetEvictionVeto()
+const maxVetoScan = 16
+
+// The percentage of the cache size which must be free before a full cache reports it is no
+// longer full, see SetCapacityStateCallback()
+const capacityHysteresis = 5
+
+// LRUCache is an LRU cache that supports expiration.
+//
+// The cache is not safe for concurrent use by itself; the caller must hold the lock via Lock() and
+// Unlock() while calling any method which accesses the entries, such as Get(), Add(), Remove() and
+// UpdateExpiration(), or configures the cache. None of these methods acquire the lock.
+//
+// The methods called by other subsystems, which can not be expected to know about the lock, are the
+// exception: ConsistencyCheck(), WriteSnapshot(), WriteSnapshotFile(), ReadSnapshot(), ReplaceContents()
+// and the view returned by ReadOnly() acquire the lock themselves via the same mutex, as such the caller
+// must NOT hold the lock when calling them. Collect(), LiveSize() and LiveStats() only read atomic counts and
+// never lock.
 type LRUCache struct {
-	cache     map[interface{}]*list.Element
-	mutex     sync.Mutex
-	ll        *list.List
-	stats     Stats
+	cache map[Key]*list.Element
+	mutex sync.Mutex
+	ll    *list.List
+	stats cacheStats
+
+	// The number of entries held, maintained by addRecord() and removeElement(), see LiveSize()
+	live atomic.Int64
+
 	cacheSize int
+	clock     holster.Clock
+
+	// The unit of every time and expiration, see SetTimeUnit()
+	unit time.Duration
+
+	// TTL bounds, zero means unbounded
+	minTTL time.Duration
+	maxTTL time.Duration
+
+	// Max age of an entry, zero means no max age
+	maxAge time.Duration
+
+	// Records of removed entries which can be reused, see freeRecord()
+	free []*cacheRecord
+
+	// Optional, consulted before an entry is evicted to make room for a new entry
+	veto EvictionVeto
+
+	// Optional, interns the keys of new entries, see SetKeyInterner()
+	interner Interner
+
+	// Optional, the memory budget the weight of the entries is registered with
+	budget *Budget
+	weight int64
+
+	// Eviction listeners and the entries evicted while the lock was held
+	listenerMutex  sync.Mutex
+	listeners      []*evictionListener
+	listenerCount  int32
+	listenerPanics int64
+	evicted        []cacheRecord
+
+	// Optional, called when the cache becomes full or is no longer full, see SetCapacityStateCallback()
+	capacityFn    func(full bool)
+	full          atomic.Bool
+	capacityMutex sync.Mutex
+	reportedFull  bool // protected by capacityMutex
+	notifying     bool // protected by capacityMutex
+
+	// Optional, called with each value added, see SetWriteThrough()
+	writeThrough *writeThrough
+	writeErrors  atomic.Int64
+	queued       bool // async writes were queued while the lock was held
+	writeMutex   sync.Mutex
+	writes       []pendingWrite // protected by writeMutex
+	writing      bool           // protected by writeMutex
 
 	// Stats
-	sizeMetric   *prometheus.Desc
-	accessMetric *prometheus.Desc
+	sizeMetric    *prometheus.Desc
+	accessMetric  *prometheus.Desc
+	clampMetric   *prometheus.Desc
+	panicMetric   *prometheus.Desc
+	writeMetric   *prometheus.Desc
+	removalMetric *prometheus.Desc
+}
+
+// cacheStats are updated atomically such that recording a hit or miss does not require exclusive
+// access to the cache. Each count is padded onto its own cache line to avoid false sharing.
+type cacheStats struct {
+	hit      atomic.Int64
+	_        [56]byte
+	miss     atomic.Int64
+	_        [56]byte
+	clamped  atomic.Int64
+	removals [numRemovalReasons]atomic.Int64
+}
+
+func (s *cacheStats) reset() {
+	s.hit.Store(0)
+	s.miss.Store(0)
+	s.clamped.Store(0)
+	for i := range s.removals {
+		s.removals[i].Store(0)
+	}
+}
+
+// RemovalReason is the reason an entry left the cache, see the cache_removals_total metric
+type RemovalReason int
+
+const (
+	// The entry was evicted to make room for a new entry
+	RemovalCapacity RemovalReason = iota
+	// The entry was evicted to bring the cache back under its memory budget, see SetBudget()
+	RemovalBudget
+	// The entry expired; expired entries which are evicted or overwritten are counted as expired
+	RemovalExpired
+	// The entry was removed via Remove() or Delete()
+	RemovalExplicit
+	// The value of the entry was overwritten by an Add() of the same key
+	RemovalReplaced
+
+	numRemovalReasons = iota
+)
+
+var removalReasons = [numRemovalReasons]string{
+	RemovalCapacity: "capacity",
+	RemovalBudget:   "budget",
+	RemovalExpired:  "expired",
+	RemovalExplicit: "explicit",
+	RemovalReplaced: "replaced",
+}
+
+func (r RemovalReason) String() string {
+	if r < 0 || int(r) >= len(removalReasons) {
+		return "unknown"
+	}
+	return removalReasons[r]
+}
+
+// removalReason returns RemovalExpired if the record being evicted or overwritten had expired, else `reason`
+func (c *LRUCache) removalReason(record *cacheRecord, reason RemovalReason) RemovalReason {
+	if c.expired(record, c.Now()) {
+		return RemovalExpired
+	}
+	return reason
 }
 
 type cacheRecord struct {
 	key      Key
 	value    interface{}
 	expireAt int64
+	// When the value was last set, used to enforce the max age
+	createdAt int64
+	// When the value was last set or promoted by a lookup, see LastAccess()
+	accessedAt int64
+	// Optional metadata, nil unless added via AddWithMeta()
+	meta map[string]string
 }
 
 // New creates a new Cache with a maximum size
@@ -50,95 +195,762 @@ func NewLRUCache(maxSize int) *LRUCache {
 	holster.SetDefault(&maxSize, 50000)
 
 	return &LRUCache{
-		cache:     make(map[interface{}]*list.Element),
+		cache:     make(map[Key]*list.Element),
 		ll:        list.New(),
 		cacheSize: maxSize,
+		clock:     DefaultCoarseClock,
+		unit:      time.Millisecond,
 		sizeMetric: prometheus.NewDesc("cache_size",
 			"Size of the LRU Cache which holds the rate limits.", nil, nil),
 		accessMetric: prometheus.NewDesc("cache_access_count",
 			"Cache access counts.", []string{"type"}, nil),
+		clampMetric: prometheus.NewDesc("cache_ttl_clamp_count",
+			"The number of expiration times clamped into the configured TTL bounds.", nil, nil),
+		panicMetric: prometheus.NewDesc("cache_eviction_listener_panic_count",
+			"The number of eviction listener calls which panicked.", nil, nil),
+		writeMetric: prometheus.NewDesc("cache_write_through_error_count",
+			"The number of values which failed to write through to the external store.", nil, nil),
+		removalMetric: prometheus.NewDesc("cache_removals_total",
+			"The number of entries removed from the cache by reason.", []string{"reason"}, nil),
 	}
 }
 
+// Lock acquires the lock which must be held while accessing the cache, see LRUCache
 func (c *LRUCache) Lock() {
 	c.mutex.Lock()
 }
 
+// Unlock releases the lock and then calls the eviction listeners
+// for any entries evicted while the lock was held, the capacity
+// state callback if the cache became full or is no longer full
+// and the write through for any async writes queued.
 func (c *LRUCache) Unlock() {
+	evicted := c.evicted
+	c.evicted = nil
+	capacityFn := c.capacityFn
+	changed := capacityFn != nil && c.updateCapacityState()
+	queued := c.queued
+	c.queued = false
 	c.mutex.Unlock()
+
+	if len(evicted) != 0 {
+		c.notifyEvicted(evicted)
+	}
+	if queued {
+		c.flushWrites()
+	}
+	if changed {
+		c.notifyCapacityState(capacityFn)
+	}
+}
+
+// SetCapacityStateCallback registers a function which is called with true when the cache becomes full
+// and with false once it is no longer full; IE: to toggle load shedding in an admission controller.
+// The cache is full once it holds its max size of entries. To avoid flapping as entries are removed
+// and added, a full cache is no longer full only once capacityHysteresis percent of the cache is free.
+//
+// Like the eviction listeners, the state is checked when the lock is released and the callback is
+// called once the lock is released, as such the callback is free to use the cache. Changes in state
+// while the lock is held are reported once; if the cache filled and drained below capacity again
+// the callback is not called. Calls are never concurrent and the last call reports the latest state.
+//
+// The callback is never called by a cache with a max size of zero, which is never full. Pass nil to
+// remove the callback. Like Add() the caller must hold the lock.
+func (c *LRUCache) SetCapacityStateCallback(fn func(full bool)) {
+	c.capacityFn = fn
+	c.full.Store(false)
+
+	c.capacityMutex.Lock()
+	c.reportedFull = false
+	c.capacityMutex.Unlock()
+}
+
+// updateCapacityState returns true if the cache became full or is no longer full. The caller
+// must hold the lock.
+func (c *LRUCache) updateCapacityState() bool {
+	if c.cacheSize == 0 {
+		return false
+	}
+
+	full := c.full.Load()
+	if full {
+		hysteresis := c.cacheSize * capacityHysteresis / 100
+		if hysteresis < 1 {
+			hysteresis = 1
+		}
+		if c.ll.Len() > c.cacheSize-hysteresis {
+			return false
+		}
+	} else if c.ll.Len() < c.cacheSize {
+		return false
+	}
+	c.full.Store(!full)
+	return true
+}
+
+// notifyCapacityState calls `fn` with the current state until the state reported is the current state.
+// As the lock was released, another Unlock() may have changed the state again before this call; reporting
+// the current state instead of the change which triggered the call ensures the last report is correct.
+// If another go routine is already calling `fn`, it reports any change instead, such that calls are
+// never concurrent and a callback which uses the cache does not deadlock.
+func (c *LRUCache) notifyCapacityState(fn func(full bool)) {
+	c.capacityMutex.Lock()
+	if c.notifying {
+		c.capacityMutex.Unlock()
+		return
+	}
+	c.notifying = true
+	defer func() {
+		c.notifying = false
+		c.capacityMutex.Unlock()
+	}()
+
+	for {
+		full := c.full.Load()
+		if full == c.reportedFull {
+			return
+		}
+		c.reportedFull = full
+
+		func() {
+			c.capacityMutex.Unlock()
+			defer c.capacityMutex.Lock()
+			fn(full)
+		}()
+	}
+}
+
+// EvictionListener is called with the key and value of an entry evicted from the cache
+type EvictionListener func(key Key, value interface{})
+
+type evictionListener struct {
+	fn EvictionListener
+}
+
+// AddEvictionListener registers a listener which is called each time an entry is evicted because
+// the cache is full. Listeners are called in the order they were registered once the cache lock
+// is released, as such listeners are free to use the cache. A panic in one listener is recovered
+// and counted such that it does not prevent the remaining listeners from being called.
+//
+// Returns a function which removes the listener.
+func (c *LRUCache) AddEvictionListener(fn EvictionListener) (remove func()) {
+	l := &evictionListener{fn: fn}
+
+	c.listenerMutex.Lock()
+	defer c.listenerMutex.Unlock()
+	c.listeners = append(c.listeners, l)
+	atomic.StoreInt32(&c.listenerCount, int32(len(c.listeners)))
+
+	return func() {
+		c.listenerMutex.Lock()
+		defer c.listenerMutex.Unlock()
+		for i, ll := range c.listeners {
+			if ll == l {
+				// Copy such that a notify in progress can continue to range over the old slice
+				listeners := make([]*evictionListener, 0, len(c.listeners)-1)
+				listeners = append(listeners, c.listeners[:i]...)
+				c.listeners = append(listeners, c.listeners[i+1:]...)
+				break
+			}
+		}
+		atomic.StoreInt32(&c.listenerCount, int32(len(c.listeners)))
+	}
 }
 
-// Adds a value to the cache with an expiration
+func (c *LRUCache) notifyEvicted(evicted []cacheRecord) {
+	c.listenerMutex.Lock()
+	listeners := c.listeners
+	c.listenerMutex.Unlock()
+
+	for _, record := range evicted {
+		for _, l := range listeners {
+			c.callListener(l, record)
+		}
+	}
+}
+
+func (c *LRUCache) callListener(l *evictionListener, record cacheRecord) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&c.listenerPanics, 1)
+		}
+	}()
+	l.fn(record.key, record.value)
+}
+
+// EvictionVeto returns true if the entry at `key` must not be evicted
+type EvictionVeto func(key Key, value interface{}) bool
+
+// SetEvictionVeto registers a function which is consulted before the oldest entry is evicted to make
+// room for a new entry; if the entry is vetoed the next oldest entry is considered instead. This pins
+// entries, such as a critical system wide limit, in the cache without a separate data structure.
+//
+// Pinning is best effort. At most maxVetoScan entries are considered for each eviction; if all of them
+// are vetoed the oldest entry is evicted regardless, such that a cache full of pinned entries continues
+// to accept new entries. Expired entries are never pinned. Pinned entries are still removed by
+// Remove() and when they expire. The veto is called while the lock is held, as such it must be fast and
+// must not use the cache. Pass nil to remove the veto. Like Add() the caller must hold the lock.
+func (c *LRUCache) SetEvictionVeto(veto EvictionVeto) {
+	c.veto = veto
+}
+
+// evictionCandidate returns the oldest element which is not vetoed, see SetEvictionVeto()
+func (c *LRUCache) evictionCandidate() *list.Element {
+	oldest := c.ll.Back()
+	if c.veto == nil {
+		return oldest
+	}
+
+	now := c.Now()
+	ele := oldest
+	for i := 0; i < maxVetoScan && ele != nil; i++ {
+		record := ele.Value.(*cacheRecord)
+		if c.expired(record, now) || !c.veto(record.key, record.value) {
+			return ele
+		}
+		ele = ele.Prev()
+	}
+	return oldest
+}
+
+// Interner returns a canonical copy of the strings it is given, such as the InternTable of the
+// gubernator package. It must be safe for concurrent use if it is shared by several caches.
+type Interner interface {
+	Intern(s string) string
+}
+
+// SetKeyInterner registers an Interner which the keys of new entries are interned with, such that
+// caches which hold the same keys, or callers which hold the keys elsewhere, share a single copy of
+// each key instead of each retaining its own. Long keys built from a bounded set of patterns benefit
+// the most. Interning is transparent to callers; keys are looked up by value as always.
+//
+// The interner is called while the lock is held, as such it must be fast and must not use the cache.
+// Pass nil to stop interning. Like Add() the caller must hold the lock.
+func (c *LRUCache) SetKeyInterner(i Interner) {
+	c.interner = i
+}
+
+// SetClock sets the clock used to determine if an entry has expired; this is
+// useful for tests which need to control the passage of time.
+func (c *LRUCache) SetClock(clock holster.Clock) {
+	c.clock = clock
+}
+
+// Now returns the current time of the cache clock as a unix epoch in the time unit of the cache
+func (c *LRUCache) Now() int64 {
+	return c.clock.Now().UnixNano() / int64(c.unit)
+}
+
+// SetTimeUnit sets the unit of every time the cache accepts or returns; the expiration times passed to
+// Add() and friends, the TTLs of AddWithTTL() and GetWithTTL(), LastAccess() and Now(). Integrators which
+// work in seconds or nanoseconds can use their own unit instead of converting to and from milliseconds.
+// The unit can not be finer than the resolution of the clock, see SetClock(); DefaultCoarseClock has a
+// resolution of one millisecond. Defaults to time.Millisecond, which the rate limit algorithms require.
+//
+// SetTimeUnit is not thread safe and must be called before the cache is used, as the times of entries
+// already in the cache are not converted.
+func (c *LRUCache) SetTimeUnit(unit time.Duration) {
+	c.unit = unit
+}
+
+// TimeUnit returns the time unit of the cache, see SetTimeUnit()
+func (c *LRUCache) TimeUnit() time.Duration {
+	return c.unit
+}
+
+// units converts the duration into the time unit of the cache
+func (c *LRUCache) units(d time.Duration) int64 {
+	return int64(d / c.unit)
+}
+
+// addTime returns `t` plus `d` in the time unit of the cache, saturating at the bounds of an int64 rather
+// than overflowing into the past; like addTime() of the rate limit algorithms.
+func addTime(t, d int64) int64 {
+	switch {
+	case d > 0 && t > math.MaxInt64-d:
+		return math.MaxInt64
+	case d < 0 && t < math.MinInt64-d:
+		return math.MinInt64
+	}
+	return t + d
+}
+
+// SetTTLBounds configures the cache to clamp the expiration time of entries added or updated
+// such that the TTL is never below `min` or above `max`. A zero value disables that bound.
+// This guards against misconfigured durations which produce absurdly short or long windows.
+func (c *LRUCache) SetTTLBounds(min, max time.Duration) {
+	c.minTTL = min
+	c.maxTTL = max
+}
+
+// SetMaxAge configures the cache to treat any entry whose value was set more than `maxAge` ago as
+// expired, even if the expiration time of the entry has not yet passed. This is a global staleness
+// cap layered on top of the per entry expiration; an entry is expired if EITHER its expiration time
+// has passed OR it is older than the max age. A zero value disables the max age.
+func (c *LRUCache) SetMaxAge(maxAge time.Duration) {
+	c.maxAge = maxAge
+}
+
+// expired returns true if the record has passed its expiration time or is older than the max age
+func (c *LRUCache) expired(record *cacheRecord, now int64) bool {
+	if record.expireAt < now {
+		return true
+	}
+	return c.maxAge != 0 && now-record.createdAt > c.units(c.maxAge)
+}
+
+// clampExpiration returns the expiration time clamped into the configured TTL bounds
+func (c *LRUCache) clampExpiration(expireAt int64) int64 {
+	if c.minTTL == 0 && c.maxTTL == 0 {
+		return expireAt
+	}
+
+	// Compare against the bounds rather than `expireAt - now`, which overflows for far off expirations
+	now := c.Now()
+	if minExpire := addTime(now, c.units(c.minTTL)); c.minTTL != 0 && expireAt < minExpire {
+		c.stats.clamped.Add(1)
+		return minExpire
+	}
+	if maxExpire := addTime(now, c.units(c.maxTTL)); c.maxTTL != 0 && expireAt > maxExpire {
+		c.stats.clamped.Add(1)
+		return maxExpire
+	}
+	return expireAt
+}
+
+// AddWithTTL adds a value to the cache like Add() which expires `ttl` from now, where `ttl` is in the
+// time unit of the cache. Returns true if the key already existed in the cache.
+func (c *LRUCache) AddWithTTL(key Key, value interface{}, ttl int64) bool {
+	return c.Add(key, value, addTime(c.Now(), ttl))
+}
+
+// Adds a value to the cache with an expiration. A nil value is stored like any other
+// value; Get() will return the nil value with ok=true until it expires or is evicted.
+// Adding resets the age of the entry. Returns true if the key already existed in the cache.
 func (c *LRUCache) Add(key Key, value interface{}, expireAt int64) bool {
-	return c.addRecord(&cacheRecord{
-		key:      key,
-		value:    value,
-		expireAt: expireAt,
+	existed, _ := c.TryAdd(key, value, expireAt)
+	return existed
+}
+
+// TryAdd adds a value to the cache like Add() and returns the error of the write through if the write
+// failed and the Add was rejected, see WriteThroughReject(). A rejected value is not added, in which case
+// `existed` reports whether the cache holds a previous value of the key.
+func (c *LRUCache) TryAdd(key Key, value interface{}, expireAt int64) (existed bool, err error) {
+	return c.add(cacheRecord{
+		key:       key,
+		value:     value,
+		expireAt:  c.clampExpiration(expireAt),
+		createdAt: c.Now(),
 	})
 }
 
-// Adds a value to the cache.
-func (c *LRUCache) addRecord(record *cacheRecord) bool {
-	// If the key already exist, set the new value
+// add writes the record through, if a write through is set, then adds it to the cache
+func (c *LRUCache) add(record cacheRecord) (bool, error) {
+	if c.writeThrough != nil {
+		if err := c.write(&record); err != nil {
+			_, existed := c.cache[record.key]
+			return existed, err
+		}
+	}
+	return c.addRecord(record), nil
+}
+
+// AddWithMeta adds a value to the cache like Add() along with metadata about the value, such as
+// the algorithm which produced it. The metadata is replaced or cleared each time the value is set;
+// a later Add() of the same key leaves the entry without metadata. Metadata is not included in
+// snapshots. The map is stored as is, the caller must not modify it after it is added.
+func (c *LRUCache) AddWithMeta(key Key, value interface{}, expireAt int64, meta map[string]string) bool {
+	existed, _ := c.add(cacheRecord{
+		key:       key,
+		value:     value,
+		expireAt:  c.clampExpiration(expireAt),
+		createdAt: c.Now(),
+		meta:      meta,
+	})
+	return existed
+}
+
+// GetMeta returns the metadata of the entry at `key`. The `ok` result is false if the key is not
+// in the cache or has expired; an entry added without metadata returns nil with ok=true. Unlike
+// Get(), the entry is not promoted and no hit or miss is counted.
+func (c *LRUCache) GetMeta(key Key) (meta map[string]string, ok bool) {
+	if ele, hit := c.cache[key]; hit {
+		entry := ele.Value.(*cacheRecord)
+		if !c.expired(entry, c.Now()) {
+			return entry.meta, true
+		}
+	}
+	return nil, false
+}
+
+// Item is a key, value and expiration added to the cache by MAdd()
+type Item struct {
+	Key      Key
+	Value    interface{}
+	ExpireAt int64
+}
+
+// MAdd adds many values to the cache at once, such that a batch of updates requires a single
+// acquisition of the lock instead of one per item. Each item is added exactly like Add(); if a
+// key appears more than once the last item wins. Returns the number of keys which already existed.
+func (c *LRUCache) MAdd(items []Item) int {
+	var existed int
+	now := c.Now()
+	for _, item := range items {
+		ok, _ := c.add(cacheRecord{
+			key:       item.Key,
+			value:     item.Value,
+			expireAt:  c.clampExpiration(item.ExpireAt),
+			createdAt: now,
+		})
+		if ok {
+			existed++
+		}
+	}
+	return existed
+}
+
+// Adds a value to the cache. The record is passed by value such that
+// updating an existing key or replacing the oldest entry does not allocate.
+func (c *LRUCache) addRecord(record cacheRecord) bool {
+	record.accessedAt = record.createdAt
+
+	// If the key already exist, set the new value. Overwriting an entry does not change the live count.
 	if ee, ok := c.cache[record.key]; ok {
 		c.ll.MoveToFront(ee)
 		temp := ee.Value.(*cacheRecord)
-		*temp = *record
+		c.stats.removals[c.removalReason(temp, RemovalReplaced)].Add(1)
+		// Keep the key held by the map, else the entry would retain both its key and the caller's copy
+		record.key = temp.key
+		*temp = record
 		return true
 	}
 
-	ele := c.ll.PushFront(record)
-	c.cache[record.key] = ele
-	if c.cacheSize != 0 && c.ll.Len() > c.cacheSize {
-		c.removeOldest()
+	if c.interner != nil {
+		record.key = c.interner.Intern(record.key)
+	}
+
+	// If the cache is full, reuse the oldest entry instead of allocating a new one. Replacing the
+	// evicted entry with the new one does not change the live count.
+	if c.cacheSize != 0 && c.ll.Len() >= c.cacheSize {
+		ele := c.evictionCandidate()
+		temp := ele.Value.(*cacheRecord)
+		c.stats.removals[c.removalReason(temp, RemovalCapacity)].Add(1)
+		delete(c.cache, temp.key)
+		if atomic.LoadInt32(&c.listenerCount) != 0 {
+			c.evicted = append(c.evicted, *temp)
+		}
+		if c.budget != nil {
+			c.charge(weigh(record.key) - weigh(temp.key))
+		}
+		*temp = record
+		c.ll.MoveToFront(ele)
+		c.cache[record.key] = ele
+		if c.budget != nil {
+			c.shed()
+		}
+		return false
+	}
+
+	temp := c.newRecord()
+	*temp = record
+	c.cache[record.key] = c.ll.PushFront(temp)
+	c.live.Add(1)
+	if c.budget != nil {
+		c.charge(weigh(record.key))
+		c.shed()
 	}
 	return false
 }
 
+// newRecord returns a record from the free list, or allocates one if the free list is empty
+func (c *LRUCache) newRecord() *cacheRecord {
+	if n := len(c.free); n != 0 {
+		record := c.free[n-1]
+		c.free = c.free[:n-1]
+		return record
+	}
+	return &cacheRecord{}
+}
+
 // Return unix epoch in milliseconds
 func MillisecondNow() int64 {
 	return time.Now().UnixNano() / 1000000
 }
 
-// Get looks up a key's value from the cache.
+// Get looks up a key's value from the cache. The `ok` result is false only if the key
+// is not in the cache or has expired; a stored nil value returns nil with ok=true.
 func (c *LRUCache) Get(key Key) (value interface{}, ok bool) {
+	return c.GetOpt(key)
+}
+
+type getOptions struct {
+	noPromote bool
+	noStats   bool
+}
+
+// GetOption modifies the behavior of a single call to GetOpt()
+type GetOption func(*getOptions)
 
+// NoPromote prevents a hit from moving the entry to the front of the LRU list
+func NoPromote() GetOption {
+	return func(o *getOptions) {
+		o.noPromote = true
+	}
+}
+
+// NoStats prevents the lookup from being counted as a hit or miss
+func NoStats() GetOption {
+	return func(o *getOptions) {
+		o.noStats = true
+	}
+}
+
+// GetOpt looks up a key's value from the cache with the options provided. Calling
+// GetOpt() without options is identical to calling Get()
+func (c *LRUCache) GetOpt(key Key, opts ...GetOption) (value interface{}, ok bool) {
+	var o getOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return c.get(key, c.Now(), o)
+}
+
+// GetAt looks up a key's value like Get(), except the entry is checked for expiration against `now`
+// instead of the current time of the cache clock. This allows a caller to read the clock once and
+// have every lookup made on behalf of a single request agree on the current time.
+func (c *LRUCache) GetAt(key Key, now int64) (value interface{}, ok bool) {
+	return c.get(key, now, getOptions{})
+}
+
+func (c *LRUCache) get(key Key, now int64, o getOptions) (value interface{}, ok bool) {
 	if ele, hit := c.cache[key]; hit {
 		entry := ele.Value.(*cacheRecord)
 
 		// If the entry has expired, remove it from the cache
-		if entry.expireAt < MillisecondNow() {
-			c.removeElement(ele)
-			c.stats.Miss++
+		if c.expired(entry, now) {
+			c.removeElement(ele, RemovalExpired)
+			c.freeRecord(ele)
+			if !o.noStats {
+				c.stats.miss.Add(1)
+			}
 			return
 		}
-		c.stats.Hit++
-		c.ll.MoveToFront(ele)
+		if !o.noStats {
+			c.stats.hit.Add(1)
+		}
+		if !o.noPromote {
+			c.ll.MoveToFront(ele)
+			entry.accessedAt = now
+		}
 		return entry.value, true
 	}
-	c.stats.Miss++
+	if !o.noStats {
+		c.stats.miss.Add(1)
+	}
 	return
 }
 
+// GetWithTTL looks up a key's value like Get() and returns the time remaining until the entry expires
+// in the time unit of the cache. An entry which expires at exactly the current time has a TTL of zero.
+func (c *LRUCache) GetWithTTL(key Key) (value interface{}, ttl int64, ok bool) {
+	now := c.Now()
+	value, ok = c.get(key, now, getOptions{})
+	if !ok {
+		return nil, 0, false
+	}
+	return value, c.cache[key].Value.(*cacheRecord).expireAt - now, true
+}
+
+// LastAccess returns the time as a unix epoch in the time unit of the cache the entry at `key` was last set or
+// promoted by a lookup; IE: when it was last moved to the front of the LRU list. The `ok` result is
+// false if the key is not in the cache or has expired. The entry is not promoted and no hit or miss
+// is counted. Like Get() the caller must hold the lock.
+func (c *LRUCache) LastAccess(key Key) (int64, bool) {
+	if ele, hit := c.cache[key]; hit {
+		entry := ele.Value.(*cacheRecord)
+		if !c.expired(entry, c.Now()) {
+			return entry.accessedAt, true
+		}
+	}
+	return 0, false
+}
+
+// peek returns the value of an entry which has not expired without modifying the cache in any way
+func (c *LRUCache) peek(key Key) (value interface{}, ok bool) {
+	if ele, hit := c.cache[key]; hit {
+		entry := ele.Value.(*cacheRecord)
+		if !c.expired(entry, c.Now()) {
+			return entry.value, true
+		}
+	}
+	return nil, false
+}
+
+// GetRefresh looks up a key's value like Get() and, only on a hit, extends the expiration time of
+// the entry by `extend`. The extended expiration is capped by the TTL ceiling if one is configured
+// via SetTTLBounds(). A miss or expired entry is treated exactly like Get() and nothing is extended.
+func (c *LRUCache) GetRefresh(key Key, extend time.Duration) (value interface{}, ok bool) {
+	value, ok = c.GetOpt(key)
+	if !ok {
+		return
+	}
+
+	entry := c.cache[key].Value.(*cacheRecord)
+	entry.expireAt = c.clampExpiration(addTime(entry.expireAt, c.units(extend)))
+	return value, true
+}
+
+// TakeN consumes `n` from the int64 quota stored at `key`. If at least `n` remains, the quota is
+// decremented and the remainder is returned with ok=true, else the quota is left untouched and
+// ok=false is returned. If the key is missing, expired or does not hold an int64, the quota is
+// considered refreshed to `quota` and stored with the provided `expireAt` before consuming `n`.
+// The fresh quota is added like Add(), as such it is written through; if the write through rejects
+// it, see WriteThroughReject(), nothing is stored and 0 is returned with ok=false.
+//
+// Like Get() and Add() the caller must hold the lock, which makes the read and
+// decrement a single atomic operation.
+func (c *LRUCache) TakeN(key Key, n int64, quota int64, expireAt int64) (remaining int64, ok bool) {
+	if ele, hit := c.cache[key]; hit {
+		entry := ele.Value.(*cacheRecord)
+		value, isInt := entry.value.(int64)
+
+		if now := c.Now(); isInt && !c.expired(entry, now) {
+			c.stats.hit.Add(1)
+			c.ll.MoveToFront(ele)
+			entry.accessedAt = now
+			if value < n {
+				return value, false
+			}
+			entry.value = value - n
+			return value - n, true
+		}
+	}
+	c.stats.miss.Add(1)
+
+	// Start a fresh quota
+	remaining, ok = quota-n, true
+	if quota < n {
+		remaining, ok = quota, false
+	}
+	record := cacheRecord{key: key, value: remaining, expireAt: c.clampExpiration(expireAt), createdAt: c.Now()}
+	if _, err := c.add(record); err != nil {
+		return 0, false
+	}
+	return remaining, ok
+}
+
+// Hit counts a hit against the fixed window counter stored at `key`. If the window of the counter has
+// not ended the counter is incremented, else a fresh window which ends `window` from now is started with
+// a count of 1. Returns the count including this hit, whether the count is within `limit` and the time the
+// window ends in the time unit of the cache, after which the next hit starts a fresh window.
+//
+// Every hit is counted up to math.MaxInt64, including those over the limit. A key which is missing, expired
+// or does not hold an int64 starts a fresh window, which is added like Add() and as such written through; if
+// the write through rejects it, see WriteThroughReject(), the hit is not counted and 0 is returned with
+// allowed=false.
+// Like TakeN() the caller must hold the lock, which makes the lookup, increment and insert a single atomic
+// operation.
+func (c *LRUCache) Hit(key Key, window time.Duration, limit int64) (count int64, allowed bool, resetAt int64) {
+	now := c.Now()
+	if ele, hit := c.cache[key]; hit {
+		entry := ele.Value.(*cacheRecord)
+		value, isInt := entry.value.(int64)
+
+		if isInt && !c.expired(entry, now) {
+			c.stats.hit.Add(1)
+			c.ll.MoveToFront(ele)
+			entry.accessedAt = now
+			// Saturate rather than wrap around to a negative count, which every limit would allow
+			if value == math.MaxInt64 {
+				return value, false, entry.expireAt
+			}
+			entry.value = value + 1
+			return value + 1, value+1 <= limit, entry.expireAt
+		}
+	}
+	c.stats.miss.Add(1)
+
+	// Start a fresh window
+	resetAt = c.clampExpiration(addTime(now, c.units(window)))
+	if _, err := c.add(cacheRecord{key: key, value: int64(1), expireAt: resetAt, createdAt: now}); err != nil {
+		return 0, false, resetAt
+	}
+	return 1, 1 <= limit, resetAt
+}
+
 // Remove removes the provided key from the cache.
 func (c *LRUCache) Remove(key Key) {
+	c.Delete(key)
+}
+
+// Delete removes the provided key from the cache. Returns true if the key was in the cache,
+// false if it was already gone. An expired entry which has not yet been removed is still
+// in the cache and is reported as removed.
+func (c *LRUCache) Delete(key Key) bool {
 	if ele, hit := c.cache[key]; hit {
-		c.removeElement(ele)
+		c.removeElement(ele, RemovalExplicit)
+		c.freeRecord(ele)
+		return true
 	}
+	return false
 }
 
-// RemoveOldest removes the oldest item from the cache.
-func (c *LRUCache) removeOldest() {
-	ele := c.ll.Back()
+// RemoveOldest removes the oldest item from the cache which is not vetoed.
+func (c *LRUCache) removeOldest(reason RemovalReason) {
+	ele := c.evictionCandidate()
 	if ele != nil {
-		c.removeElement(ele)
+		c.removeElement(ele, c.removalReason(ele.Value.(*cacheRecord), reason))
+		if atomic.LoadInt32(&c.listenerCount) != 0 {
+			c.evicted = append(c.evicted, *ele.Value.(*cacheRecord))
+		}
 	}
 }
 
-func (c *LRUCache) removeElement(e *list.Element) {
+// removeElement removes the entry from the cache, every removal of an entry MUST go through here
+// such that the live count does not drift from the entries held and the removal is counted.
+func (c *LRUCache) removeElement(e *list.Element, reason RemovalReason) {
+	c.stats.removals[reason].Add(1)
 	c.ll.Remove(e)
 	kv := e.Value.(*cacheRecord)
 	delete(c.cache, kv.key)
+	c.live.Add(-1)
+	if c.budget != nil {
+		c.charge(-weigh(kv.key))
+	}
+}
+
+// freeRecord returns the record of a removed element to the free list. The record must not be
+// referenced anywhere else, as such this is only safe once the element is removed from the list.
+func (c *LRUCache) freeRecord(e *list.Element) {
+	if len(c.free) < maxFreeRecords {
+		record := e.Value.(*cacheRecord)
+		*record = cacheRecord{}
+		c.free = append(c.free, record)
+	}
+}
+
+// Stats returns the stats collected by the cache, if `clear` is true the counts are reset. The
+// counts are read atomically, however like Get() and Add() the caller must hold the lock such
+// that the size is consistent.
+func (c *LRUCache) Stats(clear bool) Stats {
+	stats := Stats{Size: int64(c.ll.Len())}
+	if clear {
+		stats.Hit = c.stats.hit.Swap(0)
+		stats.Miss = c.stats.miss.Swap(0)
+		stats.Clamped = c.stats.clamped.Swap(0)
+		for i := range c.stats.removals {
+			stats.Removals[i] = c.stats.removals[i].Swap(0)
+		}
+		return stats
+	}
+	stats.Hit = c.stats.hit.Load()
+	stats.Miss = c.stats.miss.Load()
+	stats.Clamped = c.stats.clamped.Load()
+	for i := range c.stats.removals {
+		stats.Removals[i] = c.stats.removals[i].Load()
+	}
+	return stats
 }
 
 // Len returns the number of items in the cache.
@@ -146,27 +958,141 @@ func (c *LRUCache) Size() int {
 	return c.ll.Len()
 }
 
+// LiveSize returns the number of entries held by the cache, including expired entries not yet
+// removed, like Size(). Unlike Size() the count is maintained atomically, as such LiveSize is
+// safe to call without holding the lock; IE: from a metrics scrape or an admission controller.
+func (c *LRUCache) LiveSize() int {
+	return int(c.live.Load())
+}
+
+// LiveStats returns the stats collected by the cache like Stats(false), with the size of LiveSize(). Unlike
+// Stats() it is safe to call without holding the lock; IE: from a metrics scrape.
+func (c *LRUCache) LiveStats() Stats {
+	stats := Stats{
+		Size:    int64(c.LiveSize()),
+		Hit:     c.stats.hit.Load(),
+		Miss:    c.stats.miss.Load(),
+		Clamped: c.stats.clamped.Load(),
+	}
+	for i := range c.stats.removals {
+		stats.Removals[i] = c.stats.removals[i].Load()
+	}
+	return stats
+}
+
 // Update the expiration time for the key
 func (c *LRUCache) UpdateExpiration(key Key, expireAt int64) bool {
 	if ele, hit := c.cache[key]; hit {
 		entry := ele.Value.(*cacheRecord)
-		entry.expireAt = expireAt
+		entry.expireAt = c.clampExpiration(expireAt)
 		return true
 	}
 	return false
 }
 
+// ReplaceContents swaps the contents of this cache with the contents of `other`, such
+// that `other` ends up holding our previous contents. This allows a fresh cache to be
+// built in the background and cut over atomically without a window where the cache is
+// empty. The stats are not swapped with the contents, each cache keeps the counts it
+// collected; if `resetStats` is true the counts of this cache are reset instead.
+//
+// ReplaceContents acquires the mutex of both caches in the order of their address, such
+// that concurrent calls which swap the same caches in opposite directions don't deadlock.
+// As such the caller must NOT hold the lock of either cache when calling this method.
+func (c *LRUCache) ReplaceContents(other *LRUCache, resetStats bool) {
+	if other == c {
+		return
+	}
+
+	first, second := c, other
+	if uintptr(unsafe.Pointer(other)) < uintptr(unsafe.Pointer(c)) {
+		first, second = other, c
+	}
+	first.mutex.Lock()
+	second.mutex.Lock()
+	defer c.Unlock()
+	defer other.mutex.Unlock()
+
+	c.cache, other.cache = other.cache, c.cache
+	c.ll, other.ll = other.ll, c.ll
+	live := c.live.Load()
+	c.live.Store(other.live.Load())
+	other.live.Store(live)
+	c.reweigh()
+	other.reweigh()
+
+	if resetStats {
+		c.stats.reset()
+	}
+
+	// The new contents might exceed our max size
+	for c.cacheSize != 0 && c.ll.Len() > c.cacheSize {
+		c.removeOldest(RemovalCapacity)
+	}
+}
+
+// ConsistencyCheck verifies the map and the LRU list which make up the cache agree with each other;
+// every map entry must reference an element in the list under the same key and every element in
+// the list must be referenced by the map. Returns a descriptive error on the first mismatch found.
+//
+// ConsistencyCheck acquires the cache mutex, as such the caller must NOT hold the lock.
+func (c *LRUCache) ConsistencyCheck() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.cache) != c.ll.Len() {
+		return errors.Errorf("cache has '%d' keys but the list has '%d' elements", len(c.cache), c.ll.Len())
+	}
+	if live := c.live.Load(); live != int64(len(c.cache)) {
+		return errors.Errorf("live count is '%d' but the cache has '%d' keys", live, len(c.cache))
+	}
+
+	inList := make(map[*list.Element]struct{}, c.ll.Len())
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		record := e.Value.(*cacheRecord)
+		ele, ok := c.cache[record.key]
+		if !ok {
+			return errors.Errorf("list element with key '%v' is missing from the cache", record.key)
+		}
+		if ele != e {
+			return errors.Errorf("cache key '%v' references a different list element", record.key)
+		}
+		inList[e] = struct{}{}
+	}
+
+	for key, ele := range c.cache {
+		if _, ok := inList[ele]; !ok {
+			return errors.Errorf("cache key '%v' references an element which is not in the list", key)
+		}
+		if record := ele.Value.(*cacheRecord); record.key != key {
+			return errors.Errorf("cache key '%v' references an element with key '%v'", key, record.key)
+		}
+	}
+	return nil
+}
+
 // Describe fetches prometheus metrics to be registered
 func (c *LRUCache) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.sizeMetric
 	ch <- c.accessMetric
+	ch <- c.clampMetric
+	ch <- c.panicMetric
+	ch <- c.writeMetric
+	ch <- c.removalMetric
 }
 
-// Collect fetches metric counts and gauges from the cache
+// Collect fetches metric counts and gauges from the cache. Collect only reads atomic
+// counts, as such it does not acquire the lock and never waits on the cache.
 func (c *LRUCache) Collect(ch chan<- prometheus.Metric) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	ch <- prometheus.MustNewConstMetric(c.accessMetric, prometheus.CounterValue, float64(c.stats.Hit), "hit")
-	ch <- prometheus.MustNewConstMetric(c.accessMetric, prometheus.CounterValue, float64(c.stats.Miss), "miss")
-	ch <- prometheus.MustNewConstMetric(c.sizeMetric, prometheus.GaugeValue, float64(len(c.cache)))
+	ch <- prometheus.MustNewConstMetric(c.accessMetric, prometheus.CounterValue, float64(c.stats.hit.Load()), "hit")
+	ch <- prometheus.MustNewConstMetric(c.accessMetric, prometheus.CounterValue, float64(c.stats.miss.Load()), "miss")
+	ch <- prometheus.MustNewConstMetric(c.sizeMetric, prometheus.GaugeValue, float64(c.LiveSize()))
+	ch <- prometheus.MustNewConstMetric(c.clampMetric, prometheus.CounterValue, float64(c.stats.clamped.Load()))
+	ch <- prometheus.MustNewConstMetric(c.panicMetric, prometheus.CounterValue,
+		float64(atomic.LoadInt64(&c.listenerPanics)))
+	ch <- prometheus.MustNewConstMetric(c.writeMetric, prometheus.CounterValue, float64(c.writeErrors.Load()))
+	for i := range c.stats.removals {
+		ch <- prometheus.MustNewConstMetric(c.removalMetric, prometheus.CounterValue,
+			float64(c.stats.removals[i].Load()), RemovalReason(i).String())
+	}
 }
@@ -0,0 +1,1188 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplaceContents(t *testing.T) {
+	c := cache.NewLRUCache(2)
+	c.Add("old", 1, cache.MillisecondNow()+10000)
+	c.Get("old")
+	c.Get("miss")
+
+	fresh := cache.NewLRUCache(0)
+	fresh.Add("a", 1, cache.MillisecondNow()+10000)
+	fresh.Add("b", 2, cache.MillisecondNow()+10000)
+	fresh.Add("c", 3, cache.MillisecondNow()+10000)
+
+	c.ReplaceContents(fresh, false)
+
+	// Our max size is 2, so the oldest entry should have been trimmed
+	assert.Equal(t, 2, c.Size())
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+	v, ok := c.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, 3, v)
+
+	// The other cache now holds our previous contents
+	assert.Equal(t, 1, fresh.Size())
+	_, ok = fresh.Get("old")
+	assert.True(t, ok)
+
+	// Each cache keeps the counts it collected
+	c.Lock()
+	stats := c.Stats(false)
+	c.Unlock()
+	assert.Equal(t, int64(2), stats.Hit)
+	assert.Equal(t, int64(2), stats.Miss)
+	fresh.Lock()
+	stats = fresh.Stats(false)
+	fresh.Unlock()
+	assert.Equal(t, int64(1), stats.Hit)
+	assert.Equal(t, int64(0), stats.Miss)
+}
+
+// Swapping the same caches in opposite directions concurrently must not deadlock
+func TestReplaceContentsConcurrent(t *testing.T) {
+	a, b := cache.NewLRUCache(0), cache.NewLRUCache(0)
+	a.Add("a", 1, cache.MillisecondNow()+10000)
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, pair := range [][2]*cache.LRUCache{{a, b}, {b, a}} {
+		wg.Add(1)
+		go func(c, other *cache.LRUCache) {
+			defer wg.Done()
+			<-start
+			for i := 0; i < 10000; i++ {
+				c.ReplaceContents(other, false)
+			}
+		}(pair[0], pair[1])
+	}
+	close(start)
+	wg.Wait()
+
+	assert.Equal(t, 1, a.Size()+b.Size())
+	assert.Nil(t, a.ConsistencyCheck())
+	assert.Nil(t, b.ConsistencyCheck())
+}
+
+func TestTakeN(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	expire := cache.MillisecondNow() + 10000
+
+	tests := []struct {
+		N         int64
+		Remaining int64
+		Ok        bool
+	}{
+		{N: 3, Remaining: 7, Ok: true},
+		{N: 7, Remaining: 0, Ok: true},
+		{N: 1, Remaining: 0, Ok: false},
+		{N: 0, Remaining: 0, Ok: true},
+	}
+
+	for i, test := range tests {
+		remaining, ok := c.TakeN("quota", test.N, 10, expire)
+		assert.Equal(t, test.Remaining, remaining, i)
+		assert.Equal(t, test.Ok, ok, i)
+	}
+
+	// An expired quota is refreshed
+	c.Add("expired", int64(0), c.Now()-1)
+	remaining, ok := c.TakeN("expired", 4, 10, expire)
+	assert.True(t, ok)
+	assert.Equal(t, int64(6), remaining)
+
+	// A fresh quota smaller than `n` is stored but not consumed
+	remaining, ok = c.TakeN("small", 4, 2, expire)
+	assert.False(t, ok)
+	assert.Equal(t, int64(2), remaining)
+	v, ok := c.Get("small")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), v)
+}
+
+func TestHit(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewLRUCache(0)
+	c.SetClock(clock)
+	start := c.Now()
+
+	tests := []struct {
+		Advance time.Duration
+		Count   int64
+		Allowed bool
+		ResetAt int64
+	}{
+		{Count: 1, Allowed: true, ResetAt: start + 1000},
+		{Advance: 500 * time.Millisecond, Count: 2, Allowed: true, ResetAt: start + 1000},
+		{Count: 3, Allowed: true, ResetAt: start + 1000},
+		// Hits over the limit are counted
+		{Count: 4, Allowed: false, ResetAt: start + 1000},
+		// The window is still in effect at exactly the reset time
+		{Advance: 500 * time.Millisecond, Count: 5, Allowed: false, ResetAt: start + 1000},
+		{Advance: time.Millisecond, Count: 1, Allowed: true, ResetAt: start + 2001},
+	}
+
+	for i, test := range tests {
+		clock.Sleep(test.Advance)
+		count, allowed, resetAt := c.Hit("window", time.Second, 3)
+		assert.Equal(t, test.Count, count, i)
+		assert.Equal(t, test.Allowed, allowed, i)
+		assert.Equal(t, test.ResetAt, resetAt, i)
+	}
+
+	// A key which does not hold an int64 starts a fresh window
+	c.Add("string", "value", c.Now()+10000)
+	count, allowed, resetAt := c.Hit("string", time.Minute, 0)
+	assert.Equal(t, int64(1), count)
+	assert.False(t, allowed)
+	assert.Equal(t, c.Now()+60000, resetAt)
+
+	v, ttl, ok := c.GetWithTTL("window")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), v)
+	assert.Equal(t, int64(1000), ttl)
+	assert.Equal(t, 2, c.Size())
+
+	// The count saturates instead of wrapping around to a negative count which would be allowed
+	c.Add("saturated", int64(math.MaxInt64-1), c.Now()+10000)
+	count, allowed, _ = c.Hit("saturated", time.Minute, math.MaxInt64)
+	assert.Equal(t, int64(math.MaxInt64), count)
+	assert.True(t, allowed)
+	count, allowed, _ = c.Hit("saturated", time.Minute, math.MaxInt64)
+	assert.Equal(t, int64(math.MaxInt64), count)
+	assert.False(t, allowed)
+}
+
+func TestGetOpt(t *testing.T) {
+	c := cache.NewLRUCache(2)
+	expire := cache.MillisecondNow() + 10000
+	c.Add("a", 1, expire)
+	c.Add("b", 2, expire)
+
+	// Reading "a" without promotion leaves it the oldest entry
+	v, ok := c.GetOpt("a", cache.NoPromote(), cache.NoStats())
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	c.Add("c", 3, expire)
+	_, ok = c.GetOpt("a")
+	assert.False(t, ok)
+
+	// A promoted read protects "b" from eviction
+	_, ok = c.GetOpt("b")
+	assert.True(t, ok)
+	c.Add("d", 4, expire)
+	_, ok = c.Get("b")
+	assert.True(t, ok)
+	_, ok = c.Get("c")
+	assert.False(t, ok)
+}
+
+func TestNilValue(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	c.Add("nil", nil, cache.MillisecondNow()+10000)
+
+	// A stored nil is a hit
+	v, ok := c.Get("nil")
+	assert.True(t, ok)
+	assert.Nil(t, v)
+
+	// A miss is distinguished by `ok`, not the value
+	v, ok = c.Get("missing")
+	assert.False(t, ok)
+	assert.Nil(t, v)
+}
+
+func TestTTLBounds(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewLRUCache(0)
+	c.SetClock(clock)
+	c.SetTTLBounds(time.Second, time.Second*10)
+
+	// TTL below the floor is raised
+	c.Add("short", 1, c.Now()+100)
+	// TTL above the ceiling is capped
+	c.Add("long", 2, c.Now()+int64(time.Hour/time.Millisecond))
+	// TTL within the bounds is untouched
+	c.Add("ok", 3, c.Now()+5000)
+	c.UpdateExpiration("ok", c.Now()+2000)
+
+	clock.Sleep(time.Millisecond * 500)
+	_, ok := c.Get("short")
+	assert.True(t, ok)
+
+	clock.Sleep(time.Second * 2)
+	_, ok = c.Get("ok")
+	assert.False(t, ok)
+	_, ok = c.Get("long")
+	assert.True(t, ok)
+
+	clock.Sleep(time.Second * 10)
+	_, ok = c.Get("long")
+	assert.False(t, ok)
+
+	// Both clamps were counted
+	ch := make(chan prometheus.Metric, 20)
+	c.Collect(ch)
+	close(ch)
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), "cache_ttl_clamp_count") {
+			var buf dto.Metric
+			require.Nil(t, m.Write(&buf))
+			assert.Equal(t, float64(2), buf.Counter.GetValue())
+		}
+	}
+}
+
+// Bounds far off in the future used to overflow the clamped expiration into the past
+func TestTTLBoundsOverflow(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewLRUCache(0)
+	c.SetClock(clock)
+	c.SetTimeUnit(time.Nanosecond)
+	c.SetTTLBounds(time.Duration(math.MaxInt64-1), 0)
+
+	c.Add("a", 1, c.Now()+int64(time.Second))
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+
+	// An expiration which is already in the past is raised to the floor as well
+	c.Add("b", 2, math.MinInt64)
+	_, ok = c.Get("b")
+	assert.True(t, ok)
+}
+
+func TestGetRefresh(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewLRUCache(0)
+	c.SetClock(clock)
+	c.Add("a", 1, c.Now()+1000)
+
+	// Each hit extends the entry
+	for i := 0; i < 3; i++ {
+		clock.Sleep(time.Millisecond * 800)
+		v, ok := c.GetRefresh("a", time.Millisecond*800)
+		require.True(t, ok, i)
+		assert.Equal(t, 1, v)
+	}
+
+	// A miss does nothing
+	_, ok := c.GetRefresh("b", time.Second)
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.Size())
+
+	// Extensions are capped by the TTL ceiling
+	c.SetTTLBounds(0, time.Second*2)
+	_, ok = c.GetRefresh("a", time.Hour)
+	assert.True(t, ok)
+	clock.Sleep(time.Second*2 + time.Millisecond)
+	_, ok = c.GetRefresh("a", time.Hour)
+	assert.False(t, ok)
+
+	// An extension past the end of time saturates rather than overflowing into the past
+	c.SetTTLBounds(0, 0)
+	c.Add("forever", 1, math.MaxInt64-1000)
+	_, ok = c.GetRefresh("forever", time.Hour)
+	assert.True(t, ok)
+	_, ok = c.Get("forever")
+	assert.True(t, ok)
+}
+
+func TestConsistencyCheck(t *testing.T) {
+	c := cache.NewLRUCache(50)
+	require.Nil(t, c.ConsistencyCheck())
+
+	// Exercise every path which modifies the map and the list
+	for i := 0; i < 200; i++ {
+		key := strconv.Itoa(i % 80)
+		c.Add(key, i, cache.MillisecondNow()+10000)
+		switch i % 5 {
+		case 0:
+			c.Remove(strconv.Itoa(i % 30))
+		case 1:
+			c.TakeN("quota"+key, 1, 10, cache.MillisecondNow()+10000)
+		case 2:
+			c.Add("expired"+key, i, c.Now()-1)
+			c.Get("expired" + key)
+		}
+		require.Nil(t, c.ConsistencyCheck(), i)
+	}
+
+	other := cache.NewLRUCache(0)
+	for i := 0; i < 100; i++ {
+		other.Add(strconv.Itoa(i), i, cache.MillisecondNow()+10000)
+	}
+	c.ReplaceContents(other, false)
+	assert.Equal(t, 50, c.Size())
+	assert.Nil(t, c.ConsistencyCheck())
+	assert.Nil(t, other.ConsistencyCheck())
+}
+
+func TestEvictionListeners(t *testing.T) {
+	c := cache.NewLRUCache(2)
+	var calls []string
+
+	c.AddEvictionListener(func(key cache.Key, value interface{}) {
+		calls = append(calls, fmt.Sprintf("first:%v=%v", key, value))
+	})
+	c.AddEvictionListener(func(key cache.Key, value interface{}) {
+		panic("listener failed")
+	})
+	removeLast := c.AddEvictionListener(func(key cache.Key, value interface{}) {
+		// Listeners are called outside the lock, so they are free to use the cache
+		c.Lock()
+		c.Get(key)
+		c.Unlock()
+		calls = append(calls, fmt.Sprintf("last:%v=%v", key, value))
+	})
+
+	expire := cache.MillisecondNow() + 10000
+	c.Lock()
+	c.Add("a", 1, expire)
+	c.Add("b", 2, expire)
+	c.Add("c", 3, expire)
+	// Not called until the lock is released
+	assert.Len(t, calls, 0)
+	c.Unlock()
+
+	assert.Equal(t, []string{"first:a=1", "last:a=1"}, calls)
+
+	removeLast()
+	calls = nil
+	c.Lock()
+	c.Add("d", 4, expire)
+	c.Unlock()
+	assert.Equal(t, []string{"first:b=2"}, calls)
+
+	// The panics were recovered and counted
+	ch := make(chan prometheus.Metric, 20)
+	c.Collect(ch)
+	close(ch)
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), "cache_eviction_listener_panic_count") {
+			var buf dto.Metric
+			require.Nil(t, m.Write(&buf))
+			assert.Equal(t, float64(2), buf.Counter.GetValue())
+		}
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewLRUCache(0)
+	c.SetClock(clock)
+	c.SetMaxAge(time.Second * 10)
+
+	c.Add("old", 1, c.Now()+int64(time.Hour/time.Millisecond))
+	clock.Sleep(time.Second * 5)
+	c.Add("new", 2, c.Now()+int64(time.Hour/time.Millisecond))
+	c.Add("short", 3, c.Now()+1000)
+	clock.Sleep(time.Second * 6)
+
+	// Exceeds the max age even though the expiration time has not passed
+	_, ok := c.Get("old")
+	assert.False(t, ok)
+	// The expiration time has passed even though it is within the max age
+	_, ok = c.Get("short")
+	assert.False(t, ok)
+	_, ok = c.Get("new")
+	assert.True(t, ok)
+
+	// Setting the value resets the age
+	clock.Sleep(time.Second * 3)
+	c.Add("new", 4, c.Now()+int64(time.Hour/time.Millisecond))
+	clock.Sleep(time.Second * 5)
+	v, ok := c.Get("new")
+	assert.True(t, ok)
+	assert.Equal(t, 4, v)
+}
+
+func TestDelete(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	c.Add("a", 1, cache.MillisecondNow()+10000)
+
+	assert.True(t, c.Delete("a"))
+	assert.False(t, c.Delete("a"))
+	assert.False(t, c.Delete("missing"))
+	assert.Equal(t, 0, c.Size())
+	assert.Nil(t, c.ConsistencyCheck())
+}
+
+func TestStatsConcurrent(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	c.Add("hit", 1, cache.MillisecondNow()+10000)
+
+	done := make(chan struct{})
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ch := make(chan prometheus.Metric, 20)
+			c.Collect(ch)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Lock()
+				c.Get("hit")
+				c.Get("miss")
+				c.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-collected
+
+	c.Lock()
+	stats := c.Stats(true)
+	assert.Equal(t, int64(10000), stats.Hit)
+	assert.Equal(t, int64(10000), stats.Miss)
+	assert.Equal(t, int64(0), c.Stats(false).Hit)
+	c.Unlock()
+}
+
+func BenchmarkLRUCacheGet(b *testing.B) {
+	keys := benchKeyNames()
+	c := cache.NewLRUCache(0)
+	expireAt := c.Now() + int64(time.Hour/time.Millisecond)
+	for _, key := range keys[:benchKeys/2] {
+		c.Add(key, 1, expireAt)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			c.Lock()
+			c.Get(keys[i%benchKeys])
+			c.Unlock()
+			i++
+		}
+	})
+}
+
+// mapInterner is an unbounded Interner
+type mapInterner struct {
+	mutex sync.Mutex
+	strs  map[string]string
+}
+
+func (m *mapInterner) Intern(s string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if c, ok := m.strs[s]; ok {
+		return c
+	}
+	m.strs[s] = s
+	return s
+}
+
+// copyKey returns a copy of `s` which does not share the backing array of `s`
+func copyKey(s string) string {
+	return string([]byte(s))
+}
+
+func TestKeyInterner(t *testing.T) {
+	var evicted []string
+	c := cache.NewLRUCache(1)
+	c.AddEvictionListener(func(key cache.Key, value interface{}) {
+		evicted = append(evicted, key)
+	})
+	expire := cache.MillisecondNow() + 10000
+	key := strings.Repeat("a", 64)
+
+	// Overwriting an entry keeps the key the entry was added with
+	first := copyKey(key)
+	c.Lock()
+	c.Add(first, 1, expire)
+	c.Add(copyKey(key), 2, expire)
+	c.Add("b", 3, expire)
+	c.Unlock()
+	require.Len(t, evicted, 1)
+	assert.True(t, unsafe.StringData(first) == unsafe.StringData(evicted[0]))
+
+	// New entries share the copy held by the interner
+	interner := &mapInterner{strs: make(map[string]string)}
+	canonical := interner.Intern(copyKey(key))
+	evicted = nil
+	c.Lock()
+	c.SetKeyInterner(interner)
+	c.Add(copyKey(key), 1, expire)
+	v, ok := c.Get(copyKey(key))
+	c.Add("c", 2, expire)
+	c.Unlock()
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	require.Len(t, evicted, 2)
+	assert.Equal(t, "b", evicted[0])
+	assert.True(t, unsafe.StringData(canonical) == unsafe.StringData(evicted[1]))
+}
+
+// Reports the heap retained per key by two caches which hold the same long keys, such as the rate
+// limit cache and a cache of metadata about the rate limits, with and without a shared interner.
+// The keys of each request are a fresh copy, as they are when built from a request.
+func BenchmarkKeyInterner(b *testing.B) {
+	const keys = 1000
+	prefix := strings.Repeat("requests_per_second_for_the_account_with_the_identifier_", 8)
+
+	for _, interned := range []bool{false, true} {
+		name := "plain"
+		if interned {
+			name = "interned"
+		}
+		b.Run(name, func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			limits := cache.NewLRUCache(keys)
+			meta := cache.NewLRUCache(keys)
+			if interned {
+				interner := &mapInterner{strs: make(map[string]string, keys)}
+				limits.SetKeyInterner(interner)
+				meta.SetKeyInterner(interner)
+			}
+			expireAt := limits.Now() + int64(time.Hour/time.Millisecond)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := prefix + strconv.Itoa(i%keys)
+				limits.Lock()
+				limits.Add(key, i, expireAt)
+				limits.Unlock()
+				meta.Lock()
+				meta.Add(copyKey(key), i, expireAt)
+				meta.Unlock()
+			}
+			b.StopTimer()
+
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			n := b.N
+			if n > keys {
+				n = keys
+			}
+			b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(n), "retained-B/key")
+			runtime.KeepAlive(limits)
+			runtime.KeepAlive(meta)
+		})
+	}
+}
+
+func TestMAdd(t *testing.T) {
+	c := cache.NewLRUCache(3)
+	c.Add("a", 0, cache.MillisecondNow()+10000)
+
+	existed := c.MAdd([]cache.Item{
+		{Key: "a", Value: 1, ExpireAt: cache.MillisecondNow() + 10000},
+		{Key: "b", Value: 2, ExpireAt: cache.MillisecondNow() + 10000},
+		{Key: "b", Value: 3, ExpireAt: cache.MillisecondNow() + 10000},
+		{Key: "c", Value: 4, ExpireAt: cache.MillisecondNow() + 10000},
+		{Key: "d", Value: 5, ExpireAt: cache.MillisecondNow() + 10000},
+	})
+	assert.Equal(t, 2, existed)
+	assert.Equal(t, 3, c.Size())
+
+	// The oldest key was evicted and the last duplicate wins
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+	v, ok := c.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, 3, v)
+	assert.Nil(t, c.ConsistencyCheck())
+}
+
+func TestMeta(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewLRUCache(0)
+	c.SetClock(clock)
+
+	c.AddWithMeta("a", 1, c.Now()+1000, map[string]string{"algorithm": "TOKEN_BUCKET"})
+	c.Add("b", 2, c.Now()+1000)
+
+	meta, ok := c.GetMeta("a")
+	assert.True(t, ok)
+	assert.Equal(t, "TOKEN_BUCKET", meta["algorithm"])
+
+	// Entries added without metadata have none
+	meta, ok = c.GetMeta("b")
+	assert.True(t, ok)
+	assert.Nil(t, meta)
+
+	_, ok = c.GetMeta("missing")
+	assert.False(t, ok)
+
+	// Setting the value again without metadata clears it
+	c.Add("a", 3, c.Now()+1000)
+	meta, ok = c.GetMeta("a")
+	assert.True(t, ok)
+	assert.Nil(t, meta)
+
+	// GetMeta does not count as a hit
+	assert.Equal(t, int64(0), c.Stats(false).Hit)
+
+	clock.Sleep(time.Second * 2)
+	_, ok = c.GetMeta("a")
+	assert.False(t, ok)
+}
+
+func TestReadOnly(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewLRUCache(0)
+	c.SetClock(clock)
+	c.Add("a", 1, c.Now()+1000)
+	c.Add("b", 2, c.Now()+1000)
+	c.Add("short", 3, c.Now()+10)
+
+	ro := c.ReadOnly()
+	clock.Sleep(time.Millisecond * 100)
+
+	v, ok := ro.Peek("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	assert.True(t, ro.Contains("b"))
+	assert.False(t, ro.Contains("short"))
+	assert.False(t, ro.Contains("missing"))
+
+	// Peek and Contains do not promote or count stats
+	assert.Equal(t, []cache.Key{"b", "a"}, ro.Keys())
+	assert.Equal(t, int64(0), c.Stats(false).Hit)
+
+	v, ok = ro.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	assert.Equal(t, []cache.Key{"a", "b"}, ro.Keys())
+
+	values := make(map[cache.Key]interface{})
+	ro.Each(func(key cache.Key, value interface{}) {
+		values[key] = value
+	})
+	assert.Equal(t, map[cache.Key]interface{}{"a": 1, "b": 2}, values)
+	assert.Equal(t, 3, ro.Size())
+
+	// The view exposes no way to modify the cache
+	_, ok = ro.(interface {
+		Add(cache.Key, interface{}, int64) bool
+	})
+	assert.False(t, ok)
+}
+
+func TestAnyKey(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	c.Add(cache.AnyKey(42), "answer", cache.MillisecondNow()+10000)
+
+	v, ok := c.Get("42")
+	assert.True(t, ok)
+	assert.Equal(t, "answer", v)
+	assert.Equal(t, cache.Key("key"), cache.AnyKey("key"))
+}
+
+func TestGetAt(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewLRUCache(0)
+	c.SetClock(clock)
+
+	now := c.Now()
+	c.Add("key", "value", now+10)
+
+	// The time provided decides expiration, not the cache clock
+	clock.Sleep(time.Second)
+	v, ok := c.GetAt("key", now+10)
+	assert.True(t, ok)
+	assert.Equal(t, "value", v)
+
+	_, ok = c.GetAt("key", now+11)
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Size())
+}
+
+func TestEvictionVeto(t *testing.T) {
+	c := cache.NewLRUCache(3)
+	c.SetEvictionVeto(func(key cache.Key, value interface{}) bool {
+		return strings.HasPrefix(key, "pinned")
+	})
+	expire := c.Now() + 10000
+
+	c.Add("pinned", 1, expire)
+	c.Add("a", 2, expire)
+	c.Add("b", 3, expire)
+
+	// The oldest entry is pinned, so the next oldest is evicted
+	c.Add("c", 4, expire)
+	assert.Equal(t, 3, c.Size())
+	_, ok := c.GetOpt("pinned", cache.NoPromote())
+	assert.True(t, ok)
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+	assert.Nil(t, c.ConsistencyCheck())
+
+	// When every entry is pinned the oldest is evicted regardless
+	p := cache.NewLRUCache(2)
+	p.SetEvictionVeto(func(cache.Key, interface{}) bool { return true })
+	p.Add("pinned1", 1, expire)
+	p.Add("pinned2", 2, expire)
+	p.Add("pinned3", 3, expire)
+	assert.Equal(t, 2, p.Size())
+	_, ok = p.Get("pinned1")
+	assert.False(t, ok)
+	_, ok = p.Get("pinned3")
+	assert.True(t, ok)
+
+	// Expired entries are never pinned
+	e := cache.NewLRUCache(2)
+	e.SetEvictionVeto(func(key cache.Key, value interface{}) bool { return key == "pinned" })
+	e.Add("pinned", 1, e.Now()-1)
+	e.Add("other", 2, expire)
+	e.Add("new", 3, expire)
+	_, ok = e.Get("other")
+	assert.True(t, ok)
+	assert.Nil(t, e.ConsistencyCheck())
+
+	// Removing the veto restores plain LRU eviction
+	c.SetEvictionVeto(nil)
+	c.Add("d", 5, expire)
+	_, ok = c.Get("pinned")
+	assert.False(t, ok)
+}
+
+func TestLastAccess(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewLRUCache(0)
+	c.SetClock(clock)
+
+	added := c.Now()
+	c.Add("key", "value", added+10000)
+	at, ok := c.LastAccess("key")
+	assert.True(t, ok)
+	assert.Equal(t, added, at)
+
+	// Lookups which do not promote the entry do not count as an access
+	clock.Sleep(time.Second)
+	c.GetOpt("key", cache.NoPromote())
+	at, _ = c.LastAccess("key")
+	assert.Equal(t, added, at)
+
+	c.Get("key")
+	at, _ = c.LastAccess("key")
+	assert.Equal(t, added+1000, at)
+
+	// Adding the key again resets the access time
+	clock.Sleep(time.Second)
+	c.Add("key", "other", added+10000)
+	at, _ = c.LastAccess("key")
+	assert.Equal(t, added+2000, at)
+
+	// LastAccess itself is not an access and counts no stats
+	assert.Equal(t, int64(2), c.Stats(false).Hit)
+
+	_, ok = c.LastAccess("missing")
+	assert.False(t, ok)
+	clock.Sleep(10 * time.Second)
+	_, ok = c.LastAccess("key")
+	assert.False(t, ok)
+}
+
+func TestTimeUnit(t *testing.T) {
+	for _, unit := range []time.Duration{time.Nanosecond, time.Millisecond, time.Second} {
+		t.Run(unit.String(), func(t *testing.T) {
+			clock := &holster.FrozenClock{CurrentTime: time.Now()}
+			c := cache.NewLRUCache(0)
+			c.SetClock(clock)
+			c.SetTimeUnit(unit)
+			assert.Equal(t, unit, c.TimeUnit())
+			assert.Equal(t, clock.Now().UnixNano()/int64(unit), c.Now())
+
+			// TTLs are in the unit of the cache
+			c.AddWithTTL("key", "value", 10)
+			value, ttl, ok := c.GetWithTTL("key")
+			assert.True(t, ok)
+			assert.Equal(t, "value", value)
+			assert.Equal(t, int64(10), ttl)
+
+			clock.Sleep(4 * unit)
+			_, ttl, ok = c.GetWithTTL("key")
+			assert.True(t, ok)
+			assert.Equal(t, int64(6), ttl)
+
+			at, _ := c.LastAccess("key")
+			assert.Equal(t, c.Now(), at)
+
+			clock.Sleep(7 * unit)
+			_, _, ok = c.GetWithTTL("key")
+			assert.False(t, ok)
+
+			// Durations configured on the cache are converted into its unit
+			c.SetTTLBounds(0, 5*unit)
+			c.AddWithTTL("bounded", "value", 100)
+			_, ttl, _ = c.GetWithTTL("bounded")
+			assert.Equal(t, int64(5), ttl)
+
+			c.SetMaxAge(2 * unit)
+			clock.Sleep(3 * unit)
+			_, ok = c.Get("bounded")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestCapacityStateCallback(t *testing.T) {
+	c := cache.NewLRUCache(100)
+	expire := c.Now() + 100000
+
+	var states []bool
+	c.Lock()
+	c.SetCapacityStateCallback(func(full bool) {
+		states = append(states, full)
+	})
+	c.Unlock()
+
+	add := func(from, to int) {
+		for i := from; i < to; i++ {
+			c.Lock()
+			c.Add(strconv.Itoa(i), i, expire)
+			c.Unlock()
+		}
+	}
+	remove := func(from, to int) {
+		for i := from; i < to; i++ {
+			c.Lock()
+			c.Remove(strconv.Itoa(i))
+			c.Unlock()
+		}
+	}
+
+	add(0, 99)
+	assert.Empty(t, states)
+	add(99, 100)
+	assert.Equal(t, []bool{true}, states)
+
+	// Evicting to make room for new entries does not change the state
+	add(100, 200)
+	assert.Equal(t, []bool{true}, states)
+
+	// Removing a few entries does not flap the state
+	remove(100, 104)
+	assert.Equal(t, []bool{true}, states)
+	add(100, 104)
+	assert.Equal(t, []bool{true}, states)
+
+	// Until enough of the cache is free
+	remove(100, 105)
+	assert.Equal(t, []bool{true, false}, states)
+	add(100, 104)
+	assert.Equal(t, []bool{true, false}, states)
+	add(104, 105)
+	assert.Equal(t, []bool{true, false, true}, states)
+
+	// Changes while the lock is held are reported once when the lock is released
+	c.Lock()
+	for i := 100; i < 200; i++ {
+		c.Remove(strconv.Itoa(i))
+	}
+	assert.Equal(t, []bool{true, false, true}, states)
+	c.Unlock()
+	assert.Equal(t, []bool{true, false, true, false}, states)
+
+	// Filling and draining the cache while the lock is held is not reported
+	c.Lock()
+	for i := 0; i < 100; i++ {
+		c.Add(strconv.Itoa(i), i, expire)
+	}
+	c.Remove("0")
+	for i := 1; i < 100; i++ {
+		c.Remove(strconv.Itoa(i))
+	}
+	c.Unlock()
+	assert.Equal(t, []bool{true, false, true, false}, states)
+
+	// The callback is free to use the cache, even if that changes the state again
+	c.Lock()
+	c.SetCapacityStateCallback(func(full bool) {
+		states = append(states, full)
+		if full {
+			remove(0, 10)
+		}
+	})
+	c.Unlock()
+	add(0, 100)
+	assert.Equal(t, []bool{true, false, true, false, true, false}, states)
+}
+
+func TestCapacityStateCallbackConcurrent(t *testing.T) {
+	c := cache.NewLRUCache(100)
+	expire := c.Now() + 100000
+
+	var mutex sync.Mutex
+	var states []bool
+	c.Lock()
+	c.SetCapacityStateCallback(func(full bool) {
+		mutex.Lock()
+		states = append(states, full)
+		mutex.Unlock()
+	})
+	c.Unlock()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := strconv.Itoa(g*1000 + i%20)
+				c.Lock()
+				if i%3 == 0 {
+					c.Remove(key)
+				} else {
+					c.Add(key, i, expire)
+				}
+				c.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// Reports alternate and the last report is the current state
+	require.NotEmpty(t, states)
+	for i := 1; i < len(states); i++ {
+		assert.NotEqual(t, states[i-1], states[i], i)
+	}
+	c.Lock()
+	size := c.Size()
+	c.Unlock()
+	if states[len(states)-1] {
+		assert.True(t, size > 95, "size '%d'", size)
+	} else {
+		assert.True(t, size < 100, "size '%d'", size)
+	}
+}
+
+// Run with -race; access guarded by Lock() and Unlock() and the methods which acquire the lock
+// themselves must not race with each other.
+func TestConcurrentAccess(t *testing.T) {
+	c := cache.NewLRUCache(500)
+	registry := prometheus.NewRegistry()
+	require.Nil(t, registry.Register(c))
+	view := c.ReadOnly()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				key := strconv.Itoa((g*7 + i) % 1000)
+				c.Lock()
+				switch i % 4 {
+				case 0:
+					c.Add(key, i, c.Now()+100000)
+				case 1:
+					c.Get(key)
+				case 2:
+					c.UpdateExpiration(key, c.Now()+200000)
+				case 3:
+					c.Remove(key)
+				}
+				c.Unlock()
+			}
+		}(g)
+	}
+
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, err := registry.Gather()
+			assert.Nil(t, err)
+			view.Size()
+			view.Contains("1")
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	<-collected
+
+	assert.Nil(t, c.ConsistencyCheck())
+	assert.True(t, view.Size() <= 500)
+}
+
+func TestLiveSize(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	c := cache.NewLRUCache(50)
+	c.SetClock(clock)
+	c.AddEvictionListener(func(cache.Key, interface{}) {})
+
+	for i := 0; i < 20000; i++ {
+		key := strconv.Itoa(rnd.Intn(100))
+		expire := c.Now() + int64(rnd.Intn(1000))
+
+		c.Lock()
+		switch op := rnd.Intn(10); op {
+		case 0, 1:
+			c.Add(key, i, expire)
+		case 2:
+			c.Get(key)
+		case 3:
+			c.Delete(key)
+		case 4:
+			c.TakeN(key, 1, 10, expire)
+		case 5:
+			c.MAdd([]cache.Item{{Key: key, Value: i, ExpireAt: expire}, {Key: strconv.Itoa(rnd.Intn(100)), Value: i, ExpireAt: expire}})
+		case 6:
+			c.UpdateExpiration(key, expire)
+		case 7:
+			clock.Sleep(time.Duration(rnd.Intn(500)) * time.Millisecond)
+		case 8:
+			switch rnd.Intn(4) {
+			case 0:
+				c.SetEvictionVeto(func(key cache.Key, value interface{}) bool { return rnd.Intn(2) == 0 })
+			case 1:
+				c.SetEvictionVeto(nil)
+			case 2:
+				// Small enough to shed entries once the cache holds a few
+				c.SetBudget(cache.NewBudget(int64(rnd.Intn(2000))))
+			case 3:
+				c.SetBudget(nil)
+			}
+		case 9:
+			c.AddWithTTL(key, i, int64(rnd.Intn(1000)))
+		}
+		size := c.Size()
+		c.Unlock()
+
+		if rnd.Intn(100) == 0 {
+			other := cache.NewLRUCache(50)
+			for n := rnd.Intn(60); n > 0; n-- {
+				other.Add(strconv.Itoa(rnd.Intn(100)), n, c.Now()+1000)
+			}
+			size = other.Size()
+			c.ReplaceContents(other, false)
+			require.Equal(t, other.Size(), other.LiveSize())
+		}
+
+		require.Equal(t, size, c.LiveSize(), "after operation %d", i)
+		require.Nil(t, c.ConsistencyCheck(), "after operation %d", i)
+
+		c.Lock()
+		stats := c.Stats(false)
+		c.Unlock()
+		require.Equal(t, stats, c.LiveStats(), "after operation %d", i)
+	}
+}
+
+func TestRemovalReasons(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c := cache.NewLRUCache(2)
+	c.SetClock(clock)
+	expire := c.Now() + 1000
+
+	c.Add("a", 1, expire)
+	c.Add("b", 2, expire)
+	// Evicts "a"
+	c.Add("c", 3, expire)
+	c.Add("c", 4, expire)
+	c.Remove("b")
+	c.Remove("missing")
+
+	c.Add("d", 5, c.Now()+10)
+	// Evicts "c"
+	c.Add("e", 6, c.Now()+10)
+	clock.Sleep(time.Second)
+	// An expired entry is counted as expired when it is looked up, overwritten or evicted
+	_, ok := c.Get("d")
+	assert.False(t, ok)
+	c.Add("e", 7, c.Now()+10)
+	clock.Sleep(time.Second)
+	c.Add("f", 8, c.Now()+1000)
+	c.Add("g", 9, c.Now()+1000)
+
+	// Evicted to make room within the budget
+	c.SetBudget(cache.NewBudget(260))
+
+	stats := c.Stats(false)
+	assert.Equal(t, int64(2), stats.Removals[cache.RemovalCapacity])
+	assert.Equal(t, int64(1), stats.Removals[cache.RemovalBudget])
+	assert.Equal(t, int64(3), stats.Removals[cache.RemovalExpired])
+	assert.Equal(t, int64(1), stats.Removals[cache.RemovalExplicit])
+	assert.Equal(t, int64(1), stats.Removals[cache.RemovalReplaced])
+
+	ch := make(chan prometheus.Metric, 20)
+	c.Collect(ch)
+	close(ch)
+	removals := make(map[string]float64)
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), "cache_removals_total") {
+			var buf dto.Metric
+			require.Nil(t, m.Write(&buf))
+			removals[buf.Label[0].GetValue()] = buf.Counter.GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"capacity": 2,
+		"budget":   1,
+		"expired":  3,
+		"explicit": 1,
+		"replaced": 1,
+	}, removals)
+
+	stats = c.Stats(true)
+	assert.Equal(t, int64(1), stats.Removals[cache.RemovalBudget])
+	assert.Equal(t, [len(stats.Removals)]int64{}, c.Stats(false).Removals)
+}
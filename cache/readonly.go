@@ -0,0 +1,96 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+// ReadOnlyCache is a view of a cache which can not modify the cache contents. Hand it to
+// subsystems such as metrics exporters and debug handlers which have no business calling
+// Add() or Remove(). Unlike Cache, every method acquires the cache lock itself; the caller
+// must NOT hold the lock.
+type ReadOnlyCache interface {
+	// Get looks up a key's value like LRUCache.Get(); the lookup counts as a hit or miss
+	// and a hit promotes the entry
+	Get(key Key) (value interface{}, ok bool)
+
+	// Peek looks up a key's value without promoting the entry or counting a hit or miss
+	Peek(key Key) (value interface{}, ok bool)
+
+	// Contains returns true if the key is in the cache and has not expired
+	Contains(key Key) bool
+
+	// Size returns the number of entries in the cache, including expired entries not yet removed
+	Size() int
+
+	// Keys returns the keys of the entries which have not expired, from most to least recently used
+	Keys() []Key
+
+	// Each calls `fn` with every entry which has not expired, from most to least recently used.
+	// The cache lock is held while `fn` runs, as such `fn` must not use the cache.
+	Each(fn func(key Key, value interface{}))
+}
+
+// ReadOnly returns a read only view of the cache
+func (c *LRUCache) ReadOnly() ReadOnlyCache {
+	return &readOnlyCache{c: c}
+}
+
+type readOnlyCache struct {
+	c *LRUCache
+}
+
+func (r *readOnlyCache) Get(key Key) (interface{}, bool) {
+	r.c.Lock()
+	defer r.c.Unlock()
+	return r.c.Get(key)
+}
+
+func (r *readOnlyCache) Peek(key Key) (interface{}, bool) {
+	r.c.Lock()
+	defer r.c.Unlock()
+	return r.c.peek(key)
+}
+
+func (r *readOnlyCache) Contains(key Key) bool {
+	_, ok := r.Peek(key)
+	return ok
+}
+
+func (r *readOnlyCache) Size() int {
+	r.c.Lock()
+	defer r.c.Unlock()
+	return r.c.Size()
+}
+
+func (r *readOnlyCache) Keys() []Key {
+	var keys []Key
+	r.Each(func(key Key, _ interface{}) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+func (r *readOnlyCache) Each(fn func(key Key, value interface{})) {
+	r.c.Lock()
+	defer r.c.Unlock()
+
+	now := r.c.Now()
+	for e := r.c.ll.Front(); e != nil; e = e.Next() {
+		record := e.Value.(*cacheRecord)
+		if !r.c.expired(record, now) {
+			fn(record.key, record.value)
+		}
+	}
+}
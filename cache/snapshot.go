@@ -0,0 +1,332 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Identifies the start of a snapshot
+var snapshotMagic = []byte("GBSS")
+
+// The version of the snapshot format written by WriteSnapshot(), this MUST be
+// incremented when the format changes such that old snapshots are rejected.
+const snapshotVersion byte = 3
+
+// The largest key or value read from a snapshot, such that a corrupt length is rejected instead of
+// allocating a buffer of any size it claims.
+const maxSnapshotLength = 1 << 20
+
+// ErrSnapshotVersion is returned by ReadSnapshot() when the snapshot
+// was written using a different version of the snapshot format.
+type ErrSnapshotVersion struct {
+	Expected byte
+	Found    byte
+}
+
+func (e *ErrSnapshotVersion) Error() string {
+	return fmt.Sprintf("snapshot format version mismatch; expected '%d' found '%d'", e.Expected, e.Found)
+}
+
+// MarshalFunc converts a cached value into bytes for a snapshot
+type MarshalFunc func(value interface{}) ([]byte, error)
+
+// UnmarshalFunc converts bytes from a snapshot back into a cached value
+type UnmarshalFunc func(data []byte) (interface{}, error)
+
+type snapshotOptions struct {
+	include func(key Key, value interface{}) bool
+}
+
+// SnapshotOption modifies the behavior of a single call to WriteSnapshot()
+type SnapshotOption func(*snapshotOptions)
+
+// Include limits the snapshot to the unexpired entries for which `fn` returns true; IE: the keys
+// owned by a peer the state is handed off to. The header records the number of entries written,
+// such that the snapshot is validated on read exactly like a snapshot of the entire cache. `fn` is
+// called while the lock is held, as such it must not use the cache.
+func Include(fn func(key Key, value interface{}) bool) SnapshotOption {
+	return func(o *snapshotOptions) {
+		o.include = fn
+	}
+}
+
+// WriteSnapshot writes every unexpired entry in the cache to `w`. The cache handles the framing of
+// keys and expiration times while `marshal` is called to convert each value into bytes, which
+// allows any value type to be snapshot. Entries are written oldest first regardless of the
+// options provided, such that reading the snapshot restores their LRU order.
+//
+// The context is checked between entries, such that a snapshot of a large cache can be abandoned;
+// IE: to bound how long shutdown waits on a final snapshot. If the context is cancelled ctx.Err()
+// is returned, in which case the partial snapshot written to `w` must be discarded. ReadSnapshot()
+// rejects a partial snapshot, see WriteSnapshotFile() which only replaces complete snapshots.
+//
+// WriteSnapshot acquires the cache mutex, as such the caller must NOT hold the lock.
+func (c *LRUCache) WriteSnapshot(ctx context.Context, w io.Writer, marshal MarshalFunc, opts ...SnapshotOption) error {
+	var o snapshotOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// Avoid the cost of checking a context which can never be cancelled for every entry
+	done := ctx.Done()
+	cancelled := func() bool {
+		if done == nil {
+			return false
+		}
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Select the entries up front such that the header can record the count
+	now := c.Now()
+	records := make([]*cacheRecord, 0, c.ll.Len())
+	for e := c.ll.Back(); e != nil; e = e.Prev() {
+		if cancelled() {
+			return ctx.Err()
+		}
+		record := e.Value.(*cacheRecord)
+		if c.expired(record, now) {
+			continue
+		}
+		if o.include != nil && !o.include(record.key, record.value) {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	bw := bufio.NewWriter(w)
+	var buf [binary.MaxVarintLen64]byte
+
+	writeUvarint := func(v uint64) error {
+		_, err := bw.Write(buf[:binary.PutUvarint(buf[:], v)])
+		return err
+	}
+	writeBytes := func(b []byte) error {
+		if err := writeUvarint(uint64(len(b))); err != nil {
+			return err
+		}
+		_, err := bw.Write(b)
+		return err
+	}
+
+	if _, err := bw.Write(snapshotMagic); err != nil {
+		return errors.Wrap(err, "while writing snapshot header")
+	}
+	if err := bw.WriteByte(snapshotVersion); err != nil {
+		return errors.Wrap(err, "while writing snapshot header")
+	}
+	if err := writeUvarint(uint64(c.unit)); err != nil {
+		return errors.Wrap(err, "while writing snapshot header")
+	}
+	if err := writeUvarint(uint64(len(records))); err != nil {
+		return errors.Wrap(err, "while writing snapshot header")
+	}
+
+	// Write the oldest entries first such that reading the snapshot restores the LRU order
+	for _, record := range records {
+		if cancelled() {
+			return ctx.Err()
+		}
+		key := record.key
+		value, err := marshal(record.value)
+		if err != nil {
+			return errors.Wrapf(err, "while marshalling value for key '%s'", key)
+		}
+
+		if err := writeBytes([]byte(key)); err != nil {
+			return errors.Wrapf(err, "while writing snapshot entry '%s'", key)
+		}
+		if _, err := bw.Write(buf[:binary.PutVarint(buf[:], record.expireAt)]); err != nil {
+			return errors.Wrapf(err, "while writing snapshot entry '%s'", key)
+		}
+		if _, err := bw.Write(buf[:binary.PutVarint(buf[:], record.createdAt)]); err != nil {
+			return errors.Wrapf(err, "while writing snapshot entry '%s'", key)
+		}
+		if err := writeBytes(value); err != nil {
+			return errors.Wrapf(err, "while writing snapshot entry '%s'", key)
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteSnapshotFile writes a snapshot of the cache to the file at `path`, see WriteSnapshot(). The
+// snapshot is written to a temporary file in the same directory which is only renamed over `path` once
+// complete, as such `path` never holds a partial snapshot. If the snapshot fails or the context is
+// cancelled the temporary file is removed and any previous snapshot at `path` is left untouched.
+//
+// WriteSnapshotFile acquires the cache mutex, as such the caller must NOT hold the lock.
+func (c *LRUCache) WriteSnapshotFile(ctx context.Context, path string, marshal MarshalFunc, opts ...SnapshotOption) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "while creating snapshot file")
+	}
+
+	// Remove the temporary file unless it was renamed into place
+	renamed := false
+	defer func() {
+		if !renamed {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err := c.WriteSnapshot(ctx, f, marshal, opts...); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "while syncing snapshot file '%s'", f.Name())
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "while closing snapshot file '%s'", f.Name())
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return errors.Wrapf(err, "while renaming snapshot file to '%s'", path)
+	}
+	renamed = true
+	return nil
+}
+
+// ReadSnapshot reads a snapshot previously written by WriteSnapshot() and adds the unexpired
+// entries to the cache, calling `unmarshal` to convert each value from bytes. The entire
+// snapshot is read and validated before the cache is modified, such that an error never
+// results in a partially loaded cache. Returns *ErrSnapshotVersion if the snapshot was
+// written using a different version of the snapshot format. Times are converted if the
+// snapshot was written by a cache with a different time unit, see SetTimeUnit().
+//
+// ReadSnapshot acquires the cache mutex, as such the caller must NOT hold the lock.
+func (c *LRUCache) ReadSnapshot(r io.Reader, unmarshal UnmarshalFunc) error {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return errors.Wrap(err, "while reading snapshot header")
+	}
+	if !bytes.Equal(magic, snapshotMagic) {
+		return errors.New("while reading snapshot header; not a cache snapshot")
+	}
+
+	version, err := br.ReadByte()
+	if err != nil {
+		return errors.Wrap(err, "while reading snapshot header")
+	}
+	if version != snapshotVersion {
+		return &ErrSnapshotVersion{Expected: snapshotVersion, Found: version}
+	}
+
+	unit, err := binary.ReadUvarint(br)
+	if err != nil {
+		return errors.Wrap(err, "while reading snapshot header")
+	}
+	if unit == 0 {
+		return errors.New("while reading snapshot header; invalid time unit '0'")
+	}
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return errors.Wrap(err, "while reading snapshot header")
+	}
+
+	readBytes := func() ([]byte, error) {
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxSnapshotLength {
+			return nil, errors.Errorf("length %d exceeds the max of %d", size, maxSnapshotLength)
+		}
+		b := make([]byte, size)
+		_, err = io.ReadFull(br, b)
+		return b, err
+	}
+
+	var records []cacheRecord
+	for i := uint64(0); i < count; i++ {
+		key, err := readBytes()
+		if err != nil {
+			return errors.Wrapf(err, "while reading key for snapshot entry '%d'", i)
+		}
+
+		expireAt, err := binary.ReadVarint(br)
+		if err != nil {
+			return errors.Wrapf(err, "while reading snapshot entry '%s'", key)
+		}
+
+		createdAt, err := binary.ReadVarint(br)
+		if err != nil {
+			return errors.Wrapf(err, "while reading snapshot entry '%s'", key)
+		}
+
+		data, err := readBytes()
+		if err != nil {
+			return errors.Wrapf(err, "while reading snapshot entry '%s'", key)
+		}
+
+		value, err := unmarshal(data)
+		if err != nil {
+			return errors.Wrapf(err, "while unmarshalling value for key '%s'", key)
+		}
+
+		records = append(records, cacheRecord{
+			key:       string(key),
+			value:     value,
+			expireAt:  c.convertTime(expireAt, time.Duration(unit)),
+			createdAt: c.convertTime(createdAt, time.Duration(unit)),
+		})
+	}
+
+	c.mutex.Lock()
+	defer c.Unlock()
+
+	now := c.Now()
+	for _, record := range records {
+		if c.expired(&record, now) {
+			continue
+		}
+		c.addRecord(record)
+	}
+	return nil
+}
+
+// convertTime converts `t` from `unit` into the time unit of the cache
+func (c *LRUCache) convertTime(t int64, unit time.Duration) int64 {
+	switch {
+	case unit > c.unit:
+		return t * int64(unit/c.unit)
+	case unit < c.unit:
+		return t / int64(c.unit/unit)
+	}
+	return t
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func marshalInt(value interface{}) ([]byte, error) {
+	i, ok := value.(int)
+	if !ok {
+		return nil, errors.Errorf("unexpected type '%T'", value)
+	}
+	return []byte(strconv.Itoa(i)), nil
+}
+
+func unmarshalInt(data []byte) (interface{}, error) {
+	return strconv.Atoi(string(data))
+}
+
+func TestSnapshot(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	expire := cache.MillisecondNow() + 10000
+	c.Add("a", 1, expire)
+	c.Add("b", 2, expire)
+	c.Add("c", 3, expire)
+	c.Add("expired", 4, c.Now()-1)
+
+	var buf bytes.Buffer
+	require.Nil(t, c.WriteSnapshot(context.Background(), &buf, marshalInt))
+
+	restored := cache.NewLRUCache(2)
+	require.Nil(t, restored.ReadSnapshot(&buf, unmarshalInt))
+
+	// Entries are restored in LRU order, so the oldest was evicted
+	assert.Equal(t, 2, restored.Size())
+	_, ok := restored.Get("a")
+	assert.False(t, ok)
+	for key, expected := range map[string]int{"b": 2, "c": 3} {
+		v, ok := restored.Get(key)
+		assert.True(t, ok, key)
+		assert.Equal(t, expected, v, key)
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	c.Add("a", "not an int", cache.MillisecondNow()+10000)
+
+	var buf bytes.Buffer
+	err := c.WriteSnapshot(context.Background(), &buf, marshalInt)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "while marshalling value for key 'a'")
+
+	// A truncated snapshot does not modify the cache
+	c = cache.NewLRUCache(0)
+	c.Add("a", 1, cache.MillisecondNow()+10000)
+	c.Add("b", 2, cache.MillisecondNow()+10000)
+	buf.Reset()
+	require.Nil(t, c.WriteSnapshot(context.Background(), &buf, marshalInt))
+
+	restored := cache.NewLRUCache(0)
+	err = restored.ReadSnapshot(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), unmarshalInt)
+	require.NotNil(t, err)
+	assert.Equal(t, 0, restored.Size())
+
+	// A snapshot written with a different format version is rejected
+	data := buf.Bytes()
+	data[4] = 255
+	err = restored.ReadSnapshot(bytes.NewReader(data), unmarshalInt)
+	require.NotNil(t, err)
+	verErr, ok := err.(*cache.ErrSnapshotVersion)
+	require.True(t, ok, err)
+	assert.Equal(t, byte(3), verErr.Expected)
+	assert.Equal(t, byte(255), verErr.Found)
+	assert.Equal(t, 0, restored.Size())
+
+	// A corrupt key length is rejected rather than allocated
+	data = append([]byte("GBSS"), 3)
+	data = binary.AppendUvarint(data, uint64(time.Millisecond))
+	data = binary.AppendUvarint(data, 1)
+	data = binary.AppendUvarint(data, 1<<62)
+	err = restored.ReadSnapshot(bytes.NewReader(data), unmarshalInt)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "while reading key for snapshot entry '0': length 4611686018427387904 exceeds the max")
+	assert.Equal(t, 0, restored.Size())
+}
+
+func TestSnapshotTimeUnit(t *testing.T) {
+	// Whole seconds such that no precision is lost converting between units
+	clock := &holster.FrozenClock{CurrentTime: time.Now().Truncate(time.Second)}
+	c := cache.NewLRUCache(0)
+	c.SetClock(clock)
+	c.SetTimeUnit(time.Second)
+	c.AddWithTTL("a", 1, 60)
+
+	var buf bytes.Buffer
+	require.Nil(t, c.WriteSnapshot(context.Background(), &buf, marshalInt))
+
+	// A cache using another unit converts the times of the snapshot into its own unit
+	restored := cache.NewLRUCache(0)
+	restored.SetClock(clock)
+	require.Nil(t, restored.ReadSnapshot(bytes.NewReader(buf.Bytes()), unmarshalInt))
+	value, ttl, ok := restored.GetWithTTL("a")
+	require.True(t, ok)
+	assert.Equal(t, 1, value)
+	assert.Equal(t, int64(60000), ttl)
+
+	buf.Reset()
+	require.Nil(t, restored.WriteSnapshot(context.Background(), &buf, marshalInt))
+	c = cache.NewLRUCache(0)
+	c.SetClock(clock)
+	c.SetTimeUnit(time.Second)
+	require.Nil(t, c.ReadSnapshot(bytes.NewReader(buf.Bytes()), unmarshalInt))
+	_, ttl, ok = c.GetWithTTL("a")
+	require.True(t, ok)
+	assert.Equal(t, int64(60), ttl)
+}
+
+func TestSnapshotInclude(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	expire := c.Now() + 10000
+	c.Add("a", 1, expire)
+	c.Add("b", 2, expire)
+	c.Add("c", 3, expire)
+	c.Add("d", 4, expire)
+	c.Add("expired", 5, c.Now()-1)
+
+	// Only the odd values, which excludes the expired entry even though it matches
+	var buf bytes.Buffer
+	require.Nil(t, c.WriteSnapshot(context.Background(), &buf, marshalInt, cache.Include(func(key cache.Key, value interface{}) bool {
+		return value.(int)%2 == 1
+	})))
+
+	restored := cache.NewLRUCache(0)
+	require.Nil(t, restored.ReadSnapshot(bytes.NewReader(buf.Bytes()), unmarshalInt))
+	assert.Equal(t, []cache.Key{"c", "a"}, restored.ReadOnly().Keys())
+
+	// The header records the number of entries written, so a truncated snapshot is still rejected
+	restored = cache.NewLRUCache(0)
+	err := restored.ReadSnapshot(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), unmarshalInt)
+	require.NotNil(t, err)
+	assert.Equal(t, 0, restored.Size())
+
+	// Including nothing writes an empty snapshot
+	buf.Reset()
+	require.Nil(t, c.WriteSnapshot(context.Background(), &buf, marshalInt, cache.Include(func(cache.Key, interface{}) bool {
+		return false
+	})))
+	require.Nil(t, restored.ReadSnapshot(&buf, unmarshalInt))
+	assert.Equal(t, 0, restored.Size())
+}
+
+func TestSnapshotCancel(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	expire := cache.MillisecondNow() + 10000
+	for i := 0; i < 1000; i++ {
+		c.Add(strconv.Itoa(i), i, expire)
+	}
+
+	// Cancel part way through the entries
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var marshalled int
+	cancelAfter := func(value interface{}) ([]byte, error) {
+		if marshalled++; marshalled == 10 {
+			cancel()
+		}
+		return marshalInt(value)
+	}
+
+	var buf bytes.Buffer
+	assert.Equal(t, context.Canceled, c.WriteSnapshot(ctx, &buf, cancelAfter))
+	assert.Equal(t, 10, marshalled)
+
+	// The partial snapshot is rejected
+	restored := cache.NewLRUCache(0)
+	assert.NotNil(t, restored.ReadSnapshot(&buf, unmarshalInt))
+	assert.Equal(t, 0, restored.Size())
+
+	// The cache is still usable once cancelled
+	c.Lock()
+	assert.Equal(t, 1000, c.Size())
+	c.Unlock()
+}
+
+func TestWriteSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.snapshot")
+
+	c := cache.NewLRUCache(0)
+	expire := cache.MillisecondNow() + 10000
+	c.Add("a", 1, expire)
+	c.Add("b", 2, expire)
+	require.Nil(t, c.WriteSnapshotFile(context.Background(), path, marshalInt))
+
+	// A cancelled snapshot leaves the previous snapshot in place and removes the temporary file
+	c.Add("c", 3, expire)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, c.WriteSnapshotFile(ctx, path, marshalInt))
+
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(files))
+	assert.Equal(t, "cache.snapshot", files[0].Name())
+
+	read := func() *cache.LRUCache {
+		f, err := os.Open(path)
+		require.Nil(t, err)
+		defer f.Close()
+
+		restored := cache.NewLRUCache(0)
+		require.Nil(t, restored.ReadSnapshot(f, unmarshalInt))
+		return restored
+	}
+	assert.Equal(t, 2, read().Size())
+
+	// A failed snapshot also removes the temporary file
+	err = c.WriteSnapshotFile(context.Background(), path, func(interface{}) ([]byte, error) {
+		return nil, errors.New("marshal failed")
+	})
+	assert.Contains(t, err.Error(), "marshal failed")
+	files, err = ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+
+	// A complete snapshot replaces the previous one
+	require.Nil(t, c.WriteSnapshotFile(context.Background(), path, marshalInt))
+	assert.Equal(t, 3, read().Size())
+}
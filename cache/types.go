@@ -16,12 +16,34 @@ limitations under the License.
 
 package cache
 
+import "fmt"
+
 // Interface accepts any cache which returns cache stats
 type Stater interface {
 	Stats(bool) Stats
 }
 
+// Interface accepts any cache which can add many items under a single lock acquisition
+type MultiAdder interface {
+	MAdd(items []Item) int
+}
+
+// Interface accepts any cache which can check expiration against a time provided by the caller
+type TimedGetter interface {
+	GetAt(key Key, now int64) (value interface{}, ok bool)
+}
+
+// Interface accepts any cache which keeps a clock of its own; IE: set via SetClock(). Now() returns the current
+// time as a unix epoch in the time unit of the cache; milliseconds unless the cache supports configuring another
+// unit. The rate limit algorithms require milliseconds.
+type Clocked interface {
+	Now() int64
+}
+
 // So algorithms can interface with different cache implementations
+//
+// A nil value is a valid value and is stored like any other value. Callers must use
+// the `ok` returned by Get() to distinguish a stored nil from a miss, never the value.
 type Cache interface {
 	// Access methods
 	Add(key Key, value interface{}, expireAt int64) bool
@@ -34,12 +56,28 @@ type Cache interface {
 	Lock()
 }
 
-// A Key may be any value that is comparable. See http://golang.org/ref/spec#Comparison_operators
-type Key interface{}
+// A Key identifies an entry in the cache. Keys were once any comparable value, however every
+// caller uses strings and boxing each key into an interface cost an allocation per access.
+type Key = string
+
+// AnyKey converts a key of any type into a Key for callers migrating from the interface{} keys.
+// Strings are returned as is, any other value is formatted with fmt.Sprint; note that values of
+// different types which format the same, such as 1 and "1", map to the same Key.
+//
+// Deprecated: build string keys directly.
+func AnyKey(key interface{}) Key {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
 
 // Holds stats collected about the cache
 type Stats struct {
-	Size int64
-	Miss int64
-	Hit  int64
+	Size    int64
+	Miss    int64
+	Hit     int64
+	Clamped int64
+	// The number of entries removed, indexed by RemovalReason
+	Removals [numRemovalReasons]int64
 }
@@ -0,0 +1,146 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+// WriteThrough writes a value added to the cache to an external store, see SetWriteThrough()
+type WriteThrough func(key Key, value interface{}, expireAt int64) error
+
+// WriteThroughOption modifies how SetWriteThrough() calls the WriteThrough
+type WriteThroughOption func(*writeThrough)
+
+type writeThrough struct {
+	fn      WriteThrough
+	async   bool
+	reject  bool
+	onError func(key Key, err error)
+}
+
+// WriteThroughAsync queues the writes made while the lock is held and makes them once the lock is
+// released, such that a slow store does not hold up the cache. Writes are made in the order the values
+// were added and are never concurrent. A failed write can not fail the Add, see WriteThroughReject().
+func WriteThroughAsync() WriteThroughOption {
+	return func(w *writeThrough) {
+		w.async = true
+	}
+}
+
+// WriteThroughReject fails the Add when a synchronous write fails; the value is not added and the cache
+// keeps the previous value of the key, if any. Without it the value is added regardless. Either way the
+// error is counted and passed to the WriteThroughOnError() callback. Ignored if the writes are async.
+func WriteThroughReject() WriteThroughOption {
+	return func(w *writeThrough) {
+		w.reject = true
+	}
+}
+
+// WriteThroughOnError registers a function which is called with the key and error of each failed write.
+// The function is called while the lock is held if the writes are synchronous, as such it must be fast
+// and must not use the cache.
+func WriteThroughOnError(fn func(key Key, err error)) WriteThroughOption {
+	return func(w *writeThrough) {
+		w.onError = fn
+	}
+}
+
+type pendingWrite struct {
+	w        *writeThrough
+	key      Key
+	value    interface{}
+	expireAt int64
+}
+
+// SetWriteThrough registers a function which is called with the key, value and expiration of every value
+// added to the cache via Add(), AddWithTTL(), AddWithMeta(), TryAdd() and MAdd(), and of the fresh values
+// started by TakeN() and Hit(), such that the values are mirrored to an external store. By default the write is made synchronously while the lock is held before
+// the value is added; see WriteThroughAsync() and WriteThroughReject() to change this.
+//
+// Only adds are written through. Values modified in place after they were added, expirations updated via
+// UpdateExpiration(), values restored by ReadSnapshot() and entries removed or evicted are not. Async writes
+// pass the value as it is when the write is made, not as it was when added. Pass nil to remove the write
+// through. Like Add() the caller must hold the lock.
+func (c *LRUCache) SetWriteThrough(fn WriteThrough, opts ...WriteThroughOption) {
+	if fn == nil {
+		c.writeThrough = nil
+		return
+	}
+
+	w := writeThrough{fn: fn}
+	for _, opt := range opts {
+		opt(&w)
+	}
+	c.writeThrough = &w
+}
+
+// write writes the record through to the external store, or queues it if the writes are async.
+// Returns an error only if the write failed and the Add must be rejected. The caller must hold the lock.
+func (c *LRUCache) write(record *cacheRecord) error {
+	w := c.writeThrough
+	if w.async {
+		c.writeMutex.Lock()
+		c.writes = append(c.writes, pendingWrite{w: w, key: record.key, value: record.value, expireAt: record.expireAt})
+		c.writeMutex.Unlock()
+		c.queued = true
+		return nil
+	}
+
+	err := w.fn(record.key, record.value, record.expireAt)
+	if err == nil {
+		return nil
+	}
+	c.writeErrors.Add(1)
+	if w.onError != nil {
+		w.onError(record.key, err)
+	}
+	if w.reject {
+		return err
+	}
+	return nil
+}
+
+// flushWrites makes the queued async writes once the lock is released. If another go routine is already
+// making the writes it makes ours as well, such that the writes are made in order and never concurrently.
+// Writes queued before the write through was replaced or removed are made by the function they were queued for.
+func (c *LRUCache) flushWrites() {
+	c.writeMutex.Lock()
+	if c.writing {
+		c.writeMutex.Unlock()
+		return
+	}
+	c.writing = true
+	defer func() {
+		c.writing = false
+		c.writeMutex.Unlock()
+	}()
+
+	for len(c.writes) != 0 {
+		writes := c.writes
+		c.writes = nil
+
+		func() {
+			c.writeMutex.Unlock()
+			defer c.writeMutex.Lock()
+			for _, p := range writes {
+				if err := p.w.fn(p.key, p.value, p.expireAt); err != nil {
+					c.writeErrors.Add(1)
+					if p.w.onError != nil {
+						p.w.onError(p.key, err)
+					}
+				}
+			}
+		}()
+	}
+}
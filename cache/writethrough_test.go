@@ -0,0 +1,259 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// store is an external store which fails the writes of the keys in `fail`
+type store struct {
+	mutex  sync.Mutex
+	values map[cache.Key]interface{}
+	fail   map[cache.Key]bool
+	writes []string
+}
+
+func newStore() *store {
+	return &store{values: make(map[cache.Key]interface{}), fail: make(map[cache.Key]bool)}
+}
+
+func (s *store) write(key cache.Key, value interface{}, expireAt int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.fail[key] {
+		return errors.Errorf("write of '%s' failed", key)
+	}
+	s.values[key] = value
+	s.writes = append(s.writes, fmt.Sprintf("%s=%v", key, value))
+	return nil
+}
+
+func writeErrors(t *testing.T, c *cache.LRUCache) float64 {
+	ch := make(chan prometheus.Metric, 20)
+	c.Collect(ch)
+	close(ch)
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), "cache_write_through_error_count") {
+			var buf dto.Metric
+			require.Nil(t, m.Write(&buf))
+			return buf.Counter.GetValue()
+		}
+	}
+	t.Fatal("cache_write_through_error_count metric not collected")
+	return 0
+}
+
+func TestWriteThrough(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	s := newStore()
+	s.fail["bad"] = true
+	var failed []cache.Key
+
+	c.Lock()
+	defer c.Unlock()
+	c.SetWriteThrough(s.write, cache.WriteThroughOnError(func(key cache.Key, err error) {
+		failed = append(failed, key)
+	}))
+
+	expire := cache.MillisecondNow() + 10000
+	c.Add("a", 1, expire)
+	c.AddWithMeta("b", 2, expire, map[string]string{"algorithm": "token"})
+	c.AddWithTTL("c", 3, 10000)
+	c.MAdd([]cache.Item{{Key: "d", Value: 4, ExpireAt: expire}, {Key: "a", Value: 5, ExpireAt: expire}})
+	assert.Equal(t, []string{"a=1", "b=2", "c=3", "d=4", "a=5"}, s.writes)
+
+	// Only adds are written through
+	c.UpdateExpiration("a", expire+1000)
+	c.Remove("b")
+	assert.Len(t, s.writes, 5)
+
+	// The value is added even though the write failed
+	existed, err := c.TryAdd("bad", 6, expire)
+	assert.Nil(t, err)
+	assert.False(t, existed)
+	v, ok := c.Get("bad")
+	assert.True(t, ok)
+	assert.Equal(t, 6, v)
+	assert.Equal(t, []cache.Key{"bad"}, failed)
+	assert.Equal(t, float64(1), writeErrors(t, c))
+
+	// Removing the write through stops the writes
+	c.SetWriteThrough(nil)
+	c.Add("e", 7, expire)
+	assert.Len(t, s.writes, 5)
+}
+
+func TestWriteThroughReject(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	s := newStore()
+
+	c.Lock()
+	defer c.Unlock()
+	c.SetWriteThrough(s.write, cache.WriteThroughReject())
+
+	expire := cache.MillisecondNow() + 10000
+	existed, err := c.TryAdd("a", 1, expire)
+	require.Nil(t, err)
+	assert.False(t, existed)
+
+	// A rejected value is not added and the previous value is kept
+	s.fail["a"] = true
+	s.fail["b"] = true
+	existed, err = c.TryAdd("a", 2, expire)
+	assert.EqualError(t, err, "write of 'a' failed")
+	assert.True(t, existed)
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	assert.False(t, c.Add("b", 3, expire))
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+
+	// Rejected items of a batch are skipped
+	assert.Equal(t, 0, c.MAdd([]cache.Item{{Key: "b", Value: 4, ExpireAt: expire}, {Key: "c", Value: 5, ExpireAt: expire}}))
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	v, ok = c.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, 5, v)
+
+	assert.Equal(t, 2, c.Size())
+	assert.Equal(t, float64(3), writeErrors(t, c))
+	assert.Equal(t, map[cache.Key]interface{}{"a": 1, "c": 5}, s.values)
+}
+
+// The fresh values started by TakeN() and Hit() are written through, the values they modify in place are not
+func TestWriteThroughTakeNHit(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	s := newStore()
+
+	c.Lock()
+	defer c.Unlock()
+	c.SetWriteThrough(s.write, cache.WriteThroughReject())
+
+	expire := cache.MillisecondNow() + 10000
+	remaining, ok := c.TakeN("quota", 3, 10, expire)
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), remaining)
+	c.TakeN("quota", 3, 10, expire)
+	count, allowed, _ := c.Hit("window", time.Minute, 10)
+	assert.True(t, allowed)
+	assert.Equal(t, int64(1), count)
+	c.Hit("window", time.Minute, 10)
+	assert.Equal(t, []string{"quota=7", "window=1"}, s.writes)
+
+	// A rejected fresh value is not stored, nothing is taken and the hit is not counted
+	s.fail["rejected"] = true
+	remaining, ok = c.TakeN("rejected", 1, 10, expire)
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), remaining)
+	count, allowed, _ = c.Hit("rejected", time.Minute, 10)
+	assert.False(t, allowed)
+	assert.Equal(t, int64(0), count)
+	_, ok = c.Get("rejected")
+	assert.False(t, ok)
+	assert.Equal(t, float64(2), writeErrors(t, c))
+}
+
+func TestWriteThroughAsync(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	s := newStore()
+	s.fail["bad"] = true
+	var failed []cache.Key
+
+	c.Lock()
+	c.SetWriteThrough(s.write, cache.WriteThroughAsync(), cache.WriteThroughReject(),
+		cache.WriteThroughOnError(func(key cache.Key, err error) {
+			// Async writes are made outside the lock, so the callback is free to use the cache
+			c.Lock()
+			c.Remove(key)
+			c.Unlock()
+			failed = append(failed, key)
+		}))
+
+	expire := cache.MillisecondNow() + 10000
+	c.Add("a", 1, expire)
+	existed, err := c.TryAdd("bad", 2, expire)
+	// Async writes can not reject the add
+	assert.Nil(t, err)
+	assert.False(t, existed)
+	c.Add("a", 3, expire)
+
+	// Not written until the lock is released
+	assert.Len(t, s.writes, 0)
+	c.Unlock()
+
+	assert.Equal(t, []string{"a=1", "a=3"}, s.writes)
+	assert.Equal(t, []cache.Key{"bad"}, failed)
+	assert.Equal(t, float64(1), writeErrors(t, c))
+
+	c.Lock()
+	_, ok := c.Get("bad")
+	c.Unlock()
+	assert.False(t, ok)
+}
+
+func TestWriteThroughAsyncConcurrent(t *testing.T) {
+	c := cache.NewLRUCache(0)
+	s := newStore()
+
+	c.Lock()
+	c.SetWriteThrough(s.write, cache.WriteThroughAsync())
+	c.Unlock()
+
+	const goroutines = 10
+	const adds = 1000
+	expire := cache.MillisecondNow() + 100000
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < adds; j++ {
+				c.Lock()
+				c.Add(fmt.Sprintf("key:%d", j%10), i*adds+j, expire)
+				c.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The writes are made in the order the values were added, as such the
+	// store ends up with the same values as the cache
+	assert.Len(t, s.writes, goroutines*adds)
+	c.Lock()
+	defer c.Unlock()
+	for key, value := range s.values {
+		v, ok := c.Get(key)
+		require.True(t, ok)
+		assert.Equal(t, v, value, key)
+	}
+}
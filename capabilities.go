@@ -0,0 +1,114 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+// The capabilities a peer advertises in its responses to peer requests. During a rolling upgrade the older
+// peers advertise none, as such the newer peers downgrade the requests they send to them rather than have
+// the older peers silently drop the fields they don't know.
+const (
+	// The peer dedupes retried rate limits by their request_token
+	CapabilityRequestToken = "request_token"
+	// The peer implements the REBASE_DURATION behavior and behaviors which combine flags
+	CapabilityBehaviorFlags = "behavior_flags"
+	// The peer applies each sequence of GLOBAL hits once and acknowledges it, see globalManager.sendHits()
+	CapabilityGlobalSequences = "global_sequences"
+	// The peer hands off the rate limits it holds to their owner under a new hash configuration, see migration.go
+	CapabilityHandoff = "handoff"
+	// The peer evaluates DRY_RUN rate limits apart from the rate limits enforced, see dryrun.go
+	CapabilityDryRun = "dry_run"
+)
+
+// capabilityNames are the capabilities of this instance, by the bit which represents them in a capabilitySet
+var capabilityNames = []string{CapabilityRequestToken, CapabilityBehaviorFlags, CapabilityGlobalSequences, CapabilityHandoff,
+	CapabilityDryRun}
+
+// capabilitySet is a set of capabilities represented by their bits, such that a PeerClient can store the
+// set advertised by its peer atomically
+type capabilitySet uint32
+
+const (
+	capRequestToken capabilitySet = 1 << iota
+	capBehaviorFlags
+	capGlobalSequences
+	capHandoff
+	capDryRun
+
+	// Set once the capabilities of the peer are known
+	capKnown capabilitySet = 1 << 31
+)
+
+// parseCapabilities returns the set of the capabilities named, capabilities this instance doesn't know are ignored
+func parseCapabilities(names []string) capabilitySet {
+	set := capKnown
+	for _, name := range names {
+		for i, known := range capabilityNames {
+			if name == known {
+				set |= 1 << uint(i)
+			}
+		}
+	}
+	return set
+}
+
+// has returns true if every capability in `c` is in the set
+func (s capabilitySet) has(c capabilitySet) bool {
+	return s&c == c
+}
+
+// names returns the names of the capabilities in the set
+func (s capabilitySet) names() []string {
+	var names []string
+	for i, name := range capabilityNames {
+		if s.has(1 << uint(i)) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// requires returns the capabilities a peer requires to honor the rate limit
+func requires(r *RateLimitReq) capabilitySet {
+	var set capabilitySet
+	if r.RequestToken != "" {
+		set |= capRequestToken
+	}
+	if HasBehavior(r.Behavior, Behavior_REBASE_DURATION) {
+		set |= capBehaviorFlags
+	}
+	return set
+}
+
+// downgradeRequest returns the rate limit as a peer with the capabilities provided can honor it, which is
+// a copy of the rate limit without the fields the peer doesn't know. Returns nil if the rate limit needs no
+// downgrade.
+func downgradeRequest(r *RateLimitReq, caps capabilitySet) *RateLimitReq {
+	missing := requires(r) &^ caps
+	token := missing.has(capRequestToken)
+	flags := missing.has(capBehaviorFlags)
+	if !token && !flags {
+		return nil
+	}
+
+	cpy := *r
+	if token {
+		cpy.RequestToken = ""
+	}
+	if flags {
+		cpy.Behavior &^= Behavior_REBASE_DURATION
+	}
+	return &cpy
+}
@@ -17,11 +17,18 @@ limitations under the License.
 package gubernator
 
 import (
+	"context"
 	"math/rand"
+	"strconv"
 	"time"
 
+	"github.com/mailgun/holster"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/resolver"
 )
 
 const (
@@ -30,22 +37,104 @@ const (
 	Minute      = 60 * Second
 )
 
+// HashKey returns the key which identifies the rate limit in the cache and picks the peer which owns it.
+// The name is prefixed with its length such that the key is unambiguous; else name "a_b" with key "c"
+// and name "a" with key "b_c" would share the same rate limit. A DRY_RUN rate limit has a key of its own,
+// see dryRunKeyPrefix.
 func (m *RateLimitReq) HashKey() string {
-	return m.Name + "_" + m.UniqueKey
+	if HasBehavior(m.Behavior, Behavior_DRY_RUN) {
+		return dryRunKeyPrefix + strconv.Itoa(len(m.Name)) + ":" + m.Name + "_" + m.UniqueKey
+	}
+	return strconv.Itoa(len(m.Name)) + ":" + m.Name + "_" + m.UniqueKey
+}
+
+type ClientOptions struct {
+	// (Optional) If provided the client registers latency, batch size and
+	// response status metrics with this registerer
+	Registerer prometheus.Registerer
+
+	// (Optional) Called before each request is sent to the server
+	OnRequest func(ctx context.Context, r *GetRateLimitsReq)
+
+	// (Optional) Called after each request with the response or error returned by the server
+	OnResponse func(ctx context.Context, r *GetRateLimitsReq, resp *GetRateLimitsResp, d time.Duration, err error)
+
+	// (Optional) The number of times a request is retried if the server is unavailable or the
+	// request timed out. When retries are enabled each rate limit without a `request_token` is
+	// assigned one, such that the server will not apply the hits of a retried request twice.
+	MaxRetries int
+
+	// (Optional) How long to wait between retries. Defaults to 100ms
+	RetryWait time.Duration
+
+	// (Optional) How often the server address is resolved via DNS, such that the client follows
+	// servers as they come and go. Requests are balanced round robin across all the resolved
+	// addresses and a failed connection triggers an immediate resolve. Defaults to 30s
+	ResolveInterval time.Duration
+
+	// (Optional) Resolves the server address instead of DNS; mostly useful for tests. The server
+	// passed to DialV1ServerWithOptions() is provided to the resolver as the target endpoint
+	Resolver resolver.Builder
+
+	// (Optional) If set the client pings the server after this duration of inactivity and drops
+	// the connection if the ping is not acknowledged, such that requests are no longer balanced
+	// to a server that disappeared without closing the connection. The server must permit pings
+	// at this frequency.
+	Keepalive time.Duration
 }
 
 // Create a new connection to the server
 func DialV1Server(server string) (V1Client, error) {
+	return DialV1ServerWithOptions(server, ClientOptions{})
+}
+
+// Create a new connection to the server with the provided client options
+func DialV1ServerWithOptions(server string, opts ClientOptions) (V1Client, error) {
 	if len(server) == 0 {
 		return nil, errors.New("server is empty; must provide a server")
 	}
 
-	conn, err := grpc.Dial(server, grpc.WithInsecure())
+	holster.SetDefault(&opts.ResolveInterval, time.Second*30)
+
+	cc := &clientConn{
+		resolver: opts.Resolver,
+		subConns: make(map[balancer.SubConn]*subConnState),
+	}
+	if cc.resolver == nil {
+		cc.resolver = &dnsResolverBuilder{interval: opts.ResolveInterval}
+	}
+
+	dialOpts := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithBalancerName(clientBalancerName),
+	}
+	if opts.Keepalive != 0 {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                opts.Keepalive,
+			Timeout:             opts.Keepalive,
+			PermitWithoutStream: true,
+		}))
+	}
+
+	conn, err := grpc.Dial(registerClientConn(server, cc), dialOpts...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to dial peer %s", server)
 	}
 
-	return NewV1Client(conn), nil
+	client, err := WrapV1Client(NewV1Client(conn), opts)
+	if err != nil {
+		return nil, err
+	}
+	return &dialedClient{V1Client: client, conn: cc}, nil
+}
+
+// WrapV1Client wraps an existing client such that it honors the client options provided. Errors
+// returned by the wrapped client are mapped onto ErrUnavailable, ErrInvalidRequest and ErrDeadline.
+func WrapV1Client(client V1Client, opts ClientOptions) (V1Client, error) {
+	if opts.Registerer == nil && opts.OnRequest == nil && opts.OnResponse == nil && opts.MaxRetries == 0 {
+		return &errorClient{client: client}, nil
+	}
+	return newInstrumentedClient(client, opts)
 }
 
 // Convert a time.Duration to a unix millisecond timestamp
@@ -62,6 +151,12 @@ func FromUnixMilliseconds(ts int64) time.Time {
 	return time.Unix(0, ts*int64(time.Millisecond))
 }
 
+// HasBehavior returns true if the behavior flag `flag` is set in `b`. BATCHING is the absence of
+// NO_BATCHING, as such HasBehavior(b, Behavior_BATCHING) is always false.
+func HasBehavior(b Behavior, flag Behavior) bool {
+	return b&flag != 0
+}
+
 // Given a list of peers, return a random peer
 func RandomPeer(peers []string) string {
 	rand.Shuffle(len(peers), func(i, j int) {
@@ -0,0 +1,165 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"context"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+type CachedClientConfig struct {
+	// (Optional) The max number of OVER_LIMIT responses to cache. Defaults to 50,000
+	CacheSize int
+
+	// (Optional) The max amount of time an OVER_LIMIT response is cached regardless of its
+	// `reset_time`. This bounds how long a client will continue to answer OVER_LIMIT after
+	// the rate limit was reset on the server. Defaults to 1 second
+	MaxTTL time.Duration
+
+	// (Optional) The clock used to expire cached responses
+	Clock holster.Clock
+}
+
+// CachedClient wraps a V1Client and caches OVER_LIMIT responses until their `reset_time`, such
+// that subsequent requests for the same rate limit are answered locally without asking the
+// server. UNDER_LIMIT responses are never cached. Rate limits with the NO_CLIENT_CACHE behavior
+// are always sent to the server.
+type CachedClient struct {
+	client V1Client
+	cache  *cache.LRUCache
+	conf   CachedClientConfig
+}
+
+// cachedResp is a cached OVER_LIMIT response and the rate limit it answered. A request which
+// changes the limit, duration or algorithm of the rate limit is sent to the server instead.
+type cachedResp struct {
+	resp      RateLimitResp
+	limit     int64
+	duration  int64
+	algorithm Algorithm
+}
+
+func (c *cachedResp) answers(r *RateLimitReq) bool {
+	return c.limit == r.Limit && c.duration == r.Duration && c.algorithm == r.Algorithm
+}
+
+func NewCachedClient(client V1Client, conf CachedClientConfig) *CachedClient {
+	holster.SetDefault(&conf.MaxTTL, time.Second)
+
+	c := &CachedClient{
+		client: client,
+		cache:  cache.NewLRUCache(conf.CacheSize),
+		conf:   conf,
+	}
+
+	if conf.Clock != nil {
+		c.cache.SetClock(conf.Clock)
+	}
+	return c
+}
+
+// GetRateLimits answers requests which have a cached OVER_LIMIT response locally and
+// sends the remaining requests to the server in a single call.
+func (c *CachedClient) GetRateLimits(ctx context.Context, r *GetRateLimitsReq, opts ...grpc.CallOption) (*GetRateLimitsResp, error) {
+	resp := GetRateLimitsResp{
+		Responses: make([]*RateLimitResp, len(r.Requests)),
+	}
+
+	var idx []int
+	var forward GetRateLimitsReq
+
+	c.cache.Lock()
+	for i, req := range r.Requests {
+		if HasBehavior(req.Behavior, Behavior_NO_CLIENT_CACHE) {
+			// Servers which predate the flag reject it
+			cpy := *req
+			cpy.Behavior &^= Behavior_NO_CLIENT_CACHE
+			req = &cpy
+		} else if item, ok := c.cache.Get(req.HashKey()); ok && item.(*cachedResp).answers(req) {
+			rl := item.(*cachedResp).resp
+			resp.Responses[i] = &rl
+			continue
+		}
+		idx = append(idx, i)
+		forward.Requests = append(forward.Requests, req)
+	}
+	c.cache.Unlock()
+
+	// Every request was answered by the cache
+	if len(forward.Requests) == 0 {
+		return &resp, nil
+	}
+
+	fresp, err := c.client.GetRateLimits(ctx, &forward, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fresp.Responses) != len(forward.Requests) {
+		return nil, errors.New("number of rate limits in response does not match request")
+	}
+
+	c.store(forward.Requests, fresp.Responses)
+	for i, rl := range fresp.Responses {
+		resp.Responses[idx[i]] = rl
+	}
+	return &resp, nil
+}
+
+// HealthCheck is always sent to the server
+func (c *CachedClient) HealthCheck(ctx context.Context, r *HealthCheckReq, opts ...grpc.CallOption) (*HealthCheckResp, error) {
+	return c.client.HealthCheck(ctx, r, opts...)
+}
+
+// store caches the OVER_LIMIT responses and removes any previously cached
+// response for rate limits which are now UNDER_LIMIT.
+func (c *CachedClient) store(reqs []*RateLimitReq, resps []*RateLimitResp) {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+
+	now := c.cache.Now()
+	maxExpire := now + ToTimeStamp(c.conf.MaxTTL)
+
+	for i, rl := range resps {
+		if i >= len(reqs) {
+			return
+		}
+		req := reqs[i]
+		key := req.HashKey()
+
+		if rl.Error != "" || rl.Status != Status_OVER_LIMIT || rl.ResetTime <= now {
+			c.cache.Remove(key)
+			continue
+		}
+
+		expire := rl.ResetTime
+		if expire > maxExpire {
+			expire = maxExpire
+		}
+		c.cache.Add(key, &cachedResp{
+			resp:      *rl,
+			limit:     req.Limit,
+			duration:  req.Duration,
+			algorithm: req.Algorithm,
+		}, expire)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/mailgun/holster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// countingClient counts the number of rate limits which reach the server
+type countingClient struct {
+	guber.V1Client
+	count int64
+}
+
+func (c *countingClient) GetRateLimits(ctx context.Context, r *guber.GetRateLimitsReq,
+	opts ...grpc.CallOption) (*guber.GetRateLimitsResp, error) {
+	atomic.AddInt64(&c.count, int64(len(r.Requests)))
+	return c.V1Client.GetRateLimits(ctx, r, opts...)
+}
+
+func (c *countingClient) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+func TestCachedClient(t *testing.T) {
+	server := &countingClient{V1Client: guber.NewLocalClient()}
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	client := guber.NewCachedClient(server, guber.CachedClientConfig{
+		MaxTTL: time.Second,
+		Clock:  clock,
+	})
+
+	rateLimit := func(key string) *guber.RateLimitReq {
+		return &guber.RateLimitReq{
+			Name:      "test_cached_client",
+			UniqueKey: key,
+			Duration:  guber.Minute,
+			Limit:     1,
+			Hits:      1,
+		}
+	}
+
+	sendReqs := func(reqs ...*guber.RateLimitReq) *guber.GetRateLimitsResp {
+		resp, err := client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{Requests: reqs})
+		require.Nil(t, err)
+		require.Len(t, resp.Responses, len(reqs))
+		return resp
+	}
+
+	send := func(keys ...string) *guber.GetRateLimitsResp {
+		var reqs []*guber.RateLimitReq
+		for _, key := range keys {
+			reqs = append(reqs, rateLimit(key))
+		}
+		return sendReqs(reqs...)
+	}
+
+	// UNDER_LIMIT responses are never cached
+	resp := send("account:1")
+	assert.Equal(t, guber.Status_UNDER_LIMIT, resp.Responses[0].Status)
+	resp = send("account:1")
+	assert.Equal(t, guber.Status_OVER_LIMIT, resp.Responses[0].Status)
+	assert.Equal(t, int64(2), server.Count())
+
+	// OVER_LIMIT responses are answered locally
+	for i := 0; i < 5; i++ {
+		resp = send("account:1")
+		assert.Equal(t, guber.Status_OVER_LIMIT, resp.Responses[0].Status)
+	}
+	assert.Equal(t, int64(2), server.Count())
+
+	// Only the un-cached requests in a batch are sent to the server, in the original order
+	resp = send("account:2", "account:1", "account:3")
+	assert.Equal(t, guber.Status_UNDER_LIMIT, resp.Responses[0].Status)
+	assert.Equal(t, guber.Status_OVER_LIMIT, resp.Responses[1].Status)
+	assert.Equal(t, guber.Status_UNDER_LIMIT, resp.Responses[2].Status)
+	assert.Equal(t, int64(4), server.Count())
+
+	// Callers can request an authoritative answer for some rate limits of a batch
+	uncached := rateLimit("account:1")
+	uncached.Behavior = guber.Behavior_NO_CLIENT_CACHE
+	resp = sendReqs(rateLimit("account:1"), uncached)
+	assert.Equal(t, guber.Status_OVER_LIMIT, resp.Responses[0].Status)
+	assert.Equal(t, guber.Status_OVER_LIMIT, resp.Responses[1].Status)
+	assert.Equal(t, "", resp.Responses[1].Error)
+	assert.Equal(t, int64(5), server.Count())
+	assert.Equal(t, guber.Behavior_NO_CLIENT_CACHE, uncached.Behavior)
+
+	// Responses are cached no longer than MaxTTL
+	clock.Sleep(time.Second + time.Millisecond)
+	send("account:1")
+	assert.Equal(t, int64(6), server.Count())
+
+	// A request which changes the limit isn't answered by the response cached for the old limit
+	raised := rateLimit("account:1")
+	raised.Limit = 10
+	sendReqs(raised)
+	assert.Equal(t, int64(7), server.Count())
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned by the client, use errors.Is() to check for them. A rate limit which is
+// over the limit is not an error; the response will have a status of OVER_LIMIT.
+var (
+	// The server could not be reached or was unable to service the request
+	ErrUnavailable = errors.New("gubernator unavailable")
+
+	// The server rejected the request as invalid, retrying the request will not help
+	ErrInvalidRequest = errors.New("invalid gubernator request")
+
+	// The request did not complete before the deadline
+	ErrDeadline = errors.New("gubernator deadline exceeded")
+)
+
+// ClientError is returned by the client when a request fails. It matches one of ErrUnavailable,
+// ErrInvalidRequest or ErrDeadline via errors.Is() while preserving the gRPC status returned
+// by the server, such that status.Code() and status.FromError() continue to work.
+type ClientError struct {
+	kind   error
+	status *status.Status
+}
+
+func (e *ClientError) Error() string {
+	return e.status.Err().Error()
+}
+
+// Is reports if the error is the sentinel error provided
+func (e *ClientError) Is(target error) bool {
+	return target == e.kind
+}
+
+// GRPCStatus returns the gRPC status returned by the server
+func (e *ClientError) GRPCStatus() *status.Status {
+	return e.status
+}
+
+// toClientError maps a gRPC status error onto a ClientError, errors which don't map onto
+// one of the client errors and errors which are already a ClientError are returned as is.
+func toClientError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ClientError); ok {
+		return err
+	}
+
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	switch s.Code() {
+	case codes.Unavailable:
+		return &ClientError{kind: ErrUnavailable, status: s}
+	case codes.InvalidArgument, codes.OutOfRange:
+		return &ClientError{kind: ErrInvalidRequest, status: s}
+	case codes.DeadlineExceeded:
+		return &ClientError{kind: ErrDeadline, status: s}
+	}
+	return err
+}
+
+// isClientError returns true if the error is a ClientError of the kind provided
+func isClientError(err error, kind error) bool {
+	ce, ok := toClientError(err).(*ClientError)
+	return ok && ce.Is(kind)
+}
+
+// PartialError is returned by GetRateLimitsResp.Err() when some of the rate limits in a batch failed
+type PartialError struct {
+	// The error of each failed rate limit by the index of the rate limit in the batch. Each error carries
+	// the gRPC status reported by the server, with an errdetails.ResourceInfo detail naming the index of
+	// the rate limit as `requests[<index>]`. As such errors.Is() matches the client errors and
+	// status.Code() reports the code of the failure.
+	Errors map[int]error
+
+	// The number of rate limits in the batch
+	Total int
+}
+
+func (e *PartialError) Error() string {
+	var idx []int
+	for i := range e.Errors {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	return fmt.Sprintf("%d of %d rate limits failed; first error at index '%d' - '%s'",
+		len(e.Errors), e.Total, idx[0], e.Errors[idx[0]])
+}
+
+// Err returns a *PartialError if any of the rate limits in the response has an error, else nil
+func (m *GetRateLimitsResp) Err() error {
+	var errs map[int]error
+	for i, rl := range m.Responses {
+		if rl.Error == "" {
+			continue
+		}
+		if errs == nil {
+			errs = make(map[int]error)
+		}
+		errs[i] = itemError(i, rl.Error)
+	}
+
+	if errs == nil {
+		return nil
+	}
+	return &PartialError{Errors: errs, Total: len(m.Responses)}
+}
+
+// codeNames maps the names of the gRPC codes as formatted by status errors onto the codes
+var codeNames = func() map[string]codes.Code {
+	names := make(map[string]codes.Code)
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		names[c.String()] = c
+	}
+	return names
+}()
+
+// parseStatus parses the gRPC status from the message of a status error, the server reports the error of a
+// rate limit in a batch as such a message. Messages which are not a status error are an Unknown status.
+func parseStatus(msg string) *status.Status {
+	const prefix, sep = "rpc error: code = ", " desc = "
+	if strings.HasPrefix(msg, prefix) {
+		rest := msg[len(prefix):]
+		if i := strings.Index(rest, sep); i != -1 {
+			if c, ok := codeNames[rest[:i]]; ok {
+				return status.New(c, rest[i+len(sep):])
+			}
+		}
+	}
+	return status.New(codes.Unknown, msg)
+}
+
+// itemError returns the error reported for the rate limit at index `idx` of a batch
+func itemError(idx int, msg string) error {
+	s := parseStatus(msg)
+	if d, err := s.WithDetails(&errdetails.ResourceInfo{
+		ResourceType: "RateLimitReq",
+		ResourceName: fmt.Sprintf("requests[%d]", idx),
+		Description:  s.Message(),
+	}); err == nil {
+		s = d
+	}
+	return toClientError(s.Err())
+}
+
+// errorClient maps the errors returned by the client onto client errors
+type errorClient struct {
+	client V1Client
+}
+
+func (c *errorClient) GetRateLimits(ctx context.Context, r *GetRateLimitsReq, opts ...grpc.CallOption) (*GetRateLimitsResp, error) {
+	resp, err := c.client.GetRateLimits(ctx, r, opts...)
+	return resp, toClientError(err)
+}
+
+func (c *errorClient) HealthCheck(ctx context.Context, r *HealthCheckReq, opts ...grpc.CallOption) (*HealthCheckResp, error) {
+	resp, err := c.client.HealthCheck(ctx, r, opts...)
+	return resp, toClientError(err)
+}
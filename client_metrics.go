@@ -0,0 +1,153 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"context"
+	"time"
+
+	"github.com/mailgun/holster"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+// instrumentedClient wraps a V1Client to collect metrics and call
+// the hooks provided in ClientOptions
+type instrumentedClient struct {
+	client V1Client
+	opts   ClientOptions
+
+	// Metrics collectors
+	requestDuration *prometheus.HistogramVec
+	batchSize       prometheus.Histogram
+	responseCount   *prometheus.CounterVec
+	retryCount      prometheus.Counter
+}
+
+func newInstrumentedClient(client V1Client, opts ClientOptions) (*instrumentedClient, error) {
+	c := &instrumentedClient{
+		client: client,
+		opts:   opts,
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "client_request_durations",
+			Help: "The duration of client requests to gubernator in seconds.",
+		}, []string{"method"}),
+		batchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "client_batch_sizes",
+			Help:    "The number of rate limits sent in each client request.",
+			Buckets: []float64{1, 2, 5, 10, 50, 100, 500, 1000},
+		}),
+		responseCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "client_response_counts",
+			Help: "Rate limit responses received by the client by status.",
+		}, []string{"status"}),
+		retryCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "client_retry_counts",
+			Help: "The number of requests retried by the client.",
+		}),
+	}
+
+	holster.SetDefault(&c.opts.RetryWait, time.Millisecond*100)
+
+	if opts.Registerer != nil {
+		for _, m := range []prometheus.Collector{c.requestDuration, c.batchSize, c.responseCount, c.retryCount} {
+			if err := opts.Registerer.Register(m); err != nil {
+				return nil, errors.Wrap(err, "while registering client metrics")
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *instrumentedClient) GetRateLimits(ctx context.Context, r *GetRateLimitsReq, opts ...grpc.CallOption) (*GetRateLimitsResp, error) {
+	if c.opts.MaxRetries != 0 {
+		r = withRequestTokens(r)
+	}
+
+	if c.opts.OnRequest != nil {
+		c.opts.OnRequest(ctx, r)
+	}
+
+	start := time.Now()
+	resp, err := c.client.GetRateLimits(ctx, r, opts...)
+	err = toClientError(err)
+	for attempt := 0; err != nil && attempt < c.opts.MaxRetries && isRetryable(ctx, err); attempt++ {
+		select {
+		case <-time.After(c.opts.RetryWait):
+		case <-ctx.Done():
+		}
+		c.retryCount.Inc()
+		resp, err = c.client.GetRateLimits(ctx, r, opts...)
+		err = toClientError(err)
+	}
+	duration := time.Since(start)
+
+	c.requestDuration.WithLabelValues("GetRateLimits").Observe(duration.Seconds())
+	c.batchSize.Observe(float64(len(r.Requests)))
+
+	if err != nil {
+		c.responseCount.WithLabelValues("error").Add(float64(len(r.Requests)))
+	} else {
+		for _, rl := range resp.Responses {
+			switch {
+			case rl.Error != "":
+				c.responseCount.WithLabelValues("error").Inc()
+			case rl.Status == Status_OVER_LIMIT:
+				c.responseCount.WithLabelValues("over_limit").Inc()
+			default:
+				c.responseCount.WithLabelValues("under_limit").Inc()
+			}
+		}
+	}
+
+	if c.opts.OnResponse != nil {
+		c.opts.OnResponse(ctx, r, resp, duration, err)
+	}
+	return resp, err
+}
+
+// isRetryable returns true if the request might succeed if retried
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	return isClientError(err, ErrUnavailable) || isClientError(err, ErrDeadline)
+}
+
+// withRequestTokens returns a copy of the request where every rate limit has a request token
+func withRequestTokens(r *GetRateLimitsReq) *GetRateLimitsReq {
+	cpy := GetRateLimitsReq{Requests: make([]*RateLimitReq, len(r.Requests))}
+	for i, req := range r.Requests {
+		if req.RequestToken != "" {
+			cpy.Requests[i] = req
+			continue
+		}
+		rl := *req
+		rl.RequestToken = RandomString(20)
+		cpy.Requests[i] = &rl
+	}
+	return &cpy
+}
+
+func (c *instrumentedClient) HealthCheck(ctx context.Context, r *HealthCheckReq, opts ...grpc.CallOption) (*HealthCheckResp, error) {
+	start := time.Now()
+	resp, err := c.client.HealthCheck(ctx, r, opts...)
+	c.requestDuration.WithLabelValues("HealthCheck").Observe(time.Since(start).Seconds())
+	return resp, toClientError(err)
+}
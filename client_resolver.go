@@ -0,0 +1,362 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// The scheme of the dial target used by DialV1Server(), the authority of the target identifies
+	// the connection such that the resolver and balancer can find the options the client was dialed with
+	clientScheme       = "gubernator"
+	clientBalancerName = "gubernator_round_robin"
+)
+
+func init() {
+	resolver.Register(&clientResolverBuilder{})
+	balancer.Register(&clientBalancerBuilder{})
+}
+
+// ConnStateReporter is implemented by clients returned from DialV1Server() and is intended for debugging
+type ConnStateReporter interface {
+	// ConnStates returns the connectivity state of the connection to each resolved server address
+	ConnStates() map[string]connectivity.State
+}
+
+// dialedClient is the V1Client returned by DialV1Server()
+type dialedClient struct {
+	V1Client
+	conn *clientConn
+}
+
+func (c *dialedClient) ConnStates() map[string]connectivity.State {
+	return c.conn.states()
+}
+
+// clientConn tracks the options and sub connection states of a single dialed client
+type clientConn struct {
+	resolver resolver.Builder
+
+	mutex    sync.Mutex
+	subConns map[balancer.SubConn]*subConnState
+}
+
+type subConnState struct {
+	addr  string
+	state connectivity.State
+	// The requests picked to be sent over the transport of the sub connection which are not done
+	inflight int
+	// Incremented each time the sub connection leaves the ready state, as its transport is closed; the
+	// requests picked for the transport are no longer in flight
+	transport int
+	// True if the balancer removed the sub connection while requests were in flight
+	removed bool
+}
+
+func (c *clientConn) states() map[string]connectivity.State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	result := make(map[string]connectivity.State, len(c.subConns))
+	for _, sc := range c.subConns {
+		if !sc.removed {
+			result[sc.addr] = sc.state
+		}
+	}
+	return result
+}
+
+// clientConns holds the dialed connections until the balancer for the connection is built
+var clientConns = struct {
+	sync.Mutex
+	conns map[string]*clientConn
+}{conns: make(map[string]*clientConn)}
+
+// registerClientConn returns the dial target which identifies the connection provided
+func registerClientConn(server string, conn *clientConn) string {
+	id := RandomString(10)
+	clientConns.Lock()
+	clientConns.conns[id] = conn
+	clientConns.Unlock()
+	return clientScheme + "://" + id + "/" + server
+}
+
+func lookupClientConn(id string, remove bool) *clientConn {
+	clientConns.Lock()
+	defer clientConns.Unlock()
+	conn := clientConns.conns[id]
+	if remove {
+		delete(clientConns.conns, id)
+	}
+	return conn
+}
+
+// clientResolverBuilder builds the resolver the client was dialed with
+type clientResolverBuilder struct{}
+
+func (b *clientResolverBuilder) Scheme() string {
+	return clientScheme
+}
+
+func (b *clientResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	conn := lookupClientConn(target.Authority, false)
+	if conn == nil {
+		return nil, errors.Errorf("unknown client connection '%s'", target.Authority)
+	}
+	return conn.resolver.Build(resolver.Target{
+		Scheme:   conn.resolver.Scheme(),
+		Endpoint: target.Endpoint,
+	}, cc, opts)
+}
+
+// clientBalancerBuilder builds a round robin balancer which records the state of each sub connection
+type clientBalancerBuilder struct{}
+
+func (b *clientBalancerBuilder) Name() string {
+	return clientBalancerName
+}
+
+func (b *clientBalancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	rr := balancer.Get(roundrobin.Name)
+
+	// The resolver has already been built, so the connection is no longer needed in the registry
+	id := strings.SplitN(strings.TrimPrefix(cc.Target(), clientScheme+"://"), "/", 2)[0]
+	conn := lookupClientConn(id, true)
+	if conn == nil {
+		return rr.Build(cc, opts)
+	}
+
+	return &clientBalancer{
+		Balancer: rr.Build(&clientBalancerConn{ClientConn: cc, conn: conn}, opts),
+		cc:       cc,
+		conn:     conn,
+	}
+}
+
+type clientBalancer struct {
+	balancer.Balancer
+	cc   balancer.ClientConn
+	conn *clientConn
+}
+
+func (b *clientBalancer) HandleSubConnStateChange(sc balancer.SubConn, state connectivity.State) {
+	b.conn.mutex.Lock()
+	var remove bool
+	if s, ok := b.conn.subConns[sc]; ok {
+		// grpc doesn't report a request as done if the transport picked for it was not ready
+		if s.state == connectivity.Ready && state != connectivity.Ready {
+			s.transport++
+			s.inflight = 0
+		}
+		s.state = state
+		// A removed sub connection which is no longer ready has no requests in flight
+		if s.removed && state != connectivity.Ready {
+			delete(b.conn.subConns, sc)
+			remove = true
+		}
+	}
+	b.conn.mutex.Unlock()
+	if remove {
+		b.cc.RemoveSubConn(sc)
+	}
+	b.Balancer.HandleSubConnStateChange(sc, state)
+}
+
+type clientBalancerConn struct {
+	balancer.ClientConn
+	conn *clientConn
+}
+
+func (c *clientBalancerConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	sc, err := c.ClientConn.NewSubConn(addrs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var addr string
+	if len(addrs) != 0 {
+		addr = addrs[0].Addr
+	}
+
+	c.conn.mutex.Lock()
+	c.conn.subConns[sc] = &subConnState{addr: addr, state: connectivity.Idle}
+	c.conn.mutex.Unlock()
+	return sc, nil
+}
+
+// UpdateBalancerState wraps the picker of the round robin balancer, see clientPicker
+func (c *clientBalancerConn) UpdateBalancerState(s connectivity.State, p balancer.Picker) {
+	c.ClientConn.UpdateBalancerState(s, &clientPicker{Picker: p, cc: c})
+}
+
+// RemoveSubConn defers the removal of the sub connection until the requests in flight are done, as
+// removing it closes the transport, which fails the requests still waiting to start their stream.
+func (c *clientBalancerConn) RemoveSubConn(sc balancer.SubConn) {
+	c.conn.mutex.Lock()
+	if s, ok := c.conn.subConns[sc]; ok && s.inflight != 0 && s.state == connectivity.Ready {
+		s.removed = true
+		c.conn.mutex.Unlock()
+		return
+	}
+	delete(c.conn.subConns, sc)
+	c.conn.mutex.Unlock()
+	c.ClientConn.RemoveSubConn(sc)
+}
+
+// clientPicker never picks a sub connection which was removed; the round robin balancer picks it until
+// the sub connection reports it was shutdown. The requests picked are counted, see RemoveSubConn().
+type clientPicker struct {
+	balancer.Picker
+	cc *clientBalancerConn
+}
+
+func (p *clientPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	conn := p.cc.conn
+	conn.mutex.Lock()
+	attempts := len(conn.subConns) + 1
+	conn.mutex.Unlock()
+
+	// Each pick of the round robin balancer moves to the next sub connection
+	for i := 0; i < attempts; i++ {
+		sc, done, err := p.Picker.Pick(ctx, opts)
+		if err != nil {
+			return sc, done, err
+		}
+
+		conn.mutex.Lock()
+		s, ok := conn.subConns[sc]
+		if !ok || s.removed {
+			conn.mutex.Unlock()
+			continue
+		}
+		s.inflight++
+		transport := s.transport
+		conn.mutex.Unlock()
+
+		return sc, func(info balancer.DoneInfo) {
+			if done != nil {
+				done(info)
+			}
+			conn.mutex.Lock()
+			if s.transport == transport {
+				s.inflight--
+			}
+			_, ok := conn.subConns[sc]
+			remove := ok && s.removed && s.inflight == 0
+			if remove {
+				delete(conn.subConns, sc)
+			}
+			conn.mutex.Unlock()
+			if remove {
+				p.cc.ClientConn.RemoveSubConn(sc)
+			}
+		}, nil
+	}
+	return nil, nil, balancer.ErrNoSubConnAvailable
+}
+
+// dnsResolverBuilder builds a resolver which looks up the addresses of the server every `interval`
+type dnsResolverBuilder struct {
+	interval time.Duration
+}
+
+func (b *dnsResolverBuilder) Scheme() string {
+	return "gubernator-dns"
+}
+
+func (b *dnsResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	host, port, err := net.SplitHostPort(target.Endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while parsing server address '%s'", target.Endpoint)
+	}
+
+	r := &dnsResolver{
+		host:     host,
+		port:     port,
+		interval: b.interval,
+		cc:       cc,
+		resolve:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+type dnsResolver struct {
+	host     string
+	port     string
+	interval time.Duration
+	cc       resolver.ClientConn
+	resolve  chan struct{}
+	done     chan struct{}
+}
+
+func (r *dnsResolver) run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.lookup()
+		select {
+		case <-ticker.C:
+		case <-r.resolve:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *dnsResolver) lookup() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+	defer cancel()
+
+	hosts, err := net.DefaultResolver.LookupHost(ctx, r.host)
+	// On error keep using the last known addresses, if the servers are
+	// truly gone the balancer will report the connections as failed
+	if err != nil || len(hosts) == 0 {
+		return
+	}
+
+	addrs := make([]resolver.Address, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = resolver.Address{Addr: net.JoinHostPort(host, r.port)}
+	}
+	r.cc.NewAddress(addrs)
+}
+
+// ResolveNow is called by the balancer when a connection fails
+func (r *dnsResolver) ResolveNow(resolver.ResolveNowOption) {
+	select {
+	case r.resolve <- struct{}{}:
+	default:
+	}
+}
+
+func (r *dnsResolver) Close() {
+	close(r.done)
+}
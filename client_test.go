@@ -0,0 +1,315 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	var requests, responses int
+
+	client, err := guber.DialV1ServerWithOptions(testCluster.GetPeer(), guber.ClientOptions{
+		Registerer: reg,
+		OnRequest: func(ctx context.Context, r *guber.GetRateLimitsReq) {
+			requests++
+		},
+		OnResponse: func(ctx context.Context, r *guber.GetRateLimitsReq, resp *guber.GetRateLimitsResp,
+			d time.Duration, err error) {
+			assert.Nil(t, err)
+			responses++
+		},
+	})
+	require.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_client_metrics",
+					UniqueKey: "account:1234",
+					Duration:  guber.Minute,
+					Limit:     1,
+					Hits:      1,
+				},
+				{
+					Name:      "test_client_metrics",
+					UniqueKey: "account:5678",
+					Duration:  guber.Minute,
+					Limit:     10,
+					Hits:      1,
+				},
+			},
+		})
+		require.Nil(t, err)
+	}
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, 3, responses)
+
+	families, err := reg.Gather()
+	require.Nil(t, err)
+
+	metrics := make(map[string][]*dto.Metric)
+	for _, f := range families {
+		metrics[f.GetName()] = f.Metric
+	}
+
+	require.Len(t, metrics["client_request_durations"], 1)
+	assert.Equal(t, uint64(3), metrics["client_request_durations"][0].Histogram.GetSampleCount())
+
+	require.Len(t, metrics["client_batch_sizes"], 1)
+	assert.Equal(t, uint64(3), metrics["client_batch_sizes"][0].Histogram.GetSampleCount())
+	assert.Equal(t, float64(6), metrics["client_batch_sizes"][0].Histogram.GetSampleSum())
+
+	statuses := make(map[string]float64)
+	for _, m := range metrics["client_response_counts"] {
+		statuses[labelValue(m, "status")] = m.Counter.GetValue()
+	}
+	assert.Equal(t, float64(4), statuses["under_limit"])
+	assert.Equal(t, float64(2), statuses["over_limit"])
+}
+
+// flakyClient applies the first request on the server but reports it as failed,
+// as if the response was lost in transit.
+type flakyClient struct {
+	guber.V1Client
+	failed bool
+}
+
+func (c *flakyClient) GetRateLimits(ctx context.Context, r *guber.GetRateLimitsReq,
+	opts ...grpc.CallOption) (*guber.GetRateLimitsResp, error) {
+	resp, err := c.V1Client.GetRateLimits(ctx, r, opts...)
+	if !c.failed {
+		c.failed = true
+		return nil, status.Error(codes.Unavailable, "response lost")
+	}
+	return resp, err
+}
+
+func TestClientRetryRequestToken(t *testing.T) {
+	server, err := guber.DialV1Server(testCluster.GetPeer())
+	require.Nil(t, err)
+
+	client, err := guber.WrapV1Client(&flakyClient{V1Client: server}, guber.ClientOptions{
+		MaxRetries: 2,
+		RetryWait:  time.Millisecond,
+	})
+	require.Nil(t, err)
+
+	req := guber.RateLimitReq{
+		Name:      "test_client_retry",
+		UniqueKey: "account:1234",
+		Duration:  guber.Minute,
+		Limit:     10,
+		Hits:      1,
+	}
+
+	resp, err := client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+		Requests: []*guber.RateLimitReq{&req},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, int64(9), resp.Responses[0].Remaining)
+	// The callers request was not modified
+	assert.Equal(t, "", req.RequestToken)
+
+	// Only a single hit was applied
+	req.Hits = 0
+	resp, err = server.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+		Requests: []*guber.RateLimitReq{&req},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, int64(9), resp.Responses[0].Remaining)
+}
+
+func TestRequestTokenDedupe(t *testing.T) {
+	// Send to every peer, such that requests are both applied locally and forwarded to the owner
+	for i := 0; i < 6; i++ {
+		client, err := guber.DialV1Server(testCluster.PeerAt(i))
+		require.Nil(t, err)
+
+		req := guber.RateLimitReq{
+			Name:         "test_request_token",
+			UniqueKey:    "account:1234",
+			Duration:     guber.Minute,
+			Limit:        10,
+			Hits:         1,
+			RequestToken: fmt.Sprintf("token-%d", i),
+		}
+
+		for retry := 0; retry < 3; retry++ {
+			resp, err := client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+				Requests: []*guber.RateLimitReq{&req},
+			})
+			require.Nil(t, err)
+			assert.Equal(t, "", resp.Responses[0].Error)
+			assert.Equal(t, int64(9-i), resp.Responses[0].Remaining, i)
+		}
+	}
+}
+
+func TestClientResolver(t *testing.T) {
+	r := manual.NewBuilderWithScheme("test-client-resolver")
+	r.InitialAddrs([]resolver.Address{{Addr: testCluster.PeerAt(0)}})
+
+	client, err := guber.DialV1ServerWithOptions("gubernator:81", guber.ClientOptions{Resolver: r})
+	require.Nil(t, err)
+
+	waitForStates := func(expected map[string]connectivity.State) {
+		for i := 0; i < 100; i++ {
+			if assert.ObjectsAreEqual(expected, client.(guber.ConnStateReporter).ConnStates()) {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		assert.Equal(t, expected, client.(guber.ConnStateReporter).ConnStates())
+	}
+
+	check := func() {
+		for i := 0; i < 10; i++ {
+			_, err := client.HealthCheck(context.Background(), &guber.HealthCheckReq{})
+			require.Nil(t, err)
+		}
+	}
+
+	check()
+	waitForStates(map[string]connectivity.State{testCluster.PeerAt(0): connectivity.Ready})
+
+	// Traffic moves to the new address set without errors
+	r.NewAddress([]resolver.Address{{Addr: testCluster.PeerAt(0)}, {Addr: testCluster.PeerAt(1)}})
+	check()
+	waitForStates(map[string]connectivity.State{
+		testCluster.PeerAt(0): connectivity.Ready,
+		testCluster.PeerAt(1): connectivity.Ready,
+	})
+
+	r.NewAddress([]resolver.Address{{Addr: testCluster.PeerAt(1)}})
+	check()
+	waitForStates(map[string]connectivity.State{testCluster.PeerAt(1): connectivity.Ready})
+	check()
+}
+
+// errClient returns the error provided for every request
+type errClient struct {
+	guber.V1Client
+	err error
+}
+
+func (c *errClient) GetRateLimits(ctx context.Context, r *guber.GetRateLimitsReq,
+	opts ...grpc.CallOption) (*guber.GetRateLimitsResp, error) {
+	return nil, c.err
+}
+
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		Err      error
+		Expected error
+	}{
+		{Err: status.Error(codes.Unavailable, "no peers"), Expected: guber.ErrUnavailable},
+		{Err: status.Error(codes.InvalidArgument, "bad request"), Expected: guber.ErrInvalidRequest},
+		{Err: status.Error(codes.OutOfRange, "batch too large"), Expected: guber.ErrInvalidRequest},
+		{Err: status.Error(codes.DeadlineExceeded, "too slow"), Expected: guber.ErrDeadline},
+	}
+
+	for _, test := range tests {
+		client, err := guber.WrapV1Client(&errClient{err: test.Err}, guber.ClientOptions{})
+		require.Nil(t, err)
+
+		_, err = client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{})
+		require.NotNil(t, err)
+		assert.True(t, errors.Is(err, test.Expected), err)
+
+		// The underlying status is preserved
+		assert.Equal(t, status.Code(test.Err), status.Code(err))
+		assert.Equal(t, test.Err.Error(), err.Error())
+	}
+
+	// Errors which don't map are returned as is
+	other := status.Error(codes.Internal, "boom")
+	client, err := guber.WrapV1Client(&errClient{err: other}, guber.ClientOptions{})
+	require.Nil(t, err)
+	_, err = client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{})
+	assert.Equal(t, other, err)
+
+	// Invalid requests are not retried
+	reg := prometheus.NewRegistry()
+	client, err = guber.WrapV1Client(&errClient{err: status.Error(codes.InvalidArgument, "bad request")},
+		guber.ClientOptions{Registerer: reg, MaxRetries: 3, RetryWait: time.Millisecond})
+	require.Nil(t, err)
+	_, err = client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{})
+	assert.True(t, errors.Is(err, guber.ErrInvalidRequest), err)
+
+	families, err := reg.Gather()
+	require.Nil(t, err)
+	for _, f := range families {
+		if f.GetName() == "client_retry_counts" {
+			assert.Equal(t, float64(0), f.Metric[0].Counter.GetValue())
+		}
+	}
+}
+
+func TestPartialError(t *testing.T) {
+	client, err := guber.DialV1Server(testCluster.GetPeer())
+	require.Nil(t, err)
+
+	resp, err := client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+		Requests: []*guber.RateLimitReq{
+			{
+				Name:      "test_partial_error",
+				UniqueKey: "account:1234",
+				Duration:  guber.Minute,
+				Limit:     10,
+				Hits:      1,
+			},
+			{
+				Name:     "test_partial_error",
+				Duration: guber.Minute,
+				Limit:    10,
+				Hits:     1,
+			},
+		},
+	})
+	require.Nil(t, err)
+
+	err = resp.Err()
+	var partial *guber.PartialError
+	require.True(t, errors.As(err, &partial), err)
+	assert.Equal(t, 2, partial.Total)
+	require.Len(t, partial.Errors, 1)
+	assert.True(t, errors.Is(partial.Errors[1], guber.ErrInvalidRequest), partial.Errors[1])
+	assert.Equal(t, codes.InvalidArgument, status.Code(partial.Errors[1]))
+	assert.Equal(t, "field 'unique_key' cannot be empty", status.Convert(partial.Errors[1]).Message())
+
+	resp.Responses = resp.Responses[:1]
+	assert.Nil(t, resp.Err())
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/mailgun/holster"
+	"github.com/pkg/errors"
+)
+
+// ErrWaitExceedsDeadline is returned by WaitUntilAllowed when the rate limit will not
+// reset before the deadline of the context provided.
+var ErrWaitExceedsDeadline = errors.New("rate limit will not reset before the context deadline")
+
+// WaiterConfig configures a Waiter created by NewWaiter()
+type WaiterConfig struct {
+	// (Optional) The clock used to sleep until the rate limit resets. Defaults to the system clock
+	Clock holster.Clock
+
+	// (Optional) The max random duration added to each sleep, such that many waiting
+	// clients don't all retry at the same instant. Defaults to 10ms
+	Jitter time.Duration
+}
+
+// Waiter provides blocking and non-blocking helpers for callers which
+// would rather wait for a rate limit than handle OVER_LIMIT themselves.
+type Waiter struct {
+	client V1Client
+	conf   WaiterConfig
+}
+
+// NewWaiter creates a new Waiter which checks rate limits using the client provided
+func NewWaiter(client V1Client, conf WaiterConfig) *Waiter {
+	if conf.Clock == nil {
+		conf.Clock = &holster.SystemClock{}
+	}
+	holster.SetDefault(&conf.Jitter, time.Millisecond*10)
+
+	return &Waiter{
+		client: client,
+		conf:   conf,
+	}
+}
+
+// WaitUntilAllowed applies the rate limit provided and if it is over the limit, sleeps until
+// the rate limit resets before trying again. Returns the first UNDER_LIMIT response or an
+// error if the context is cancelled. If the context has a deadline which will pass before
+// the rate limit resets, ErrWaitExceedsDeadline is returned without sleeping.
+func (w *Waiter) WaitUntilAllowed(ctx context.Context, req *RateLimitReq) (*RateLimitResp, error) {
+	for {
+		rl, err := w.check(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if rl.Status == Status_UNDER_LIMIT {
+			return rl, nil
+		}
+
+		wait := w.waitFor(rl.ResetTime)
+		if deadline, ok := ctx.Deadline(); ok && wait > time.Until(deadline) {
+			return rl, ErrWaitExceedsDeadline
+		}
+
+		select {
+		case <-w.conf.Clock.After(wait):
+		case <-ctx.Done():
+			return rl, ctx.Err()
+		}
+	}
+}
+
+// Allow applies a single hit to a TOKEN_BUCKET rate limit without blocking. Returns true if
+// the hit was allowed, else false along with the suggested duration to wait before trying again.
+func (w *Waiter) Allow(ctx context.Context, name, key string, limit, duration int64) (bool, time.Duration, error) {
+	rl, err := w.check(ctx, &RateLimitReq{
+		Name:      name,
+		UniqueKey: key,
+		Algorithm: Algorithm_TOKEN_BUCKET,
+		Limit:     limit,
+		Duration:  duration,
+		Hits:      1,
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	if rl.Status == Status_UNDER_LIMIT {
+		return true, 0, nil
+	}
+	return false, w.waitFor(rl.ResetTime), nil
+}
+
+func (w *Waiter) check(ctx context.Context, req *RateLimitReq) (*RateLimitResp, error) {
+	resp, err := w.client.GetRateLimits(ctx, &GetRateLimitsReq{
+		Requests: []*RateLimitReq{req},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Responses) != 1 {
+		return nil, errors.Errorf("expected 1 rate limit response; got '%d'", len(resp.Responses))
+	}
+
+	rl := resp.Responses[0]
+	if rl.Error != "" {
+		return nil, itemError(0, rl.Error)
+	}
+	return rl, nil
+}
+
+// waitFor returns the duration until the reset time provided plus some jitter
+func (w *Waiter) waitFor(resetTime int64) time.Duration {
+	wait := time.Duration(resetTime-w.conf.Clock.Now().UnixNano()/1000000) * time.Millisecond
+	if wait < 0 {
+		wait = 0
+	}
+	if w.conf.Jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(w.conf.Jitter)))
+	}
+	return wait
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/status"
+)
+
+// localClock sleeps by advancing the clock of a LocalClient
+type localClock struct {
+	client *guber.LocalClient
+	slept  time.Duration
+}
+
+func (c *localClock) Now() time.Time {
+	return time.Unix(0, c.client.Now()*int64(time.Millisecond))
+}
+
+func (c *localClock) Sleep(d time.Duration) {
+	c.slept += d
+	c.client.Advance(d)
+}
+
+func (c *localClock) After(d time.Duration) <-chan time.Time {
+	c.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+func TestWaiter(t *testing.T) {
+	client := guber.NewLocalClient()
+	clock := &localClock{client: client}
+	waiter := guber.NewWaiter(client, guber.WaiterConfig{
+		Clock:  clock,
+		Jitter: time.Millisecond,
+	})
+	ctx := context.Background()
+
+	allowed, wait, err := waiter.Allow(ctx, "test_waiter", "account:1234", 1, guber.Minute)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, time.Duration(0), wait)
+
+	allowed, wait, err = waiter.Allow(ctx, "test_waiter", "account:1234", 1, guber.Minute)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	assert.True(t, wait >= time.Minute-time.Millisecond && wait <= time.Minute+time.Millisecond, wait)
+	assert.Equal(t, time.Duration(0), clock.slept)
+
+	req := guber.RateLimitReq{
+		Name:      "test_waiter",
+		UniqueKey: "account:1234",
+		Algorithm: guber.Algorithm_TOKEN_BUCKET,
+		Duration:  guber.Minute,
+		Limit:     1,
+		Hits:      1,
+	}
+
+	// Sleeps until the rate limit resets
+	rl, err := waiter.WaitUntilAllowed(ctx, &req)
+	require.Nil(t, err)
+	assert.Equal(t, guber.Status_UNDER_LIMIT, rl.Status)
+	assert.True(t, clock.slept >= time.Minute, clock.slept)
+
+	// Gives up without sleeping if the reset is after the context deadline
+	clock.slept = 0
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rl, err = waiter.WaitUntilAllowed(ctx, &req)
+	assert.Equal(t, guber.ErrWaitExceedsDeadline, err)
+	require.NotNil(t, rl)
+	assert.Equal(t, guber.Status_OVER_LIMIT, rl.Status)
+	assert.Equal(t, time.Duration(0), clock.slept)
+
+	// Errors from the rate limit are returned
+	_, err = waiter.WaitUntilAllowed(context.Background(), &guber.RateLimitReq{Name: "test_waiter"})
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, guber.ErrInvalidRequest), err)
+	assert.Equal(t, "field 'unique_key' cannot be empty", status.Convert(err).Message())
+}
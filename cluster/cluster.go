@@ -14,111 +14,303 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+// Package cluster starts a cluster of gubernator instances in this process, such that applications which
+// embed gubernator can write integration tests against a real multi-node cluster. It is a supported API
+// and is what the gubernator functional tests are written against.
+//
+// Each node listens on a local port, is given every running node as a peer and has a client connected
+// to it. Nodes can be stopped and restarted individually; the peers of the other nodes are updated as
+// a discovery mechanism would when a node leaves or joins the cluster.
+//
+// Each node stores its rate limits in its own cache.LRUCache provided via Config.Cache, rather than the
+// worker pool, such that Restart() can keep the rate limits of the node. A Cluster is not safe for
+// concurrent use, however the instances and clients of its nodes are.
 package cluster
 
 import (
 	"fmt"
+	"net"
+	"time"
+
 	"github.com/mailgun/gubernator"
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
-	"net"
-	"time"
 )
 
-type instance struct {
-	GRPC    *grpc.Server
-	Guber   *gubernator.Instance
-	Address string
+// Option configures the cluster started by Start()
+type Option func(*options)
+
+type options struct {
+	addresses []string
+	conf      gubernator.Config
 }
 
-func (i *instance) Peers() []gubernator.PeerInfo {
-	var result []gubernator.PeerInfo
-	for _, peer := range peers {
-		info := gubernator.PeerInfo{Address: peer}
-		if peer == i.Address {
-			info.IsOwner = true
-		}
-		result = append(result, info)
+// WithAddresses starts the nodes on the addresses provided instead of random local ports. The number
+// of addresses must match the number of nodes.
+func WithAddresses(addresses ...string) Option {
+	return func(o *options) {
+		o.addresses = addresses
 	}
-	return result
 }
 
-func (i *instance) Stop() {
-	i.GRPC.GracefulStop()
+// WithConfig sets the template for the config of each node. The GRPCServer and Cache are replaced for
+// each node and the Picker is copied via Picker.New(). Defaults to a config suitable for testing.
+func WithConfig(conf gubernator.Config) Option {
+	return func(o *options) {
+		o.conf = conf
+	}
 }
 
-var instances []*instance
-var peers []string
+// WithClock sets the clock of every node and its cache; IE: a holster.FrozenClock such that tests can
+// control the passage of time instead of sleeping
+func WithClock(clock holster.Clock) Option {
+	return func(o *options) {
+		o.conf.Clock = clock
+	}
+}
+
+// WithPicker sets the peer picker of every node; each node is given a copy via Picker.New()
+func WithPicker(picker gubernator.PeerPicker) Option {
+	return func(o *options) {
+		o.conf.Picker = picker
+	}
+}
+
+// RestartOption configures how Restart() restarts a node
+type RestartOption func(*restartOptions)
+
+type restartOptions struct {
+	keepCache bool
+}
 
-// Returns a random peer from the cluster
-func GetPeer() string {
-	return gubernator.RandomPeer(peers)
+// KeepCache restarts the node with the cache it had when it stopped, as if the rate limits of the node
+// were persisted across the restart. By default a node restarts with an empty cache.
+func KeepCache() RestartOption {
+	return func(o *restartOptions) {
+		o.keepCache = true
+	}
 }
 
-// Returns a specific peer
-func PeerAt(idx int) string {
-	return peers[idx]
+// Node is a gubernator instance in the cluster. Restart() replaces the Instance, Client and Cache of the
+// node, as such callers should not hold on to them across a restart.
+type Node struct {
+	Address  string
+	Instance *gubernator.Instance
+	// A client connected to this node
+	Client gubernator.V1Client
+	// The cache which holds the rate limits of this node
+	Cache *cache.LRUCache
+
+	server  *grpc.Server
+	conn    *grpc.ClientConn
+	running bool
 }
 
-// Returns a specific instance
-func InstanceAt(idx int) *instance {
-	return instances[idx]
+// Running returns true if the node was not stopped
+func (n *Node) Running() bool {
+	return n.running
 }
 
-// Start a local cluster of gubernator servers
-func Start(numInstances int) error {
-	var addresses []string
-	for i := 0; i < numInstances; i++ {
-		addresses = append(addresses, "")
+// peers returns the peers of this node, which are the running nodes of the cluster
+func (n *Node) peers(nodes []*Node) []gubernator.PeerInfo {
+	var result []gubernator.PeerInfo
+	for _, node := range nodes {
+		if node.running {
+			result = append(result, gubernator.PeerInfo{Address: node.Address, IsOwner: node == n})
+		}
 	}
-	return StartWith(addresses)
+	return result
 }
 
-// Start a local cluster with specific addresses
-func StartWith(addresses []string) error {
-	for _, address := range addresses {
-		srv := grpc.NewServer()
+// Cluster is a cluster of gubernator instances started by Start()
+type Cluster struct {
+	nodes []*Node
+	conf  gubernator.Config
+}
 
-		guber, err := gubernator.New(gubernator.Config{
-			GRPCServer: srv,
+// Start starts a cluster of `size` nodes listening on random local ports
+func Start(size int, opts ...Option) (*Cluster, error) {
+	o := options{
+		conf: gubernator.Config{
 			Behaviors: gubernator.BehaviorConfig{
 				GlobalSyncWait: time.Millisecond * 50, // Suitable for testing but not production
 				GlobalTimeout:  time.Second,
 			},
-		})
-		if err != nil {
-			return errors.Wrap(err, "while creating new gubernator instance")
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.addresses == nil {
+		o.addresses = make([]string, size)
+		for i := range o.addresses {
+			o.addresses[i] = "127.0.0.1:0"
+		}
+	}
+	if len(o.addresses) != size {
+		return nil, fmt.Errorf("expected '%d' addresses; got '%d'", size, len(o.addresses))
+	}
+
+	c := &Cluster{conf: o.conf}
+	for _, address := range o.addresses {
+		n := &Node{Address: address}
+		if err := c.start(n, nil); err != nil {
+			c.Stop()
+			return nil, err
+		}
+		c.nodes = append(c.nodes, n)
+	}
+	c.setPeers()
+	return c, nil
+}
+
+// start starts the node on its address with the cache provided, or a new cache if nil
+func (c *Cluster) start(n *Node, lru *cache.LRUCache) error {
+	conf := c.conf
+	if lru == nil {
+		lru = cache.NewLRUCache(conf.CacheSize)
+		if conf.Clock != nil {
+			lru.SetClock(conf.Clock)
+		}
+	}
+	conf.Cache = lru
+	conf.GRPCServer = grpc.NewServer()
+	if c.conf.Picker != nil {
+		conf.Picker = c.conf.Picker.New()
+	}
+
+	instance, err := gubernator.New(conf)
+	if err != nil {
+		return errors.Wrap(err, "while creating new gubernator instance")
+	}
+
+	listener, err := net.Listen("tcp", n.Address)
+	if err != nil {
+		instance.Close()
+		return errors.Wrapf(err, "while listening on '%s'", n.Address)
+	}
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		listener.Close()
+		instance.Close()
+		return errors.Wrapf(err, "while dialing '%s'", listener.Addr().String())
+	}
+
+	go func(srv *grpc.Server) {
+		logrus.Infof("Listening on %s", listener.Addr().String())
+		if err := srv.Serve(listener); err != nil {
+			fmt.Printf("while serving: %s\n", err)
 		}
+	}(conf.GRPCServer)
+
+	n.Address = listener.Addr().String()
+	n.Instance = instance
+	n.Client = gubernator.NewV1Client(conn)
+	n.Cache = lru
+	n.server = conf.GRPCServer
+	n.conn = conn
+	n.running = true
+	return nil
+}
+
+// stop stops the node without updating the peers of the other nodes
+func (n *Node) stop() {
+	if !n.running {
+		return
+	}
+	n.conn.Close()
+	n.server.GracefulStop()
+	n.Instance.Close()
+	n.running = false
+}
+
+// setPeers gives each running node the running nodes as its peers
+func (c *Cluster) setPeers() {
+	for _, n := range c.nodes {
+		if n.running {
+			n.Instance.SetPeers(n.peers(c.nodes))
+		}
+	}
+}
+
+// Nodes returns every node in the cluster, including those which are stopped
+func (c *Cluster) Nodes() []*Node {
+	return c.nodes
+}
+
+// NodeAt returns the node at index `idx`
+func (c *Cluster) NodeAt(idx int) *Node {
+	return c.nodes[idx]
+}
+
+// PeerAt returns the address of the node at index `idx`
+func (c *Cluster) PeerAt(idx int) string {
+	return c.nodes[idx].Address
+}
+
+// InstanceAt returns the gubernator instance of the node at index `idx`
+func (c *Cluster) InstanceAt(idx int) *gubernator.Instance {
+	return c.nodes[idx].Instance
+}
 
-		listener, err := net.Listen("tcp", address)
-		if err != nil {
-			return errors.Wrap(err, "while listening on random interface")
+// Addresses returns the addresses of the running nodes
+func (c *Cluster) Addresses() []string {
+	var result []string
+	for _, n := range c.nodes {
+		if n.running {
+			result = append(result, n.Address)
 		}
+	}
+	return result
+}
 
-		go func() {
-			logrus.Infof("Listening on %s", listener.Addr().String())
-			if err := srv.Serve(listener); err != nil {
-				fmt.Printf("while serving: %s\n", err)
-			}
-		}()
+// GetPeer returns the address of a random running node
+func (c *Cluster) GetPeer() string {
+	return gubernator.RandomPeer(c.Addresses())
+}
 
-		peers = append(peers, listener.Addr().String())
-		instances = append(instances, &instance{
-			Address: listener.Addr().String(),
-			Guber:   guber,
-			GRPC:    srv,
-		})
+// StopNode stops the node at index `idx` and removes it from the peers of the other nodes. The rate limits
+// owned by the node move to the other nodes until it is restarted.
+func (c *Cluster) StopNode(idx int) {
+	c.nodes[idx].stop()
+	c.setPeers()
+}
+
+// Restart stops the node at index `idx` if it is running, then starts it on the same address and adds it
+// back to the peers of the other nodes. The node restarts with an empty cache unless KeepCache() is passed.
+func (c *Cluster) Restart(idx int, opts ...RestartOption) error {
+	var o restartOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// Remove the node from the peers of the other nodes while it restarts, such that they connect to
+	// the restarted node instead of waiting for their existing connection to reconnect.
+	n := c.nodes[idx]
+	if n.running {
+		c.StopNode(idx)
 	}
 
-	for _, ins := range instances {
-		ins.Guber.SetPeers(ins.Peers())
+	var lru *cache.LRUCache
+	if o.keepCache {
+		lru = n.Cache
+	}
+	if err := c.start(n, lru); err != nil {
+		c.setPeers()
+		return errors.Wrapf(err, "while restarting node '%d'", idx)
 	}
+	c.setPeers()
 	return nil
 }
 
-func Stop() {
-	for _, ins := range instances {
-		ins.Stop()
+// Stop stops every node in the cluster
+func (c *Cluster) Stop() {
+	for _, n := range c.nodes {
+		n.stop()
 	}
 }
@@ -0,0 +1,108 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mailgun/gubernator"
+	"github.com/mailgun/gubernator/cluster"
+	"github.com/mailgun/holster"
+)
+
+func hit(client gubernator.V1Client, hits int64) *gubernator.RateLimitResp {
+	resp, err := client.GetRateLimits(context.Background(), &gubernator.GetRateLimitsReq{
+		Requests: []*gubernator.RateLimitReq{
+			{
+				Name:      "requests_per_minute",
+				UniqueKey: "account:1234",
+				Duration:  gubernator.Minute,
+				Limit:     10,
+				Hits:      hits,
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return resp.Responses[0]
+}
+
+func Example() {
+	c, err := cluster.Start(3)
+	if err != nil {
+		panic(err)
+	}
+	defer c.Stop()
+
+	// Every node applies the same rate limit, no matter which node owns it
+	for _, n := range c.Nodes() {
+		rl := hit(n.Client, 2)
+		fmt.Println(rl.Status, rl.Remaining)
+	}
+	// Output:
+	// UNDER_LIMIT 8
+	// UNDER_LIMIT 6
+	// UNDER_LIMIT 4
+}
+
+func ExampleWithClock() {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c, err := cluster.Start(3, cluster.WithClock(clock))
+	if err != nil {
+		panic(err)
+	}
+	defer c.Stop()
+
+	client := c.NodeAt(0).Client
+	fmt.Println(hit(client, 10).Remaining)
+
+	// The rate limit resets once the frozen clock passes its duration
+	clock.Sleep(time.Minute + time.Millisecond)
+	fmt.Println(hit(client, 1).Remaining)
+	// Output:
+	// 0
+	// 9
+}
+
+func ExampleCluster_Restart() {
+	c, err := cluster.Start(1)
+	if err != nil {
+		panic(err)
+	}
+	defer c.Stop()
+
+	fmt.Println(hit(c.NodeAt(0).Client, 4).Remaining)
+
+	// The node restarts with the rate limits it had
+	if err := c.Restart(0, cluster.KeepCache()); err != nil {
+		panic(err)
+	}
+	fmt.Println(hit(c.NodeAt(0).Client, 1).Remaining)
+
+	// The node restarts with an empty cache
+	if err := c.Restart(0); err != nil {
+		panic(err)
+	}
+	fmt.Println(hit(c.NodeAt(0).Client, 1).Remaining)
+	// Output:
+	// 6
+	// 5
+	// 9
+}
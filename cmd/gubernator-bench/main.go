@@ -0,0 +1,98 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/mailgun/gubernator/bench"
+	"github.com/sirupsen/logrus"
+)
+
+func checkErr(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Drive a local in-process cluster of each size requested and report the throughput and latency
+func main() {
+	var conf bench.LoadConfig
+	var nodes, behavior, algorithm string
+
+	flag.StringVar(&nodes, "nodes", "1,3,5", "comma separated list of cluster sizes to run")
+	flag.IntVar(&conf.Cardinality, "keys", 10000, "number of distinct rate limits")
+	flag.Float64Var(&conf.Skew, "skew", 0, "zipf skew of the rate limits hit; 1 or less is uniform")
+	flag.IntVar(&conf.BatchSize, "batch", 1, "number of rate limits in each request")
+	flag.StringVar(&behavior, "behavior", "BATCHING", "behavior of the rate limits; BATCHING, NO_BATCHING or GLOBAL")
+	flag.StringVar(&algorithm, "algorithm", "TOKEN_BUCKET", "algorithm of the rate limits; TOKEN_BUCKET or LEAKY_BUCKET")
+	flag.Int64Var(&conf.Limit, "limit", 1000000, "limit of each rate limit")
+	flag.DurationVar(&conf.Duration, "duration", time.Hour, "duration of each rate limit")
+	flag.IntVar(&conf.Concurrency, "concurrency", 10, "number of clients sending requests concurrently")
+	flag.DurationVar(&conf.Length, "length", time.Second*10, "how long to generate load for each cluster size")
+	flag.Int64Var(&conf.Seed, "seed", 1, "seed of the key generators")
+	flag.Parse()
+
+	// The instances log every peer update, which would drown out the report
+	logrus.SetLevel(logrus.WarnLevel)
+
+	b, ok := guber.Behavior_value[strings.ToUpper(behavior)]
+	if !ok {
+		checkErr(fmt.Errorf("unknown behavior '%s'", behavior))
+	}
+	conf.Behavior = guber.Behavior(b)
+
+	a, ok := guber.Algorithm_value[strings.ToUpper(algorithm)]
+	if !ok {
+		checkErr(fmt.Errorf("unknown algorithm '%s'", algorithm))
+	}
+	conf.Algorithm = guber.Algorithm(a)
+
+	// Stop the current run on interrupt
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	for _, n := range strings.Split(nodes, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil {
+			checkErr(fmt.Errorf("invalid cluster size '%s'", n))
+		}
+		conf.Nodes = size
+
+		report, err := bench.RunLoad(ctx, conf)
+		checkErr(err)
+		fmt.Println(report)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -29,26 +29,27 @@ import (
 func main() {
 	logrus.SetLevel(logrus.InfoLevel)
 	// Start a local cluster
-	err := cluster.StartWith([]string{
+	c, err := cluster.Start(6, cluster.WithAddresses(
 		"127.0.0.1:9090",
 		"127.0.0.1:9091",
 		"127.0.0.1:9092",
 		"127.0.0.1:9093",
 		"127.0.0.1:9094",
 		"127.0.0.1:9095",
-	})
+	))
 	if err != nil {
 		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	fmt.Println("Ready")
 
 	// Wait until we get a INT signal then shutdown the cluster
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	for sig := range c {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	for sig := range signals {
 		if sig == os.Interrupt {
-			cluster.Stop()
+			c.Stop()
 			os.Exit(0)
 		}
 	}
@@ -21,6 +21,8 @@ import (
 	"crypto/x509"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"hash/fnv"
 	"io/ioutil"
 	"os"
 	"strconv"
@@ -40,12 +42,50 @@ import (
 var debug = false
 
 type ServerConfig struct {
+	// The env config file the config was read from, if any; re-read when the namespaces are reloaded
+	ConfigFile string
+
 	GRPCListenAddress    string
 	EtcdAdvertiseAddress string
 	HTTPListenAddress    string
 	EtcdKeyPrefix        string
 	CacheSize            int
 
+	// If set, the consistency of the cache is verified at this interval and any corruption is logged
+	CacheConsistencyCheck time.Duration
+
+	// The number of workers rate limits are partitioned across, defaults to GOMAXPROCS
+	PoolSize int
+
+	// If true, all rate limits share a single cache instead of being partitioned across workers
+	SingleCache bool
+
+	// The max bytes of rate limit state held in memory, zero means unbounded
+	MemoryBudget int
+
+	// The range of durations and the max limit accepted for a rate limit, see gubernator.Config
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	MaxLimit    int
+
+	// If true, unknown behavior flags are removed from a rate limit instead of rejecting it
+	IgnoreUnknownBehaviors bool
+
+	// Caps the new unique keys of the names matched, see gubernator.Config
+	KeyFloodRules []gubernator.KeyFloodRule
+
+	// The namespaces the rate limits are isolated by, see gubernator.NamespaceConfig
+	Namespaces []gubernator.NamespaceConfig
+
+	// The number of names whose usage is tracked, and the names exported as metrics; see gubernator.Config
+	NameStatsSize    int
+	NameStatsMetrics []string
+
+	// Assigns the rate limits to their owners, and optionally migrates them from the owners assigned by
+	// a previous hash function; see gubernator.MigrationConfig
+	Picker    gubernator.PeerPicker
+	Migration gubernator.MigrationConfig
+
 	// Etcd configuration used to find peers
 	EtcdConf etcd.Config
 
@@ -86,21 +126,64 @@ func confFromEnv() (ServerConfig, error) {
 			return conf, err
 		}
 	}
+	conf.ConfigFile = configFile
 
 	// Main config
 	holster.SetDefault(&conf.GRPCListenAddress, os.Getenv("GUBER_GRPC_ADDRESS"), "0.0.0.0:81")
 	holster.SetDefault(&conf.HTTPListenAddress, os.Getenv("GUBER_HTTP_ADDRESS"), "0.0.0.0:80")
 	holster.SetDefault(&conf.CacheSize, getEnvInteger("GUBER_CACHE_SIZE"), 50000)
+	holster.SetDefault(&conf.CacheConsistencyCheck, getEnvDuration("GUBER_CACHE_CONSISTENCY_CHECK"))
+	holster.SetDefault(&conf.PoolSize, getEnvInteger("GUBER_POOL_SIZE"))
+	conf.SingleCache = os.Getenv("GUBER_SINGLE_CACHE") != ""
+	holster.SetDefault(&conf.MemoryBudget, getEnvInteger("GUBER_MEMORY_BUDGET"))
+	holster.SetDefault(&conf.MinDuration, getEnvDuration("GUBER_MIN_DURATION"))
+	holster.SetDefault(&conf.MaxDuration, getEnvDuration("GUBER_MAX_DURATION"))
+	holster.SetDefault(&conf.MaxLimit, getEnvInteger("GUBER_MAX_LIMIT"))
+	conf.IgnoreUnknownBehaviors = os.Getenv("GUBER_IGNORE_UNKNOWN_BEHAVIORS") != ""
+	holster.SetDefault(&conf.NameStatsSize, getEnvInteger("GUBER_NAME_STATS_SIZE"))
+	conf.NameStatsMetrics = getEnvSlice("GUBER_NAME_STATS_METRICS")
+
+	var err error
+	if conf.KeyFloodRules, err = getEnvKeyFloodRules("GUBER_KEY_FLOOD_RULES"); err != nil {
+		return conf, err
+	}
+	if conf.Namespaces, err = getEnvNamespaces("GUBER_NAMESPACES"); err != nil {
+		return conf, err
+	}
+
+	// Peer picker and migration from a previous hash function
+	hash, err := getEnvHashFunc("GUBER_PEER_PICKER_HASH")
+	if err != nil {
+		return conf, err
+	}
+	conf.Picker = gubernator.NewConsistantHash(hash)
+	if os.Getenv("GUBER_MIGRATE_FROM_PEER_PICKER_HASH") != "" {
+		from, err := getEnvHashFunc("GUBER_MIGRATE_FROM_PEER_PICKER_HASH")
+		if err != nil {
+			return conf, err
+		}
+		conf.Migration.From = gubernator.NewConsistantHash(from)
+		holster.SetDefault(&conf.Migration.Window, getEnvDuration("GUBER_MIGRATION_WINDOW"))
+	}
 
 	// Behaviors
 	holster.SetDefault(&conf.Behaviors.BatchTimeout, getEnvDuration("GUBER_BATCH_TIMEOUT"))
 	holster.SetDefault(&conf.Behaviors.BatchLimit, getEnvInteger("GUBER_BATCH_LIMIT"))
 	holster.SetDefault(&conf.Behaviors.BatchWait, getEnvDuration("GUBER_BATCH_WAIT"))
+	holster.SetDefault(&conf.Behaviors.ForwardConcurrency, getEnvInteger("GUBER_FORWARD_CONCURRENCY"))
+	holster.SetDefault(&conf.Behaviors.HedgeDelay, getEnvDuration("GUBER_HEDGE_DELAY"))
+	holster.SetDefault(&conf.Behaviors.HedgeBudget, getEnvFloat("GUBER_HEDGE_BUDGET"))
 
 	holster.SetDefault(&conf.Behaviors.GlobalTimeout, getEnvDuration("GUBER_GLOBAL_TIMEOUT"))
 	holster.SetDefault(&conf.Behaviors.GlobalBatchLimit, getEnvInteger("GUBER_GLOBAL_BATCH_LIMIT"))
 	holster.SetDefault(&conf.Behaviors.GlobalSyncWait, getEnvDuration("GUBER_GLOBAL_SYNC_WAIT"))
 
+	holster.SetDefault(&conf.Behaviors.PeerReconnectErrors, getEnvInteger("GUBER_PEER_RECONNECT_ERRORS"))
+	holster.SetDefault(&conf.Behaviors.PeerReconnectTimeout, getEnvDuration("GUBER_PEER_RECONNECT_TIMEOUT"))
+
+	holster.SetDefault(&conf.Behaviors.DedupeWindow, getEnvDuration("GUBER_DEDUPE_WINDOW"))
+	holster.SetDefault(&conf.Behaviors.DedupeCacheSize, getEnvInteger("GUBER_DEDUPE_CACHE_SIZE"))
+
 	// ETCD Config
 	holster.SetDefault(&conf.EtcdAdvertiseAddress, os.Getenv("GUBER_ETCD_ADVERTISE_ADDRESS"), "127.0.0.1:81")
 	holster.SetDefault(&conf.EtcdKeyPrefix, os.Getenv("GUBER_ETCD_KEY_PREFIX"), "/gubernator-peers")
@@ -213,6 +296,19 @@ func getEnvInteger(name string) int {
 	return int(i)
 }
 
+func getEnvFloat(name string) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.WithError(err).Errorf("while parsing '%s' as a float", name)
+		return 0
+	}
+	return f
+}
+
 func getEnvDuration(name string) time.Duration {
 	v := os.Getenv(name)
 	if v == "" {
@@ -234,6 +330,119 @@ func getEnvSlice(name string) []string {
 	return strings.Split(v, ",")
 }
 
+// hashFuncs are the hash functions the peers can be picked by
+var hashFuncs = map[string]gubernator.HashFunc{
+	"crc32": crc32.ChecksumIEEE,
+	"fnv1": func(data []byte) uint32 {
+		h := fnv.New32()
+		h.Write(data)
+		return h.Sum32()
+	},
+	"fnv1a": func(data []byte) uint32 {
+		h := fnv.New32a()
+		h.Write(data)
+		return h.Sum32()
+	},
+}
+
+// getEnvHashFunc returns the hash function named, crc32 if none is named
+func getEnvHashFunc(name string) (gubernator.HashFunc, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		v = "crc32"
+	}
+	fn, ok := hashFuncs[strings.ToLower(v)]
+	if !ok {
+		return nil, errors.Errorf("unknown hash function '%s' in '%s'; expected 'crc32', 'fnv1' or 'fnv1a'", v, name)
+	}
+	return fn, nil
+}
+
+// getEnvKeyFloodRules parses a comma separated list of rules in the format `pattern:limit/interval:action`;
+// IE: `email_*:1000/1m:under_limit`
+func getEnvKeyFloodRules(name string) ([]gubernator.KeyFloodRule, error) {
+	var rules []gubernator.KeyFloodRule
+	for _, v := range getEnvSlice(name) {
+		parts := strings.Split(v, ":")
+		if len(parts) != 3 {
+			return nil, errors.Errorf("malformed rule '%s' in '%s'; expected 'pattern:limit/interval:action'", v, name)
+		}
+		rate := strings.SplitN(parts[1], "/", 2)
+		if len(rate) != 2 {
+			return nil, errors.Errorf("malformed rate '%s' in '%s'; expected 'limit/interval'", parts[1], name)
+		}
+
+		limit, err := strconv.ParseInt(rate[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while parsing the limit of rule '%s' in '%s'", v, name)
+		}
+		interval, err := time.ParseDuration(rate[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "while parsing the interval of rule '%s' in '%s'", v, name)
+		}
+		action, err := gubernator.ParseKeyFloodAction(parts[2])
+		if err != nil {
+			return nil, errors.Wrapf(err, "while parsing the action of rule '%s' in '%s'", v, name)
+		}
+		rules = append(rules, gubernator.KeyFloodRule{
+			Pattern:  parts[0],
+			Limit:    limit,
+			Interval: interval,
+			Action:   action,
+		})
+	}
+	return rules, nil
+}
+
+// getEnvNamespaces parses a comma separated list of namespaces in the format `name:prefix` followed by
+// optional bounds in the format `:bound=value`, where bound is one of `cache`, `queue` or `inflight`;
+// IE: `billing:billing_:cache=10000:inflight=500`
+func getEnvNamespaces(name string) ([]gubernator.NamespaceConfig, error) {
+	var namespaces []gubernator.NamespaceConfig
+	for _, v := range getEnvSlice(name) {
+		parts := strings.Split(v, ":")
+		if len(parts) < 2 {
+			return nil, errors.Errorf("malformed namespace '%s' in '%s'; expected 'name:prefix[:bound=value]'", v, name)
+		}
+
+		ns := gubernator.NamespaceConfig{Name: parts[0], Prefix: parts[1]}
+		for _, bound := range parts[2:] {
+			kv := strings.SplitN(bound, "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.Errorf("malformed bound '%s' of namespace '%s' in '%s'; expected 'bound=value'",
+					bound, ns.Name, name)
+			}
+			value, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "while parsing bound '%s' of namespace '%s' in '%s'", bound, ns.Name, name)
+			}
+			switch kv[0] {
+			case "cache":
+				ns.CacheSize = value
+			case "queue":
+				ns.MaxQueued = value
+			case "inflight":
+				ns.MaxInFlight = value
+			default:
+				return nil, errors.Errorf("unknown bound '%s' of namespace '%s' in '%s'; expected 'cache', "+
+					"'queue' or 'inflight'", kv[0], ns.Name, name)
+			}
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces, nil
+}
+
+// reloadNamespaces reads the namespaces from the environment again, after re-reading the env config file
+func reloadNamespaces(configFile string) ([]gubernator.NamespaceConfig, error) {
+	if configFile != "" {
+		if err := fromEnvFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+	return getEnvNamespaces("GUBER_NAMESPACES")
+}
+
 // Take values from a file in the format `GUBER_CONF_ITEM=my-value` and put them into the environment
 // lines that begin with `#` are ignored
 func fromEnvFile(configFile string) error {
@@ -24,6 +24,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"github.com/mailgun/gubernator"
@@ -46,12 +48,6 @@ func main() {
 	conf, err = confFromEnv()
 	checkErr(err, "while getting config")
 
-	// The LRU cache we store rate limits in
-	cache := cache.NewLRUCache(conf.CacheSize)
-
-	// cache also implements prometheus.Collector interface
-	prometheus.MustRegister(cache)
-
 	// Handler to collect duration and API access metrics for GRPC
 	statsHandler := gubernator.NewGRPCStatsHandler()
 
@@ -60,13 +56,54 @@ func main() {
 		grpc.StatsHandler(statsHandler),
 		grpc.MaxRecvMsgSize(1024*1024))
 
+	guberConf := gubernator.Config{
+		GRPCServer:   grpcSrv,
+		Behaviors:    conf.Behaviors,
+		PoolSize:     conf.PoolSize,
+		CacheSize:    conf.CacheSize,
+		MemoryBudget: int64(conf.MemoryBudget),
+		MinDuration:  conf.MinDuration,
+		MaxDuration:  conf.MaxDuration,
+		MaxLimit:     int64(conf.MaxLimit),
+
+		IgnoreUnknownBehaviors: conf.IgnoreUnknownBehaviors,
+		KeyFloodRules:          conf.KeyFloodRules,
+		Namespaces:             conf.Namespaces,
+		NameStatsSize:          conf.NameStatsSize,
+		NameStatsMetrics:       conf.NameStatsMetrics,
+		Picker:                 conf.Picker,
+		Migration:              conf.Migration,
+	}
+
+	// Unless configured otherwise, rate limits are partitioned across workers with a private cache each
+	if conf.SingleCache {
+		// The LRU cache we store rate limits in
+		cache := cache.NewLRUCache(conf.CacheSize)
+
+		// cache also implements prometheus.Collector interface
+		prometheus.MustRegister(cache)
+		guberConf.Cache = cache
+	}
+
 	// Registers a new gubernator instance with the GRPC server
-	guber, err := gubernator.New(gubernator.Config{
-		GRPCServer: grpcSrv,
-		Cache:      cache,
-	})
+	guber, err := gubernator.New(guberConf)
 	checkErr(err, "while creating new gubernator instance")
 
+	// Periodically assert the cache has not been corrupted
+	if conf.CacheConsistencyCheck != 0 {
+		wg.Until(func(done chan struct{}) bool {
+			select {
+			case <-time.After(conf.CacheConsistencyCheck):
+				if err := guber.ConsistencyCheck(); err != nil {
+					log.WithError(err).Error("cache consistency check failed")
+				}
+				return true
+			case <-done:
+				return false
+			}
+		})
+	}
+
 	// guber instance also implements prometheus.Collector interface
 	prometheus.MustRegister(guber)
 
@@ -123,16 +160,27 @@ func main() {
 		checkErr(httpSrv.Serve(listener), "while starting HTTP server")
 	})
 
-	// Wait here for signals to clean up our mess
+	// Wait here for signals to clean up our mess, or to reload the namespaces
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGHUP)
 	for sig := range c {
+		if sig == syscall.SIGHUP {
+			namespaces, err := reloadNamespaces(conf.ConfigFile)
+			if err == nil {
+				err = guber.SetNamespaces(namespaces)
+			}
+			if err != nil {
+				log.WithError(err).Error("while reloading namespaces; keeping the namespaces in use")
+			}
+			continue
+		}
 		if sig == os.Interrupt {
 			log.Info("caught interrupt; user requested premature exit")
 			pool.Close()
 			httpSrv.Shutdown(ctx)
 			grpcSrv.GracefulStop()
 			wg.Stop()
+			guber.Close()
 			statsHandler.Close()
 			os.Exit(0)
 		}
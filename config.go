@@ -21,6 +21,8 @@ import (
 	"github.com/mailgun/gubernator/cache"
 	"github.com/mailgun/holster"
 	"google.golang.org/grpc"
+	"math"
+	"runtime"
 	"time"
 )
 
@@ -32,12 +34,68 @@ type Config struct {
 	// (Optional) Adjust how gubernator behaviors are configured
 	Behaviors BehaviorConfig
 
-	// (Optional) The cache implementation
+	// (Optional) The cache implementation. If provided, every rate limit is stored in this cache
+	// and access is serialized by the cache lock, which disables the worker pool.
 	Cache cache.Cache
 
+	// (Optional) The number of workers rate limits are partitioned across. Each worker owns a private
+	// shard of the cache such that no lock is required. Defaults to GOMAXPROCS
+	PoolSize int
+
+	// (Optional) The max number of rate limits held by all the workers combined. Defaults to 50000
+	CacheSize int
+
+	// (Optional) The max bytes of rate limit state held in memory by the caches, the peer batching queues
+	// and the GLOBAL broadcast buffers combined. Once exceeded the caches evict their least recently used
+	// rate limits, then new batched requests are rejected with RESOURCE_EXHAUSTED. Usage is estimated,
+	// see cache.Budget. A Cache provided via `Cache` is only bounded if it implements SetBudget().
+	// Defaults to zero, which means unbounded
+	MemoryBudget int64
+
+	// (Optional) The clock used to determine when rate limits expire and reset. Tests can provide
+	// a holster.FrozenClock to control the passage of time instead of sleeping. Only applies to the
+	// caches created by the instance; a Cache provided via `Cache` must be given the clock directly.
+	// Defaults to cache.DefaultCoarseClock
+	Clock holster.Clock
+
+	// (Optional) The range of durations accepted for a rate limit, rate limits outside the range are
+	// rejected with INVALID_ARGUMENT. Defaults to zero and 10 years
+	MinDuration time.Duration
+	MaxDuration time.Duration
+
+	// (Optional) The max limit accepted for a rate limit, which also bounds the hits of a single request.
+	// Rate limits which exceed it are rejected with INVALID_ARGUMENT. Defaults to math.MaxInt64
+	MaxLimit int64
+
+	// (Optional) If true, behavior flags this server doesn't know are removed from a rate limit instead of
+	// rejecting it with INVALID_ARGUMENT. Defaults to false, such that a client which depends on a newer
+	// behavior fails rather than silently getting the semantics of an older server.
+	IgnoreUnknownBehaviors bool
+
+	// (Optional) Caps the number of rate limits with a new unique key created per interval for the names
+	// matched, such that a flood of unique keys can't evict the rate limits in use. The first rule which
+	// matches the name of a rate limit applies. Defaults to none
+	KeyFloodRules []KeyFloodRule
+
+	// (Optional) The max number of rate limit names GetNameStats() tracks the usage of, the names with the
+	// most requests are tracked. Defaults to 100
+	NameStatsSize int
+
+	// (Optional) The rate limit names whose usage is exported as prometheus metrics labelled by name. The
+	// names are counted exactly and don't take the place of the names tracked by NameStatsSize. The other
+	// names are counted under the name 'other' by the metrics which are always labelled by name.
+	NameStatsMetrics []string
+
+	// (Optional) Isolates the rate limits of each namespace from those of the other namespaces, see
+	// NamespaceConfig. The namespaces can be replaced at runtime via Instance.SetNamespaces()
+	Namespaces []NamespaceConfig
+
 	// (Optional) This is the peer picker algorithm the server will use decide which peer in the cluster
 	// will coordinate a rate limit
 	Picker PeerPicker
+
+	// (Optional) Migrates the rate limits from the owners assigned by a previous picker, see MigrationConfig
+	Migration MigrationConfig
 }
 
 type BehaviorConfig struct {
@@ -47,6 +105,16 @@ type BehaviorConfig struct {
 	BatchWait time.Duration
 	// The max number of requests we can batch into a single peer request
 	BatchLimit int
+	// The max number of peers the rate limits of a single GetRateLimits request are forwarded to concurrently
+	ForwardConcurrency int
+
+	// How long to wait for a peer before the request is sent again on a second connection to the peer, the
+	// answer which arrives first is used; roughly the 95th percentile latency of the peers. The rate limits
+	// of a hedged request are deduped by their request token, those without one are assigned a token. Zero
+	// disables hedging, which is the default
+	HedgeDelay time.Duration
+	// The max fraction of the requests to peers which are hedged, in addition to a burst of 10. Defaults to 0.05
+	HedgeBudget float64
 
 	// How long a non-owning peer should wait before syncing hits to the owning peer
 	GlobalSyncWait time.Duration
@@ -54,22 +122,66 @@ type BehaviorConfig struct {
 	GlobalTimeout time.Duration
 	// The max number of global updates we can batch into a single peer request
 	GlobalBatchLimit int
+
+	// The number of consecutive connection errors after which a peer is re-dialed
+	PeerReconnectErrors int
+	// How long the connection to a peer may be in TRANSIENT_FAILURE before the peer is re-dialed
+	PeerReconnectTimeout time.Duration
+
+	// How long an owning peer remembers a request_token in order to detect retried requests
+	DedupeWindow time.Duration
+	// The max number of request tokens an owning peer remembers
+	DedupeCacheSize int
 }
 
 func (c *Config) SetDefaults() error {
 	holster.SetDefault(&c.Behaviors.BatchTimeout, time.Millisecond*500)
 	holster.SetDefault(&c.Behaviors.BatchLimit, maxBatchSize)
 	holster.SetDefault(&c.Behaviors.BatchWait, time.Microsecond*500)
+	holster.SetDefault(&c.Behaviors.ForwardConcurrency, 100)
+	holster.SetDefault(&c.Behaviors.HedgeBudget, 0.05)
 
 	holster.SetDefault(&c.Behaviors.GlobalTimeout, time.Millisecond*500)
 	holster.SetDefault(&c.Behaviors.GlobalBatchLimit, maxBatchSize)
 	holster.SetDefault(&c.Behaviors.GlobalSyncWait, time.Microsecond*500)
 
+	holster.SetDefault(&c.Behaviors.PeerReconnectErrors, 5)
+	holster.SetDefault(&c.Behaviors.PeerReconnectTimeout, time.Second*5)
+
+	holster.SetDefault(&c.Behaviors.DedupeWindow, time.Second*30)
+	holster.SetDefault(&c.Behaviors.DedupeCacheSize, 50000)
+
 	holster.SetDefault(&c.Picker, NewConsistantHash(nil))
-	holster.SetDefault(&c.Cache, cache.NewLRUCache(0))
+	holster.SetDefault(&c.PoolSize, runtime.GOMAXPROCS(0))
+	holster.SetDefault(&c.CacheSize, 50000)
+	holster.SetDefault(&c.Clock, cache.DefaultCoarseClock)
+	holster.SetDefault(&c.MaxDuration, defaultMaxDuration)
+	holster.SetDefault(&c.MaxLimit, int64(math.MaxInt64))
+	holster.SetDefault(&c.NameStatsSize, 100)
+	if c.Migration.From != nil {
+		holster.SetDefault(&c.Migration.Window, time.Minute*10)
+	}
 
 	if c.Behaviors.BatchLimit > maxBatchSize {
 		return fmt.Errorf("Behaviors.BatchLimit cannot exceed '%d'", maxBatchSize)
 	}
-	return nil
+	if c.Behaviors.HedgeDelay < 0 {
+		return fmt.Errorf("Behaviors.HedgeDelay cannot be negative")
+	}
+	if c.Behaviors.HedgeBudget < 0 || c.Behaviors.HedgeBudget > 1 {
+		return fmt.Errorf("Behaviors.HedgeBudget must be between '0' and '1'")
+	}
+	if c.MinDuration < 0 || c.MinDuration > c.MaxDuration {
+		return fmt.Errorf("MinDuration must be between '0' and MaxDuration '%s'", c.MaxDuration)
+	}
+	if c.MaxLimit < 0 {
+		return fmt.Errorf("MaxLimit cannot be negative")
+	}
+	if c.NameStatsSize < 0 {
+		return fmt.Errorf("NameStatsSize cannot be negative")
+	}
+	if err := validateNamespaces(c.Namespaces); err != nil {
+		return err
+	}
+	return validateKeyFloodRules(c.KeyFloodRules)
 }
@@ -0,0 +1,62 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// dryRunKeyPrefix starts the key of a DRY_RUN rate limit, such that its hits are counted against a state of
+// their own instead of the state of the rate limit enforced under the same name and unique key. The key of
+// every other rate limit starts with the length of its name, as such no other key starts with the prefix.
+const dryRunKeyPrefix = "dry_run:"
+
+// The metadata of a DRY_RUN response which reports the status the rate limit would have had
+const dryRunStatusKey = "dry_run_status"
+
+// errNoDryRun is returned when the owner of a DRY_RUN rate limit is older than the dry run capability, as it
+// would count the hits against the rate limit enforced
+var errNoDryRun = status.Error(codes.Unimplemented, "peer can not evaluate DRY_RUN rate limits; it lacks the dry_run capability")
+
+// dryRun reports the status of a DRY_RUN rate limit via the metadata of the response and answers it with
+// UNDER_LIMIT instead. Returns true if the rate limit would have been OVER_LIMIT. The metadata is copied,
+// as a forwarded response may share its metadata with other responses; see Instance.forwardBatch().
+func dryRun(rl *RateLimitResp) bool {
+	metadata := make(map[string]string, len(rl.Metadata)+1)
+	for k, v := range rl.Metadata {
+		metadata[k] = v
+	}
+	metadata[dryRunStatusKey] = rl.Status.String()
+	rl.Metadata = metadata
+
+	over := rl.Status == Status_OVER_LIMIT
+	rl.Status = Status_UNDER_LIMIT
+	return over
+}
+
+// shadow answers the rate limit received from a client with UNDER_LIMIT if it is DRY_RUN, and counts the
+// rate limits which would have been OVER_LIMIT by name, see nameStats.metricName(). The owner answers with
+// the true status, as such only the instance which received the rate limit from the client calls shadow().
+func (s *Instance) shadow(req *RateLimitReq, rl *RateLimitResp) {
+	if !HasBehavior(req.Behavior, Behavior_DRY_RUN) || rl == nil || rl.Error != "" {
+		return
+	}
+	if dryRun(rl) {
+		s.shadowOverLimit.WithLabelValues(s.names.metricName(req.Name)).Inc()
+	}
+}
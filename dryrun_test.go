@@ -0,0 +1,252 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/mailgun/gubernator/cluster"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// shadowOverLimit returns the shadow_over_limit_total metric of the rate limit name provided
+func shadowOverLimit(t *testing.T, instance *guber.Instance, name string) float64 {
+	reg := prometheus.NewRegistry()
+	require.Nil(t, reg.Register(instance))
+	metrics, err := reg.Gather()
+	require.Nil(t, err)
+	for _, m := range metrics {
+		if m.GetName() != "shadow_over_limit_total" {
+			continue
+		}
+		for _, metric := range m.Metric {
+			if labelValue(metric, "name") == name {
+				return metric.Counter.GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+// A DRY_RUN rate limit is never enforced, and counts its hits apart from the rate limit enforced
+func TestDryRun(t *testing.T) {
+	instance, err := guber.New(guber.Config{
+		GRPCServer:       grpc.NewServer(),
+		NameStatsMetrics: []string{"test_dry_run"},
+	})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+
+	hit := func(behavior guber.Behavior) *guber.RateLimitResp {
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_dry_run",
+					UniqueKey: "account:1",
+					Behavior:  behavior,
+					Duration:  guber.Minute,
+					Limit:     3,
+					Hits:      1,
+				},
+			},
+		})
+		require.Nil(t, err)
+		require.Empty(t, resp.Responses[0].Error)
+		return resp.Responses[0]
+	}
+
+	// The rate limit enforced is over the limit, which the dry run doesn't see
+	for i := 0; i < 5; i++ {
+		hit(guber.Behavior_BATCHING)
+	}
+
+	for i := 0; i < 10; i++ {
+		rl := hit(guber.Behavior_DRY_RUN)
+		assert.Equal(t, guber.Status_UNDER_LIMIT, rl.Status)
+		if i < 3 {
+			assert.Equal(t, "UNDER_LIMIT", rl.Metadata["dry_run_status"])
+			assert.Equal(t, int64(2-i), rl.Remaining)
+		} else {
+			assert.Equal(t, "OVER_LIMIT", rl.Metadata["dry_run_status"])
+		}
+	}
+	assert.Equal(t, float64(7), shadowOverLimit(t, instance, "test_dry_run"))
+
+	// Nor does the rate limit enforced see the hits of the dry run
+	rl := hit(guber.Behavior_BATCHING)
+	assert.Equal(t, guber.Status_OVER_LIMIT, rl.Status)
+	assert.Empty(t, rl.Metadata["dry_run_status"])
+	assert.Equal(t, float64(7), shadowOverLimit(t, instance, "test_dry_run"))
+
+	// The cache entries of both are counted under the name of the rate limit
+	stats, err := instance.GetNameStats(context.Background(), &guber.GetNameStatsReq{})
+	require.Nil(t, err)
+	require.Len(t, stats.Names, 1)
+	assert.Equal(t, "test_dry_run", stats.Names[0].Name)
+	assert.Equal(t, int64(2), stats.Names[0].CacheEntries)
+}
+
+// The status of a DRY_RUN rate limit owned by a peer is reported by the instance which received it
+func TestDryRunForwarded(t *testing.T) {
+	c, err := cluster.Start(2)
+	require.Nil(t, err)
+	defer c.Stop()
+
+	const keys = 20
+	var requests []*guber.RateLimitReq
+	for i := 0; i < keys; i++ {
+		requests = append(requests, &guber.RateLimitReq{
+			Name:      "test_dry_run_forwarded",
+			UniqueKey: fmt.Sprintf("account:%d", i),
+			Behavior:  guber.Behavior_DRY_RUN,
+			Duration:  guber.Minute,
+			Limit:     2,
+			Hits:      1,
+		})
+	}
+
+	// Each round hits every rate limit via both instances, one of which forwards it to the other
+	var forwarded int
+	for round := 0; round < 3; round++ {
+		for idx := 0; idx < 2; idx++ {
+			resp, err := c.InstanceAt(idx).GetRateLimits(context.Background(), &guber.GetRateLimitsReq{Requests: requests})
+			require.Nil(t, err)
+			for _, rl := range resp.Responses {
+				require.Empty(t, rl.Error)
+				assert.Equal(t, guber.Status_UNDER_LIMIT, rl.Status)
+				if round == 0 {
+					assert.Equal(t, "UNDER_LIMIT", rl.Metadata["dry_run_status"])
+				} else {
+					assert.Equal(t, "OVER_LIMIT", rl.Metadata["dry_run_status"])
+				}
+				if rl.Metadata["owner"] != "" {
+					forwarded++
+				}
+			}
+		}
+	}
+	assert.Equal(t, 3*keys, forwarded)
+
+	// The owner doesn't count the rate limits forwarded to it, and the name is not in Config.NameStatsMetrics
+	for idx := 0; idx < 2; idx++ {
+		assert.Equal(t, float64(2*keys), shadowOverLimit(t, c.InstanceAt(idx), "other"), idx)
+		assert.Equal(t, float64(0), shadowOverLimit(t, c.InstanceAt(idx), "test_dry_run_forwarded"), idx)
+	}
+}
+
+// The owner broadcasts the status of a GLOBAL DRY_RUN rate limit apart from the rate limit enforced, such
+// that the peers don't answer the rate limit enforced with the status of the dry run
+func TestDryRunGlobal(t *testing.T) {
+	c, err := cluster.Start(2)
+	require.Nil(t, err)
+	defer c.Stop()
+
+	hit := func(idx int, behavior guber.Behavior, hits int64) *guber.RateLimitResp {
+		resp, err := c.InstanceAt(idx).GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_dry_run_global",
+					UniqueKey: "account:1",
+					Behavior:  guber.Behavior_GLOBAL | behavior,
+					Duration:  guber.Minute,
+					Limit:     10,
+					Hits:      hits,
+				},
+			},
+		})
+		require.Nil(t, err)
+		require.Empty(t, resp.Responses[0].Error)
+		return resp.Responses[0]
+	}
+
+	// waitFor polls both instances, one of which is not the owner, until the broadcast arrives
+	waitFor := func(cond func(rl *guber.RateLimitResp) bool, behavior guber.Behavior) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if cond(hit(0, behavior, 0)) && cond(hit(1, behavior, 0)) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("the owner never broadcast the status of the rate limit")
+	}
+
+	hit(0, 0, 2)
+	hit(1, 0, 2)
+	waitFor(func(rl *guber.RateLimitResp) bool { return rl.Remaining == 6 }, 0)
+
+	for i := 0; i < 3; i++ {
+		hit(0, guber.Behavior_DRY_RUN, 10)
+		hit(1, guber.Behavior_DRY_RUN, 10)
+	}
+	waitFor(func(rl *guber.RateLimitResp) bool { return rl.Metadata["dry_run_status"] == "OVER_LIMIT" }, guber.Behavior_DRY_RUN)
+
+	for idx := 0; idx < 2; idx++ {
+		rl := hit(idx, 0, 0)
+		assert.Equal(t, guber.Status_UNDER_LIMIT, rl.Status, idx)
+		assert.Equal(t, int64(6), rl.Remaining, idx)
+	}
+}
+
+// An owner older than DRY_RUN would count the hits against the rate limit enforced
+func TestDryRunOlderOwner(t *testing.T) {
+	old := startFakePeer(t)
+	old.capabilities = []string{guber.CapabilityRequestToken, guber.CapabilityBehaviorFlags}
+	defer old.server.Stop()
+
+	instance, err := guber.New(guber.Config{GRPCServer: grpc.NewServer()})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: old.address}})
+
+	hit := func(behavior guber.Behavior) *guber.GetRateLimitsResp {
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_dry_run_older_owner",
+					UniqueKey: "account:1",
+					Behavior:  guber.Behavior_NO_BATCHING | behavior,
+					Duration:  guber.Minute,
+					Limit:     10,
+					Hits:      1,
+				},
+			},
+		})
+		require.Nil(t, err)
+		return resp
+	}
+
+	// Learn the capabilities of the owner
+	require.Nil(t, hit(0).Err())
+
+	err = hit(guber.Behavior_DRY_RUN).Err()
+	var partial *guber.PartialError
+	require.True(t, errors.As(err, &partial), "unexpected error '%v'", err)
+	assert.Equal(t, codes.Unimplemented, status.Code(partial.Errors[0]))
+	assert.Contains(t, err.Error(), "lacks the dry_run capability")
+	assert.Len(t, old.received, 1)
+}
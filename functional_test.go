@@ -18,38 +18,65 @@ package gubernator_test
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"math"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	guber "github.com/mailgun/gubernator"
+	"github.com/mailgun/gubernator/cache"
 	"github.com/mailgun/gubernator/cluster"
+	"github.com/mailgun/holster"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// The cluster shared by the tests of the entire test suite, see TestMain()
+var testCluster *cluster.Cluster
+
 // Setup and shutdown the mailgun mock server for the entire test suite
 func TestMain(m *testing.M) {
-	if err := cluster.StartWith([]string{
+	// Fuzz workers are separate processes which only run the fuzz targets, as such they
+	// don't need the cluster and can't bind the ports held by the parent process
+	flag.Parse()
+	if f := flag.Lookup("test.fuzzworker"); f != nil && f.Value.String() == "true" {
+		os.Exit(m.Run())
+	}
+
+	var err error
+	testCluster, err = cluster.Start(6, cluster.WithAddresses(
 		"127.0.0.1:9990",
 		"127.0.0.1:9991",
 		"127.0.0.1:9992",
 		"127.0.0.1:9993",
 		"127.0.0.1:9994",
 		"127.0.0.1:9995",
-	}); err != nil {
+	))
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	defer cluster.Stop()
+	defer testCluster.Stop()
 	os.Exit(m.Run())
 }
 
 func TestOverTheLimit(t *testing.T) {
-	client, errs := guber.DialV1Server(cluster.GetPeer())
+	client, errs := guber.DialV1Server(testCluster.GetPeer())
 	require.Nil(t, errs)
 
 	tests := []struct {
@@ -95,7 +122,7 @@ func TestOverTheLimit(t *testing.T) {
 }
 
 func TestTokenBucket(t *testing.T) {
-	client, errs := guber.DialV1Server(cluster.GetPeer())
+	client, errs := guber.DialV1Server(testCluster.GetPeer())
 	require.Nil(t, errs)
 
 	tests := []struct {
@@ -146,7 +173,7 @@ func TestTokenBucket(t *testing.T) {
 }
 
 func TestLeakyBucket(t *testing.T) {
-	client, errs := guber.DialV1Server(cluster.GetPeer())
+	client, errs := guber.DialV1Server(testCluster.GetPeer())
 	require.Nil(t, errs)
 
 	tests := []struct {
@@ -206,7 +233,7 @@ func TestLeakyBucket(t *testing.T) {
 }
 
 func TestMissingFields(t *testing.T) {
-	client, errs := guber.DialV1Server(cluster.GetPeer())
+	client, errs := guber.DialV1Server(testCluster.GetPeer())
 	require.Nil(t, errs)
 
 	tests := []struct {
@@ -243,7 +270,7 @@ func TestMissingFields(t *testing.T) {
 				Duration:  10000,
 				Limit:     5,
 			},
-			Error:  "field 'namespace' cannot be empty",
+			Error:  "rpc error: code = InvalidArgument desc = field 'namespace' cannot be empty",
 			Status: guber.Status_UNDER_LIMIT,
 		},
 		{
@@ -253,7 +280,7 @@ func TestMissingFields(t *testing.T) {
 				Duration: 10000,
 				Limit:    5,
 			},
-			Error:  "field 'unique_key' cannot be empty",
+			Error:  "rpc error: code = InvalidArgument desc = field 'unique_key' cannot be empty",
 			Status: guber.Status_UNDER_LIMIT,
 		},
 	}
@@ -268,8 +295,47 @@ func TestMissingFields(t *testing.T) {
 	}
 }
 
+// clusterOwner returns the index of the node of the test cluster which owns the rate limit provided.
+// The peers are compared by pointer, as the tests can't access the host of a peer.
+func clusterOwner(t *testing.T, r *guber.RateLimitReq) int {
+	picker := guber.NewConsistantHash(nil)
+	var peers []*guber.PeerClient
+	for _, addr := range testCluster.Addresses() {
+		peer, err := guber.NewPeerClient(guber.BehaviorConfig{}, addr)
+		require.Nil(t, err)
+		defer peer.Shutdown()
+		picker.Add(peer)
+		peers = append(peers, peer)
+	}
+
+	owner, err := picker.Get(r.HashKey())
+	require.Nil(t, err)
+	for i, peer := range peers {
+		if peer == owner {
+			return i
+		}
+	}
+	t.Fatalf("no owner for rate limit '%s'", r.HashKey())
+	return -1
+}
+
 func TestGlobalRateLimits(t *testing.T) {
-	client, errs := guber.DialV1Server(cluster.PeerAt(0))
+	req := guber.RateLimitReq{
+		Name:      "test_global",
+		UniqueKey: "account:1234",
+		Algorithm: guber.Algorithm_TOKEN_BUCKET,
+		Behavior:  guber.Behavior_GLOBAL,
+		Duration:  guber.Second * 3,
+		Hits:      1,
+		Limit:     5,
+	}
+
+	// The peer we are connected to must NOT be the owner, such that it forwards the hits
+	// asynchronously to the owner
+	owner := clusterOwner(t, &req)
+	peer := (owner + 1) % len(testCluster.Nodes())
+
+	client, errs := guber.DialV1Server(testCluster.PeerAt(peer))
 	require.Nil(t, errs)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
@@ -277,19 +343,7 @@ func TestGlobalRateLimits(t *testing.T) {
 
 	sendHit := func(status guber.Status, remain int64, i int) {
 		resp, err := client.GetRateLimits(ctx, &guber.GetRateLimitsReq{
-			Requests: []*guber.RateLimitReq{
-				{
-					// For this test this name/key should ensure our connected peer is NOT the owner,
-					// the peer we are connected to should forward requests asynchronously to the owner.
-					Name:      "test_global",
-					UniqueKey: "account:1234",
-					Algorithm: guber.Algorithm_TOKEN_BUCKET,
-					Behavior:  guber.Behavior_GLOBAL,
-					Duration:  guber.Second * 3,
-					Hits:      1,
-					Limit:     5,
-				},
-			},
+			Requests: []*guber.RateLimitReq{&req},
 		})
 		require.Nil(t, err, i)
 		assert.Equal(t, "", resp.Responses[0].Error, i)
@@ -311,18 +365,18 @@ func TestGlobalRateLimits(t *testing.T) {
 	sendHit(guber.Status_UNDER_LIMIT, 3, 3)
 
 	// Inspect our metrics, ensure they collected the counts we expected during this test
-	instance := cluster.InstanceAt(0)
-	metricCh := make(chan prometheus.Metric, 5)
-	instance.Guber.Collect(metricCh)
+	instance := testCluster.InstanceAt(peer)
+	metricCh := make(chan prometheus.Metric, 64)
+	instance.Collect(metricCh)
 
 	buf := dto.Metric{}
 	m := <-metricCh // Async metric
 	assert.Nil(t, m.Write(&buf))
 	assert.Equal(t, uint64(1), *buf.Histogram.SampleCount)
 
-	instance = cluster.InstanceAt(3)
-	metricCh = make(chan prometheus.Metric, 5)
-	instance.Guber.Collect(metricCh)
+	instance = testCluster.InstanceAt(owner)
+	metricCh = make(chan prometheus.Metric, 64)
+	instance.Collect(metricCh)
 
 	m = <-metricCh // Async metric
 	m = <-metricCh // Broadcast metric
@@ -330,4 +384,1058 @@ func TestGlobalRateLimits(t *testing.T) {
 	assert.Equal(t, uint64(1), *buf.Histogram.SampleCount)
 }
 
+// Batches are returned to the pool by the last of the sender and its waiters to release them, this
+// guards against responses leaking between waiters when many go routines share a batch and some of
+// them give up before the batch is delivered.
+func TestPeerClientBatchingStress(t *testing.T) {
+	conf := guber.Config{}
+	require.Nil(t, conf.SetDefaults())
+
+	client, err := guber.NewPeerClient(conf.Behaviors, testCluster.PeerAt(1))
+	require.Nil(t, err)
+
+	const limit = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+
+		// Each key is only hit by a single go routine, so the remaining count is predictable
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("account:%d:%s", i, guber.RandomString(10))
+			for j := int64(1); j <= limit; j++ {
+				rl, err := client.GetPeerRateLimit(context.Background(), &guber.RateLimitReq{
+					Name:      "test_peer_client_batching_stress",
+					UniqueKey: key,
+					Behavior:  guber.Behavior_BATCHING,
+					Limit:     limit,
+					Duration:  guber.Minute,
+					Hits:      1,
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if rl.Remaining != limit-j {
+					errs <- fmt.Errorf("key '%s' expected remaining '%d'; got '%d'", key, limit-j, rl.Remaining)
+					return
+				}
+			}
+		}(i)
+
+		// Abandons requests before the batch is sent
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < limit; j++ {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Microsecond*time.Duration(j*10))
+				client.GetPeerRateLimit(ctx, &guber.RateLimitReq{
+					Name:      "test_peer_client_batching_stress_cancel",
+					UniqueKey: fmt.Sprintf("account:%d", i),
+					Behavior:  guber.Behavior_BATCHING,
+					Limit:     limit,
+					Duration:  guber.Minute,
+					Hits:      1,
+				})
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
 // TODO: Add a test for sending no rate limits RateLimitReqList.RateLimits = nil
+
+// A frozen clock makes rate limit expiry deterministic without sleeping
+func TestFrozenClockExpiry(t *testing.T) {
+	clock := &holster.FrozenClock{CurrentTime: time.Now()}
+	c, err := cluster.Start(3, cluster.WithClock(clock))
+	require.Nil(t, err)
+	defer c.Stop()
+
+	hit := func() *guber.RateLimitResp {
+		resp, err := c.NodeAt(0).Client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_frozen_clock_expiry",
+					UniqueKey: "account:1234",
+					Algorithm: guber.Algorithm_TOKEN_BUCKET,
+					Duration:  guber.Second,
+					Limit:     1,
+					Hits:      1,
+				},
+			},
+		})
+		require.Nil(t, err)
+		return resp.Responses[0]
+	}
+
+	assert.Equal(t, guber.Status_UNDER_LIMIT, hit().Status)
+	assert.Equal(t, guber.Status_OVER_LIMIT, hit().Status)
+
+	// Still within the duration, no matter how long the test actually took
+	clock.Sleep(time.Second)
+	assert.Equal(t, guber.Status_OVER_LIMIT, hit().Status)
+
+	clock.Sleep(time.Millisecond)
+	assert.Equal(t, guber.Status_UNDER_LIMIT, hit().Status)
+}
+
+// A restarted node keeps the rate limits it owns only if its cache is kept
+func TestRestartNode(t *testing.T) {
+	c, err := cluster.Start(3)
+	require.Nil(t, err)
+	defer c.Stop()
+
+	hit := func() *guber.RateLimitResp {
+		resp, err := c.NodeAt(0).Client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_restart_node",
+					UniqueKey: "account:1234",
+					Duration:  guber.Minute,
+					Limit:     10,
+					Hits:      1,
+				},
+			},
+		})
+		require.Nil(t, err)
+		require.Empty(t, resp.Responses[0].Error)
+		return resp.Responses[0]
+	}
+
+	rl := hit()
+	assert.Equal(t, int64(9), rl.Remaining)
+
+	// Find the node which owns the rate limit; forwarded responses name the owner
+	owner := 0
+	for i, n := range c.Nodes() {
+		if n.Address == rl.Metadata["owner"] {
+			owner = i
+		}
+	}
+
+	require.Nil(t, c.Restart(owner, cluster.KeepCache()))
+	assert.Equal(t, int64(8), hit().Remaining)
+
+	require.Nil(t, c.Restart(owner))
+	assert.Equal(t, int64(9), hit().Remaining)
+
+	// While the owner is stopped another node owns the rate limit
+	c.StopNode(owner)
+	if owner != 0 {
+		assert.Equal(t, int64(9), hit().Remaining)
+	}
+	assert.False(t, c.NodeAt(owner).Running())
+	assert.Len(t, c.Addresses(), 2)
+}
+
+// Guards against regressions in the number of allocations made when a rate limit is owned by the local instance
+func TestGetRateLimitsAllocs(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		conf guber.Config
+	}{
+		{name: "SingleCache", conf: guber.Config{Cache: cache.NewLRUCache(0)}},
+		{name: "WorkerPool", conf: guber.Config{PoolSize: 2}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.GRPCServer = grpc.NewServer()
+			instance, err := guber.New(tt.conf)
+			require.Nil(t, err)
+			defer instance.Close()
+			instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+
+			req := guber.GetRateLimitsReq{
+				Requests: []*guber.RateLimitReq{
+					{
+						Name:      "test_get_rate_limits_allocs",
+						UniqueKey: "account:1234",
+						Behavior:  guber.Behavior_NO_BATCHING,
+						Limit:     1000000,
+						Duration:  guber.Minute,
+						Hits:      1,
+					},
+				},
+			}
+
+			allocs := testing.AllocsPerRun(1000, func() {
+				resp, err := instance.GetRateLimits(context.Background(), &req)
+				if err != nil || resp.Responses[0].Error != "" {
+					t.Fatalf("GetRateLimits() failed: %v %v", err, resp)
+				}
+			})
+			assert.True(t, allocs < 5, "expected less than 5 allocs per request; got '%v'", allocs)
+		})
+	}
+}
+
+// minimalCache implements only the methods of cache.Cache, like a cache written against the interface
+// before it knew of clocks
+type minimalCache struct {
+	lru *cache.LRUCache
+}
+
+func (c *minimalCache) Add(key cache.Key, value interface{}, expireAt int64) bool {
+	return c.lru.Add(key, value, expireAt)
+}
+func (c *minimalCache) UpdateExpiration(key cache.Key, expireAt int64) bool {
+	return c.lru.UpdateExpiration(key, expireAt)
+}
+func (c *minimalCache) Get(key cache.Key) (interface{}, bool) { return c.lru.Get(key) }
+func (c *minimalCache) Remove(key cache.Key)                  { c.lru.Remove(key) }
+func (c *minimalCache) Lock()                                 { c.lru.Lock() }
+func (c *minimalCache) Unlock()                               { c.lru.Unlock() }
+
+// A Config.Cache which only implements cache.Cache is measured against the system clock
+func TestMinimalCache(t *testing.T) {
+	instance, err := guber.New(guber.Config{
+		GRPCServer: grpc.NewServer(),
+		Cache:      &minimalCache{lru: cache.NewLRUCache(0)},
+	})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+
+	for i, remaining := range []int64{1, 0, 0} {
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_minimal_cache",
+					UniqueKey: "account:1234",
+					Behavior:  guber.Behavior_NO_BATCHING,
+					Limit:     2,
+					Duration:  guber.Minute,
+					Hits:      1,
+				},
+			},
+		})
+		require.Nil(t, err)
+		rl := resp.Responses[0]
+		require.Empty(t, rl.Error)
+		assert.Equal(t, remaining, rl.Remaining, i)
+		assert.True(t, rl.ResetTime > cache.MillisecondNow(), i)
+	}
+}
+
+// Rate limits received once the instance is closed fail with Unavailable instead of panicking or hanging on
+// the queues of the global manager. A single cache still answers the rate limits it owns, without broadcasting.
+func TestRequestsAfterClose(t *testing.T) {
+	for _, mode := range []string{"SingleCache", "WorkerPool"} {
+		t.Run(mode, func(t *testing.T) {
+			closed := func(peer guber.PeerInfo) *guber.Instance {
+				conf := guber.Config{GRPCServer: grpc.NewServer(), PoolSize: 2}
+				if mode == "SingleCache" {
+					conf.Cache = cache.NewLRUCache(0)
+				}
+				instance, err := guber.New(conf)
+				require.Nil(t, err)
+				instance.SetPeers([]guber.PeerInfo{peer})
+				instance.Close()
+				return instance
+			}
+			hit := func(instance *guber.Instance, behavior guber.Behavior) string {
+				resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+					Requests: []*guber.RateLimitReq{
+						{
+							Name:      "test_requests_after_close",
+							UniqueKey: "account:1234",
+							Behavior:  behavior,
+							Limit:     10,
+							Duration:  guber.Minute,
+							Hits:      1,
+						},
+					},
+				})
+				require.Nil(t, err)
+				return resp.Responses[0].Error
+			}
+
+			owner := closed(guber.PeerInfo{Address: "127.0.0.1:0", IsOwner: true})
+			for _, behavior := range []guber.Behavior{guber.Behavior_NO_BATCHING, guber.Behavior_GLOBAL} {
+				if mode == "WorkerPool" {
+					assert.Contains(t, hit(owner, behavior), "instance is closed", behavior)
+				} else {
+					assert.Empty(t, hit(owner, behavior), behavior)
+				}
+			}
+
+			// The hits of a GLOBAL rate limit owned by a peer can no longer be queued
+			notOwner := closed(guber.PeerInfo{Address: "127.0.0.1:1"})
+			assert.Contains(t, hit(notOwner, guber.Behavior_GLOBAL), "instance is closed")
+
+			if mode == "WorkerPool" {
+				_, err := owner.UpdatePeerGlobals(context.Background(), &guber.UpdatePeerGlobalsReq{
+					Globals: []*guber.UpdatePeerGlobal{{Key: "test_requests_after_close", Status: &guber.RateLimitResp{}}},
+				})
+				assert.Equal(t, codes.Unavailable, status.Code(err))
+			}
+		})
+	}
+}
+
+// slowPeer is a fake peer which echos the limit of each request back after a delay
+type slowPeer struct {
+	latency time.Duration
+}
+
+func (p *slowPeer) GetPeerRateLimits(ctx context.Context, r *guber.GetPeerRateLimitsReq) (*guber.GetPeerRateLimitsResp, error) {
+	time.Sleep(p.latency)
+	resp := guber.GetPeerRateLimitsResp{}
+	for _, req := range r.Requests {
+		resp.RateLimits = append(resp.RateLimits, &guber.RateLimitResp{Limit: req.Limit, Remaining: req.Limit})
+	}
+	return &resp, nil
+}
+
+func (p *slowPeer) UpdatePeerGlobals(ctx context.Context, r *guber.UpdatePeerGlobalsReq) (*guber.UpdatePeerGlobalsResp, error) {
+	return &guber.UpdatePeerGlobalsResp{}, nil
+}
+
+// modPicker assigns each rate limit to a peer by the number at the end of its unique key, such that
+// tests decide which peer owns a rate limit. Peers are numbered in the order they are added.
+type modPicker struct {
+	peers []*guber.PeerClient
+}
+
+func (p *modPicker) GetPeerByHost(host string) *guber.PeerClient { return nil }
+func (p *modPicker) Peers() []*guber.PeerClient                  { return p.peers }
+func (p *modPicker) New() guber.PeerPicker                       { return &modPicker{} }
+func (p *modPicker) Add(peer *guber.PeerClient)                  { p.peers = append(p.peers, peer) }
+func (p *modPicker) Size() int                                   { return len(p.peers) }
+
+func (p *modPicker) Get(key string) (*guber.PeerClient, error) {
+	n, err := strconv.Atoi(key[strings.LastIndex(key, ":")+1:])
+	if err != nil {
+		return nil, err
+	}
+	return p.peers[n%len(p.peers)], nil
+}
+
+func startSlowPeer(t testing.TB, latency time.Duration) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	server := grpc.NewServer()
+	guber.RegisterPeersV1Server(server, &slowPeer{latency: latency})
+	go server.Serve(listener)
+	return listener.Addr().String(), server.Stop
+}
+
+func TestGetRateLimitsForwardsConcurrently(t *testing.T) {
+	latencies := []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 150 * time.Millisecond}
+	peers := []guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}}
+	for _, latency := range latencies {
+		addr, stop := startSlowPeer(t, latency)
+		defer stop()
+		peers = append(peers, guber.PeerInfo{Address: addr})
+	}
+
+	// Nothing listens on this peer, such that requests to it fail
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	deadPeer := listener.Addr().String()
+	require.Nil(t, listener.Close())
+	peers = append(peers, guber.PeerInfo{Address: deadPeer})
+
+	instance, err := guber.New(guber.Config{
+		GRPCServer: grpc.NewServer(),
+		Picker:     &modPicker{},
+	})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers(peers)
+
+	var req guber.GetRateLimitsReq
+	for i := 0; i < 20; i++ {
+		req.Requests = append(req.Requests, &guber.RateLimitReq{
+			Name:      "test_forwards_concurrently",
+			UniqueKey: fmt.Sprintf("account:%d", i),
+			Duration:  guber.Minute,
+			Limit:     int64(i + 1),
+		})
+	}
+
+	start := time.Now()
+	resp, err := instance.GetRateLimits(context.Background(), &req)
+	elapsed := time.Since(start)
+	require.Nil(t, err)
+	require.Len(t, resp.Responses, len(req.Requests))
+
+	// The latency is that of the slowest peer, not the sum of all the peers
+	assert.True(t, elapsed >= 150*time.Millisecond, "elapsed '%s'", elapsed)
+	assert.True(t, elapsed < 250*time.Millisecond, "elapsed '%s'", elapsed)
+
+	for i, rl := range resp.Responses {
+		peer := peers[i%len(peers)]
+		if peer.IsOwner {
+			assert.Nil(t, rl.Metadata, i)
+		} else {
+			assert.Equal(t, peer.Address, rl.Metadata["owner"], i)
+		}
+
+		// A failed peer only fails the rate limits it owns
+		if peer.Address == deadPeer {
+			assert.Contains(t, rl.Error, "while fetching rate limit", i)
+			continue
+		}
+
+		// The responses are in the same order as the requests
+		assert.Empty(t, rl.Error, i)
+		assert.Equal(t, int64(i+1), rl.Limit, i)
+	}
+}
+
+// errorPeer is a fake peer which fails every request with its error
+type errorPeer struct {
+	slowPeer
+	err error
+}
+
+func (p *errorPeer) GetPeerRateLimits(ctx context.Context, r *guber.GetPeerRateLimitsReq) (*guber.GetPeerRateLimitsResp, error) {
+	return nil, p.err
+}
+
+func startErrorPeer(t testing.TB, err error) (string, func()) {
+	listener, lerr := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, lerr)
+
+	server := grpc.NewServer()
+	guber.RegisterPeersV1Server(server, &errorPeer{err: err})
+	go server.Serve(listener)
+	return listener.Addr().String(), server.Stop
+}
+
+// The error of each rate limit carries a gRPC code, such that clients can decide which errors to retry
+func TestErrorCodes(t *testing.T) {
+	errorAddr, stop := startErrorPeer(t, status.Error(codes.ResourceExhausted, "shedding load"))
+	defer stop()
+	slowAddr, stop := startSlowPeer(t, time.Second)
+	defer stop()
+
+	// Nothing listens on this peer, such that requests to it fail
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	deadAddr := listener.Addr().String()
+	require.Nil(t, listener.Close())
+
+	newInstance := func(conf guber.Config, peers ...string) *guber.Instance {
+		conf.GRPCServer = grpc.NewServer()
+		if len(peers) != 0 {
+			conf.Picker = &modPicker{}
+		}
+		instance, err := guber.New(conf)
+		require.Nil(t, err)
+
+		if len(peers) != 0 {
+			infos := []guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}}
+			for _, peer := range peers {
+				infos = append(infos, guber.PeerInfo{Address: peer})
+			}
+			instance.SetPeers(infos)
+		}
+		return instance
+	}
+
+	// Rate limits are owned by the peer at the index of the number at the end of their unique key
+	instance := newInstance(guber.Config{}, errorAddr, slowAddr, deadAddr)
+	defer instance.Close()
+	budgeted := newInstance(guber.Config{MemoryBudget: 1}, slowAddr)
+	defer budgeted.Close()
+	noPeers := newInstance(guber.Config{})
+	defer noPeers.Close()
+
+	tests := []struct {
+		Name      string
+		Instance  *guber.Instance
+		UniqueKey string
+		Algorithm guber.Algorithm
+		Behavior  guber.Behavior
+		Code      codes.Code
+	}{
+		{Name: "invalid field", Instance: instance, UniqueKey: "", Code: codes.InvalidArgument},
+		{Name: "invalid algorithm", Instance: instance, UniqueKey: "account:0", Algorithm: 5, Code: codes.InvalidArgument},
+		{Name: "peer error", Instance: instance, UniqueKey: "account:1", Behavior: guber.Behavior_NO_BATCHING, Code: codes.ResourceExhausted},
+		{Name: "peer timeout", Instance: instance, UniqueKey: "account:2", Behavior: guber.Behavior_NO_BATCHING, Code: codes.DeadlineExceeded},
+		{Name: "batched peer timeout", Instance: instance, UniqueKey: "account:2", Code: codes.DeadlineExceeded},
+		{Name: "peer unreachable", Instance: instance, UniqueKey: "account:3", Behavior: guber.Behavior_NO_BATCHING, Code: codes.Unavailable},
+		{Name: "memory budget exhausted", Instance: budgeted, UniqueKey: "account:1", Behavior: guber.Behavior_GLOBAL, Code: codes.ResourceExhausted},
+		{Name: "no peers", Instance: noPeers, UniqueKey: "account:0", Code: codes.Unavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			failed := &guber.RateLimitReq{
+				Name:      "test_error_codes",
+				UniqueKey: test.UniqueKey,
+				Algorithm: test.Algorithm,
+				Behavior:  test.Behavior,
+				Duration:  guber.Minute,
+				Limit:     10,
+				Hits:      1,
+			}
+			// Both a single rate limit and a batch where the failed rate limit is at index 1
+			for _, requests := range [][]*guber.RateLimitReq{
+				{failed},
+				{{Name: "test_error_codes", UniqueKey: "account:0", Duration: guber.Minute, Limit: 10}, failed},
+			} {
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				resp, err := test.Instance.GetRateLimits(ctx, &guber.GetRateLimitsReq{Requests: requests})
+				cancel()
+				require.Nil(t, err)
+
+				var partial *guber.PartialError
+				require.True(t, errors.As(resp.Err(), &partial), resp.Err())
+				idx := len(requests) - 1
+				if test.Instance == noPeers {
+					// Even the rate limit at index 0 has no owner
+					require.Len(t, partial.Errors, len(requests))
+				} else {
+					require.Len(t, partial.Errors, 1)
+				}
+
+				err = partial.Errors[idx]
+				assert.Equal(t, test.Code, status.Code(err), err)
+
+				details := status.Convert(err).Details()
+				require.Len(t, details, 1)
+				assert.Equal(t, fmt.Sprintf("requests[%d]", idx), details[0].(*errdetails.ResourceInfo).ResourceName)
+			}
+		})
+	}
+}
+
+// metadataPeer is a fake peer which attaches metadata to each response
+type metadataPeer struct {
+	slowPeer
+}
+
+func (p *metadataPeer) GetPeerRateLimits(ctx context.Context, r *guber.GetPeerRateLimitsReq) (*guber.GetPeerRateLimitsResp, error) {
+	resp, _ := p.slowPeer.GetPeerRateLimits(ctx, r)
+	for _, rl := range resp.RateLimits {
+		rl.Metadata = map[string]string{"region": "us-east-1"}
+	}
+	return resp, nil
+}
+
+func TestGetRateLimitsKeepsPeerMetadata(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	server := grpc.NewServer()
+	guber.RegisterPeersV1Server(server, &metadataPeer{})
+	go server.Serve(listener)
+	defer server.Stop()
+	addr := listener.Addr().String()
+
+	instance, err := guber.New(guber.Config{
+		GRPCServer: grpc.NewServer(),
+		Picker:     &modPicker{},
+	})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}, {Address: addr}})
+
+	var req guber.GetRateLimitsReq
+	for i := 1; i < 6; i += 2 {
+		req.Requests = append(req.Requests, &guber.RateLimitReq{
+			Name:      "test_keeps_peer_metadata",
+			UniqueKey: fmt.Sprintf("account:%d", i),
+			Duration:  guber.Minute,
+			Limit:     int64(i),
+		})
+	}
+
+	// Both the batched and the single rate limit paths add the owner to the metadata of the peer
+	resp, err := instance.GetRateLimits(context.Background(), &req)
+	require.Nil(t, err)
+	single, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+		Requests: req.Requests[:1],
+	})
+	require.Nil(t, err)
+
+	for i, rl := range append(resp.Responses, single.Responses...) {
+		assert.Empty(t, rl.Error, i)
+		assert.Equal(t, map[string]string{"region": "us-east-1", "owner": addr}, rl.Metadata, i)
+	}
+	assert.Equal(t, int64(3), resp.Responses[1].Limit)
+}
+
+// Fills an instance with far more rate limits than the memory budget holds, see
+// cache.TestBudgetStress for a measure of the heap held by a budgeted cache.
+func TestMemoryBudget(t *testing.T) {
+	instance, err := guber.New(guber.Config{
+		GRPCServer:   grpc.NewServer(),
+		CacheSize:    1000000,
+		MemoryBudget: 1 << 20,
+	})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(instance)
+	utilization := func() float64 {
+		families, err := reg.Gather()
+		require.Nil(t, err)
+		for _, f := range families {
+			if f.GetName() == "memory_budget_utilization" {
+				return f.Metric[0].Gauge.GetValue()
+			}
+		}
+		t.Fatal("memory_budget_utilization metric not found")
+		return 0
+	}
+	assert.Equal(t, float64(0), utilization())
+
+	// Unbounded these would hold roughly 3MB
+	for i := 0; i < 10000; i++ {
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_memory_budget",
+					UniqueKey: fmt.Sprintf("account:%d", i),
+					Duration:  guber.Minute,
+					Limit:     10,
+					Hits:      1,
+				},
+			},
+		})
+		require.Nil(t, err)
+		require.Empty(t, resp.Responses[0].Error)
+	}
+
+	// The oldest rate limits were evicted to stay within the budget
+	assert.True(t, utilization() <= 1)
+	assert.True(t, utilization() > 0.9)
+}
+
+func TestMemoryBudgetRejectsBatches(t *testing.T) {
+	addr, stop := startSlowPeer(t, 0)
+	defer stop()
+
+	// Too small to queue a single request
+	instance, err := guber.New(guber.Config{
+		GRPCServer:   grpc.NewServer(),
+		MemoryBudget: 64,
+		Picker:       &modPicker{},
+	})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}, {Address: addr}})
+
+	hit := func(behavior guber.Behavior) *guber.RateLimitResp {
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_memory_budget_rejects_batches",
+					UniqueKey: "account:1",
+					Behavior:  behavior,
+					Duration:  guber.Minute,
+					Limit:     10,
+					Hits:      1,
+				},
+			},
+		})
+		require.Nil(t, err)
+		return resp.Responses[0]
+	}
+
+	rl := hit(guber.Behavior_BATCHING)
+	assert.Contains(t, rl.Error, "ResourceExhausted")
+	assert.Equal(t, addr, rl.Metadata["owner"])
+
+	// Requests which are not queued are unaffected
+	rl = hit(guber.Behavior_NO_BATCHING)
+	assert.Empty(t, rl.Error)
+	assert.Equal(t, int64(10), rl.Limit)
+}
+
+// Run with -race; concurrent requests for the same rate limits must not share the state held by the
+// cache with the caller, nor modify the requests of the caller once they return.
+func TestConcurrentRequests(t *testing.T) {
+	for _, mode := range []string{"SingleCache", "WorkerPool"} {
+		t.Run(mode, func(t *testing.T) {
+			conf := guber.Config{
+				GRPCServer: grpc.NewServer(),
+				Behaviors: guber.BehaviorConfig{
+					GlobalSyncWait: time.Millisecond,
+				},
+			}
+			if mode == "SingleCache" {
+				conf.Cache = cache.NewLRUCache(0)
+			}
+			instance, err := guber.New(conf)
+			require.Nil(t, err)
+			defer instance.Close()
+			instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+
+			registry := prometheus.NewRegistry()
+			require.Nil(t, registry.Register(instance))
+
+			behaviors := []guber.Behavior{guber.Behavior_NO_BATCHING, guber.Behavior_GLOBAL}
+			algorithms := []guber.Algorithm{guber.Algorithm_TOKEN_BUCKET, guber.Algorithm_LEAKY_BUCKET}
+
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 200; i++ {
+						req := &guber.RateLimitReq{
+							Name:      "test_concurrent_requests",
+							UniqueKey: fmt.Sprintf("account:%d", i%5),
+							Behavior:  behaviors[i%2],
+							Algorithm: algorithms[(i/10)%2],
+							Duration:  guber.Minute,
+							Limit:     100,
+							Hits:      1,
+						}
+						resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+							Requests: []*guber.RateLimitReq{req},
+						})
+						require.Nil(t, err)
+
+						// Read the response and request after another request may have updated the rate limit
+						rl := resp.Responses[0]
+						assert.Empty(t, rl.Error)
+						assert.True(t, rl.Remaining <= rl.Limit)
+						assert.Equal(t, int64(1), req.Hits)
+					}
+				}(g)
+			}
+
+			done := make(chan struct{})
+			gathered := make(chan struct{})
+			go func() {
+				defer close(gathered)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					_, err := registry.Gather()
+					assert.Nil(t, err)
+				}
+			}()
+
+			wg.Wait()
+			close(done)
+			<-gathered
+		})
+	}
+}
+
+// The owner of a GLOBAL rate limit computes the reset time with its own clock, a peer whose clock
+// is ahead by more than the duration must not treat the status broadcast by the owner as expired.
+func TestClockSkew(t *testing.T) {
+	hook := &logtest.Hook{}
+	hooks := logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	defer logrus.StandardLogger().ReplaceHooks(hooks)
+	logrus.AddHook(hook)
+
+	// The clock of the second instance is 5 seconds behind the first
+	now := time.Now()
+	clocks := []*holster.FrozenClock{{CurrentTime: now}, {CurrentTime: now.Add(-5 * time.Second)}}
+
+	var instances []*guber.Instance
+	var servers []*grpc.Server
+	var peers []guber.PeerInfo
+	defer func() {
+		// Stop serving peers before closing the instances they would call
+		for i := range instances {
+			servers[i].Stop()
+		}
+		for _, instance := range instances {
+			instance.Close()
+		}
+	}()
+	for _, clock := range clocks {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+
+		server := grpc.NewServer()
+		instance, err := guber.New(guber.Config{
+			GRPCServer: server,
+			Clock:      clock,
+			Picker:     &modPicker{},
+			Behaviors: guber.BehaviorConfig{
+				GlobalSyncWait: time.Millisecond,
+			},
+		})
+		require.Nil(t, err)
+		go server.Serve(listener)
+
+		instances = append(instances, instance)
+		servers = append(servers, server)
+		peers = append(peers, guber.PeerInfo{Address: listener.Addr().String()})
+	}
+	for i, instance := range instances {
+		var info []guber.PeerInfo
+		for j, peer := range peers {
+			info = append(info, guber.PeerInfo{Address: peer.Address, IsOwner: i == j})
+		}
+		instance.SetPeers(info)
+	}
+
+	// The modPicker assigns account:1 to the second instance
+	hit := func(instance *guber.Instance, hits int64) *guber.RateLimitResp {
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_clock_skew",
+					UniqueKey: "account:1",
+					Behavior:  guber.Behavior_GLOBAL,
+					Duration:  guber.Second * 3,
+					Limit:     10,
+					Hits:      hits,
+				},
+			},
+		})
+		require.Nil(t, err)
+		require.Empty(t, resp.Responses[0].Error)
+		return resp.Responses[0]
+	}
+	assert.Equal(t, int64(5), hit(instances[1], 5).Remaining)
+
+	// The duration of the rate limit is shorter than the skew, which is worth a warning once the first
+	// instance has sent its hits to the owner
+	warned := func() bool {
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "clock skew") {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Without converting the reset time to its own clock, the status broadcast by the owner expired
+	// 2 seconds before it arrived and the first instance reports a fresh rate limit instead.
+	var rl *guber.RateLimitResp
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if rl = hit(instances[0], 0); rl.Remaining == 5 && warned() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(5), rl.Remaining)
+	assert.Equal(t, now.UnixNano()/int64(time.Millisecond)+3000, rl.ResetTime)
+	assert.True(t, warned(), "expected a warning about the clock skew")
+
+	// Each instance measured the skew with the other
+	skew := func(instance *guber.Instance, peer string) float64 {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(instance)
+		families, err := reg.Gather()
+		require.Nil(t, err)
+		for _, f := range families {
+			if f.GetName() != "peer_clock_skew_seconds" {
+				continue
+			}
+			for _, m := range f.Metric {
+				if m.Label[0].GetValue() == peer {
+					return m.Gauge.GetValue()
+				}
+			}
+		}
+		t.Fatalf("peer_clock_skew_seconds metric not found for peer '%s'", peer)
+		return 0
+	}
+	assert.InDelta(t, -5, skew(instances[0], peers[1].Address), 0.001)
+	assert.InDelta(t, 5, skew(instances[1], peers[0].Address), 0.001)
+}
+
+func TestRateLimitBounds(t *testing.T) {
+	instance, err := guber.New(guber.Config{
+		GRPCServer:  grpc.NewServer(),
+		MinDuration: time.Millisecond,
+		MaxDuration: time.Hour,
+		MaxLimit:    1000,
+	})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+
+	tests := []struct {
+		Name     string
+		Duration int64
+		Limit    int64
+		Hits     int64
+		Error    string
+	}{
+		{Name: "min duration", Duration: 1, Limit: 10, Hits: 1},
+		{Name: "max duration", Duration: guber.Minute * 60, Limit: 10, Hits: 1},
+		{Name: "below min duration", Duration: 0, Limit: 10, Hits: 1, Error: "field 'duration'"},
+		{Name: "above max duration", Duration: guber.Minute*60 + 1, Limit: 10, Hits: 1, Error: "field 'duration'"},
+		{Name: "negative duration", Duration: -1, Limit: 10, Hits: 1, Error: "field 'duration'"},
+		{Name: "zero limit", Duration: guber.Minute, Limit: 0, Hits: 1},
+		{Name: "max limit", Duration: guber.Minute, Limit: 1000, Hits: 1000},
+		{Name: "negative limit", Duration: guber.Minute, Limit: -1, Hits: 1, Error: "field 'limit'"},
+		{Name: "above max limit", Duration: guber.Minute, Limit: 1001, Hits: 1, Error: "field 'limit'"},
+		{Name: "negative hits", Duration: guber.Minute, Limit: 10, Hits: -1, Error: "field 'hits'"},
+		{Name: "above max hits", Duration: guber.Minute, Limit: 10, Hits: 1001, Error: "field 'hits'"},
+	}
+
+	for i, test := range tests {
+		for _, algo := range []guber.Algorithm{guber.Algorithm_TOKEN_BUCKET, guber.Algorithm_LEAKY_BUCKET} {
+			resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+				Requests: []*guber.RateLimitReq{
+					{
+						Name:      "test_rate_limit_bounds",
+						UniqueKey: fmt.Sprintf("account:%d", i),
+						Algorithm: algo,
+						Duration:  test.Duration,
+						Limit:     test.Limit,
+						Hits:      test.Hits,
+					},
+				},
+			})
+			require.Nil(t, err)
+
+			rl := resp.Responses[0]
+			if test.Error == "" {
+				assert.Empty(t, rl.Error, "%s %s", test.Name, algo)
+				continue
+			}
+			assert.Contains(t, rl.Error, "InvalidArgument", "%s %s", test.Name, algo)
+			assert.Contains(t, rl.Error, test.Error, "%s %s", test.Name, algo)
+		}
+	}
+}
+
+// Every combination of the defined behavior flags, and a flag which isn't defined yet
+func TestBehaviorCombinations(t *testing.T) {
+	newInstance := func(ignoreUnknown bool) *guber.Instance {
+		instance, err := guber.New(guber.Config{GRPCServer: grpc.NewServer(), IgnoreUnknownBehaviors: ignoreUnknown})
+		require.Nil(t, err)
+		instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+		return instance
+	}
+	strict, lenient := newInstance(false), newInstance(true)
+	defer strict.Close()
+	defer lenient.Close()
+
+	const unknown = guber.Behavior(1 << 10)
+	flags := []guber.Behavior{guber.Behavior_NO_BATCHING, guber.Behavior_GLOBAL, guber.Behavior_REBASE_DURATION,
+		guber.Behavior_NO_CLIENT_CACHE}
+
+	for combination := 0; combination < 1<<len(flags); combination++ {
+		var behavior guber.Behavior
+		for i, flag := range flags {
+			if combination&(1<<i) != 0 {
+				behavior |= flag
+			}
+		}
+		conflict := guber.HasBehavior(behavior, guber.Behavior_GLOBAL) && guber.HasBehavior(behavior, guber.Behavior_NO_BATCHING)
+
+		for _, test := range []struct {
+			Instance *guber.Instance
+			Behavior guber.Behavior
+			Error    string
+		}{
+			{Instance: strict, Behavior: behavior},
+			{Instance: strict, Behavior: behavior | unknown, Error: "unknown flags '0x400'"},
+			{Instance: lenient, Behavior: behavior | unknown},
+		} {
+			if conflict && test.Error == "" {
+				test.Error = "behavior 'GLOBAL' cannot be combined with 'NO_BATCHING'"
+			}
+
+			resp, err := test.Instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+				Requests: []*guber.RateLimitReq{
+					{
+						Name:      "test_behavior_combinations",
+						UniqueKey: fmt.Sprintf("account:%d", test.Behavior),
+						Behavior:  test.Behavior,
+						Duration:  guber.Minute,
+						Limit:     10,
+						Hits:      1,
+					},
+				},
+			})
+			require.Nil(t, err)
+
+			rl := resp.Responses[0]
+			if test.Error == "" {
+				assert.Empty(t, rl.Error, "behavior %#x", test.Behavior)
+				assert.Equal(t, int64(9), rl.Remaining, "behavior %#x", test.Behavior)
+				continue
+			}
+			assert.Contains(t, rl.Error, "InvalidArgument", "behavior %#x", test.Behavior)
+			assert.Contains(t, rl.Error, test.Error, "behavior %#x", test.Behavior)
+		}
+	}
+}
+
+// A duration of math.MaxInt64 used to overflow the expiration into the past, such that every request
+// for the rate limit was over the limit until the rate limit was evicted.
+func TestRateLimitDurationOverflow(t *testing.T) {
+	instance, err := guber.New(guber.Config{GRPCServer: grpc.NewServer()})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+
+	hit := func(algo guber.Algorithm, duration, limit int64) *guber.RateLimitResp {
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_rate_limit_duration_overflow",
+					UniqueKey: "account:" + algo.String(),
+					Algorithm: algo,
+					Duration:  duration,
+					Limit:     limit,
+					Hits:      1,
+				},
+			},
+		})
+		require.Nil(t, err)
+		return resp.Responses[0]
+	}
+
+	for _, algo := range []guber.Algorithm{guber.Algorithm_TOKEN_BUCKET, guber.Algorithm_LEAKY_BUCKET} {
+		rl := hit(algo, math.MaxInt64, 10)
+		assert.Contains(t, rl.Error, "InvalidArgument", algo)
+		assert.Contains(t, rl.Error, "field 'duration'", algo)
+
+		// The rejected request did not poison the rate limit
+		rl = hit(algo, guber.Minute, 10)
+		assert.Empty(t, rl.Error, algo)
+		assert.Equal(t, guber.Status_UNDER_LIMIT, rl.Status, algo)
+		assert.Equal(t, int64(9), rl.Remaining, algo)
+	}
+}
+
+// A leaky bucket with a limit greater than its duration in milliseconds, or a limit of zero,
+// used to divide by zero
+func TestLeakyBucketRate(t *testing.T) {
+	instance, err := guber.New(guber.Config{GRPCServer: grpc.NewServer()})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+
+	for _, limit := range []int64{0, 1000000} {
+		for i := 0; i < 2; i++ {
+			resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+				Requests: []*guber.RateLimitReq{
+					{
+						Name:      "test_leaky_bucket_rate",
+						UniqueKey: fmt.Sprintf("account:%d", limit),
+						Algorithm: guber.Algorithm_LEAKY_BUCKET,
+						Duration:  guber.Second,
+						Limit:     limit,
+						Hits:      1,
+					},
+				},
+			})
+			require.Nil(t, err)
+			assert.Empty(t, resp.Responses[0].Error)
+			assert.Equal(t, limit, resp.Responses[0].Limit)
+		}
+	}
+}
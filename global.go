@@ -18,21 +18,43 @@ package gubernator
 
 import (
 	"context"
+	"sync"
+	"time"
+
 	"github.com/mailgun/holster"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
-	"time"
 )
 
 // globalManager manages async hit queue and updates peers in
 // the cluster periodically when a global rate limit we own updates.
+//
+// The hits of a GLOBAL rate limit are sent to its owner as deltas. Each request of hits to an owner is
+// numbered by the next sequence of this instance for the owner, and is retransmitted until the owner
+// acknowledges it before the next request is sent. The owner applies each sequence once, as such hits
+// are never lost to a request which timed out nor counted twice when a request which timed out was
+// applied after all. Each hit is tagged with the generation of the rate limit it was counted against,
+// the owner discards the hits of a window which has since ended rather than count them against the
+// next window.
 type globalManager struct {
-	asyncQueue     chan *RateLimitReq
+	asyncQueue     chan globalHit
 	broadcastQueue chan *RateLimitReq
 	wg             holster.WaitGroup
-	conf           BehaviorConfig
-	log            *logrus.Entry
-	instance       *Instance
+	// Closed by Close(), such that requests no longer wait on the queues nobody reads
+	closed   chan struct{}
+	conf     BehaviorConfig
+	log      *logrus.Entry
+	instance *Instance
+
+	// Queued requests are held until sent, so their names are interned
+	names *InternTable
+
+	// Identifies this run of the instance to the owners of its hits, see GetPeerRateLimitsReq.epoch
+	epoch int64
+	// The hits sent to each owner by host, only accessed by runAsyncHits()
+	streams map[string]*hitStream
+	// The last sequence of hits applied from each peer which sent hits to this instance
+	sequences *sequenceTracker
 
 	asyncMetrics     prometheus.Histogram
 	broadcastMetrics prometheus.Histogram
@@ -49,46 +71,114 @@ func newGlobalManager(conf BehaviorConfig, instance *Instance) *globalManager {
 			Name: "broadcast_durations",
 			Help: "The duration of GLOBAL broadcasts to peers in seconds.",
 		}),
-		asyncQueue:     make(chan *RateLimitReq, 0),
+		asyncQueue:     make(chan globalHit, 0),
 		broadcastQueue: make(chan *RateLimitReq, 0),
+		closed:         make(chan struct{}),
 		instance:       instance,
 		conf:           conf,
+		names:          NewInternTable(maxInternedNames),
+		epoch:          time.Now().UnixNano(),
+		streams:        make(map[string]*hitStream),
+		sequences:      newSequenceTracker(),
 	}
 	gm.runAsyncHits()
 	gm.runBroadcasts()
 	return &gm
 }
 
-func (gm *globalManager) QueueHit(r *RateLimitReq) {
-	gm.asyncQueue <- r
+// globalHit is a request queued for the owner of the rate limit, with the generation of the rate limit
+// its hits were counted against
+type globalHit struct {
+	req        *RateLimitReq
+	generation int64
+}
+
+// hitKey identifies the aggregate of the hits of a rate limit counted against the same generation
+type hitKey struct {
+	key        string
+	generation int64
 }
 
+// hitStream is the state of the hits sent to a single owner
+type hitStream struct {
+	// The sequence of the last request sent
+	sequence uint64
+	// The last request sent if the owner did not acknowledge it yet, else nil
+	unacked *GetPeerRateLimitsReq
+}
+
+// QueueHit queues the hits of the request to be sent to the owning peer, tagged with the generation of
+// the rate limit they were counted against. Returns an error if the hits can not be queued without
+// exceeding the memory budget, or errPoolClosed once the manager is closed.
+func (gm *globalManager) QueueHit(r *RateLimitReq, generation int64) error {
+	b := gm.instance.budget
+	if b != nil && !b.Reserve(requestWeight(r)) {
+		return errBudgetExhausted
+	}
+	r.Name = gm.names.Intern(r.Name)
+	select {
+	case gm.asyncQueue <- globalHit{req: r, generation: generation}:
+		return nil
+	case <-gm.closed:
+		if b != nil {
+			b.Release(requestWeight(r))
+		}
+		return errPoolClosed
+	}
+}
+
+// QueueUpdate queues the status of the request to be broadcast to the peers, the update is dropped once
+// the manager is closed
 func (gm *globalManager) QueueUpdate(r *RateLimitReq) {
-	gm.broadcastQueue <- r
+	r.Name = gm.names.Intern(r.Name)
+	select {
+	case gm.broadcastQueue <- r:
+	case <-gm.closed:
+	}
 }
 
 // runAsyncHits collects async hit requests and queues them to
 // be sent to their owning peers.
 func (gm *globalManager) runAsyncHits() {
 	var interval = NewInterval(gm.conf.GlobalSyncWait)
-	hits := make(map[string]*RateLimitReq)
+	hits := make(map[hitKey]*RateLimitReq)
+	// The number of hits held back by the last send, see sendHits()
+	var held int
+
+	// send sends the hits collected and keeps those held back for the next interval
+	send := func() {
+		hits = gm.sendHits(hits)
+		held = len(hits)
+		if held != 0 || gm.unacked() {
+			interval.Next()
+		}
+	}
 
 	gm.wg.Until(func(done chan struct{}) bool {
 		select {
-		case r := <-gm.asyncQueue:
+		case h := <-gm.asyncQueue:
+			r := h.req
 			// Aggregate the hits into a single request
-			key := r.HashKey()
-			_, ok := hits[key]
+			key := hitKey{key: r.HashKey(), generation: h.generation}
+			agg, ok := hits[key]
 			if ok {
-				hits[key].Hits += r.Hits
+				// The aggregate is over any limit once it reaches the max, clamp it such that it can't
+				// overflow or be rejected by the owner
+				if maxHits := gm.instance.limits.maxLimit; agg.Hits > maxHits-r.Hits {
+					agg.Hits = maxHits
+				} else {
+					agg.Hits += r.Hits
+				}
+				gm.release(r)
 			} else {
-				hits[key] = r
+				// The caller may still be using the request, aggregate the hits into a copy
+				cpy := *r
+				hits[key] = &cpy
 			}
 
 			// Send the hits if we reached our batch limit
-			if len(hits) == gm.conf.GlobalBatchLimit {
-				gm.sendHits(hits)
-				hits = make(map[string]*RateLimitReq)
+			if len(hits)-held == gm.conf.GlobalBatchLimit {
+				send()
 				return true
 			}
 
@@ -99,59 +189,213 @@ func (gm *globalManager) runAsyncHits() {
 			}
 
 		case <-interval.C:
-			if len(hits) != 0 {
-				gm.sendHits(hits)
-				hits = make(map[string]*RateLimitReq)
+			if len(hits) != 0 || gm.unacked() {
+				send()
 			}
 		case <-done:
+			interval.Stop()
 			return false
 		}
 		return true
 	})
 }
 
-// sendHits takes the hits collected by runAsyncHits and sends them to their
-// owning peers
-func (gm *globalManager) sendHits(hits map[string]*RateLimitReq) {
-	type pair struct {
-		client *PeerClient
-		req    GetPeerRateLimitsReq
+// sendHits takes the hits collected by runAsyncHits and sends them to their owning peers. An owner which
+// did not acknowledge the last request sent to it is sent that request again first. The hits for an
+// owner which still doesn't acknowledge it are held back and returned, such that they are sent with the
+// hits of the next interval; to the peer which owns them by then.
+func (gm *globalManager) sendHits(hits map[hitKey]*RateLimitReq) map[hitKey]*RateLimitReq {
+	type pending struct {
+		keys []hitKey
+		req  GetPeerRateLimitsReq
 	}
-	peerRequests := make(map[string]*pair)
+	peerRequests := make(map[string]*pending)
 	start := time.Now()
 
 	// Assign each request to a peer
-	for _, r := range hits {
-		peer, err := gm.instance.GetPeer(r.HashKey())
+	for k, r := range hits {
+		peer, err := gm.instance.GetPeer(k.key)
 		if err != nil {
-			gm.log.WithError(err).Errorf("while getting peer for hash key '%s'", r.HashKey())
+			gm.log.WithError(err).Errorf("while getting peer for hash key '%s'", k.key)
+			gm.release(r)
 			continue
 		}
 
 		p, ok := peerRequests[peer.host]
-		if ok {
-			p.req.Requests = append(p.req.Requests, r)
-		} else {
-			peerRequests[peer.host] = &pair{
-				client: peer,
-				req:    GetPeerRateLimitsReq{Requests: []*RateLimitReq{r}},
-			}
+		if !ok {
+			p = &pending{}
+			peerRequests[peer.host] = p
 		}
+		p.keys = append(p.keys, k)
+		p.req.Requests = append(p.req.Requests, r)
+		p.req.Generations = append(p.req.Generations, k.generation)
 	}
 
+	peers := gm.instance.GetPeerList()
+	current := make(map[string]struct{}, len(peers))
+	held := make(map[hitKey]*RateLimitReq)
+
 	// Send the rate limit requests to their respective owning peers.
+	for _, peer := range peers {
+		current[peer.host] = struct{}{}
+		p, ok := peerRequests[peer.host]
+		delete(peerRequests, peer.host)
+
+		s, found := gm.streams[peer.host]
+		if !found {
+			if !ok {
+				continue
+			}
+			s = &hitStream{}
+			gm.streams[peer.host] = s
+		}
+
+		if s.unacked != nil && !gm.transmit(peer, s) {
+			if ok {
+				for i, k := range p.keys {
+					held[k] = p.req.Requests[i]
+				}
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		for _, r := range p.req.Requests {
+			gm.release(r)
+		}
+		s.sequence++
+		p.req.Sequence, p.req.Epoch = s.sequence, gm.epoch
+		s.unacked = &p.req
+		gm.transmit(peer, s)
+	}
+
+	// The peer list changed since the peers were assigned, the hits are assigned again on the next send
 	for _, p := range peerRequests {
-		ctx, cancel := context.WithTimeout(context.Background(), gm.conf.GlobalTimeout)
-		_, err := p.client.GetPeerRateLimits(ctx, &p.req)
-		cancel()
+		for i, k := range p.keys {
+			held[k] = p.req.Requests[i]
+		}
+	}
 
-		if err != nil {
-			gm.log.WithError(err).
-				Errorf("error sending global hits to '%s'", p.client.host)
+	// The hits not yet acknowledged by a peer which left the cluster are lost
+	for host, s := range gm.streams {
+		if _, ok := current[host]; ok {
 			continue
 		}
+		if s.unacked != nil {
+			gm.log.Errorf("dropped '%d' global hits never acknowledged by '%s'; the peer left the cluster",
+				len(s.unacked.Requests), host)
+		}
+		delete(gm.streams, host)
 	}
+
 	gm.asyncMetrics.Observe(time.Since(start).Seconds())
+	return held
+}
+
+// transmit sends the request of hits the owner did not acknowledge yet. Returns true once the owner
+// acknowledges the request.
+func (gm *globalManager) transmit(peer *PeerClient, s *hitStream) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), gm.conf.GlobalTimeout)
+	resp, err := peer.GetPeerRateLimits(ctx, s.unacked)
+	cancel()
+
+	if err != nil {
+		gm.log.WithError(err).
+			Errorf("error sending global hits to '%s'; retrying on the next interval", peer.host)
+		return false
+	}
+
+	// A peer older than the sequences applies every request it receives, its response is all the
+	// acknowledgement there will be. A peer which acknowledges an earlier sequence rejected the
+	// request as sent by an earlier run of this instance; sending it again won't change that.
+	if resp.AckedSequence < s.unacked.Sequence && peer.hasCapability(capGlobalSequences) {
+		gm.log.Errorf("'%s' discarded '%d' global hits as sent by an earlier run of this instance",
+			peer.host, len(s.unacked.Requests))
+	}
+	s.unacked = nil
+	return true
+}
+
+// unacked returns true if a request of hits was not acknowledged by its owner
+func (gm *globalManager) unacked() bool {
+	for _, s := range gm.streams {
+		if s.unacked != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops sending hits and broadcasts and waits for any in progress to complete
+func (gm *globalManager) Close() {
+	gm.wg.Stop()
+	close(gm.closed)
+}
+
+// sequenceTracker remembers the last sequence of hits applied from each peer, such that a peer can send
+// hits again which it doesn't know were applied without them being counted twice.
+//
+// sequenceTracker is safe for concurrent use.
+type sequenceTracker struct {
+	mutex   sync.Mutex
+	senders map[string]*senderSequence // protected by mutex
+}
+
+type senderSequence struct {
+	epoch   int64
+	applied uint64
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{senders: make(map[string]*senderSequence)}
+}
+
+// advance records that the hits numbered by the sequence of `sender` are applied. Returns false if the
+// hits were already applied, or were sent by an earlier run of the sender than the last run seen; the
+// hits of an earlier run might have been applied before the tracker forgot about them. Also returns
+// the last sequence of the sender applied, which acknowledges the sequence to the sender.
+//
+// A sender only sends the next sequence once the last one is acknowledged, as such any sequence after
+// the last one applied was not applied; even if the tracker missed sequences as it forgot the sender.
+func (t *sequenceTracker) advance(sender string, epoch int64, sequence uint64) (bool, uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	s, ok := t.senders[sender]
+	if !ok || epoch > s.epoch {
+		t.senders[sender] = &senderSequence{epoch: epoch, applied: sequence}
+		return true, sequence
+	}
+	if epoch < s.epoch || sequence <= s.applied {
+		return false, s.applied
+	}
+	s.applied = sequence
+	return true, sequence
+}
+
+// setPeers forgets the peers which left the cluster
+func (t *sequenceTracker) setPeers(peers []PeerInfo) {
+	current := make(map[string]struct{}, len(peers))
+	for _, peer := range peers {
+		current[peer.Address] = struct{}{}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for sender := range t.senders {
+		if _, ok := current[sender]; !ok {
+			delete(t.senders, sender)
+		}
+	}
+}
+
+// release releases the memory budget reserved by a queued request
+func (gm *globalManager) release(r *RateLimitReq) {
+	if b := gm.instance.budget; b != nil {
+		b.Release(requestWeight(r))
+	}
 }
 
 // runBroadcasts collects status changes for global rate limits and broadcasts the changes to each peer in the cluster.
@@ -162,7 +406,15 @@ func (gm *globalManager) runBroadcasts() {
 	gm.wg.Until(func(done chan struct{}) bool {
 		select {
 		case r := <-gm.broadcastQueue:
-			updates[r.HashKey()] = r
+			key := r.HashKey()
+			if _, ok := updates[key]; !ok {
+				// Drop the update rather than exceed the memory budget, the next
+				// update of the rate limit broadcasts its current status anyway
+				if b := gm.instance.budget; b != nil && !b.Reserve(requestWeight(r)) {
+					return true
+				}
+			}
+			updates[key] = r
 
 			// Send the hits if we reached our batch limit
 			if len(updates) == gm.conf.GlobalBatchLimit {
@@ -183,6 +435,7 @@ func (gm *globalManager) runBroadcasts() {
 				updates = make(map[string]*RateLimitReq)
 			}
 		case <-done:
+			interval.Stop()
 			return false
 		}
 		return true
@@ -191,24 +444,29 @@ func (gm *globalManager) runBroadcasts() {
 
 // updatePeers broadcasts global rate limit statuses to all other peers
 func (gm *globalManager) updatePeers(updates map[string]*RateLimitReq) {
-	var req UpdatePeerGlobalsReq
+	req := UpdatePeerGlobalsReq{Sender: gm.instance.skew.sender()}
 	start := time.Now()
 
-	for _, rl := range updates {
-		// We are only sending the status of the rate limit so
-		// we clear the behavior flag so we don't get queued for update again.
-		rl.Behavior = 0
+	for _, r := range updates {
+		gm.release(r)
+
+		// We are only sending the status of the rate limit so we clear the GLOBAL flag so we don't
+		// get queued for update again. The other flags are kept, as DRY_RUN is part of the key of the
+		// rate limit. The caller may still be using the request, modify a copy.
+		rl := *r
+		rl.Behavior &^= Behavior_GLOBAL
 		rl.Hits = 0
 
-		status, err := gm.instance.getRateLimit(rl)
+		status, err := gm.instance.getRateLimit(&rl)
 		if err != nil {
 			gm.log.WithError(err).Errorf("while sending global updates to peers for: '%s'", rl.HashKey())
 			continue
 		}
 		// Build an UpdatePeerGlobalsReq
 		req.Globals = append(req.Globals, &UpdatePeerGlobal{
-			Key:    rl.HashKey(),
-			Status: status,
+			Key:        rl.HashKey(),
+			Status:     status,
+			Generation: gm.instance.generation(rl.HashKey()),
 		})
 	}
 
@@ -218,6 +476,8 @@ func (gm *globalManager) updatePeers(updates map[string]*RateLimitReq) {
 			continue
 		}
 
+		// Stamp each send with the local time such that the peer can convert the reset times to its clock
+		req.SenderTime = gm.instance.skew.now()
 		ctx, cancel := context.WithTimeout(context.Background(), gm.conf.GlobalTimeout)
 		_, err := peer.UpdatePeerGlobals(ctx, &req)
 		cancel()
@@ -0,0 +1,304 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/mailgun/holster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// lockedClock is a holster.FrozenClock which is safe for concurrent use, as the owner reads the clock
+// to broadcast the status of GLOBAL rate limits while the test advances it
+type lockedClock struct {
+	mutex  sync.Mutex
+	frozen holster.FrozenClock
+}
+
+func (c *lockedClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.frozen.Now()
+}
+
+func (c *lockedClock) Sleep(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.frozen.Sleep(d)
+}
+
+func (c *lockedClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.frozen.After(d)
+}
+
+// The owner applies each sequence of GLOBAL hits from a peer once, and discards the hits counted against
+// a window which has ended
+func TestGlobalHitSequences(t *testing.T) {
+	clock := &lockedClock{frozen: holster.FrozenClock{CurrentTime: time.Now()}}
+	owner, err := guber.New(guber.Config{GRPCServer: grpc.NewServer(), Clock: clock})
+	require.Nil(t, err)
+	defer owner.Close()
+
+	now := func() int64 {
+		return clock.Now().UnixNano() / int64(time.Millisecond)
+	}
+	first := now()
+
+	tests := []struct {
+		Name       string
+		Epoch      int64
+		Sequence   uint64
+		Hits       int64
+		Generation int64
+		Sleep      time.Duration
+		Remaining  int64
+		Acked      uint64
+	}{
+		{Name: "first hits", Epoch: 1, Sequence: 1, Hits: 5, Remaining: 95, Acked: 1},
+		{Name: "retransmitted", Epoch: 1, Sequence: 1, Hits: 5, Remaining: 95, Acked: 1},
+		{Name: "next sequence", Epoch: 1, Sequence: 2, Hits: 3, Remaining: 92, Acked: 2},
+		{Name: "late duplicate", Epoch: 1, Sequence: 1, Hits: 5, Remaining: 92, Acked: 2},
+		{Name: "sender restarted", Epoch: 2, Sequence: 1, Hits: 1, Remaining: 91, Acked: 1},
+		{Name: "earlier run of the sender", Epoch: 1, Sequence: 3, Hits: 5, Remaining: 91, Acked: 1},
+		{Name: "current generation", Epoch: 2, Sequence: 2, Hits: 1, Generation: first, Remaining: 90, Acked: 2},
+		{
+			Name:       "generation expired",
+			Epoch:      2,
+			Sequence:   3,
+			Hits:       4,
+			Generation: first,
+			Sleep:      2 * time.Minute,
+			Remaining:  100,
+			Acked:      3,
+		},
+		{Name: "generation superseded", Epoch: 2, Sequence: 4, Hits: 4, Generation: first, Remaining: 100, Acked: 4},
+		{Name: "unknown generation", Epoch: 2, Sequence: 5, Hits: 2, Remaining: 98, Acked: 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			clock.Sleep(test.Sleep)
+			resp, err := owner.GetPeerRateLimits(context.Background(), &guber.GetPeerRateLimitsReq{
+				Requests: []*guber.RateLimitReq{
+					{
+						Name:      "test_global_hit_sequences",
+						UniqueKey: "account:1",
+						Behavior:  guber.Behavior_GLOBAL,
+						Duration:  guber.Minute,
+						Limit:     100,
+						Hits:      test.Hits,
+					},
+				},
+				Sender:      "10.0.0.1:81",
+				Sequence:    test.Sequence,
+				Epoch:       test.Epoch,
+				Generations: []int64{test.Generation},
+			})
+			require.Nil(t, err)
+			require.Empty(t, resp.RateLimits[0].Error)
+			assert.Equal(t, test.Remaining, resp.RateLimits[0].Remaining)
+			assert.Equal(t, test.Acked, resp.AckedSequence)
+		})
+	}
+}
+
+// chaosPeer stands between the peers and the owner of a rate limit. It loses, duplicates and delays the
+// GLOBAL hits sent to the owner, such that they arrive out of order, and loses the responses of the owner.
+type chaosPeer struct {
+	owner guber.PeersV1Client
+	wg    sync.WaitGroup
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func (p *chaosPeer) roll(n int) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.rand.Intn(n)
+}
+
+// later delivers the request to the owner after a random delay
+func (p *chaosPeer) later(r *guber.GetPeerRateLimitsReq) {
+	delay := time.Duration(p.roll(50)) * time.Millisecond
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		time.Sleep(delay)
+		p.owner.GetPeerRateLimits(context.Background(), r)
+	}()
+}
+
+func (p *chaosPeer) GetPeerRateLimits(ctx context.Context, r *guber.GetPeerRateLimitsReq) (*guber.GetPeerRateLimitsResp, error) {
+	lost := status.Error(codes.Unavailable, "lost by the chaos peer")
+	if r.Sequence == 0 {
+		return p.owner.GetPeerRateLimits(ctx, r)
+	}
+
+	switch p.roll(8) {
+	case 0:
+		return nil, lost
+	case 1:
+		// Arrives after the sender gave up on it, perhaps even after the sequences which follow it
+		p.later(r)
+		return nil, lost
+	case 2:
+		p.later(r)
+		return p.owner.GetPeerRateLimits(ctx, r)
+	case 3:
+		// The owner applies the hits, but the sender never knows it did
+		if _, err := p.owner.GetPeerRateLimits(ctx, r); err != nil {
+			return nil, err
+		}
+		return nil, lost
+	}
+	return p.owner.GetPeerRateLimits(ctx, r)
+}
+
+func (p *chaosPeer) UpdatePeerGlobals(ctx context.Context, r *guber.UpdatePeerGlobalsReq) (*guber.UpdatePeerGlobalsResp, error) {
+	return p.owner.UpdatePeerGlobals(ctx, r)
+}
+
+// Whichever way the GLOBAL hits of the peers are lost, duplicated or reordered on their way to the owner,
+// the owner counts every hit exactly once
+func TestGlobalHitsConverge(t *testing.T) {
+	var servers []*grpc.Server
+	var instances []*guber.Instance
+	defer func() {
+		for _, server := range servers {
+			server.Stop()
+		}
+		for _, instance := range instances {
+			instance.Close()
+		}
+	}()
+	start := func() (*guber.Instance, string) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		server := grpc.NewServer()
+		instance, err := guber.New(guber.Config{
+			GRPCServer: server,
+			Picker:     &modPicker{},
+			Behaviors: guber.BehaviorConfig{
+				GlobalSyncWait: 5 * time.Millisecond,
+				GlobalTimeout:  time.Second,
+			},
+		})
+		require.Nil(t, err)
+		go server.Serve(listener)
+		servers = append(servers, server)
+		instances = append(instances, instance)
+		return instance, listener.Addr().String()
+	}
+
+	owner, ownerAddr := start()
+	conn, err := grpc.Dial(ownerAddr, grpc.WithInsecure())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	chaos := &chaosPeer{owner: guber.NewPeersV1Client(conn), rand: rand.New(rand.NewSource(1))}
+	server := grpc.NewServer()
+	guber.RegisterPeersV1Server(server, chaos)
+	go server.Serve(listener)
+	defer server.Stop()
+	chaosAddr := listener.Addr().String()
+
+	// The modPicker assigns account:1 to the second peer, which is the owner for the owner and the
+	// chaos peer in front of the owner for the other peers
+	var peers []*guber.Instance
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		instance, addr := start()
+		instance.SetPeers([]guber.PeerInfo{{Address: addr, IsOwner: true}, {Address: chaosAddr}})
+		peers = append(peers, instance)
+		addrs = append(addrs, addr)
+	}
+	owner.SetPeers([]guber.PeerInfo{
+		{Address: addrs[0]}, {Address: ownerAddr, IsOwner: true}, {Address: addrs[1]}, {Address: addrs[2]},
+	})
+
+	req := func(hits int64) *guber.RateLimitReq {
+		return &guber.RateLimitReq{
+			Name:      "test_global_hits_converge",
+			UniqueKey: "account:1",
+			Behavior:  guber.Behavior_GLOBAL,
+			Duration:  guber.Minute * 60,
+			Limit:     1000000,
+			Hits:      hits,
+		}
+	}
+
+	var wg sync.WaitGroup
+	totals := make([]int64, len(peers))
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer *guber.Instance) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				hits := int64(j%5 + 1)
+				resp, err := peer.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+					Requests: []*guber.RateLimitReq{req(hits)},
+				})
+				if !assert.Nil(t, err) || !assert.Empty(t, resp.Responses[0].Error) {
+					return
+				}
+				totals[i] += hits
+				time.Sleep(time.Millisecond)
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+
+	var total int64
+	for _, hits := range totals {
+		total += hits
+	}
+
+	consumed := func() int64 {
+		resp, err := owner.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{req(0)},
+		})
+		require.Nil(t, err)
+		require.Empty(t, resp.Responses[0].Error)
+		return resp.Responses[0].Limit - resp.Responses[0].Remaining
+	}
+
+	// The peers send their hits again until the owner acknowledges them
+	for deadline := time.Now().Add(10 * time.Second); consumed() != total && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, total, consumed())
+
+	// The duplicates which arrive last are not counted either
+	chaos.wg.Wait()
+	assert.Equal(t, total, consumed())
+}
@@ -19,9 +19,11 @@ package gubernator
 import (
 	"context"
 	"fmt"
+	"github.com/mailgun/gubernator/cache"
 	"github.com/prometheus/client_golang/prometheus"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/mailgun/holster"
 	"github.com/pkg/errors"
@@ -44,6 +46,51 @@ type Instance struct {
 	global    *globalManager
 	peerMutex sync.RWMutex
 	conf      Config
+
+	// Waits for the clients of the peers which left the cluster to shutdown, see SetPeers()
+	peerShutdown sync.WaitGroup
+
+	// Remembers responses by request token, protected by the cache lock
+	dedupe *cache.LRUCache
+
+	// Owns the rate limits when Config.Cache is not provided
+	pool *workerPool
+
+	// Optional, bounds the memory held by the caches and queues
+	budget       *cache.Budget
+	budgetMetric *prometheus.Desc
+
+	// Converts the reset times computed by peers to the local clock
+	skew *skewTracker
+
+	// Counts the rate limits downgraded for peers which lack a capability, see PeerClient.downgrade()
+	downgraded prometheus.Counter
+
+	// Counts the DRY_RUN rate limits which would have been OVER_LIMIT by name, see shadow()
+	shadowOverLimit *prometheus.CounterVec
+
+	// Optional, hedges the requests to peers which are slow to respond; see BehaviorConfig.HedgeDelay
+	hedger *hedger
+
+	// Optional, caps the new keys of the names matched by Config.KeyFloodRules
+	floods *keyFloodGuard
+
+	// The ranges of the fields of a rate limit accepted, see Config.MaxDuration
+	limits limits
+
+	// Optional, the owners of the rate limits under the previous picker; see Migrate()
+	migration *migration // protected by peerMutex
+
+	// Counts the usage of the rate limit names with the most requests, see GetNameStats()
+	names *nameStats
+	// Optional, exports the usage of the names of Config.NameStatsMetrics
+	nameMetrics *nameMetrics
+
+	// The namespaces of Config.Namespaces, replaced by SetNamespaces()
+	namespaces       atomic.Pointer[namespaceSet]
+	namespaceMetrics *namespaceMetrics
+	// The cache partitions of the namespaces when Config.Cache is provided, protected by the cache lock
+	partitions *partitions
 }
 
 func New(conf Config) (*Instance, error) {
@@ -58,6 +105,55 @@ func New(conf Config) (*Instance, error) {
 
 	s := Instance{
 		conf: conf,
+		budgetMetric: prometheus.NewDesc("memory_budget_utilization",
+			"The fraction of the memory budget in use by the caches and queues.", nil, nil),
+		downgraded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "peer_downgraded_requests",
+			Help: "The number of rate limits downgraded for peers which lack a capability they require.",
+		}),
+		shadowOverLimit: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "shadow_over_limit_total",
+			Help: "The number of DRY_RUN rate limits which would have been OVER_LIMIT, by name; the names not exported are counted as 'other'.",
+		}, []string{"name"}),
+		skew:   newSkewTracker(conf.Clock),
+		limits: newLimits(conf),
+		names:  newNameStats(conf.NameStatsSize, conf.NameStatsMetrics),
+
+		namespaceMetrics: newNamespaceMetrics(),
+	}
+	s.namespaces.Store(newNamespaceSet(conf.Namespaces, nil))
+	if len(conf.NameStatsMetrics) != 0 {
+		s.nameMetrics = newNameMetrics()
+	}
+	if conf.MemoryBudget > 0 {
+		s.budget = cache.NewBudget(conf.MemoryBudget)
+	}
+	if conf.Behaviors.HedgeDelay > 0 {
+		s.hedger = newHedger(conf.Behaviors)
+	}
+	if len(conf.KeyFloodRules) != 0 {
+		s.floods = newKeyFloodGuard(conf.KeyFloodRules, conf.Clock)
+	}
+	if conf.Migration.From != nil {
+		now := conf.Clock.Now()
+		s.migration = newMigration(conf.Migration.From.New(), now, now.Add(conf.Migration.Window))
+	}
+
+	if conf.Cache != nil {
+		s.partitions = newPartitions(1, conf.Clock, s.budget)
+		s.dedupe = cache.NewLRUCache(conf.Behaviors.DedupeCacheSize)
+		s.dedupe.SetClock(conf.Clock)
+		if s.budget != nil {
+			s.dedupe.SetBudget(s.budget)
+			if b, ok := conf.Cache.(interface{ SetBudget(*cache.Budget) }); ok {
+				conf.Cache.Lock()
+				b.SetBudget(s.budget)
+				conf.Cache.Unlock()
+			}
+		}
+	} else {
+		s.pool = newWorkerPool(conf.PoolSize, conf.CacheSize, conf.Behaviors.DedupeCacheSize, conf.Clock, s.budget,
+			&s.namespaces, s.applyRateLimit)
 	}
 
 	s.global = newGlobalManager(conf.Behaviors, &s)
@@ -65,189 +161,565 @@ func New(conf Config) (*Instance, error) {
 	// Register our server with GRPC
 	RegisterV1Server(conf.GRPCServer, &s)
 	RegisterPeersV1Server(conf.GRPCServer, &s)
+	RegisterAdminV1Server(conf.GRPCServer, &s)
 
 	return &s, nil
 }
 
 // GetRateLimits is the public interface used by clients to request rate limits from the system. If the
 // rate limit `Name` and `UniqueKey` is not owned by this instance then we forward the request to the
-// peer that does.
+// peer that does. The responses of rate limits forwarded in the same batch may share a `Metadata` map,
+// as such callers must copy the map of a response before modifying it.
 func (s *Instance) GetRateLimits(ctx context.Context, r *GetRateLimitsReq) (*GetRateLimitsResp, error) {
-	var resp GetRateLimitsResp
-
 	if len(r.Requests) > maxBatchSize {
 		return nil, status.Errorf(codes.OutOfRange,
 			"Requests.RateLimits list too large; max size is '%d'", maxBatchSize)
 	}
 
-	type InOut struct {
-		In  *RateLimitReq
-		Idx int
-		Out *RateLimitResp
-	}
-
-	// Asynchronously fetch rate limits
-	out := make(chan InOut)
-	go func() {
-		fan := holster.NewFanOut(1000)
-		// For each item in the request body
-		for i, item := range r.Requests {
-			fan.Run(func(data interface{}) error {
-				inOut := data.(InOut)
-
-				globalKey := inOut.In.Name + "_" + inOut.In.UniqueKey
-				var peer *PeerClient
-				var err error
-
-				if len(inOut.In.UniqueKey) == 0 {
-					inOut.Out = &RateLimitResp{Error: "field 'unique_key' cannot be empty"}
-					out <- inOut
-					return nil
-				}
-
-				if len(inOut.In.Name) == 0 {
-					inOut.Out = &RateLimitResp{Error: "field 'namespace' cannot be empty"}
-					out <- inOut
-					return nil
-				}
-
-				peer, err = s.GetPeer(globalKey)
-				if err != nil {
-					inOut.Out = &RateLimitResp{
-						Error: fmt.Sprintf("while finding peer that owns rate limit '%s' - '%s'", globalKey, err),
-					}
-					out <- inOut
-					return nil
-				}
-
-				// If our server instance is the owner of this rate limit
-				if peer.isOwner {
-					// Apply our rate limit algorithm to the request
-					inOut.Out, err = s.getRateLimit(inOut.In)
-					if err != nil {
-						inOut.Out = &RateLimitResp{
-							Error: fmt.Sprintf("while applying rate limit for '%s' - '%s'", globalKey, err),
-						}
-					}
-				} else {
-					if inOut.In.Behavior == Behavior_GLOBAL {
-						inOut.Out, err = s.getGlobalRateLimit(inOut.In)
-						if err != nil {
-							inOut.Out = &RateLimitResp{Error: err.Error()}
-						}
-						out <- inOut
-						return nil
-					}
-
-					// Make an RPC call to the peer that owns this rate limit
-					inOut.Out, err = peer.GetPeerRateLimit(ctx, inOut.In)
-					if err != nil {
-						inOut.Out = &RateLimitResp{
-							Error: fmt.Sprintf("while fetching rate limit '%s' from peer - '%s'", globalKey, err),
-						}
-					}
-
-					// Inform the client of the owner key of the key
-					inOut.Out.Metadata = map[string]string{"owner": peer.host}
-				}
-
-				out <- inOut
-				return nil
-			}, InOut{In: item, Idx: i})
-		}
-		fan.Wait()
-		close(out)
-	}()
-
-	resp.Responses = make([]*RateLimitResp, len(r.Requests))
-	// Collect the async responses as they return
-	for i := range out {
-		resp.Responses[i.Idx] = i.Out
+	// Avoid the cost of the fan out when there is only a single rate limit
+	if len(r.Requests) == 1 {
+		single := &singleResp{}
+		single.responses[0] = s.handleRateLimit(ctx, r.Requests[0])
+		single.resp.Responses = single.responses[:]
+		return &single.resp, nil
+	}
+
+	resp := GetRateLimitsResp{
+		Responses: make([]*RateLimitResp, len(r.Requests)),
+	}
+
+	// Group the rate limits we do not own by the peer which owns them
+	var batches []*forwardBatch
+	var forwarded []*forwardBatch
+	byPeer := make(map[*PeerClient]*forwardBatch)
+	var local []*PeerClient
+	keys := make([]string, len(r.Requests))
+	set := s.namespaces.Load()
+	var acquired []*namespace
+
+	for i, req := range r.Requests {
+		key, peer, rl := s.route(req)
+		if rl != nil {
+			resp.Responses[i] = rl
+			continue
+		}
+		if ns := set.lookup(req.Name); ns != nil {
+			if err := ns.acquire(); err != nil {
+				resp.Responses[i] = &RateLimitResp{Error: err.Error()}
+				continue
+			}
+			acquired = append(acquired, ns)
+		}
+		keys[i] = key
+		if peer.isOwner || HasBehavior(req.Behavior, Behavior_GLOBAL) {
+			if local == nil {
+				local = make([]*PeerClient, len(r.Requests))
+			}
+			local[i] = peer
+			continue
+		}
+
+		b, ok := byPeer[peer]
+		if !ok {
+			b = &forwardBatch{peer: peer}
+			byPeer[peer] = b
+			batches = append(batches, b)
+		}
+		if forwarded == nil {
+			forwarded = make([]*forwardBatch, len(r.Requests))
+		}
+		forwarded[i] = b
+		b.size++
+	}
+
+	// Now the size of each batch is known, fill them without growing the slices
+	for i, b := range forwarded {
+		if b == nil {
+			continue
+		}
+		if b.requests == nil {
+			b.requests = make([]*RateLimitReq, 0, b.size)
+			b.idx = make([]int, 0, b.size)
+		}
+		b.requests = append(b.requests, r.Requests[i])
+		b.idx = append(b.idx, i)
 	}
 
+	// Forward each batch to its peer concurrently, such that the latency of the request is that of
+	// the slowest peer instead of the sum of all the peers. Each batch fills in its own responses.
+	fan := holster.NewFanOut(s.conf.Behaviors.ForwardConcurrency)
+	for _, b := range batches {
+		fan.Run(func(data interface{}) error {
+			s.forwardBatch(ctx, data.(*forwardBatch), keys, resp.Responses)
+			return nil
+		}, b)
+	}
+
+	// Apply the rate limits we own while the peers respond
+	if local != nil && s.migrating() {
+		owned := make([]string, len(keys))
+		for i, peer := range local {
+			if peer != nil && peer.isOwner {
+				owned[i] = keys[i]
+			}
+		}
+		s.takeOver(owned, r.Requests)
+	}
+	for i, peer := range local {
+		if peer != nil {
+			resp.Responses[i] = s.applyLocal(keys[i], peer.isOwner, r.Requests[i])
+		}
+	}
+
+	fan.Wait()
+	for _, ns := range acquired {
+		ns.release()
+	}
+
+	for i, req := range r.Requests {
+		s.shadow(req, resp.Responses[i])
+		s.names.observe(req.Name, forwarded != nil && forwarded[i] != nil, resp.Responses[i])
+	}
 	return &resp, nil
 }
 
+// forwardBatch is the rate limits of a single GetRateLimits request owned by the same peer
+type forwardBatch struct {
+	peer     *PeerClient
+	size     int
+	requests []*RateLimitReq
+	// The index of each rate limit in the GetRateLimits request
+	idx []int
+}
+
+// forwardBatch sends the batch to the owning peer in a single request and places each response at the
+// index of its rate limit in `responses`. If the peer request fails, every rate limit in the batch
+// reports the error via the `Error` field of the response.
+//
+// The responses decoded from the peer are owned by this request and are placed in `responses` as is
+// instead of being copied. Responses without metadata share a single metadata map naming the owner.
+func (s *Instance) forwardBatch(ctx context.Context, b *forwardBatch, keys []string, responses []*RateLimitResp) {
+	owner := map[string]string{"owner": b.peer.host}
+
+	resp, err := b.peer.GetPeerRateLimits(ctx, &GetPeerRateLimitsReq{Requests: b.requests})
+	for i, idx := range b.idx {
+		var rl *RateLimitResp
+		if err != nil {
+			rl = errorResp(err, "while fetching rate limit '%s' from peer", keys[idx])
+		} else {
+			rl = resp.RateLimits[i]
+		}
+
+		// Inform the client of the owner key of the key
+		if rl.Metadata == nil {
+			rl.Metadata = owner
+		} else {
+			rl.Metadata["owner"] = b.peer.host
+		}
+		responses[idx] = rl
+	}
+}
+
+// singleResp allows the response to a single rate limit to be allocated at once
+type singleResp struct {
+	resp      GetRateLimitsResp
+	responses [1]*RateLimitResp
+}
+
+// handleRateLimit applies the rate limit if we own it, else forwards it to the peer that does.
+// Errors are reported via the `Error` field of the response.
+func (s *Instance) handleRateLimit(ctx context.Context, req *RateLimitReq) *RateLimitResp {
+	globalKey, peer, rl := s.route(req)
+	if rl != nil {
+		s.names.observe(req.Name, false, rl)
+		return rl
+	}
+	if ns := s.namespaces.Load().lookup(req.Name); ns != nil {
+		if err := ns.acquire(); err != nil {
+			rl = &RateLimitResp{Error: err.Error()}
+			s.names.observe(req.Name, false, rl)
+			return rl
+		}
+		defer ns.release()
+	}
+
+	if peer.isOwner || HasBehavior(req.Behavior, Behavior_GLOBAL) {
+		if peer.isOwner && s.migrating() {
+			s.takeOver([]string{globalKey}, []*RateLimitReq{req})
+		}
+		rl = s.applyLocal(globalKey, peer.isOwner, req)
+		s.shadow(req, rl)
+		s.names.observe(req.Name, false, rl)
+		return rl
+	}
+
+	// Make an RPC call to the peer that owns this rate limit
+	rl, err := peer.GetPeerRateLimit(ctx, req)
+	if err != nil {
+		rl = errorResp(err, "while fetching rate limit '%s' from peer", globalKey)
+	}
+
+	// Inform the client of the owner key of the key
+	if rl.Metadata == nil {
+		rl.Metadata = make(map[string]string, 1)
+	}
+	rl.Metadata["owner"] = peer.host
+	s.shadow(req, rl)
+	s.names.observe(req.Name, true, rl)
+	return rl
+}
+
+// route validates the request and finds the peer which owns the rate limit. If the request is invalid,
+// the owner could not be found or the owner can't honor the request, the response reporting the error
+// is returned instead.
+func (s *Instance) route(req *RateLimitReq) (string, *PeerClient, *RateLimitResp) {
+	if err := validateRateLimitReq(req, s.limits); err != nil {
+		return "", nil, &RateLimitResp{Error: err.Error()}
+	}
+
+	globalKey := req.HashKey()
+	peer, err := s.GetPeer(globalKey)
+	if err != nil {
+		return "", nil, errorResp(err, "while finding peer that owns rate limit '%s'", globalKey)
+	}
+
+	// An owner older than DRY_RUN would count the hits against the rate limit enforced. The capabilities
+	// of an owner which never responded are unknown, such an owner is assumed to have the capability.
+	if HasBehavior(req.Behavior, Behavior_DRY_RUN) && !peer.isOwner {
+		if caps := capabilitySet(peer.capabilities.Load()); caps.has(capKnown) && !caps.has(capDryRun) {
+			return "", nil, errorResp(errNoDryRun, "while forwarding rate limit '%s'", globalKey)
+		}
+	}
+	return globalKey, peer, nil
+}
+
+// applyLocal applies a rate limit which is either owned by this instance or is GLOBAL, in which case
+// the response is returned from the local cache and the hits are queued for the owner.
+func (s *Instance) applyLocal(globalKey string, isOwner bool, req *RateLimitReq) *RateLimitResp {
+	// If our server instance is the owner of this rate limit
+	if isOwner {
+		// Apply our rate limit algorithm to the request
+		rl, err := s.getRateLimitKey(globalKey, req)
+		if err != nil {
+			return errorResp(err, "while applying rate limit for '%s'", globalKey)
+		}
+		return rl
+	}
+
+	rl, err := s.getGlobalRateLimit(req)
+	if err != nil {
+		return &RateLimitResp{Error: err.Error()}
+	}
+	return rl
+}
+
+// errorResp returns a response which reports the error via its `Error` field, prefixed by the context
+// provided. The gRPC status code of the error is kept, such that clients can tell an invalid rate limit
+// from a peer which is unavailable; see GetRateLimitsResp.Err().
+func errorResp(err error, format string, args ...interface{}) *RateLimitResp {
+	s := status.Convert(err)
+	msg := fmt.Sprintf(format, args...)
+	return &RateLimitResp{Error: status.Errorf(s.Code(), "%s - '%s'", msg, s.Message()).Error()}
+}
+
 // getGlobalRateLimit handles rate limits that are marked as `Behavior = GLOBAL`. Rate limit responses
 // are returned from the local cache and the hits are queued to be sent to the owning peer.
 func (s *Instance) getGlobalRateLimit(req *RateLimitReq) (*RateLimitResp, error) {
-	// Queue the hit for async update
-	s.global.QueueHit(req)
-
-	s.conf.Cache.Lock()
-	item, ok := s.conf.Cache.Get(req.HashKey())
-	s.conf.Cache.Unlock()
-	if ok {
-		rl, ok := item.(*RateLimitResp)
+	var rl *RateLimitResp
+	var generation int64
+	if err := s.withCache(req.HashKey(), func(c cache.Cache, _ *cache.LRUCache) {
+		item, ok := c.Get(req.HashKey())
+		if !ok {
+			return
+		}
+		cached, ok := cachedStatus(item)
 		if !ok {
 			// Perhaps the rate limit algorithm was changed by the user.
-			s.conf.Cache.Remove(req.HashKey())
-			return s.getGlobalRateLimit(req)
+			c.Remove(req.HashKey())
+			return
 		}
+		if g, ok := item.(*globalItem); ok {
+			generation = g.Generation
+		}
+		rl = respCopy(cached)
+	}); err != nil {
+		return nil, err
+	}
+
+	// Queue the hit for async update, counted against the status we respond with
+	if err := s.global.QueueHit(req, generation); err != nil {
+		return nil, err
+	}
+	if rl != nil {
 		return rl, nil
-	} else {
-		cpy := *req
-		cpy.Behavior = Behavior_NO_BATCHING
-		// Process the rate limit like we own it since we have no data on the rate limit
-		resp, err := s.getRateLimit(&cpy)
-		return resp, err
 	}
+
+	cpy := *req
+	cpy.Behavior = cpy.Behavior&^Behavior_GLOBAL | Behavior_NO_BATCHING
+	// Process the rate limit like we own it since we have no data on the rate limit
+	return s.getRateLimit(&cpy)
 }
 
 // UpdatePeerGlobals updates the local cache with a list of global rate limits. This method should only
-// be called by a peer who is the owner of a global rate limit.
+// be called by a peer who is the owner of a global rate limit. The reset times computed by the owner
+// are converted to the local clock, such that clock skew between the peers does not expire them early.
 func (s *Instance) UpdatePeerGlobals(ctx context.Context, r *UpdatePeerGlobalsReq) (*UpdatePeerGlobalsResp, error) {
-	s.conf.Cache.Lock()
-	defer s.conf.Cache.Unlock()
-
-	for _, g := range r.Globals {
-		s.conf.Cache.Add(g.Key, g.Status, g.Status.ResetTime)
+	offset := s.skew.observe(r.Sender, r.SenderTime, s.skew.now())
+
+	items := make([]cache.Item, len(r.Globals))
+	for i, g := range r.Globals {
+		g.Status.ResetTime = toLocal(g.Status.ResetTime, offset)
+		items[i] = cache.Item{
+			Key:      g.Key,
+			Value:    &globalItem{Status: *g.Status, Generation: g.Generation},
+			ExpireAt: g.Status.ResetTime,
+		}
 	}
-	return &UpdatePeerGlobalsResp{}, nil
+	if err := s.addAll(items); err != nil {
+		return nil, err
+	}
+	return &UpdatePeerGlobalsResp{Capabilities: capabilityNames}, nil
 }
 
 // GetPeerRateLimits is called by other peers to get the rate limits owned by this peer.
 func (s *Instance) GetPeerRateLimits(ctx context.Context, r *GetPeerRateLimitsReq) (*GetPeerRateLimitsResp, error) {
-	var resp GetPeerRateLimitsResp
-
 	if len(r.Requests) > maxBatchSize {
 		return nil, status.Errorf(codes.OutOfRange,
 			"'PeerRequest.rate_limits' list too large; max size is '%d'", maxBatchSize)
 	}
 
-	for _, req := range r.Requests {
-		rl, err := s.getRateLimit(req)
+	s.skew.observe(r.Sender, r.SenderTime, s.skew.now())
+
+	if r.Handoff {
+		resp := s.handOff(r)
+		resp.SenderTime = s.skew.now()
+		resp.Capabilities = capabilityNames
+		return resp, nil
+	}
+
+	resp := GetPeerRateLimitsResp{
+		RateLimits: make([]*RateLimitResp, 0, len(r.Requests)),
+	}
+
+	// The GLOBAL hits of a peer are sent again until acknowledged, apply each sequence once
+	apply := true
+	if r.Sequence != 0 && r.Sender != "" {
+		apply, resp.AckedSequence = s.global.sequences.advance(r.Sender, r.Epoch, r.Sequence)
+	}
+
+	if s.migrating() {
+		keys := make([]string, len(r.Requests))
+		for i, req := range r.Requests {
+			keys[i] = req.HashKey()
+		}
+		s.takeOver(keys, r.Requests)
+	}
+
+	for i, req := range r.Requests {
+		// The peer which forwarded the request may be configured with different limits
+		if err := validateRateLimitReq(req, s.limits); err != nil {
+			resp.RateLimits = append(resp.RateLimits, &RateLimitResp{Error: err.Error()})
+			continue
+		}
+
+		var rl *RateLimitResp
+		var err error
+		if r.Sequence != 0 || len(r.Generations) != 0 {
+			var generation int64
+			if i < len(r.Generations) {
+				generation = r.Generations[i]
+			}
+			rl, err = s.applyGlobalHits(req, generation, apply)
+		} else {
+			rl, err = s.getRateLimit(req)
+		}
 		if err != nil {
 			// Return the error for this request
 			rl = &RateLimitResp{Error: err.Error()}
 		}
 		resp.RateLimits = append(resp.RateLimits, rl)
 	}
+	resp.SenderTime = s.skew.now()
+	resp.Capabilities = capabilityNames
 	return &resp, nil
 }
 
-// HealthCheck Returns the health of our instance.
+// HealthCheck Returns the health of our instance and the capabilities of each peer
 func (s *Instance) HealthCheck(ctx context.Context, r *HealthCheckReq) (*HealthCheckResp, error) {
 	s.peerMutex.RLock()
-	defer s.peerMutex.RUnlock()
-	return &s.health, nil
+	health := s.health
+	peers := s.conf.Picker.Peers()
+	s.peerMutex.RUnlock()
+
+	health.Peers = make([]*PeerCapabilities, len(peers))
+	for i, peer := range peers {
+		caps := capabilityNames
+		if !peer.isOwner {
+			caps = peer.Capabilities()
+		}
+		health.Peers[i] = &PeerCapabilities{Address: peer.host, Capabilities: caps}
+	}
+	return &health, nil
 }
 
 func (s *Instance) getRateLimit(r *RateLimitReq) (*RateLimitResp, error) {
+	return s.getRateLimitKey(r.HashKey(), r)
+}
+
+// getRateLimitKey is identical to getRateLimit() but accepts the hash key of the request
+func (s *Instance) getRateLimitKey(key string, r *RateLimitReq) (*RateLimitResp, error) {
+	rl, err := s.applyExclusive(key, r)
+	if err == errPoolClosed {
+		return nil, err
+	}
+
+	// Queue the broadcast only once the cache is released; the broadcast applies the rate limit to
+	// read its status, as such queuing while holding the cache would deadlock.
+	if HasBehavior(r.Behavior, Behavior_GLOBAL) {
+		s.global.QueueUpdate(r)
+	}
+	return rl, err
+}
+
+// applyGlobalHits applies the GLOBAL hits sent by a peer which doesn't own the rate limit. If the hits
+// were already applied or the window of the rate limit they were counted against has ended, the hits
+// are not applied and the current status of the rate limit is returned.
+func (s *Instance) applyGlobalHits(r *RateLimitReq, generation int64, apply bool) (*RateLimitResp, error) {
+	key := r.HashKey()
+	var rl *RateLimitResp
+	var applyErr error
+	if err := s.withCache(key, func(c cache.Cache, _ *cache.LRUCache) {
+		now := cacheNow(c)
+		if s.floods != nil {
+			if rl = s.floods.check(c, key, r, now); rl != nil {
+				return
+			}
+		}
+		req := r
+		if !apply || superseded(c, key, r, generation, now) {
+			cpy := *r
+			cpy.Hits = 0
+			req = &cpy
+		}
+		rl, applyErr = applyAlgorithmKey(c, key, req, now)
+	}); err != nil {
+		return nil, err
+	}
+
+	if HasBehavior(r.Behavior, Behavior_GLOBAL) {
+		s.global.QueueUpdate(r)
+	}
+	return rl, applyErr
+}
+
+// generation returns the generation of a rate limit we own, see windowStart()
+func (s *Instance) generation(key string) int64 {
+	var generation int64
+	s.withCache(key, func(c cache.Cache, _ *cache.LRUCache) {
+		if item, ok := c.Get(key); ok {
+			generation = windowStart(item)
+		}
+	})
+	return generation
+}
+
+// applyExclusive applies the rate limit with exclusive access to the caches which hold it
+func (s *Instance) applyExclusive(key string, r *RateLimitReq) (*RateLimitResp, error) {
+	// Avoid the closure used by withCache() as it would allocate on every call
+	if s.pool != nil {
+		return s.pool.apply(key, r)
+	}
+
 	s.conf.Cache.Lock()
 	defer s.conf.Cache.Unlock()
+	if p := s.partitions.forKey(s.namespaces.Load(), key); p != nil {
+		p.Lock()
+		defer p.Unlock()
+		return s.applyRateLimit(p, s.dedupe, key, r)
+	}
+	return s.applyRateLimit(s.conf.Cache, s.dedupe, key, r)
+}
 
-	if r.Behavior == Behavior_GLOBAL {
-		s.global.QueueUpdate(r)
+// withCache calls `fn` with exclusive access to the cache and dedupe cache which hold the rate limit
+// for `key`; the cache partition of its namespace if it has one. When the worker pool is enabled `fn`
+// is run by the worker which owns the key, else the cache lock is held while `fn` runs. Returns
+// errPoolClosed without calling `fn` once the worker pool is closed by Close().
+func (s *Instance) withCache(key string, fn func(c cache.Cache, dedupe *cache.LRUCache)) error {
+	if s.pool != nil {
+		return s.pool.do(key, fn)
+	}
+
+	s.conf.Cache.Lock()
+	defer s.conf.Cache.Unlock()
+	if p := s.partitions.forKey(s.namespaces.Load(), key); p != nil {
+		p.Lock()
+		defer p.Unlock()
+		fn(p, s.dedupe)
+		return nil
+	}
+	fn(s.conf.Cache, s.dedupe)
+	return nil
+}
+
+// addAll adds the items to the cache, acquiring the lock of each cache shard only once for the entire batch.
+// Returns errPoolClosed once the worker pool is closed by Close().
+func (s *Instance) addAll(items []cache.Item) error {
+	if s.pool != nil {
+		return s.pool.addAll(items)
 	}
 
-	switch r.Algorithm {
-	case Algorithm_TOKEN_BUCKET:
-		return tokenBucket(s.conf.Cache, r)
-	case Algorithm_LEAKY_BUCKET:
-		return leakyBucket(s.conf.Cache, r)
+	s.conf.Cache.Lock()
+	defer s.conf.Cache.Unlock()
+	if set := s.namespaces.Load(); set != nil {
+		for _, item := range items {
+			if p := s.partitions.forKey(set, item.Key); p != nil {
+				p.Lock()
+				p.Add(item.Key, item.Value, item.ExpireAt)
+				p.Unlock()
+				continue
+			}
+			s.conf.Cache.Add(item.Key, item.Value, item.ExpireAt)
+		}
+		return nil
 	}
-	return nil, errors.Errorf("invalid rate limit algorithm '%d'", r.Algorithm)
+	if m, ok := s.conf.Cache.(cache.MultiAdder); ok {
+		m.MAdd(items)
+		return nil
+	}
+	for _, item := range items {
+		s.conf.Cache.Add(item.Key, item.Value, item.ExpireAt)
+	}
+	return nil
+}
+
+// applyRateLimit applies the rate limit to the cache provided, the caller must have exclusive access to the caches
+func (s *Instance) applyRateLimit(c cache.Cache, dedupe *cache.LRUCache, key string, r *RateLimitReq) (*RateLimitResp, error) {
+	now := cacheNow(c)
+	if s.floods != nil {
+		if rl := s.floods.check(c, key, r, now); rl != nil {
+			return rl, nil
+		}
+	}
+
+	// GLOBAL hits are aggregated before reaching the owner, so tokens are only honored for non GLOBAL requests
+	if r.RequestToken == "" || r.Hits == 0 || HasBehavior(r.Behavior, Behavior_GLOBAL) {
+		return applyAlgorithmKey(c, key, r, now)
+	}
+
+	// If we have seen this request before, return the original response
+	dedupeKey := key + "_" + r.RequestToken
+	if item, ok := dedupe.GetAt(dedupeKey, now); ok {
+		rl := *item.(*RateLimitResp)
+		return &rl, nil
+	}
+
+	rl, err := applyAlgorithmKey(c, key, r, now)
+	if err != nil {
+		return nil, err
+	}
+	cpy := *rl
+	dedupe.Add(dedupeKey, &cpy, addTime(now, ToTimeStamp(s.conf.Behaviors.DedupeWindow)))
+	return rl, nil
 }
 
 // SetPeers is called when the pool of peers changes
@@ -256,31 +728,60 @@ func (s *Instance) SetPeers(peers []PeerInfo) {
 	var errs []string
 
 	for _, peer := range peers {
-		peerInfo, err := NewPeerClient(s.conf.Behaviors, peer.Address)
-		if err != nil {
-			errs = append(errs,
-				fmt.Sprintf("failed to connect to peer '%s'; consistent hash is incomplete", peer.Address))
-			continue
-		}
-
-		if info := s.conf.Picker.GetPeerByHost(peer.Address); info != nil {
-			peerInfo = info
+		// Reuse the client of a peer already in the cluster, else connect to the new peer. The client is
+		// in use by requests in flight, as such a peer which changed ownership gets a new client.
+		peerInfo := s.conf.Picker.GetPeerByHost(peer.Address)
+		if peerInfo == nil || peerInfo.isOwner != peer.IsOwner {
+			var err error
+			peerInfo, err = NewPeerClient(s.conf.Behaviors, peer.Address)
+			if err != nil {
+				errs = append(errs,
+					fmt.Sprintf("failed to connect to peer '%s'; consistent hash is incomplete", peer.Address))
+				continue
+			}
+			peerInfo.budget = s.budget
+			peerInfo.skew = s.skew
+			peerInfo.downgraded = s.downgraded
+			peerInfo.hedger = s.hedger
+			peerInfo.namespaces = &s.namespaces
+
+			// If this peer refers to this server instance
+			peerInfo.isOwner = peer.IsOwner
 		}
 
-		// If this peer refers to this server instance
-		peerInfo.isOwner = peer.IsOwner
-
 		picker.Add(peerInfo)
 	}
 
-	// TODO: schedule a disconnect for old PeerClients once they are no longer in flight
+	s.skew.setPeers(peers)
+	s.global.sequences.setPeers(peers)
 
 	s.peerMutex.Lock()
 	defer s.peerMutex.Unlock()
 
 	// Replace our current picker
+	old := s.conf.Picker
 	s.conf.Picker = picker
 
+	// The previous owners of the rate limits are the same peers assigned by the previous picker
+	if s.migration != nil {
+		previous := s.migration.picker.New()
+		for _, peer := range picker.Peers() {
+			previous.Add(peer)
+		}
+		s.migration.picker = previous
+	}
+
+	// Disconnect from the peers which left the cluster once their requests in flight complete
+	for _, peer := range old.Peers() {
+		if picker.GetPeerByHost(peer.host) != peer {
+			s.peerShutdown.Add(1)
+			go func(peer *PeerClient) {
+				defer s.peerShutdown.Done()
+				peer.Shutdown()
+			}(peer)
+		}
+	}
+
 	// Update our health status
 	s.health.Status = Healthy
 	if len(errs) != 0 {
@@ -309,14 +810,109 @@ func (s *Instance) GetPeerList() []*PeerClient {
 	return s.conf.Picker.Peers()
 }
 
-// Describe fetches prometheus metrics to be registered
+// ConsistencyCheck verifies the internal consistency of every cache which holds rate limits,
+// Returns nil if the cache provided via Config.Cache is not a *cache.LRUCache.
+func (s *Instance) ConsistencyCheck() error {
+	if s.pool != nil {
+		return s.pool.consistencyCheck()
+	}
+	if c, ok := s.conf.Cache.(*cache.LRUCache); ok {
+		if err := c.ConsistencyCheck(); err != nil {
+			return err
+		}
+	}
+	var err error
+	s.eachPartition(func(_ string, c *cache.LRUCache) {
+		if err == nil {
+			err = c.ConsistencyCheck()
+		}
+	})
+	return err
+}
+
+// Close stops the background go routines of the instance and disconnects from its peers,
+// the instance must not be used after calling Close()
+func (s *Instance) Close() {
+	// Stop the global manager first, as broadcasts apply rate limits via the worker pool
+	s.global.Close()
+	if s.pool != nil {
+		s.pool.close()
+	}
+
+	for _, peer := range s.GetPeerList() {
+		s.peerShutdown.Add(1)
+		go func(peer *PeerClient) {
+			defer s.peerShutdown.Done()
+			peer.Shutdown()
+		}(peer)
+	}
+	s.peerShutdown.Wait()
+}
+
+// Describe fetches prometheus metrics to be registered. When the worker pool is enabled
+// this includes the cache metrics, else the caller should register Config.Cache.
 func (s *Instance) Describe(ch chan<- *prometheus.Desc) {
 	ch <- s.global.asyncMetrics.Desc()
 	ch <- s.global.broadcastMetrics.Desc()
+	ch <- s.downgraded.Desc()
+	s.shadowOverLimit.Describe(ch)
+	s.skew.Describe(ch)
+	if s.hedger != nil {
+		ch <- s.hedger.issued.Desc()
+		ch <- s.hedger.won.Desc()
+	}
+	if s.floods != nil {
+		s.floods.metric.Describe(ch)
+	}
+	if s.nameMetrics != nil {
+		s.nameMetrics.Describe(ch)
+	}
+	s.namespaceMetrics.Describe(ch)
+	if s.budget != nil {
+		ch <- s.budgetMetric
+	}
+	if s.pool != nil {
+		s.pool.Describe(ch)
+	}
 }
 
 // Collect fetches metrics from the server for use by prometheus
 func (s *Instance) Collect(ch chan<- prometheus.Metric) {
 	ch <- s.global.asyncMetrics
 	ch <- s.global.broadcastMetrics
+	ch <- s.downgraded
+	s.shadowOverLimit.Collect(ch)
+	s.skew.Collect(ch)
+	if s.hedger != nil {
+		ch <- s.hedger.issued
+		ch <- s.hedger.won
+	}
+	if s.floods != nil {
+		s.floods.metric.Collect(ch)
+	}
+	if s.nameMetrics != nil {
+		stats := s.names.stats(false)
+		s.countCacheEntries(stats)
+		s.nameMetrics.collect(ch, stats)
+	}
+	if set := s.namespaces.Load(); set != nil {
+		caches := make(map[string]cache.Stats)
+		s.eachPartition(func(name string, c *cache.LRUCache) {
+			stats, total := c.LiveStats(), caches[name]
+			total.Size += stats.Size
+			total.Hit += stats.Hit
+			total.Miss += stats.Miss
+			for i, n := range stats.Removals {
+				total.Removals[i] += n
+			}
+			caches[name] = total
+		})
+		s.namespaceMetrics.collect(ch, set, caches)
+	}
+	if s.budget != nil {
+		ch <- prometheus.MustNewConstMetric(s.budgetMetric, prometheus.GaugeValue, s.budget.Utilization())
+	}
+	if s.pool != nil {
+		s.pool.Collect(ch)
+	}
 }
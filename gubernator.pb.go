@@ -7,6 +7,7 @@ Package gubernator is a generated protocol buffer package.
 It is generated from these files:
 	gubernator.proto
 	peers.proto
+	admin.proto
 
 It has these top-level messages:
 	GetRateLimitsReq
@@ -15,11 +16,17 @@ It has these top-level messages:
 	RateLimitResp
 	HealthCheckReq
 	HealthCheckResp
+	PeerCapabilities
 	GetPeerRateLimitsReq
 	GetPeerRateLimitsResp
 	UpdatePeerGlobalsReq
 	UpdatePeerGlobal
 	UpdatePeerGlobalsResp
+	GetMigrationStatusReq
+	GetMigrationStatusResp
+	GetNameStatsReq
+	GetNameStatsResp
+	NameStats
 */
 package gubernator
 
@@ -96,17 +103,37 @@ const (
 	// gain massive performance as every request coming into the system does not have to wait for a
 	// single peer to decide if the rate limit has been reached.
 	Behavior_GLOBAL Behavior = 2
+	// Changes the duration of an existing rate limit immediately. By default a request which changes the
+	// duration of a rate limit only takes effect once the current window resets. With this flag the
+	// current window is rebased to end at its start plus the new duration, keeping the hits already
+	// consumed; if the new window would already have ended a new window starts.
+	Behavior_REBASE_DURATION Behavior = 4
+	// Evaluates the rate limit without enforcing it, IE: before tightening a limit in production. The hits
+	// are counted as usual, but against a state of their own such that the rate limit of the same name
+	// and unique_key which is enforced is not affected. The response always reports UNDER_LIMIT, the
+	// status the rate limit would have had is reported via the `dry_run_status` metadata.
+	Behavior_DRY_RUN Behavior = 8
+	// Has the CachedClient send the rate limit to the server instead of answering it with a cached
+	// OVER_LIMIT response, IE: when an authoritative answer is required. The response still updates the
+	// cache of the client. The server has no use for it and ignores it.
+	Behavior_NO_CLIENT_CACHE Behavior = 16
 )
 
 var Behavior_name = map[int32]string{
-	0: "BATCHING",
-	1: "NO_BATCHING",
-	2: "GLOBAL",
+	0:  "BATCHING",
+	1:  "NO_BATCHING",
+	2:  "GLOBAL",
+	4:  "REBASE_DURATION",
+	8:  "DRY_RUN",
+	16: "NO_CLIENT_CACHE",
 }
 var Behavior_value = map[string]int32{
-	"BATCHING":    0,
-	"NO_BATCHING": 1,
-	"GLOBAL":      2,
+	"BATCHING":        0,
+	"NO_BATCHING":     1,
+	"GLOBAL":          2,
+	"REBASE_DURATION": 4,
+	"DRY_RUN":         8,
+	"NO_CLIENT_CACHE": 16,
 }
 
 func (x Behavior) String() string {
@@ -189,6 +216,10 @@ type RateLimitReq struct {
 	Algorithm Algorithm `protobuf:"varint,6,opt,name=algorithm,enum=pb.gubernator.Algorithm" json:"algorithm,omitempty"`
 	// The behavior of the rate limit in gubernator.
 	Behavior Behavior `protobuf:"varint,7,opt,name=behavior,enum=pb.gubernator.Behavior" json:"behavior,omitempty"`
+	// (Optional) A client generated token which uniquely identifies this request. If a request with the
+	// same token is received again within the dedupe window, the owning peer returns the original
+	// response without applying the hits again. This makes retrying a request safe.
+	RequestToken string `protobuf:"bytes,8,opt,name=request_token,json=requestToken" json:"request_token,omitempty"`
 }
 
 func (m *RateLimitReq) Reset()                    { *m = RateLimitReq{} }
@@ -245,6 +276,13 @@ func (m *RateLimitReq) GetBehavior() Behavior {
 	return Behavior_BATCHING
 }
 
+func (m *RateLimitReq) GetRequestToken() string {
+	if m != nil {
+		return m.RequestToken
+	}
+	return ""
+}
+
 type RateLimitResp struct {
 	// The status of the rate limit.
 	Status Status `protobuf:"varint,1,opt,name=status,enum=pb.gubernator.Status" json:"status,omitempty"`
@@ -322,6 +360,8 @@ type HealthCheckResp struct {
 	Message string `protobuf:"bytes,2,opt,name=message" json:"message,omitempty"`
 	// The number of peers we know about
 	PeerCount int32 `protobuf:"varint,3,opt,name=peer_count,json=peerCount" json:"peer_count,omitempty"`
+	// The capabilities of each peer, such that operators can track the progress of a rolling upgrade
+	Peers []*PeerCapabilities `protobuf:"bytes,4,rep,name=peers" json:"peers,omitempty"`
 }
 
 func (m *HealthCheckResp) Reset()                    { *m = HealthCheckResp{} }
@@ -350,6 +390,40 @@ func (m *HealthCheckResp) GetPeerCount() int32 {
 	return 0
 }
 
+func (m *HealthCheckResp) GetPeers() []*PeerCapabilities {
+	if m != nil {
+		return m.Peers
+	}
+	return nil
+}
+
+type PeerCapabilities struct {
+	// The address of the peer
+	Address string `protobuf:"bytes,1,opt,name=address" json:"address,omitempty"`
+	// The capabilities the peer advertised in its last response, empty if the peer never responded
+	// or is older than the capabilities; IE: 'request_token', 'behavior_flags'
+	Capabilities []string `protobuf:"bytes,2,rep,name=capabilities" json:"capabilities,omitempty"`
+}
+
+func (m *PeerCapabilities) Reset()                    { *m = PeerCapabilities{} }
+func (m *PeerCapabilities) String() string            { return proto.CompactTextString(m) }
+func (*PeerCapabilities) ProtoMessage()               {}
+func (*PeerCapabilities) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *PeerCapabilities) GetAddress() string {
+	if m != nil {
+		return m.Address
+	}
+	return ""
+}
+
+func (m *PeerCapabilities) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*GetRateLimitsReq)(nil), "pb.gubernator.GetRateLimitsReq")
 	proto.RegisterType((*GetRateLimitsResp)(nil), "pb.gubernator.GetRateLimitsResp")
@@ -357,6 +431,7 @@ func init() {
 	proto.RegisterType((*RateLimitResp)(nil), "pb.gubernator.RateLimitResp")
 	proto.RegisterType((*HealthCheckReq)(nil), "pb.gubernator.HealthCheckReq")
 	proto.RegisterType((*HealthCheckResp)(nil), "pb.gubernator.HealthCheckResp")
+	proto.RegisterType((*PeerCapabilities)(nil), "pb.gubernator.PeerCapabilities")
 	proto.RegisterEnum("pb.gubernator.Algorithm", Algorithm_name, Algorithm_value)
 	proto.RegisterEnum("pb.gubernator.Behavior", Behavior_name, Behavior_value)
 	proto.RegisterEnum("pb.gubernator.Status", Status_name, Status_value)
@@ -476,46 +551,54 @@ var _V1_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("gubernator.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 655 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0xcd, 0x6e, 0xda, 0x4c,
-	0x14, 0x8d, 0x21, 0x21, 0xf8, 0x26, 0x80, 0x33, 0xfa, 0xbe, 0xc4, 0xa2, 0xa4, 0x45, 0x5e, 0x51,
-	0xa4, 0x82, 0x42, 0xd4, 0x1f, 0xa5, 0x2b, 0xa0, 0x34, 0x89, 0x20, 0x20, 0x4d, 0x49, 0xa4, 0x76,
-	0x83, 0x86, 0xe4, 0x0a, 0xac, 0xe0, 0x1f, 0x3c, 0xe3, 0x48, 0xd9, 0x55, 0x7d, 0x85, 0xbe, 0x46,
-	0xdf, 0xa6, 0xeb, 0xee, 0xfa, 0x08, 0x7d, 0x80, 0x6a, 0x06, 0x30, 0xd8, 0x52, 0xb3, 0x9b, 0x7b,
-	0xce, 0xb9, 0x67, 0x98, 0x73, 0x64, 0xc0, 0x98, 0x84, 0x63, 0x0c, 0x5c, 0x26, 0xbc, 0xa0, 0xe6,
-	0x07, 0x9e, 0xf0, 0x48, 0xce, 0x1f, 0xd7, 0xd6, 0x60, 0xb1, 0x34, 0xf1, 0xbc, 0xc9, 0x0c, 0xeb,
-	0xcc, 0xb7, 0xeb, 0xcc, 0x75, 0x3d, 0xc1, 0x84, 0xed, 0xb9, 0x7c, 0x21, 0xb6, 0xba, 0x60, 0x9c,
-	0xa3, 0xa0, 0x4c, 0x60, 0xcf, 0x76, 0x6c, 0xc1, 0x29, 0xce, 0xc9, 0x5b, 0xc8, 0x06, 0x38, 0x0f,
-	0x91, 0x0b, 0x6e, 0x6a, 0xe5, 0x74, 0x65, 0xaf, 0xf1, 0xac, 0x16, 0xf3, 0xac, 0x45, 0x7a, 0x8a,
-	0x73, 0x1a, 0x89, 0xad, 0x01, 0x1c, 0x24, 0xcc, 0xb8, 0x4f, 0xce, 0x40, 0x0f, 0x90, 0xfb, 0x9e,
-	0xcb, 0x71, 0x65, 0x57, 0xfa, 0xb7, 0x1d, 0xf7, 0xe9, 0x5a, 0x6e, 0xfd, 0xd1, 0x60, 0x7f, 0xf3,
-	0x2e, 0x42, 0x60, 0xdb, 0x65, 0x0e, 0x9a, 0x5a, 0x59, 0xab, 0xe8, 0x54, 0x9d, 0xc9, 0x31, 0x40,
-	0xe8, 0xda, 0xf3, 0x10, 0x47, 0xf7, 0xf8, 0x68, 0xa6, 0x14, 0xa3, 0x2f, 0x90, 0x2e, 0x3e, 0xca,
-	0x95, 0xa9, 0x2d, 0xb8, 0x99, 0x2e, 0x6b, 0x95, 0x34, 0x55, 0x67, 0xf2, 0x1f, 0xec, 0xcc, 0xa4,
-	0xa5, 0xb9, 0xad, 0xc0, 0xc5, 0x40, 0x8a, 0x90, 0xbd, 0x0b, 0x03, 0x15, 0x8f, 0xb9, 0xa3, 0x88,
-	0x68, 0x26, 0x6f, 0x40, 0x67, 0xb3, 0x89, 0x17, 0xd8, 0x62, 0xea, 0x98, 0x99, 0xb2, 0x56, 0xc9,
-	0x37, 0xcc, 0xc4, 0x2b, 0x9a, 0x2b, 0x9e, 0xae, 0xa5, 0xe4, 0x14, 0xb2, 0x63, 0x9c, 0xb2, 0x07,
-	0xdb, 0x0b, 0xcc, 0x5d, 0xb5, 0x76, 0x94, 0x58, 0x6b, 0x2d, 0x69, 0x1a, 0x09, 0xad, 0x1f, 0x29,
-	0xc8, 0xc5, 0x32, 0x21, 0xaf, 0x20, 0xc3, 0x05, 0x13, 0x21, 0x57, 0x2f, 0xcf, 0x37, 0xfe, 0x4f,
-	0x98, 0x7c, 0x52, 0x24, 0x5d, 0x8a, 0xd6, 0xef, 0x4b, 0x6d, 0xbe, 0xaf, 0x24, 0x9b, 0x70, 0x98,
-	0xed, 0xda, 0xee, 0x64, 0x19, 0xc7, 0x1a, 0x90, 0x31, 0x06, 0xc8, 0x51, 0x8c, 0x84, 0xed, 0xe0,
-	0x32, 0x18, 0x5d, 0x21, 0x43, 0xdb, 0x41, 0x69, 0x89, 0x41, 0xe0, 0x05, 0x2a, 0x19, 0x9d, 0x2e,
-	0x06, 0xf2, 0x11, 0xb2, 0x0e, 0x0a, 0x76, 0xc7, 0x04, 0x33, 0x33, 0xaa, 0xdb, 0xea, 0x53, 0xdd,
-	0xd6, 0xae, 0x96, 0xe2, 0x8e, 0x2b, 0x82, 0x47, 0x1a, 0xed, 0x16, 0xdf, 0x43, 0x2e, 0x46, 0x11,
-	0x03, 0xd2, 0xb2, 0xcd, 0x45, 0xcf, 0xf2, 0x28, 0x7f, 0xc0, 0x03, 0x9b, 0x85, 0xb8, 0x6c, 0x78,
-	0x31, 0x9c, 0xa5, 0xde, 0x69, 0x96, 0x01, 0xf9, 0x0b, 0x64, 0x33, 0x31, 0x6d, 0x4f, 0xf1, 0xf6,
-	0x9e, 0xe2, 0xdc, 0x1a, 0x43, 0x21, 0x86, 0x70, 0x9f, 0x1c, 0xc6, 0x12, 0xd4, 0xa3, 0xa8, 0x4c,
-	0xd8, 0x75, 0x90, 0x73, 0x36, 0x59, 0x19, 0xaf, 0x46, 0x19, 0x88, 0x8f, 0x18, 0x8c, 0x6e, 0xbd,
-	0xd0, 0x15, 0x2a, 0xaf, 0x1d, 0xaa, 0x4b, 0xa4, 0x2d, 0x81, 0x6a, 0x1d, 0xf4, 0xa8, 0x71, 0x62,
-	0xc0, 0xfe, 0x70, 0xd0, 0xed, 0xf4, 0x47, 0xad, 0xeb, 0x76, 0xb7, 0x33, 0x34, 0xb6, 0x24, 0xd2,
-	0xeb, 0x34, 0xbb, 0x9f, 0x57, 0x88, 0x56, 0x7d, 0x0d, 0xd9, 0x55, 0xd7, 0x64, 0x1f, 0xb2, 0xad,
-	0xe6, 0xb0, 0x7d, 0x71, 0xd9, 0x3f, 0x37, 0xb6, 0x48, 0x01, 0xf6, 0xfa, 0x83, 0x51, 0x04, 0x68,
-	0x04, 0x20, 0x73, 0xde, 0x1b, 0xb4, 0x9a, 0x3d, 0x23, 0x55, 0x7d, 0x09, 0x99, 0x45, 0xbb, 0x52,
-	0x76, 0xdd, 0xff, 0xd0, 0xa1, 0xa3, 0xde, 0xe5, 0xd5, 0xa5, 0xbc, 0x23, 0x0f, 0x30, 0xb8, 0x89,
-	0x66, 0xad, 0xf1, 0x4b, 0x83, 0xd4, 0xcd, 0x09, 0xf1, 0x21, 0x17, 0xfb, 0x0c, 0xc9, 0x8b, 0x44,
-	0x27, 0xc9, 0x2f, 0xbe, 0x58, 0x7e, 0x5a, 0xc0, 0x7d, 0xab, 0xf4, 0xed, 0xe7, 0xef, 0xef, 0xa9,
-	0x43, 0xeb, 0xa0, 0xfe, 0x70, 0x52, 0x8f, 0xd1, 0x67, 0x5a, 0x95, 0x20, 0xec, 0x6d, 0xe4, 0x4d,
-	0x8e, 0x13, 0x76, 0xf1, 0x76, 0x8a, 0xcf, 0x9f, 0xa2, 0xb9, 0x6f, 0x1d, 0xa9, 0xbb, 0x0e, 0x48,
-	0x41, 0xde, 0xb5, 0x41, 0xb6, 0x0a, 0x5f, 0x60, 0xbd, 0xf6, 0x55, 0xd3, 0xc6, 0x19, 0xf5, 0x27,
-	0x76, 0xfa, 0x37, 0x00, 0x00, 0xff, 0xff, 0xb6, 0xa1, 0xf2, 0xf6, 0x05, 0x05, 0x00, 0x00,
+	// 774 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x5d, 0x6f, 0xe2, 0x46,
+	0x14, 0x5d, 0x9b, 0x84, 0xe0, 0x1b, 0x08, 0xce, 0xb4, 0xdd, 0xb5, 0x68, 0xb6, 0x45, 0xee, 0x4b,
+	0x8a, 0x54, 0xd0, 0x66, 0xd5, 0x0f, 0xa5, 0x4f, 0x40, 0xdc, 0x04, 0xc1, 0xc2, 0x6a, 0x96, 0xac,
+	0xb4, 0x7d, 0xb1, 0x86, 0x70, 0x05, 0x56, 0xc0, 0x36, 0x9e, 0x21, 0x52, 0xde, 0xaa, 0xfe, 0x85,
+	0x3e, 0xe5, 0x3f, 0xf4, 0xdf, 0xf4, 0xb9, 0x6f, 0xfd, 0x21, 0xd5, 0x8c, 0x3f, 0xc0, 0x96, 0x36,
+	0x6f, 0x73, 0xcf, 0x39, 0xf7, 0xce, 0xcc, 0x99, 0xa3, 0x01, 0x73, 0xb1, 0x9d, 0x61, 0xe4, 0x33,
+	0x11, 0x44, 0xed, 0x30, 0x0a, 0x44, 0x40, 0x6a, 0xe1, 0xac, 0xbd, 0x03, 0x1b, 0x67, 0x8b, 0x20,
+	0x58, 0xac, 0xb0, 0xc3, 0x42, 0xaf, 0xc3, 0x7c, 0x3f, 0x10, 0x4c, 0x78, 0x81, 0xcf, 0x63, 0xb1,
+	0x3d, 0x04, 0xf3, 0x1a, 0x05, 0x65, 0x02, 0x47, 0xde, 0xda, 0x13, 0x9c, 0xe2, 0x86, 0xfc, 0x0c,
+	0x95, 0x08, 0x37, 0x5b, 0xe4, 0x82, 0x5b, 0x5a, 0xb3, 0x74, 0x7e, 0x7c, 0xf1, 0x75, 0x3b, 0x37,
+	0xb3, 0x9d, 0xe9, 0x29, 0x6e, 0x68, 0x26, 0xb6, 0x27, 0x70, 0x5a, 0x18, 0xc6, 0x43, 0x72, 0x09,
+	0x46, 0x84, 0x3c, 0x0c, 0x7c, 0x8e, 0xe9, 0xb8, 0xb3, 0xcf, 0x8f, 0xe3, 0x21, 0xdd, 0xc9, 0xed,
+	0x27, 0x1d, 0xaa, 0xfb, 0x7b, 0x11, 0x02, 0x07, 0x3e, 0x5b, 0xa3, 0xa5, 0x35, 0xb5, 0x73, 0x83,
+	0xaa, 0x35, 0x79, 0x0d, 0xb0, 0xf5, 0xbd, 0xcd, 0x16, 0xdd, 0x7b, 0x7c, 0xb4, 0x74, 0xc5, 0x18,
+	0x31, 0x32, 0xc4, 0x47, 0xd9, 0xb2, 0xf4, 0x04, 0xb7, 0x4a, 0x4d, 0xed, 0xbc, 0x44, 0xd5, 0x9a,
+	0x7c, 0x09, 0x87, 0x2b, 0x39, 0xd2, 0x3a, 0x50, 0x60, 0x5c, 0x90, 0x06, 0x54, 0xe6, 0xdb, 0x48,
+	0xd9, 0x63, 0x1d, 0x2a, 0x22, 0xab, 0xc9, 0x4f, 0x60, 0xb0, 0xd5, 0x22, 0x88, 0x3c, 0xb1, 0x5c,
+	0x5b, 0xe5, 0xa6, 0x76, 0x7e, 0x72, 0x61, 0x15, 0x6e, 0xd1, 0x4d, 0x79, 0xba, 0x93, 0x92, 0xb7,
+	0x50, 0x99, 0xe1, 0x92, 0x3d, 0x78, 0x41, 0x64, 0x1d, 0xa9, 0xb6, 0x57, 0x85, 0xb6, 0x5e, 0x42,
+	0xd3, 0x4c, 0x48, 0xbe, 0x83, 0x5a, 0xe2, 0xa9, 0x2b, 0x82, 0x7b, 0xf4, 0xad, 0x8a, 0xba, 0x54,
+	0x35, 0x01, 0xa7, 0x12, 0xb3, 0xff, 0xd6, 0xa1, 0x96, 0x33, 0x8e, 0xfc, 0x00, 0x65, 0x2e, 0x98,
+	0xd8, 0x72, 0x65, 0xcf, 0xc9, 0xc5, 0x57, 0x85, 0x9d, 0x3e, 0x28, 0x92, 0x26, 0xa2, 0x9d, 0x09,
+	0xfa, 0xbe, 0x09, 0x67, 0xf2, 0xb9, 0xd6, 0xcc, 0xf3, 0x3d, 0x7f, 0x91, 0x78, 0xb6, 0x03, 0xa4,
+	0xd7, 0x11, 0x72, 0x14, 0xae, 0xf0, 0xd6, 0x98, 0xb8, 0x67, 0x28, 0x64, 0xea, 0xad, 0x51, 0x8e,
+	0xc4, 0x28, 0x0a, 0x22, 0x65, 0x9f, 0x41, 0xe3, 0x82, 0xfc, 0x06, 0x95, 0x35, 0x0a, 0x36, 0x67,
+	0x82, 0x59, 0x65, 0x15, 0x80, 0xd6, 0x73, 0x01, 0x68, 0xbf, 0x4b, 0xc4, 0x8e, 0x2f, 0xa2, 0x47,
+	0x9a, 0xf5, 0x36, 0x7e, 0x85, 0x5a, 0x8e, 0x22, 0x26, 0x94, 0xe4, 0x93, 0xc7, 0x61, 0x90, 0x4b,
+	0x79, 0x80, 0x07, 0xb6, 0xda, 0x62, 0x12, 0x83, 0xb8, 0xb8, 0xd4, 0x7f, 0xd1, 0x6c, 0x13, 0x4e,
+	0x6e, 0x90, 0xad, 0xc4, 0xb2, 0xbf, 0xc4, 0xbb, 0x7b, 0x8a, 0x1b, 0xfb, 0x49, 0x83, 0x7a, 0x0e,
+	0xe2, 0x21, 0x79, 0x99, 0xb3, 0xd0, 0xc8, 0xbc, 0xb2, 0xe0, 0x68, 0x8d, 0x9c, 0xb3, 0x45, 0x3a,
+	0x39, 0x2d, 0xa5, 0x23, 0x21, 0x62, 0xe4, 0xde, 0x05, 0x5b, 0x5f, 0x28, 0xc3, 0x0e, 0xa9, 0x21,
+	0x91, 0xbe, 0x04, 0xc8, 0x8f, 0x70, 0x28, 0x0b, 0x6e, 0x1d, 0xa8, 0x8b, 0x7f, 0x5b, 0xb8, 0xf8,
+	0x7b, 0x29, 0x64, 0x21, 0x9b, 0x79, 0x2b, 0x4f, 0x78, 0xc8, 0x69, 0xac, 0xb6, 0xdf, 0x83, 0x59,
+	0xa4, 0xe4, 0x19, 0xd8, 0x7c, 0x1e, 0x21, 0x4f, 0x0f, 0x97, 0x96, 0xc4, 0x86, 0xea, 0xdd, 0x9e,
+	0xd2, 0xd2, 0x9b, 0x25, 0x19, 0x97, 0x7d, 0xac, 0xd5, 0x01, 0x23, 0x0b, 0x28, 0x31, 0xa1, 0x3a,
+	0x9d, 0x0c, 0x9d, 0xb1, 0xdb, 0xbb, 0xed, 0x0f, 0x9d, 0xa9, 0xf9, 0x42, 0x22, 0x23, 0xa7, 0x3b,
+	0xfc, 0x94, 0x22, 0x5a, 0x6b, 0x05, 0x95, 0x34, 0x9a, 0xa4, 0x0a, 0x95, 0x5e, 0x77, 0xda, 0xbf,
+	0x19, 0x8c, 0xaf, 0xcd, 0x17, 0xa4, 0x0e, 0xc7, 0xe3, 0x89, 0x9b, 0x01, 0x1a, 0x01, 0x28, 0x5f,
+	0x8f, 0x26, 0xbd, 0xee, 0xc8, 0xd4, 0xc9, 0x17, 0x50, 0xa7, 0x4e, 0xaf, 0xfb, 0xc1, 0x71, 0xaf,
+	0x6e, 0x69, 0x77, 0x3a, 0x98, 0x8c, 0xcd, 0x03, 0x72, 0x0c, 0x47, 0x57, 0xf4, 0x93, 0x4b, 0x6f,
+	0xc7, 0x66, 0x45, 0x2a, 0xc6, 0x13, 0xb7, 0x3f, 0x1a, 0x38, 0xe3, 0xa9, 0xdb, 0xef, 0xf6, 0x6f,
+	0x1c, 0xd3, 0x6c, 0x7d, 0x0f, 0xe5, 0x38, 0x9e, 0x72, 0xfa, 0xed, 0xf8, 0xca, 0xa1, 0xee, 0x68,
+	0xf0, 0x6e, 0x20, 0x8f, 0x76, 0x02, 0x30, 0xf9, 0x98, 0xd5, 0xda, 0xc5, 0xbf, 0x1a, 0xe8, 0x1f,
+	0xdf, 0x90, 0x10, 0x6a, 0xb9, 0xcf, 0x86, 0x14, 0xbd, 0x2d, 0xfe, 0x6b, 0x8d, 0xe6, 0xf3, 0x02,
+	0x1e, 0xda, 0x67, 0x7f, 0xfe, 0xf3, 0xdf, 0x5f, 0xfa, 0x4b, 0xfb, 0xb4, 0xf3, 0xf0, 0xa6, 0x93,
+	0xa3, 0x2f, 0xb5, 0x16, 0x41, 0x38, 0xde, 0xcb, 0x0b, 0x79, 0x5d, 0x18, 0x97, 0x8f, 0x57, 0xe3,
+	0x9b, 0xe7, 0x68, 0x1e, 0xda, 0xaf, 0xd4, 0x5e, 0xa7, 0xa4, 0x2e, 0xf7, 0xda, 0x23, 0x7b, 0xf5,
+	0xdf, 0x61, 0xd7, 0xf6, 0x87, 0xa6, 0xcd, 0xca, 0xea, 0xab, 0x7e, 0xfb, 0xff, 0x00, 0x1f, 0xac,
+	0x8a, 0x80, 0xeb, 0x05, 0x00, 0x00,
 }
@@ -17,13 +17,23 @@ limitations under the License.
 package gubernator
 
 import (
-	"github.com/pkg/errors"
 	"hash/crc32"
 	"sort"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type HashFunc func(data []byte) uint32
 
+var hashBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 128)
+		return &buf
+	},
+}
+
 // Implements PeerPicker
 type ConsistantHash struct {
 	hashFunc HashFunc
@@ -79,10 +89,14 @@ func (ch *ConsistantHash) GetPeerByHost(host string) *PeerClient {
 // Given a key, return the peer that key is assigned too
 func (ch *ConsistantHash) Get(key string) (*PeerClient, error) {
 	if ch.Size() == 0 {
-		return nil, errors.New("unable to pick a peer; pool is empty")
+		return nil, status.Error(codes.Unavailable, "unable to pick a peer; pool is empty")
 	}
 
-	hash := int(ch.hashFunc([]byte(key)))
+	// Hash from a pooled buffer, as converting the key to a []byte would allocate on every call
+	buf := hashBufPool.Get().(*[]byte)
+	*buf = append((*buf)[:0], key...)
+	hash := int(ch.hashFunc(*buf))
+	hashBufPool.Put(buf)
 
 	// Binary search for appropriate peer
 	idx := sort.Search(len(ch.peerKeys), func(i int) bool { return ch.peerKeys[i] >= hash })
@@ -0,0 +1,135 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"fmt"
+	"testing"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/stretchr/testify/require"
+)
+
+// Distinct rate limits must never share a hash key, else their counters merge
+func FuzzHashKey(f *testing.F) {
+	f.Add("a", "b_c", uint8(0), "a_b", "c", uint8(0))
+	f.Add("a", "b:c", uint8(0), "a:b", "c", uint8(0))
+	f.Add("1:a", "b", uint8(0), "1", "a_b", uint8(0))
+	f.Add("", "a_b", uint8(0), "a", "b", uint8(0))
+	f.Add("requests_per_sec", "account:1234", uint8(0), "requests_per_sec", "account:1234", uint8(0))
+	f.Add("a", "b", uint8(guber.Behavior_DRY_RUN), "a", "b", uint8(0))
+	f.Add("a", "b", uint8(guber.Behavior_DRY_RUN), "a", "b\x00dry_run", uint8(0))
+	f.Add("a", "b", uint8(guber.Behavior_DRY_RUN|guber.Behavior_GLOBAL), "a", "b", uint8(guber.Behavior_DRY_RUN))
+
+	f.Fuzz(func(t *testing.T, name1, key1 string, behavior1 uint8, name2, key2 string, behavior2 uint8) {
+		r1 := guber.RateLimitReq{Name: name1, UniqueKey: key1, Behavior: guber.Behavior(behavior1)}
+		r2 := guber.RateLimitReq{Name: name2, UniqueKey: key2, Behavior: guber.Behavior(behavior2)}
+
+		// Of the behaviors only DRY_RUN keeps the rate limit apart
+		dryRun1 := guber.HasBehavior(r1.Behavior, guber.Behavior_DRY_RUN)
+		dryRun2 := guber.HasBehavior(r2.Behavior, guber.Behavior_DRY_RUN)
+		if name1 == name2 && key1 == key2 && dryRun1 == dryRun2 {
+			require.Equal(t, r1.HashKey(), r2.HashKey())
+			return
+		}
+		require.NotEqual(t, r1.HashKey(), r2.HashKey(),
+			"name '%s' key '%s' behavior '%d' and name '%s' key '%s' behavior '%d'",
+			name1, key1, behavior1, name2, key2, behavior2)
+	})
+}
+
+// The peers are dialed once and shared by every run, the peer set of each run is the subset of
+// the pool selected by the bits of `mask`
+var pickerPool []*guber.PeerClient
+
+// containsPeer compares pointers, as the peers differ only by host which the tests can't access
+func containsPeer(peers []*guber.PeerClient, peer *guber.PeerClient) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+func FuzzConsistantHash(f *testing.F) {
+	for i := 0; i < 16; i++ {
+		peer, err := guber.NewPeerClient(guber.BehaviorConfig{}, fmt.Sprintf("10.0.0.%d:81", i))
+		require.Nil(f, err)
+		pickerPool = append(pickerPool, peer)
+	}
+
+	f.Add(uint16(0xffff), uint8(0), "account:1234")
+	f.Add(uint16(0x0001), uint8(0), "")
+	f.Add(uint16(0x8421), uint8(3), "requests_per_sec_account:1234")
+	f.Add(uint16(0x0000), uint8(0), "account:1234")
+
+	f.Fuzz(func(t *testing.T, mask uint16, removed uint8, key string) {
+		var peers []*guber.PeerClient
+		for i, peer := range pickerPool {
+			if mask&(1<<uint(i)) != 0 {
+				peers = append(peers, peer)
+			}
+		}
+
+		build := func(peers []*guber.PeerClient, reverse bool) guber.PeerPicker {
+			picker := guber.NewConsistantHash(nil).New()
+			for i := range peers {
+				if reverse {
+					picker.Add(peers[len(peers)-1-i])
+				} else {
+					picker.Add(peers[i])
+				}
+			}
+			return picker
+		}
+
+		picker := build(peers, false)
+		if len(peers) == 0 {
+			_, err := picker.Get(key)
+			require.NotNil(t, err)
+			return
+		}
+
+		peer, err := picker.Get(key)
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, peer))
+
+		// Stable for a fixed peer set, regardless of the order the peers were added
+		again, err := picker.Get(key)
+		require.Nil(t, err)
+		require.True(t, peer == again)
+		again, err = build(peers, true).Get(key)
+		require.Nil(t, err)
+		require.True(t, peer == again)
+
+		if len(peers) == 1 {
+			return
+		}
+
+		// Never picks a removed peer, and keys owned by the remaining peers do not move
+		idx := int(removed) % len(peers)
+		remaining := append(append([]*guber.PeerClient{}, peers[:idx]...), peers[idx+1:]...)
+		after, err := build(remaining, false).Get(key)
+		require.Nil(t, err)
+		require.False(t, after == peers[idx])
+		require.True(t, containsPeer(remaining, after))
+		if peer != peers[idx] {
+			require.True(t, peer == after)
+		}
+	})
+}
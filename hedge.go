@@ -0,0 +1,205 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The max number of hedges the budget saves up, such that an idle instance can't hedge a burst of requests
+const maxHedgeBurst = 10
+
+// hedger is the budget and the metrics of the hedges shared by the peer clients of an instance. Each request
+// eligible for a hedge earns BehaviorConfig.HedgeBudget of a hedge, and each hedge sent spends a whole one;
+// as such the hedges are capped to a fraction of the requests, and a cluster whose peers are all slow
+// doesn't double its own traffic.
+//
+// hedger is safe for concurrent use.
+type hedger struct {
+	delay  time.Duration
+	earn   float64
+	issued prometheus.Counter
+	won    prometheus.Counter
+
+	mutex  sync.Mutex
+	tokens float64 // protected by mutex
+}
+
+func newHedger(conf BehaviorConfig) *hedger {
+	return &hedger{
+		delay: conf.HedgeDelay,
+		earn:  conf.HedgeBudget,
+		issued: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "peer_hedges_issued",
+			Help: "The number of requests to a peer sent again as the peer was slow to respond.",
+		}),
+		won: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "peer_hedges_won",
+			Help: "The number of hedged requests to a peer answered first by the hedge.",
+		}),
+		tokens: maxHedgeBurst,
+	}
+}
+
+// request earns the budget of a request eligible for a hedge
+func (h *hedger) request() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.tokens += h.earn
+	if h.tokens > maxHedgeBurst {
+		h.tokens = maxHedgeBurst
+	}
+}
+
+// spend returns true if the budget allows a hedge, which is spent
+func (h *hedger) spend() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// hedgeable returns the request with a request token for each rate limit which lacks one, such that the
+// owner applies the rate limits once even if it receives both the request and its hedge; see
+// Instance.applyRateLimit(). Returns false if a rate limit can't be deduped by its token.
+func hedgeable(r *GetPeerRateLimitsReq) (*GetPeerRateLimitsReq, bool) {
+	if r.Handoff || len(r.Requests) == 0 {
+		return nil, false
+	}
+
+	var requests []*RateLimitReq
+	for i, req := range r.Requests {
+		// GLOBAL hits are deduped by the sequence of the peer instead, which a hedge would race with
+		if HasBehavior(req.Behavior, Behavior_GLOBAL) {
+			return nil, false
+		}
+		if req.RequestToken != "" || req.Hits == 0 {
+			continue
+		}
+		if requests == nil {
+			requests = make([]*RateLimitReq, len(r.Requests))
+			copy(requests, r.Requests)
+		}
+		cpy := *req
+		cpy.RequestToken = RandomString(20)
+		requests[i] = &cpy
+	}
+
+	if requests == nil {
+		return r, true
+	}
+	cpy := *r
+	cpy.Requests = requests
+	return &cpy, true
+}
+
+// hedgeResult is the answer to a request or to its hedge
+type hedgeResult struct {
+	resp  *GetPeerRateLimitsResp
+	err   error
+	hedge bool
+}
+
+// hedged sends the request to the peer and, if the peer hasn't responded within BehaviorConfig.HedgeDelay
+// and the budget allows, sends it again on the hedge connection; see hedgeConnection(). The first answer
+// which succeeds is returned and the other request is cancelled. A request which fails before the delay
+// is not hedged, the error is returned as is.
+func (c *PeerClient) hedged(ctx context.Context, r *GetPeerRateLimitsReq) (*GetPeerRateLimitsResp, error) {
+	c.hedger.request()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Both requests may still be running once we return
+	results := make(chan hedgeResult, 2)
+	client, conn := c.connection()
+	go func() {
+		resp, err := c.send(ctx, client, r)
+		// The request cancelled once the hedge won says nothing of the connection
+		if status.Code(err) != codes.Canceled {
+			c.observe(conn, err)
+		}
+		results <- hedgeResult{resp: resp, err: err}
+	}()
+
+	timer := time.NewTimer(c.hedger.delay)
+	defer timer.Stop()
+
+	pending := 1
+	var firstErr error
+	for {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if res.hedge {
+					c.hedger.won.Inc()
+				}
+				return res.resp, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		case <-timer.C:
+			if !c.hedger.spend() {
+				continue
+			}
+			hedge, err := c.hedgeConnection()
+			if err != nil {
+				c.log.WithError(err).Warn("while dialing the hedge connection to peer")
+				continue
+			}
+			c.hedger.issued.Inc()
+			pending++
+			go func() {
+				resp, err := c.send(ctx, hedge, r)
+				results <- hedgeResult{resp: resp, err: err, hedge: true}
+			}()
+		}
+	}
+}
+
+// hedgeConnection returns the client of the connection hedges are sent on, which is dialed on first use.
+// The hedge connection is apart from the connection requests are sent on, such that a hedge doesn't wait
+// behind the requests of a connection which stalled.
+func (c *PeerClient) hedgeConnection() (PeersV1Client, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil, errPeerShutdown
+	}
+	if c.hedgeConn == nil {
+		conn, err := c.dialPeer()
+		if err != nil {
+			return nil, err
+		}
+		c.hedgeConn, c.hedgeClient = conn, NewPeersV1Client(conn)
+	}
+	return c.hedgeClient, nil
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCKeyFunc extracts the rate limit unique key from the context of an incoming gRPC request
+type GRPCKeyFunc func(ctx context.Context) (string, error)
+
+// KeyFromPeer uses the IP address of the calling peer as the unique key
+func KeyFromPeer() GRPCKeyFunc {
+	return func(ctx context.Context) (string, error) {
+		p, ok := peer.FromContext(ctx)
+		if !ok || p.Addr == nil {
+			return "", errors.New("no peer found in context")
+		}
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			// Non IP based transports (IE: unix sockets, bufconn)
+			return p.Addr.String(), nil
+		}
+		return host, nil
+	}
+}
+
+// KeyFromMetadata uses the first value of the named metadata header as the unique key
+func KeyFromMetadata(name string) GRPCKeyFunc {
+	return func(ctx context.Context) (string, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		values := md.Get(name)
+		if len(values) == 0 || values[0] == "" {
+			return "", errors.Errorf("metadata '%s' is missing or empty", name)
+		}
+		return values[0], nil
+	}
+}
+
+// MethodLimit is the rate limit applied to calls of a gRPC method
+type MethodLimit struct {
+	// The number of calls that can occur for the duration of the rate limit
+	Limit int64
+	// The duration of the rate limit in milliseconds
+	Duration int64
+	// The rate limit algorithm, defaults to TOKEN_BUCKET
+	Algorithm Algorithm
+	// The rate limit behavior, defaults to BATCHING
+	Behavior Behavior
+}
+
+type InterceptorConfig struct {
+	// Required; The client used to check the rate limit
+	Client V1Client
+
+	// (Optional) Extracts the unique key from the request context. Defaults to KeyFromPeer()
+	KeyFunc GRPCKeyFunc
+
+	// (Optional) Rate limits keyed by the full method name IE: '/pb.gubernator.V1/HealthCheck'
+	Methods map[string]MethodLimit
+
+	// (Optional) The rate limit applied to methods not found in `Methods`. If nil
+	// methods not found in `Methods` are not rate limited.
+	Default *MethodLimit
+
+	// (Optional) The max time a call will wait on gubernator for an answer. Defaults to 100ms
+	Timeout time.Duration
+
+	// (Optional) If true calls are allowed through when gubernator returns an error or
+	// does not respond within `Timeout`. Else the call is rejected with UNAVAILABLE
+	FailOpen bool
+}
+
+// Interceptor rate limits incoming calls to gRPC services using gubernator
+type Interceptor struct {
+	conf      InterceptorConfig
+	decisions *prometheus.CounterVec
+}
+
+func NewInterceptor(conf InterceptorConfig) (*Interceptor, error) {
+	if conf.Client == nil {
+		return nil, errors.New("Client is required")
+	}
+
+	if conf.KeyFunc == nil {
+		conf.KeyFunc = KeyFromPeer()
+	}
+	holster.SetDefault(&conf.Timeout, time.Millisecond*100)
+
+	return &Interceptor{
+		conf: conf,
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "interceptor_decision_counts",
+			Help: "Rate limit decisions made by the gRPC interceptor.",
+		}, []string{"decision", "method"}),
+	}, nil
+}
+
+// UnaryServerInterceptor returns an interceptor which rate limits unary calls
+func (i *Interceptor) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if err := i.check(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor which rate limits the creation of streams
+func (i *Interceptor) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		if err := i.check(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// check returns a gRPC status error if the call should be rejected
+func (i *Interceptor) check(ctx context.Context, method string) error {
+	limit, ok := i.conf.Methods[method]
+	if !ok {
+		if i.conf.Default == nil {
+			return nil
+		}
+		limit = *i.conf.Default
+	}
+
+	key, err := i.conf.KeyFunc(ctx)
+	if err != nil {
+		i.decisions.WithLabelValues("errored", method).Inc()
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	rl, err := i.getRateLimit(ctx, method, key, limit)
+	if err != nil {
+		i.decisions.WithLabelValues("errored", method).Inc()
+		if i.conf.FailOpen {
+			return nil
+		}
+		return status.Errorf(codes.Unavailable, "while checking rate limit - '%s'", err)
+	}
+
+	if rl.Status == Status_OVER_LIMIT {
+		i.decisions.WithLabelValues("limited", method).Inc()
+		return overLimitError(rl)
+	}
+
+	i.decisions.WithLabelValues("allowed", method).Inc()
+	return nil
+}
+
+func (i *Interceptor) getRateLimit(ctx context.Context, method, key string, limit MethodLimit) (*RateLimitResp, error) {
+	ctx, cancel := context.WithTimeout(ctx, i.conf.Timeout)
+	defer cancel()
+
+	resp, err := i.conf.Client.GetRateLimits(ctx, &GetRateLimitsReq{
+		Requests: []*RateLimitReq{
+			{
+				Name:      method,
+				UniqueKey: key,
+				Hits:      1,
+				Limit:     limit.Limit,
+				Duration:  limit.Duration,
+				Algorithm: limit.Algorithm,
+				Behavior:  limit.Behavior,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Responses) != 1 {
+		return nil, errors.New("number of rate limits in response does not match request")
+	}
+
+	rl := resp.Responses[0]
+	if rl.Error != "" {
+		return nil, errors.New(rl.Error)
+	}
+	return rl, nil
+}
+
+// overLimitError returns a RESOURCE_EXHAUSTED status which informs the
+// caller how long it should wait before retrying
+func overLimitError(rl *RateLimitResp) error {
+	s := status.New(codes.ResourceExhausted, "rate limit exceeded")
+
+	var delay time.Duration
+	if wait := rl.ResetTime - cache.MillisecondNow(); wait > 0 {
+		delay = time.Duration(wait) * time.Millisecond
+	}
+
+	ds, err := s.WithDetails(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(delay)})
+	if err != nil {
+		return s.Err()
+	}
+	return ds.Err()
+}
+
+// Describe fetches prometheus metrics to be registered
+func (i *Interceptor) Describe(ch chan<- *prometheus.Desc) {
+	i.decisions.Describe(ch)
+}
+
+// Collect fetches metrics from the interceptor for use by prometheus
+func (i *Interceptor) Collect(ch chan<- prometheus.Metric) {
+	i.decisions.Collect(ch)
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startHealthService starts a health service over bufconn which is
+// rate limited by the interceptor provided.
+func startHealthService(t *testing.T, i *guber.Interceptor) (healthpb.HealthClient, func()) {
+	listener := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(i.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(i.StreamServerInterceptor()))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(listener)
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	require.Nil(t, err)
+
+	return healthpb.NewHealthClient(conn), func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	client, errs := guber.DialV1Server(testCluster.GetPeer())
+	require.Nil(t, errs)
+
+	i, err := guber.NewInterceptor(guber.InterceptorConfig{
+		Client:  client,
+		KeyFunc: guber.KeyFromMetadata("x-account"),
+		Methods: map[string]guber.MethodLimit{
+			"/grpc.health.v1.Health/Check": {Limit: 2, Duration: guber.Minute},
+		},
+		Default: &guber.MethodLimit{Limit: 1, Duration: guber.Minute},
+	})
+	require.Nil(t, err)
+
+	health, stop := startHealthService(t, i)
+	defer stop()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-account", "account:1234")
+
+	tests := []codes.Code{codes.OK, codes.OK, codes.ResourceExhausted}
+	for idx, code := range tests {
+		_, err := health.Check(ctx, &healthpb.HealthCheckRequest{})
+		s := status.Convert(err)
+		require.Equal(t, code, s.Code(), idx)
+
+		if code == codes.ResourceExhausted {
+			require.Len(t, s.Details(), 1)
+			info, ok := s.Details()[0].(*errdetails.RetryInfo)
+			require.True(t, ok)
+			assert.True(t, info.RetryDelay.Seconds > 0)
+		}
+	}
+
+	// Watch uses the default limit
+	for idx, code := range []codes.Code{codes.OK, codes.ResourceExhausted} {
+		stream, err := health.Watch(ctx, &healthpb.HealthCheckRequest{})
+		require.Nil(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, code, status.Code(err), idx)
+	}
+
+	// Missing the key metadata
+	_, err = health.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Ensure our decisions were counted
+	reg := prometheus.NewRegistry()
+	require.Nil(t, reg.Register(i))
+	families, err := reg.Gather()
+	require.Nil(t, err)
+
+	counts := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.Metric {
+			counts[labelValue(m, "decision")] += *m.Counter.Value
+		}
+	}
+	assert.Equal(t, float64(3), counts["allowed"])
+	assert.Equal(t, float64(2), counts["limited"])
+	assert.Equal(t, float64(1), counts["errored"])
+}
+
+func TestInterceptorFailure(t *testing.T) {
+	// Nothing is listening on this address
+	client, errs := guber.DialV1Server("127.0.0.1:1")
+	require.Nil(t, errs)
+
+	for _, failOpen := range []bool{true, false} {
+		i, err := guber.NewInterceptor(guber.InterceptorConfig{
+			Client:   client,
+			Default:  &guber.MethodLimit{Limit: 1, Duration: guber.Minute},
+			FailOpen: failOpen,
+		})
+		require.Nil(t, err)
+
+		health, stop := startHealthService(t, i)
+		_, err = health.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		if failOpen {
+			assert.Nil(t, err)
+		} else {
+			assert.Equal(t, codes.Unavailable, status.Code(err))
+		}
+		stop()
+	}
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.Label {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
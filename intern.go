@@ -0,0 +1,78 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/mailgun/holster"
+)
+
+// The max number of rate limit names interned by an instance
+const maxInternedNames = 1024
+
+// InternTable returns a canonical copy of the strings it is given, such that many requests with
+// the same rate limit name share a single copy of the name instead of each retaining its own.
+// The table is bounded; once full the least recently interned string is dropped from the table,
+// as such an unbounded number of unique names can not grow it forever. A dropped string is not
+// freed until nothing else references it, but it is no longer shared with new callers.
+//
+// InternTable is safe for concurrent use.
+type InternTable struct {
+	mutex   sync.Mutex
+	strs    map[string]*list.Element
+	ll      *list.List
+	maxSize int
+}
+
+// NewInternTable creates an InternTable which holds at most `maxSize` strings
+func NewInternTable(maxSize int) *InternTable {
+	holster.SetDefault(&maxSize, maxInternedNames)
+
+	return &InternTable{
+		strs:    make(map[string]*list.Element, maxSize),
+		ll:      list.New(),
+		maxSize: maxSize,
+	}
+}
+
+// Intern returns the canonical copy of `s`
+func (t *InternTable) Intern(s string) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if ele, ok := t.strs[s]; ok {
+		t.ll.MoveToFront(ele)
+		return ele.Value.(string)
+	}
+
+	if t.ll.Len() >= t.maxSize {
+		ele := t.ll.Back()
+		t.ll.Remove(ele)
+		delete(t.strs, ele.Value.(string))
+	}
+	t.strs[s] = t.ll.PushFront(s)
+	return s
+}
+
+// Size returns the number of strings in the table
+func (t *InternTable) Size() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.ll.Len()
+}
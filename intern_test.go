@@ -0,0 +1,123 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/golang/protobuf/proto"
+	guber "github.com/mailgun/gubernator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInternTable(t *testing.T) {
+	table := guber.NewInternTable(2)
+
+	a := table.Intern(string([]byte("requests_per_sec")))
+	b := table.Intern(string([]byte("requests_per_sec")))
+	assert.Equal(t, "requests_per_sec", b)
+	// The second copy is replaced with the first
+	assert.Equal(t, stringData(a), stringData(b))
+
+	table.Intern("b")
+	table.Intern("c")
+	assert.Equal(t, 2, table.Size())
+
+	// The least recently interned string was dropped, so a new copy is returned
+	c := table.Intern(string([]byte("requests_per_sec")))
+	assert.NotEqual(t, stringData(a), stringData(c))
+}
+
+func TestInternTableConcurrent(t *testing.T) {
+	table := guber.NewInternTable(50)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				name := fmt.Sprintf("name_%d", (i*j)%100)
+				if got := table.Intern(name); got != name {
+					t.Errorf("expected '%s'; got '%s'", name, got)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 50, table.Size())
+}
+
+// stringData returns the address of the bytes backing the string
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+// Reports the heap retained by 100k queued requests which share 200 distinct names,
+// with and without the names interned. Each request is unmarshalled from the wire
+// such that every name starts out as a separate copy, as it would in the server.
+func BenchmarkInternTable(b *testing.B) {
+	const requests = 100000
+	const names = 200
+
+	wire := make([][]byte, names)
+	for i := range wire {
+		var err error
+		wire[i], err = proto.Marshal(&guber.RateLimitReq{
+			Name: fmt.Sprintf("rate_limit_name_used_by_some_service_%d", i),
+		})
+		require.Nil(b, err)
+	}
+
+	for _, intern := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Intern=%t", intern), func(b *testing.B) {
+			table := guber.NewInternTable(0)
+
+			var retained uint64
+			for n := 0; n < b.N; n++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				queued := make([]string, requests)
+				for i := range queued {
+					var r guber.RateLimitReq
+					if err := proto.Unmarshal(wire[i%names], &r); err != nil {
+						b.Fatal(err)
+					}
+					if intern {
+						r.Name = table.Intern(r.Name)
+					}
+					queued[i] = r.Name
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained += after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(queued)
+			}
+			b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+		})
+	}
+}
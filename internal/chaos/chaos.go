@@ -0,0 +1,415 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package chaos runs a cluster of gubernator instances in this process and injects faults into the
+// cluster while a workload runs, such that tests can assert the rate limits hold while nodes fail.
+//
+// The harness checks three invariants after each scenario:
+//
+//   - The hits admitted for each rate limit never exceed Limit * (1 + Slack). Each change in membership
+//     can move a rate limit to a new owner which starts counting from zero, as such Slack is the number
+//     of membership changes made by the faults. Faults which leave the membership alone, such as a
+//     partition or latency, can cause errors but never admit additional hits.
+//   - No go routines are leaked once the cluster is stopped.
+//   - The scenario completes within its Timeout; a deadlock fails the scenario with the stacks of
+//     every go routine instead of hanging the test.
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/mailgun/gubernator"
+	"github.com/mailgun/gubernator/cache"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Workload is the traffic sent to the cluster while the faults are injected
+type Workload struct {
+	// The number of distinct rate limits hit
+	Keys int
+	// The limit of each rate limit. The duration of the rate limits is longer than any scenario,
+	// as such no rate limit resets and each admits at most Limit hits without faults.
+	Limit int64
+	// The number of go routines sending requests concurrently
+	Clients int
+	// How long to wait for each request, defaults to a second
+	RequestTimeout time.Duration
+}
+
+// Scenario is a cluster, a workload and the faults injected while the workload runs
+type Scenario struct {
+	Name string
+	// The number of nodes in the cluster
+	Nodes    int
+	Workload Workload
+	// How long the workload runs. The faults are injected at even intervals during this time.
+	Duration time.Duration
+	Faults   []Fault
+	// The scenario fails if it has not completed by this time, defaults to Duration plus 30 seconds
+	Timeout time.Duration
+	// Seeds the choices made by the faults, such that a failed scenario can be repeated
+	Seed int64
+	// The template for the config of each instance, see StartCluster()
+	Config gubernator.Config
+}
+
+// Result is what was observed while the scenario ran
+type Result struct {
+	// The hits admitted by each rate limit
+	Admitted map[string]int64
+	// The number of requests sent and the number which failed
+	Requests int64
+	Errors   int64
+	// The number of membership changes made by the faults, see Slack
+	MembershipChanges int
+}
+
+// Slack is the number of additional multiples of the limit a rate limit may admit, see the package docs
+func (r *Result) Slack() int64 {
+	return int64(r.MembershipChanges)
+}
+
+// Fault is injected into the cluster while the workload runs
+type Fault interface {
+	Inject(c *Cluster, rnd *rand.Rand) error
+	String() string
+}
+
+// Run runs the scenario and returns an error if any of the invariants were violated
+func Run(s Scenario) (*Result, error) {
+	if s.Timeout == 0 {
+		s.Timeout = s.Duration + 30*time.Second
+	}
+	if s.Workload.RequestTimeout == 0 {
+		s.Workload.RequestTimeout = time.Second
+	}
+
+	// The clock shared by the caches runs for the life of the process, start it such that it's not a leak
+	cache.DefaultCoarseClock.Millis()
+	goroutines := runtime.NumGoroutine()
+
+	var result *Result
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, err = run(s)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(s.Timeout):
+		return nil, errors.Errorf("scenario '%s' did not complete within '%s'; possible deadlock\n%s",
+			s.Name, s.Timeout, stacks())
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "scenario '%s'", s.Name)
+	}
+
+	for key, admitted := range result.Admitted {
+		if max := s.Workload.Limit * (1 + result.Slack()); admitted > max {
+			return result, errors.Errorf("scenario '%s' admitted '%d' hits for '%s'; the limit is '%d' "+
+				"with a slack of '%d' membership changes", s.Name, admitted, key, s.Workload.Limit, result.Slack())
+		}
+	}
+
+	if err := waitForGoroutines(goroutines, 10*time.Second); err != nil {
+		return result, errors.Wrapf(err, "scenario '%s'", s.Name)
+	}
+	return result, nil
+}
+
+func run(s Scenario) (*Result, error) {
+	c, err := StartCluster(s.Nodes, s.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Duration)
+	defer cancel()
+
+	result := &Result{Admitted: make(map[string]int64)}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < s.Workload.Clients; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for ctx.Err() == nil {
+				key := fmt.Sprintf("account:%d", rnd.Intn(s.Workload.Keys))
+				admitted, err := c.hit(rnd, key, s.Workload)
+
+				mutex.Lock()
+				result.Requests++
+				if err != nil {
+					result.Errors++
+				} else if admitted {
+					result.Admitted[key]++
+				}
+				mutex.Unlock()
+			}
+		}(s.Seed + int64(i) + 1)
+	}
+
+	// Inject the faults at even intervals while the workload runs
+	rnd := rand.New(rand.NewSource(s.Seed))
+	interval := s.Duration / time.Duration(len(s.Faults)+1)
+	for _, fault := range s.Faults {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+		}
+		if err := fault.Inject(c, rnd); err != nil {
+			cancel()
+			wg.Wait()
+			return nil, errors.Wrapf(err, "while injecting fault '%s'", fault)
+		}
+	}
+
+	<-ctx.Done()
+	wg.Wait()
+	result.MembershipChanges = c.MembershipChanges()
+	return result, nil
+}
+
+// Node is a gubernator instance in the cluster
+type Node struct {
+	Address  string
+	Instance *gubernator.Instance
+	server   *grpc.Server
+	conn     *grpc.ClientConn
+	client   gubernator.V1Client
+
+	mutex   sync.Mutex
+	alive   bool                // protected by mutex
+	dropped map[string]struct{} // protected by mutex
+	latency time.Duration       // protected by mutex
+}
+
+// intercept injects the faults of the node into the peer requests it receives. The peer which sent a request
+// is identified by the sender field of the request; requests from clients have no sender and are unaffected.
+func (n *Node) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	r, ok := req.(interface{ GetSender() string })
+	if !ok || r.GetSender() == "" {
+		return handler(ctx, req)
+	}
+
+	n.mutex.Lock()
+	_, dropped := n.dropped[r.GetSender()]
+	latency := n.latency
+	n.mutex.Unlock()
+
+	if dropped {
+		return nil, status.Errorf(codes.Unavailable, "chaos: partitioned from '%s'", r.GetSender())
+	}
+	if latency != 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return handler(ctx, req)
+}
+
+// Alive returns true if the node was not killed
+func (n *Node) Alive() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.alive
+}
+
+// Cluster is a cluster of nodes which faults can be injected into
+type Cluster struct {
+	Nodes []*Node
+
+	mutex       sync.Mutex
+	members     []*Node // protected by mutex
+	memberships int     // protected by mutex
+}
+
+// StartCluster starts a cluster of `size` nodes listening on random local ports. `conf` is used as the
+// template for the config of each instance, the GRPCServer and the Picker are replaced for each instance.
+func StartCluster(size int, conf gubernator.Config) (*Cluster, error) {
+	c := &Cluster{}
+	for i := 0; i < size; i++ {
+		n := &Node{alive: true, dropped: make(map[string]struct{})}
+		n.server = grpc.NewServer(grpc.UnaryInterceptor(n.intercept))
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			c.Stop()
+			return nil, errors.Wrap(err, "while listening on random interface")
+		}
+		n.Address = listener.Addr().String()
+
+		instConf := conf
+		instConf.GRPCServer = n.server
+		instConf.Picker = nil
+		if conf.Picker != nil {
+			instConf.Picker = conf.Picker.New()
+		}
+
+		n.Instance, err = gubernator.New(instConf)
+		if err != nil {
+			listener.Close()
+			c.Stop()
+			return nil, errors.Wrap(err, "while creating new gubernator instance")
+		}
+		go n.server.Serve(listener)
+		c.Nodes = append(c.Nodes, n)
+
+		n.conn, err = grpc.Dial(n.Address, grpc.WithInsecure())
+		if err != nil {
+			c.Stop()
+			return nil, errors.Wrapf(err, "while dialing '%s'", n.Address)
+		}
+		n.client = gubernator.NewV1Client(n.conn)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.setMembers(c.Nodes)
+	// Forming the cluster is not a change in membership
+	c.memberships = 0
+	return c, nil
+}
+
+// setMembers tells every live node the cluster consists of `members`. A live node which is not a member
+// is told the same, such that it forwards every request to the members. The caller must hold the mutex.
+func (c *Cluster) setMembers(members []*Node) {
+	for _, n := range c.Nodes {
+		if !n.Alive() {
+			continue
+		}
+		var peers []gubernator.PeerInfo
+		for _, m := range members {
+			peers = append(peers, gubernator.PeerInfo{Address: m.Address, IsOwner: m == n})
+		}
+		n.Instance.SetPeers(peers)
+	}
+	c.members = members
+	c.memberships++
+}
+
+// MembershipChanges returns the number of times the membership of the cluster changed
+func (c *Cluster) MembershipChanges() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.memberships
+}
+
+// Members returns the nodes the cluster currently consists of
+func (c *Cluster) Members() []*Node {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*Node{}, c.members...)
+}
+
+// hit sends a single hit for `key` to a random live node. Returns true if the hit was admitted.
+func (c *Cluster) hit(rnd *rand.Rand, key string, w Workload) (bool, error) {
+	var alive []*Node
+	for _, n := range c.Nodes {
+		if n.Alive() {
+			alive = append(alive, n)
+		}
+	}
+	if len(alive) == 0 {
+		return false, errors.New("every node is dead")
+	}
+	n := alive[rnd.Intn(len(alive))]
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.RequestTimeout)
+	defer cancel()
+	resp, err := n.client.GetRateLimits(ctx, &gubernator.GetRateLimitsReq{
+		Requests: []*gubernator.RateLimitReq{
+			{
+				Name:      "chaos",
+				UniqueKey: key,
+				Hits:      1,
+				Limit:     w.Limit,
+				Duration:  gubernator.Minute * 60,
+			},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	rl := resp.Responses[0]
+	if rl.Error != "" {
+		return false, errors.New(rl.Error)
+	}
+	return rl.Status == gubernator.Status_UNDER_LIMIT, nil
+}
+
+// Stop stops every node in the cluster
+func (c *Cluster) Stop() {
+	for _, n := range c.Nodes {
+		if n.conn != nil {
+			n.conn.Close()
+		}
+		n.kill()
+	}
+}
+
+// kill stops the node without telling the other nodes; IE: the process died
+func (n *Node) kill() {
+	n.mutex.Lock()
+	alive := n.alive
+	n.alive = false
+	n.mutex.Unlock()
+
+	if alive {
+		n.server.Stop()
+		n.Instance.Close()
+	}
+}
+
+// waitForGoroutines waits for the number of go routines to return to `want`, as the go routines of
+// stopped servers and closed connections take a moment to exit.
+func waitForGoroutines(want int, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		got := runtime.NumGoroutine()
+		if got <= want {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("leaked '%d' go routines\n%s", got-want, stacks())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// stacks returns the stack of every go routine
+func stacks() string {
+	buf := make([]byte, 1<<20)
+	return string(buf[:runtime.Stack(buf, true)])
+}
@@ -0,0 +1,59 @@
+//go:build chaos
+
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chaos_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mailgun/gubernator/internal/chaos"
+	"github.com/stretchr/testify/require"
+)
+
+// Injects every kind of fault repeatedly into a larger cluster. Run with `go test -tags chaos -timeout 30m`
+func TestChaosLong(t *testing.T) {
+	for seed := int64(0); seed < 5; seed++ {
+		result, err := chaos.Run(chaos.Scenario{
+			Name:  "everything",
+			Nodes: 8,
+			Workload: chaos.Workload{
+				Keys:    500,
+				Limit:   200,
+				Clients: 32,
+			},
+			Duration: 2 * time.Minute,
+			Seed:     seed,
+			Faults: []chaos.Fault{
+				chaos.Latency{Delay: 50 * time.Millisecond, Duration: 5 * time.Second},
+				chaos.Partition{Duration: 5 * time.Second},
+				chaos.FlapMembership{Down: 2 * time.Second},
+				chaos.KillNode{DetectAfter: time.Second},
+				chaos.Partition{Duration: 10 * time.Second},
+				chaos.Latency{Delay: 500 * time.Millisecond, Duration: 5 * time.Second},
+				chaos.FlapMembership{Down: 5 * time.Second},
+				chaos.KillNode{DetectAfter: 5 * time.Second},
+				chaos.Partition{Duration: 5 * time.Second},
+				chaos.FlapMembership{Down: 500 * time.Millisecond},
+			},
+		})
+		require.NoError(t, err, "seed %d", seed)
+		t.Logf("seed: %d requests: %d errors: %d membership changes: %d",
+			seed, result.Requests, result.Errors, result.MembershipChanges)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chaos_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mailgun/gubernator/internal/chaos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var workload = chaos.Workload{
+	Keys:    20,
+	Limit:   10,
+	Clients: 8,
+}
+
+// A short version of each scenario which runs with every test run, see chaos_long_test.go for the long version
+func TestChaos(t *testing.T) {
+	scenarios := []chaos.Scenario{
+		{
+			Name:     "no faults",
+			Nodes:    4,
+			Workload: workload,
+			Duration: time.Second,
+		},
+		{
+			Name:     "kill a node",
+			Nodes:    4,
+			Workload: workload,
+			Duration: time.Second,
+			Faults:   []chaos.Fault{chaos.KillNode{DetectAfter: 100 * time.Millisecond}},
+		},
+		{
+			Name:     "partition a pair",
+			Nodes:    4,
+			Workload: workload,
+			Duration: time.Second,
+			Faults:   []chaos.Fault{chaos.Partition{Duration: 300 * time.Millisecond}},
+		},
+		{
+			Name:     "latency",
+			Nodes:    4,
+			Workload: workload,
+			Duration: time.Second,
+			Faults:   []chaos.Fault{chaos.Latency{Delay: 20 * time.Millisecond, Duration: 300 * time.Millisecond}},
+		},
+		{
+			Name:     "flap membership",
+			Nodes:    4,
+			Workload: workload,
+			Duration: time.Second,
+			Faults:   []chaos.Fault{chaos.FlapMembership{Down: 200 * time.Millisecond}},
+		},
+	}
+
+	for i, s := range scenarios {
+		s.Seed = int64(i)
+		t.Run(s.Name, func(t *testing.T) {
+			result, err := chaos.Run(s)
+			require.NoError(t, err)
+			assert.NotZero(t, result.Requests)
+			t.Logf("requests: %d errors: %d membership changes: %d",
+				result.Requests, result.Errors, result.MembershipChanges)
+
+			// Without faults which change the membership each rate limit admits exactly the limit
+			if result.MembershipChanges == 0 {
+				for key, admitted := range result.Admitted {
+					assert.Equal(t, workload.Limit, admitted, key)
+				}
+			}
+		})
+	}
+}
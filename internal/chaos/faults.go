@@ -0,0 +1,153 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chaos
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// KillNode stops a random member of the cluster without telling the other members, as if the process died.
+// The other members are told the node left the cluster after DetectAfter; IE: the time it takes the
+// discovery mechanism to notice. Requests forwarded to the node in the meantime fail.
+type KillNode struct {
+	DetectAfter time.Duration
+}
+
+func (f KillNode) Inject(c *Cluster, rnd *rand.Rand) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.members) < 2 {
+		return errors.New("refusing to kill the last member of the cluster")
+	}
+	victim := c.members[rnd.Intn(len(c.members))]
+	victim.kill()
+
+	time.Sleep(f.DetectAfter)
+	c.setMembers(without(c.members, victim))
+	return nil
+}
+
+func (f KillNode) String() string {
+	return fmt.Sprintf("kill node (detected after %s)", f.DetectAfter)
+}
+
+// Partition drops the peer requests between two random members of the cluster for Duration, then heals
+// the partition. The membership of the cluster is unchanged, as such requests forwarded across the partition
+// fail. Only the peer requests are dropped; clients can still reach both members.
+type Partition struct {
+	Duration time.Duration
+}
+
+func (f Partition) Inject(c *Cluster, rnd *rand.Rand) error {
+	members := c.Members()
+	if len(members) < 2 {
+		return errors.New("a partition requires at least two members")
+	}
+	i := rnd.Intn(len(members))
+	j := (i + 1 + rnd.Intn(len(members)-1)) % len(members)
+	a, b := members[i], members[j]
+
+	a.drop(b.Address, true)
+	b.drop(a.Address, true)
+	time.Sleep(f.Duration)
+	a.drop(b.Address, false)
+	b.drop(a.Address, false)
+	return nil
+}
+
+func (f Partition) String() string {
+	return fmt.Sprintf("partition a pair for %s", f.Duration)
+}
+
+// Latency delays every peer request received by the members of the cluster by Delay for Duration
+type Latency struct {
+	Delay    time.Duration
+	Duration time.Duration
+}
+
+func (f Latency) Inject(c *Cluster, rnd *rand.Rand) error {
+	members := c.Members()
+	for _, n := range members {
+		n.setLatency(f.Delay)
+	}
+	time.Sleep(f.Duration)
+	for _, n := range members {
+		n.setLatency(0)
+	}
+	return nil
+}
+
+func (f Latency) String() string {
+	return fmt.Sprintf("%s latency for %s", f.Delay, f.Duration)
+}
+
+// FlapMembership removes a random member from the cluster for Down, then adds it back. The node keeps
+// running while it is not a member and forwards the requests it receives to the members. This is two
+// changes in membership.
+type FlapMembership struct {
+	Down time.Duration
+}
+
+func (f FlapMembership) Inject(c *Cluster, rnd *rand.Rand) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.members) < 2 {
+		return errors.New("refusing to remove the last member of the cluster")
+	}
+	members := c.members
+	c.setMembers(without(members, members[rnd.Intn(len(members))]))
+
+	time.Sleep(f.Down)
+	c.setMembers(members)
+	return nil
+}
+
+func (f FlapMembership) String() string {
+	return fmt.Sprintf("flap membership for %s", f.Down)
+}
+
+func (n *Node) drop(sender string, drop bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if drop {
+		n.dropped[sender] = struct{}{}
+		return
+	}
+	delete(n.dropped, sender)
+}
+
+func (n *Node) setLatency(d time.Duration) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.latency = d
+}
+
+func without(nodes []*Node, node *Node) []*Node {
+	var result []*Node
+	for _, n := range nodes {
+		if n != node {
+			result = append(result, n)
+		}
+	}
+	return result
+}
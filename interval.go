@@ -34,18 +34,23 @@ type Interval struct {
 func NewInterval(d time.Duration) *Interval {
 	i := Interval{
 		C:  make(chan struct{}, 1),
-		in: make(chan struct{}),
+		in: make(chan struct{}, 1),
 	}
-	go i.run(d)
+	i.run(d)
 	return &i
 }
 
+// run starts the interval go routine via the WaitGroup, such that Stop() never races with the start
 func (i *Interval) run(d time.Duration) {
 	i.wg.Until(func(done chan struct{}) bool {
 		select {
 		case <-i.in:
 			time.Sleep(d)
-			i.C <- struct{}{}
+			select {
+			case i.C <- struct{}{}:
+			case <-done:
+				return false
+			}
 			return true
 		case <-done:
 			return false
@@ -58,7 +63,7 @@ func (i *Interval) Stop() {
 }
 
 // Next queues the next interval to run, If multiple calls to Next() are
-// made before previous intervals have completed they are ignored.
+// made before the queued interval has started they are ignored.
 func (i *Interval) Next() {
 	select {
 	case i.in <- struct{}{}:
@@ -0,0 +1,177 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// The max number of names the new keys are counted for, the least recently used names are forgotten
+const maxKeyFloodNames = 10000
+
+// KeyFloodAction is how a rate limit with a new unique key is answered once its name reached the cap
+// of new keys of its KeyFloodRule
+type KeyFloodAction int
+
+const (
+	// The rate limit is answered as UNDER_LIMIT without caching it, such that the flood can't evict the
+	// rate limits in use. The hits of the rate limit are not counted.
+	KeyFloodUnderLimit KeyFloodAction = iota
+	// The rate limit is answered as OVER_LIMIT, with a reset time of when new keys are accepted again
+	KeyFloodOverLimit
+)
+
+var keyFloodActions = map[KeyFloodAction]string{
+	KeyFloodUnderLimit: "under_limit",
+	KeyFloodOverLimit:  "over_limit",
+}
+
+func (a KeyFloodAction) String() string {
+	if s, ok := keyFloodActions[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("KeyFloodAction(%d)", int(a))
+}
+
+// ParseKeyFloodAction returns the action named by KeyFloodAction.String()
+func ParseKeyFloodAction(s string) (KeyFloodAction, error) {
+	for a, name := range keyFloodActions {
+		if strings.EqualFold(s, name) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key flood action '%s'; expected 'under_limit' or 'over_limit'", s)
+}
+
+// KeyFloodRule caps the number of rate limits with a new unique key created per interval for each name
+// it matches. A client which can influence the unique key, IE: a rate limit per email address, could
+// otherwise flood the cache with unique keys and evict the rate limits in use. See Config.KeyFloodRules
+type KeyFloodRule struct {
+	// The names of the rate limits the rule applies to, a pattern as matched by path.Match(); IE: "email_*"
+	Pattern string
+	// The max number of new unique keys per Interval for each name matched
+	Limit    int64
+	Interval time.Duration
+	// How a rate limit with a new unique key is answered once its name reached the Limit
+	Action KeyFloodAction
+}
+
+// keyFloodGuard enforces the KeyFloodRules. The new keys of each name are counted by a fixed window
+// counter held by a private cache, which is a tiny rate limit of its own.
+//
+// keyFloodGuard is safe for concurrent use.
+type keyFloodGuard struct {
+	rules  []KeyFloodRule
+	log    *logrus.Entry
+	metric *prometheus.CounterVec
+
+	mutex sync.Mutex
+	names *cache.LRUCache // protected by mutex
+}
+
+func newKeyFloodGuard(rules []KeyFloodRule, clock holster.Clock) *keyFloodGuard {
+	names := cache.NewLRUCache(maxKeyFloodNames)
+	names.SetClock(clock)
+	return &keyFloodGuard{
+		rules: rules,
+		log:   log.WithField("category", "key-flood"),
+		metric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "key_flood_detected",
+			Help: "The number of rate limits with a new unique key refused, by the name which reached its cap.",
+		}, []string{"name"}),
+		names: names,
+	}
+}
+
+// rule returns the first rule which matches the name, nil if none does
+func (g *keyFloodGuard) rule(name string) *KeyFloodRule {
+	for i := range g.rules {
+		if ok, _ := path.Match(g.rules[i].Pattern, name); ok {
+			return &g.rules[i]
+		}
+	}
+	return nil
+}
+
+// check counts the rate limit against the cap of its name if its key is not in the cache. Returns the
+// response of the rule once the cap is reached, else nil and the rate limit can be applied as usual. The
+// caller must have exclusive access to the cache.
+func (g *keyFloodGuard) check(c cache.Cache, key cache.Key, r *RateLimitReq, now int64) *RateLimitResp {
+	if _, ok := getAt(c, key, now); ok {
+		return nil
+	}
+	rule := g.rule(r.Name)
+	if rule == nil {
+		return nil
+	}
+
+	g.mutex.Lock()
+	count, allowed, resetAt := g.names.Hit(r.Name, rule.Interval, rule.Limit)
+	g.mutex.Unlock()
+	if allowed {
+		return nil
+	}
+
+	g.metric.WithLabelValues(r.Name).Inc()
+	if count == rule.Limit+1 {
+		g.log.Warnf("key flood detected for rate limit '%s'; more than '%d' new unique keys in '%s', "+
+			"answering new keys as '%s'", r.Name, rule.Limit, rule.Interval, rule.Action)
+	}
+
+	if rule.Action == KeyFloodOverLimit {
+		return &RateLimitResp{Status: Status_OVER_LIMIT, Limit: r.Limit, ResetTime: resetAt}
+	}
+	rl := &RateLimitResp{
+		Status:    Status_UNDER_LIMIT,
+		Limit:     r.Limit,
+		Remaining: r.Limit - r.Hits,
+		ResetTime: addTime(now, r.Duration),
+	}
+	if r.Hits > r.Limit {
+		rl.Status = Status_OVER_LIMIT
+		rl.Remaining = 0
+	}
+	return rl
+}
+
+// validateKeyFloodRules returns an error if a rule has an invalid pattern or is out of range
+func validateKeyFloodRules(rules []KeyFloodRule) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("KeyFloodRules pattern '%s' is invalid: %s", rule.Pattern, err)
+		}
+		if rule.Limit < 0 {
+			return fmt.Errorf("KeyFloodRules limit of pattern '%s' cannot be negative", rule.Pattern)
+		}
+		if rule.Interval <= 0 {
+			return fmt.Errorf("KeyFloodRules interval of pattern '%s' must be positive", rule.Pattern)
+		}
+		if _, ok := keyFloodActions[rule.Action]; !ok {
+			return fmt.Errorf("KeyFloodRules action of pattern '%s' is unknown; got '%d'", rule.Pattern, rule.Action)
+		}
+	}
+	return nil
+}
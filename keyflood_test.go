@@ -0,0 +1,166 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/mailgun/gubernator/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// keyFloodsDetected returns the key_flood_detected metric of the rate limit name provided
+func keyFloodsDetected(t *testing.T, instance *guber.Instance, name string) float64 {
+	reg := prometheus.NewRegistry()
+	require.Nil(t, reg.Register(instance))
+	metrics, err := reg.Gather()
+	require.Nil(t, err)
+	for _, m := range metrics {
+		if m.GetName() != "key_flood_detected" {
+			continue
+		}
+		for _, metric := range m.Metric {
+			for _, label := range metric.Label {
+				if label.GetName() == "name" && label.GetValue() == name {
+					return metric.Counter.GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// A flood of unique keys for a name which reached its cap doesn't evict the rate limits in use
+func TestKeyFlood(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Action guber.KeyFloodAction
+		Status guber.Status
+	}{
+		{Name: "under limit", Action: guber.KeyFloodUnderLimit, Status: guber.Status_UNDER_LIMIT},
+		{Name: "over limit", Action: guber.KeyFloodOverLimit, Status: guber.Status_OVER_LIMIT},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			lru := cache.NewLRUCache(100)
+			instance, err := guber.New(guber.Config{
+				GRPCServer: grpc.NewServer(),
+				Cache:      lru,
+				KeyFloodRules: []guber.KeyFloodRule{
+					{Pattern: "email_*", Limit: 60, Interval: time.Minute, Action: test.Action},
+				},
+			})
+			require.Nil(t, err)
+			defer instance.Close()
+			instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+
+			hit := func(key string) *guber.RateLimitResp {
+				resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+					Requests: []*guber.RateLimitReq{
+						{
+							Name:      "email_per_address",
+							UniqueKey: key,
+							Duration:  guber.Minute,
+							Limit:     10,
+							Hits:      1,
+						},
+					},
+				})
+				require.Nil(t, err)
+				require.Empty(t, resp.Responses[0].Error)
+				return resp.Responses[0]
+			}
+
+			// The rate limits in use
+			for i := 0; i < 50; i++ {
+				rl := hit(fmt.Sprintf("hot%d@example.com", i))
+				require.Equal(t, guber.Status_UNDER_LIMIT, rl.Status)
+			}
+
+			// The flood of unique keys, far more than the cache holds
+			for i := 0; i < 5000; i++ {
+				rl := hit(fmt.Sprintf("flood%d@example.com", i))
+				if i < 10 {
+					assert.Equal(t, guber.Status_UNDER_LIMIT, rl.Status)
+				} else {
+					assert.Equal(t, test.Status, rl.Status)
+				}
+			}
+			assert.Equal(t, float64(4990), keyFloodsDetected(t, instance, "email_per_address"))
+
+			// The rate limits in use kept their hits
+			lru.Lock()
+			for i := 0; i < 50; i++ {
+				key := (&guber.RateLimitReq{Name: "email_per_address", UniqueKey: fmt.Sprintf("hot%d@example.com", i)}).HashKey()
+				_, ok := lru.Get(key)
+				assert.True(t, ok, "rate limit '%s' was evicted", key)
+			}
+			lru.Unlock()
+			for i := 0; i < 50; i++ {
+				rl := hit(fmt.Sprintf("hot%d@example.com", i))
+				assert.Equal(t, guber.Status_UNDER_LIMIT, rl.Status)
+				assert.Equal(t, int64(8), rl.Remaining)
+			}
+		})
+	}
+}
+
+func TestKeyFloodRulesValidation(t *testing.T) {
+	tests := []struct {
+		Name string
+		Rule guber.KeyFloodRule
+		Err  string
+	}{
+		{
+			Name: "invalid pattern",
+			Rule: guber.KeyFloodRule{Pattern: "email_[", Limit: 1, Interval: time.Minute},
+			Err:  "KeyFloodRules pattern 'email_[' is invalid: syntax error in pattern",
+		},
+		{
+			Name: "negative limit",
+			Rule: guber.KeyFloodRule{Pattern: "email_*", Limit: -1, Interval: time.Minute},
+			Err:  "KeyFloodRules limit of pattern 'email_*' cannot be negative",
+		},
+		{
+			Name: "no interval",
+			Rule: guber.KeyFloodRule{Pattern: "email_*", Limit: 1},
+			Err:  "KeyFloodRules interval of pattern 'email_*' must be positive",
+		},
+		{
+			Name: "unknown action",
+			Rule: guber.KeyFloodRule{Pattern: "email_*", Limit: 1, Interval: time.Minute, Action: 5},
+			Err:  "KeyFloodRules action of pattern 'email_*' is unknown; got '5'",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			conf := guber.Config{KeyFloodRules: []guber.KeyFloodRule{test.Rule}}
+			err := conf.SetDefaults()
+			require.NotNil(t, err)
+			assert.Equal(t, test.Err, err.Error())
+		})
+	}
+}
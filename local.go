@@ -0,0 +1,154 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LocalClient implements V1Client by evaluating rate limits against an in-process cache
+// using the same algorithms as the server. No networking is involved, as such it is
+// intended for unit testing code which depends on a V1Client.
+//
+// Time as seen by the LocalClient is frozen and only moves when Advance() is called.
+type LocalClient struct {
+	cache *cache.LRUCache
+	clock *holster.FrozenClock
+}
+
+// NewLocalClient creates a new LocalClient with an empty cache and a
+// frozen clock set to the current time.
+func NewLocalClient() *LocalClient {
+	c := &LocalClient{
+		cache: cache.NewLRUCache(0),
+		clock: &holster.FrozenClock{CurrentTime: time.Now()},
+	}
+	c.cache.SetClock(c.clock)
+	return c
+}
+
+// GetRateLimits evaluates the rate limits provided as if they were sent to a gubernator server
+func (c *LocalClient) GetRateLimits(ctx context.Context, r *GetRateLimitsReq, opts ...grpc.CallOption) (*GetRateLimitsResp, error) {
+	if len(r.Requests) > maxBatchSize {
+		return nil, status.Errorf(codes.OutOfRange,
+			"Requests.RateLimits list too large; max size is '%d'", maxBatchSize)
+	}
+
+	resp := GetRateLimitsResp{
+		Responses: make([]*RateLimitResp, len(r.Requests)),
+	}
+
+	for i, req := range r.Requests {
+		rl, err := c.apply(req)
+		if err != nil {
+			rl = &RateLimitResp{Error: err.Error()}
+		} else if HasBehavior(req.Behavior, Behavior_DRY_RUN) {
+			dryRun(rl)
+		}
+		resp.Responses[i] = rl
+	}
+	return &resp, nil
+}
+
+// HealthCheck always reports the LocalClient as healthy
+func (c *LocalClient) HealthCheck(ctx context.Context, r *HealthCheckReq, opts ...grpc.CallOption) (*HealthCheckResp, error) {
+	return &HealthCheckResp{Status: Healthy, PeerCount: 1}, nil
+}
+
+// Advance moves the clock of the LocalClient forward by the duration provided
+func (c *LocalClient) Advance(d time.Duration) {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	c.clock.Sleep(d)
+}
+
+// Now returns the current time of the LocalClient as a unix epoch in milliseconds
+func (c *LocalClient) Now() int64 {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	return c.cache.Now()
+}
+
+// Preload applies the rate limit request provided, such that tests can
+// start with a rate limit which has already received hits.
+func (c *LocalClient) Preload(r *RateLimitReq) error {
+	_, err := c.apply(r)
+	return err
+}
+
+// Inspect returns the current status of the rate limit without applying any hits. Returns
+// false if there is no state for the rate limit; IE: it never received a hit or it expired.
+// The state of the rate limit is not modified; IE: hits don't leak out of a leaky bucket.
+func (c *LocalClient) Inspect(r *RateLimitReq) (*RateLimitResp, bool) {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+
+	key := r.HashKey()
+	item, ok := c.cache.GetOpt(key, cache.NoPromote(), cache.NoStats())
+	if !ok {
+		return nil, false
+	}
+
+	// The algorithms update the state they read, apply the request to a copy of it instead
+	scratch := cache.NewLRUCache(1)
+	scratch.SetClock(c.clock)
+	scratch.Add(key, copyItem(item), math.MaxInt64)
+
+	cpy := *r
+	cpy.Hits = 0
+	rl, err := applyAlgorithm(scratch, &cpy)
+	if err != nil {
+		return nil, false
+	}
+	return rl, true
+}
+
+// copyItem returns a copy of the state of a rate limit held by the cache
+func copyItem(item interface{}) interface{} {
+	switch v := item.(type) {
+	case *tokenBucketItem:
+		cpy := *v
+		return &cpy
+	case *leakyBucketItem:
+		cpy := *v
+		return &cpy
+	case *globalItem:
+		cpy := *v
+		return &cpy
+	}
+	return item
+}
+
+func (c *LocalClient) apply(r *RateLimitReq) (*RateLimitResp, error) {
+	if err := validateRateLimitReq(r, defaultLimits); err != nil {
+		return nil, err
+	}
+
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	// The algorithms never return the response held in the cache, as such the
+	// caller can't observe or modify our internal state
+	return applyAlgorithm(c.cache, r)
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalClient(t *testing.T) {
+	client := guber.NewLocalClient()
+
+	req := guber.RateLimitReq{
+		Name:      "test_local_client",
+		UniqueKey: "account:1234",
+		Algorithm: guber.Algorithm_TOKEN_BUCKET,
+		Duration:  guber.Minute,
+		Limit:     5,
+		Hits:      3,
+	}
+
+	_, ok := client.Inspect(&req)
+	assert.False(t, ok)
+
+	require.Nil(t, client.Preload(&req))
+
+	rl, ok := client.Inspect(&req)
+	require.True(t, ok)
+	assert.Equal(t, int64(2), rl.Remaining)
+
+	tests := []struct {
+		Remaining int64
+		Status    guber.Status
+		Advance   time.Duration
+	}{
+		{Remaining: 0, Status: guber.Status_UNDER_LIMIT},
+		{Remaining: 0, Status: guber.Status_OVER_LIMIT, Advance: time.Minute + time.Millisecond},
+		{Remaining: 3, Status: guber.Status_UNDER_LIMIT},
+	}
+
+	for i, test := range tests {
+		req.Hits = 2
+		resp, err := client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{&req},
+		})
+		require.Nil(t, err)
+		assert.Equal(t, "", resp.Responses[0].Error, i)
+		assert.Equal(t, test.Status, resp.Responses[0].Status, i)
+		assert.Equal(t, test.Remaining, resp.Responses[0].Remaining, i)
+		client.Advance(test.Advance)
+	}
+
+	// Validation matches the server
+	resp, err := client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+		Requests: []*guber.RateLimitReq{{Name: "test_local_client"}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "rpc error: code = InvalidArgument desc = field 'unique_key' cannot be empty", resp.Responses[0].Error)
+}
+
+// Inspecting a leaky bucket used to leak the hits into the bucket without moving its timestamp, such that
+// every inspection leaked them again
+func TestLocalClientInspectLeakyBucket(t *testing.T) {
+	client := guber.NewLocalClient()
+	req := guber.RateLimitReq{
+		Name:      "test_local_client_inspect",
+		UniqueKey: "account:1234",
+		Algorithm: guber.Algorithm_LEAKY_BUCKET,
+		Duration:  guber.Minute,
+		Limit:     10,
+		Hits:      10,
+	}
+	require.Nil(t, client.Preload(&req))
+
+	// A hit leaks out of the bucket every 6 seconds
+	client.Advance(6 * time.Second)
+	for i := 0; i < 3; i++ {
+		rl, ok := client.Inspect(&req)
+		require.True(t, ok)
+		assert.Equal(t, int64(1), rl.Remaining, i)
+	}
+
+	req.Hits = 1
+	resp, err := client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+		Requests: []*guber.RateLimitReq{&req},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, guber.Status_UNDER_LIMIT, resp.Responses[0].Status)
+	assert.Equal(t, int64(0), resp.Responses[0].Remaining)
+}
+
+// Demonstrates testing a service which is rate limited by gubernator
+// without starting a gubernator server.
+func ExampleLocalClient() {
+	client := guber.NewLocalClient()
+
+	m, err := guber.NewHTTPMiddleware(guber.HTTPMiddlewareConfig{
+		Client:   client,
+		Name:     "requests_per_minute",
+		KeyFunc:  guber.KeyFromHeader("X-Account"),
+		Limit:    2,
+		Duration: guber.Minute,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	call := func() int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Account", "account:1234")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	fmt.Println(call(), call(), call())
+
+	// Once the duration has passed the client is allowed again
+	client.Advance(time.Minute + time.Millisecond)
+	fmt.Println(call())
+
+	// Output:
+	// 200 200 429
+	// 200
+}
+
+func TestLocalClientDryRun(t *testing.T) {
+	client := guber.NewLocalClient()
+	for i := 0; i < 3; i++ {
+		resp, err := client.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      "test_local_dry_run",
+					UniqueKey: "account:1",
+					Behavior:  guber.Behavior_DRY_RUN,
+					Duration:  guber.Minute,
+					Limit:     1,
+					Hits:      1,
+				},
+			},
+		})
+		require.Nil(t, err)
+		rl := resp.Responses[0]
+		require.Empty(t, rl.Error)
+		assert.Equal(t, guber.Status_UNDER_LIMIT, rl.Status)
+		if i == 0 {
+			assert.Equal(t, "UNDER_LIMIT", rl.Metadata["dry_run_status"])
+		} else {
+			assert.Equal(t, "OVER_LIMIT", rl.Metadata["dry_run_status"])
+		}
+	}
+}
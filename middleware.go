@@ -0,0 +1,197 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"github.com/pkg/errors"
+)
+
+// HTTPKeyFunc extracts the rate limit unique key from an inbound HTTP request
+type HTTPKeyFunc func(r *http.Request) (string, error)
+
+// KeyFromRemoteAddr uses the IP address of the client as the unique key
+func KeyFromRemoteAddr() HTTPKeyFunc {
+	return func(r *http.Request) (string, error) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return "", errors.Wrapf(err, "while parsing remote address '%s'", r.RemoteAddr)
+		}
+		return host, nil
+	}
+}
+
+// KeyFromHeader uses the value of the named header as the unique key
+func KeyFromHeader(name string) HTTPKeyFunc {
+	return func(r *http.Request) (string, error) {
+		value := r.Header.Get(name)
+		if value == "" {
+			return "", errors.Errorf("header '%s' is missing or empty", name)
+		}
+		return value, nil
+	}
+}
+
+// KeyFromCookie uses the value of the named cookie as the unique key
+func KeyFromCookie(name string) HTTPKeyFunc {
+	return func(r *http.Request) (string, error) {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return "", errors.Wrapf(err, "while reading cookie '%s'", name)
+		}
+		if cookie.Value == "" {
+			return "", errors.Errorf("cookie '%s' is empty", name)
+		}
+		return cookie.Value, nil
+	}
+}
+
+type HTTPMiddlewareConfig struct {
+	// Required; The client used to check the rate limit
+	Client V1Client
+
+	// Required; The name of the rate limit IE: 'requests_per_second'
+	Name string
+
+	// (Optional) Extracts the unique key from the request. Defaults to KeyFromRemoteAddr()
+	KeyFunc HTTPKeyFunc
+
+	// The number of requests that can occur for the duration of the rate limit
+	Limit int64
+
+	// The duration of the rate limit in milliseconds
+	Duration int64
+
+	// (Optional) The rate limit algorithm, defaults to TOKEN_BUCKET
+	Algorithm Algorithm
+
+	// (Optional) The rate limit behavior, defaults to BATCHING
+	Behavior Behavior
+
+	// (Optional) The max time the request path will wait on gubernator for an answer. Defaults to 100ms
+	Timeout time.Duration
+
+	// (Optional) If true requests are allowed through when gubernator returns an error or
+	// does not respond within `Timeout`. Else the request is rejected with 503
+	FailOpen bool
+}
+
+// HTTPMiddleware rate limits inbound HTTP requests using gubernator
+type HTTPMiddleware struct {
+	conf HTTPMiddlewareConfig
+}
+
+func NewHTTPMiddleware(conf HTTPMiddlewareConfig) (*HTTPMiddleware, error) {
+	if conf.Client == nil {
+		return nil, errors.New("Client is required")
+	}
+
+	if conf.Name == "" {
+		return nil, errors.New("Name is required")
+	}
+
+	if conf.KeyFunc == nil {
+		conf.KeyFunc = KeyFromRemoteAddr()
+	}
+	holster.SetDefault(&conf.Timeout, time.Millisecond*100)
+
+	return &HTTPMiddleware{conf: conf}, nil
+}
+
+// Handler wraps the provided handler such that requests over the limit are
+// rejected with 429 before reaching the handler.
+func (m *HTTPMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := m.conf.KeyFunc(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rl, err := m.getRateLimit(r.Context(), key)
+		if err != nil {
+			if m.conf.FailOpen {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "rate limit service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(rl.Limit, 10))
+		w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(rl.Remaining, 10))
+		if rl.ResetTime != 0 {
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(rl.ResetTime/Second, 10))
+		}
+
+		if rl.Status == Status_OVER_LIMIT {
+			w.Header().Set("Retry-After", strconv.FormatInt(retryAfter(rl.ResetTime), 10))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *HTTPMiddleware) getRateLimit(ctx context.Context, key string) (*RateLimitResp, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.conf.Timeout)
+	defer cancel()
+
+	resp, err := m.conf.Client.GetRateLimits(ctx, &GetRateLimitsReq{
+		Requests: []*RateLimitReq{
+			{
+				Name:      m.conf.Name,
+				UniqueKey: key,
+				Hits:      1,
+				Limit:     m.conf.Limit,
+				Duration:  m.conf.Duration,
+				Algorithm: m.conf.Algorithm,
+				Behavior:  m.conf.Behavior,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Responses) != 1 {
+		return nil, errors.New("number of rate limits in response does not match request")
+	}
+
+	rl := resp.Responses[0]
+	if rl.Error != "" {
+		return nil, errors.New(rl.Error)
+	}
+	return rl, nil
+}
+
+// retryAfter returns the number of whole seconds until the reset time provided
+func retryAfter(resetTime int64) int64 {
+	wait := resetTime - cache.MillisecondNow()
+	if wait <= 0 {
+		return 0
+	}
+	// Round up so clients never retry before the reset
+	return (wait + Second - 1) / Second
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPMiddleware(t *testing.T) {
+	client, errs := guber.DialV1Server(testCluster.GetPeer())
+	require.Nil(t, errs)
+
+	m, err := guber.NewHTTPMiddleware(guber.HTTPMiddlewareConfig{
+		Client:   client,
+		Name:     "test_http_middleware",
+		KeyFunc:  guber.KeyFromHeader("X-Account"),
+		Limit:    2,
+		Duration: guber.Minute,
+	})
+	require.Nil(t, err)
+
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		Code      int
+		Remaining string
+	}{
+		{Code: http.StatusOK, Remaining: "1"},
+		{Code: http.StatusOK, Remaining: "0"},
+		{Code: http.StatusTooManyRequests, Remaining: "0"},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Account", "account:1234")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, test.Code, w.Code, i)
+		assert.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"), i)
+		assert.Equal(t, test.Remaining, w.Header().Get("X-RateLimit-Remaining"), i)
+		assert.NotEmpty(t, w.Header().Get("X-RateLimit-Reset"), i)
+		if test.Code == http.StatusTooManyRequests {
+			assert.NotEmpty(t, w.Header().Get("Retry-After"), i)
+		}
+	}
+
+	// Missing the key header
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHTTPMiddlewareFailure(t *testing.T) {
+	// Nothing is listening on this address
+	client, errs := guber.DialV1Server("127.0.0.1:1")
+	require.Nil(t, errs)
+
+	for _, failOpen := range []bool{true, false} {
+		m, err := guber.NewHTTPMiddleware(guber.HTTPMiddlewareConfig{
+			Client:   client,
+			Name:     "test_http_middleware_failure",
+			Limit:    2,
+			Duration: guber.Minute,
+			FailOpen: failOpen,
+		})
+		require.Nil(t, err)
+
+		handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if failOpen {
+			assert.Equal(t, http.StatusOK, w.Code)
+		} else {
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		}
+	}
+}
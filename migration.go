@@ -0,0 +1,385 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The length of the intervals GetMigrationStatusResp.old_owner_fraction is measured over
+const migrationStatsInterval = 10 * time.Second
+
+// errNoHandoff is returned when the previous owner of a rate limit is older than the handoff capability
+var errNoHandoff = status.Error(codes.Unimplemented, "peer can not hand off rate limits; it lacks the handoff capability")
+
+// MigrationConfig migrates the rate limits from the owners assigned by a previous picker to the owners
+// assigned by Config.Picker; IE: after a change of the hash function. Without a migration every rate limit
+// which changes owner starts over at its new owner, as if the cluster lost its cache.
+//
+// For the Window which follows, the new owner of a rate limit which holds no state for it asks the previous
+// owner to hand off its state before applying the rate limit. Only then is the state forgotten by the
+// previous owner. A handoff which fails is lost, as is the state of a rate limit the previous owner counted
+// hits against after its handoff; IE: while the peers of the cluster disagree on the picker.
+type MigrationConfig struct {
+	// The picker which assigned the rate limits to their owners before, nil if there is no migration
+	From PeerPicker
+	// How long after the instance starts the previous owner of a rate limit is consulted, the rate limits
+	// in use during the window move to their new owner. Defaults to 10 minutes
+	Window time.Duration
+}
+
+// migration tracks the migration of the rate limits to the owners assigned by a new picker
+type migration struct {
+	picker PeerPicker // protected by Instance.peerMutex
+	ends   time.Time
+
+	mutex sync.Mutex
+	// The handoffs in flight by key, closed once the handoff completes
+	pulls     map[string]chan struct{} // protected by mutex
+	owned     int64                    // protected by mutex
+	consulted int64                    // protected by mutex
+	handedOff int64                    // protected by mutex
+	// The rate limits owned and consulted during the current and the previous interval, see record()
+	current, previous migrationStats // protected by mutex
+	started           time.Time      // protected by mutex
+}
+
+type migrationStats struct {
+	owned, consulted int64
+}
+
+func newMigration(previous PeerPicker, now, ends time.Time) *migration {
+	return &migration{
+		picker:  previous,
+		ends:    ends,
+		pulls:   make(map[string]chan struct{}),
+		started: now,
+	}
+}
+
+// rotate starts a new interval of stats once the current one is over. The caller must hold the mutex.
+func (m *migration) rotate(now time.Time) {
+	elapsed := now.Sub(m.started)
+	if elapsed < migrationStatsInterval {
+		return
+	}
+	m.previous = m.current
+	if elapsed >= 2*migrationStatsInterval {
+		m.previous = migrationStats{}
+	}
+	m.current = migrationStats{}
+	m.started = now
+}
+
+// record counts a rate limit owned, and whether its previous owner was consulted
+func (m *migration) record(now time.Time, consulted bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rotate(now)
+	m.owned++
+	m.current.owned++
+	if consulted {
+		m.consulted++
+		m.current.consulted++
+	}
+}
+
+// begin returns the channel closed once the handoff of the key completes, and true if the caller must
+// perform the handoff; the first caller for the key does, the others wait for it.
+func (m *migration) begin(key string) (chan struct{}, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if done, ok := m.pulls[key]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	m.pulls[key] = done
+	return done, true
+}
+
+// end completes the handoff begun for the key
+func (m *migration) end(key string, done chan struct{}, handedOff bool) {
+	m.mutex.Lock()
+	delete(m.pulls, key)
+	if handedOff {
+		m.handedOff++
+	}
+	m.mutex.Unlock()
+	close(done)
+}
+
+func (m *migration) status(now time.Time) *GetMigrationStatusResp {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rotate(now)
+
+	resp := GetMigrationStatusResp{
+		Active:    now.Before(m.ends),
+		EndsAt:    m.ends.UnixNano() / int64(time.Millisecond),
+		Owned:     m.owned,
+		Consulted: m.consulted,
+		HandedOff: m.handedOff,
+	}
+	if owned := m.current.owned + m.previous.owned; owned != 0 {
+		resp.OldOwnerFraction = float64(m.current.consulted+m.previous.consulted) / float64(owned)
+	}
+	return &resp
+}
+
+// Migrate replaces the picker with `picker`, which assigns the rate limits to their owners by a new hash
+// configuration; IE: NewConsistantHash(fnv1a). For the window which follows, the new owner of a rate limit
+// takes its state over from the previous owner, see MigrationConfig. A window of zero replaces the picker
+// without a migration. Every peer of the cluster must be migrated to the same picker.
+func (s *Instance) Migrate(picker PeerPicker, window time.Duration) {
+	now := s.conf.Clock.Now()
+
+	s.peerMutex.Lock()
+	defer s.peerMutex.Unlock()
+
+	previous := s.conf.Picker
+	next := picker.New()
+	for _, peer := range previous.Peers() {
+		next.Add(peer)
+	}
+	s.conf.Picker = next
+
+	s.migration = nil
+	if window > 0 {
+		s.migration = newMigration(previous, now, now.Add(window))
+	}
+	log.WithField("window", window).Info("Migrating rate limits to a new picker")
+}
+
+// GetMigrationStatus reports the progress of the migration started by Config.Migration or Migrate()
+func (s *Instance) GetMigrationStatus(ctx context.Context, r *GetMigrationStatusReq) (*GetMigrationStatusResp, error) {
+	s.peerMutex.RLock()
+	m := s.migration
+	s.peerMutex.RUnlock()
+
+	if m == nil {
+		return &GetMigrationStatusResp{}, nil
+	}
+	return m.status(s.conf.Clock.Now()), nil
+}
+
+// migrating returns true if a migration was started, see takeOver()
+func (s *Instance) migrating() bool {
+	s.peerMutex.RLock()
+	defer s.peerMutex.RUnlock()
+	return s.migration != nil
+}
+
+// takeOver takes the state of the rate limits this instance owns over from their previous owners during a
+// migration, unless the instance already holds state for a rate limit. The rate limits are handed off by a
+// single request to each previous owner, concurrent requests for the same rate limit wait for a single
+// handoff. Entries of `keys` which are empty are skipped.
+func (s *Instance) takeOver(keys []string, requests []*RateLimitReq) {
+	now := s.conf.Clock.Now()
+
+	s.peerMutex.RLock()
+	m := s.migration
+	if m == nil || !now.Before(m.ends) {
+		s.peerMutex.RUnlock()
+		return
+	}
+	previous := make([]*PeerClient, len(keys))
+	for i, key := range keys {
+		if key != "" {
+			previous[i], _ = m.picker.Get(key)
+		}
+	}
+	s.peerMutex.RUnlock()
+
+	var waits []chan struct{}
+	var batches []*handoffBatch
+	byPeer := make(map[*PeerClient]*handoffBatch)
+	for i, peer := range previous {
+		if peer == nil {
+			continue
+		}
+		key := keys[i]
+		if peer.isOwner || s.holds(key) {
+			m.record(now, false)
+			continue
+		}
+
+		done, first := m.begin(key)
+		if !first {
+			m.record(now, false)
+			waits = append(waits, done)
+			continue
+		}
+		m.record(now, true)
+
+		b, ok := byPeer[peer]
+		if !ok {
+			b = &handoffBatch{peer: peer}
+			byPeer[peer] = b
+			batches = append(batches, b)
+		}
+		b.keys = append(b.keys, key)
+		b.requests = append(b.requests, requests[i])
+		b.done = append(b.done, done)
+	}
+
+	var wg sync.WaitGroup
+	for _, b := range batches {
+		wg.Add(1)
+		go func(b *handoffBatch) {
+			defer wg.Done()
+			s.handoffBatch(m, b)
+		}(b)
+	}
+	wg.Wait()
+
+	for _, done := range waits {
+		<-done
+	}
+}
+
+// handoffBatch is the rate limits taken over from the same previous owner
+type handoffBatch struct {
+	peer     *PeerClient
+	keys     []string
+	requests []*RateLimitReq
+	done     []chan struct{}
+}
+
+// handoffBatch asks the previous owner to hand off the rate limits of the batch and adopts their state
+func (s *Instance) handoffBatch(m *migration, b *handoffBatch) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.conf.Behaviors.BatchTimeout)
+	defer cancel()
+
+	resp, err := b.peer.handoff(ctx, b.requests)
+	if err != nil {
+		log.WithError(err).WithField("peer", b.peer.host).
+			Warnf("while taking over '%d' rate limits from their previous owner", len(b.keys))
+	}
+
+	for i, key := range b.keys {
+		var adopted bool
+		if err == nil && resp.HandoffDurations[i] >= 0 {
+			rl, duration := resp.RateLimits[i], resp.HandoffDurations[i]
+			s.withCache(key, func(c cache.Cache, _ *cache.LRUCache) {
+				adopted = adopt(c, key, b.requests[i], rl, duration, cacheNow(c))
+			})
+		}
+		m.end(key, b.done[i], adopted)
+	}
+}
+
+// holds returns true if the cache holds state for the key
+func (s *Instance) holds(key string) bool {
+	var held bool
+	s.withCache(key, func(c cache.Cache, _ *cache.LRUCache) {
+		_, held = getAt(c, key, cacheNow(c))
+	})
+	return held
+}
+
+// adopt adds the state of a rate limit handed off by its previous owner to the cache, unless the cache
+// already holds state for the rate limit. Returns true if the state was added.
+func adopt(c cache.Cache, key cache.Key, r *RateLimitReq, rl *RateLimitResp, duration, now int64) bool {
+	if _, ok := getAt(c, key, now); ok {
+		return false
+	}
+
+	switch r.Algorithm {
+	case Algorithm_TOKEN_BUCKET:
+		// The window ended while the state was handed off
+		if rl.ResetTime <= now {
+			return false
+		}
+		t := &tokenBucketItem{
+			Status: RateLimitResp{
+				Status:    rl.Status,
+				Limit:     rl.Limit,
+				Remaining: rl.Remaining,
+				ResetTime: rl.ResetTime,
+			},
+			Duration: duration,
+		}
+		c.Add(key, t, rl.ResetTime)
+	case Algorithm_LEAKY_BUCKET:
+		// The hits which leaked out so far were counted by the previous owner, the bucket leaks from now on
+		b := &leakyBucketItem{
+			Limit:          rl.Limit,
+			Duration:       duration,
+			LimitRemaining: rl.Remaining,
+			TimeStamp:      now,
+		}
+		c.Add(key, b, addTime(now, duration))
+	default:
+		return false
+	}
+	return true
+}
+
+// handOff answers a request of the new owner of the rate limits for their state, which is forgotten once
+// handed off; see takeOver(). A rate limit the instance holds no state for is answered with a duration of -1.
+func (s *Instance) handOff(r *GetPeerRateLimitsReq) *GetPeerRateLimitsResp {
+	resp := GetPeerRateLimitsResp{
+		RateLimits:       make([]*RateLimitResp, len(r.Requests)),
+		HandoffDurations: make([]int64, len(r.Requests)),
+	}
+
+	for i, req := range r.Requests {
+		rl := &RateLimitResp{}
+		duration := int64(-1)
+		if err := validateRateLimitReq(req, s.limits); err != nil {
+			rl.Error = err.Error()
+		} else {
+			key := req.HashKey()
+			if err := s.withCache(key, func(c cache.Cache, _ *cache.LRUCache) {
+				now := cacheNow(c)
+				item, ok := getAt(c, key, now)
+				if !ok {
+					return
+				}
+				// The status of a GLOBAL rate limit received from its owner is not ours to hand off
+				if _, ok := itemDuration(item); !ok {
+					return
+				}
+
+				// Read the status without applying hits, which also leaks a leaky bucket up to now
+				cpy := *req
+				cpy.Hits = 0
+				status, err := applyAlgorithmKey(c, key, &cpy, now)
+				if err != nil {
+					return
+				}
+				if item, ok = getAt(c, key, now); !ok {
+					return
+				}
+				d, _ := itemDuration(item)
+				c.Remove(key)
+				rl, duration = status, d
+			}); err != nil {
+				rl.Error = err.Error()
+			}
+		}
+		resp.RateLimits[i] = rl
+		resp.HandoffDurations[i] = duration
+	}
+	return &resp
+}
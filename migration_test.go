@@ -0,0 +1,218 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/mailgun/holster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func fnv1a(data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(data)
+	return h.Sum32()
+}
+
+// startMigrationCluster starts a cluster of instances which pick the owner of a rate limit by crc32
+func startMigrationCluster(t *testing.T, clock holster.Clock, size int) ([]*guber.Instance, []guber.PeerInfo, func()) {
+	var servers []*grpc.Server
+	var instances []*guber.Instance
+	var peers []guber.PeerInfo
+	for i := 0; i < size; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		server := grpc.NewServer()
+		instance, err := guber.New(guber.Config{GRPCServer: server, Clock: clock})
+		require.Nil(t, err)
+		go server.Serve(listener)
+
+		servers = append(servers, server)
+		instances = append(instances, instance)
+		peers = append(peers, guber.PeerInfo{Address: listener.Addr().String()})
+	}
+
+	for i, instance := range instances {
+		self := make([]guber.PeerInfo, len(peers))
+		copy(self, peers)
+		self[i].IsOwner = true
+		instance.SetPeers(self)
+	}
+
+	return instances, peers, func() {
+		for _, server := range servers {
+			server.Stop()
+		}
+		for _, instance := range instances {
+			instance.Close()
+		}
+	}
+}
+
+// movedKeys returns which of the rate limits change owner when the cluster of `peers` migrates from crc32
+// to fnv1a. The peers listen on random ports, as such the share of the rate limits which move varies.
+func movedKeys(t *testing.T, peers []guber.PeerInfo, reqs []*guber.RateLimitReq) []bool {
+	conf := guber.Config{}
+	require.Nil(t, conf.SetDefaults())
+
+	from, to := guber.NewConsistantHash(nil), guber.NewConsistantHash(fnv1a)
+	for _, peer := range peers {
+		client, err := guber.NewPeerClient(conf.Behaviors, peer.Address)
+		require.Nil(t, err)
+		defer client.Shutdown()
+		from.Add(client)
+		to.Add(client)
+	}
+
+	moved := make([]bool, len(reqs))
+	for i, req := range reqs {
+		before, err := from.Get(req.HashKey())
+		require.Nil(t, err)
+		after, err := to.Get(req.HashKey())
+		require.Nil(t, err)
+		moved[i] = before != after
+	}
+	return moved
+}
+
+// Rate limits which change owner when the cluster migrates to a new hash function keep their hits
+func TestMigration(t *testing.T) {
+	const keys = 300
+	const limit = 1000
+
+	tests := []struct {
+		Name   string
+		Window time.Duration
+		// The max fraction of the hits counted before the migration which may be lost
+		Tolerance float64
+	}{
+		{Name: "migration", Window: time.Minute, Tolerance: 0.01},
+		// A cluster which doesn't migrate resets the rate limits which move
+		{Name: "no migration", Window: 0, Tolerance: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			clock := &lockedClock{frozen: holster.FrozenClock{CurrentTime: time.Now()}}
+			instances, peers, stop := startMigrationCluster(t, clock, 3)
+			defer stop()
+
+			rateLimit := func(key int, hits int64) *guber.RateLimitReq {
+				return &guber.RateLimitReq{
+					Name:      "test_migration",
+					UniqueKey: fmt.Sprintf("account:%d", key),
+					Duration:  guber.Minute * 60,
+					Limit:     limit,
+					Hits:      hits,
+				}
+			}
+
+			// Each hit is sent to a different instance, which forwards it to the owner
+			var sent int
+			hit := func(key int, hits int64) *guber.RateLimitResp {
+				sent++
+				resp, err := instances[sent%len(instances)].GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+					Requests: []*guber.RateLimitReq{rateLimit(key, hits)},
+				})
+				require.Nil(t, err)
+				require.Empty(t, resp.Responses[0].Error)
+				return resp.Responses[0]
+			}
+
+			var total, movedHits int64
+			var movedCount int
+			reqs := make([]*guber.RateLimitReq, keys)
+			for i := range reqs {
+				reqs[i] = rateLimit(i, 0)
+			}
+			moved := movedKeys(t, peers, reqs)
+
+			counted := make([]int64, keys)
+			for i := 0; i < keys; i++ {
+				counted[i] = int64(i%5 + 1)
+				total += counted[i]
+				if moved[i] {
+					movedHits += counted[i]
+					movedCount++
+				}
+				hit(i, counted[i])
+			}
+
+			for _, instance := range instances {
+				instance.Migrate(guber.NewConsistantHash(fnv1a), test.Window)
+			}
+
+			// The new owner of each rate limit which moved consults its previous owner on the first hit
+			var lost int64
+			for i := 0; i < keys; i++ {
+				rl := hit(i, 1)
+				lost += rl.Remaining - (limit - counted[i] - 1)
+			}
+			assert.True(t, float64(lost) <= test.Tolerance*float64(total), "lost '%d' of '%d' hits", lost, total)
+			if test.Window == 0 {
+				assert.Equal(t, movedHits, lost)
+				return
+			}
+
+			var status guber.GetMigrationStatusResp
+			for _, instance := range instances {
+				s, err := instance.GetMigrationStatus(context.Background(), &guber.GetMigrationStatusReq{})
+				require.Nil(t, err)
+				assert.True(t, s.Active)
+				status.Owned += s.Owned
+				status.Consulted += s.Consulted
+				status.HandedOff += s.HandedOff
+			}
+			// Every rate limit which changed owner was handed off
+			assert.Equal(t, int64(keys), status.Owned)
+			assert.Equal(t, int64(movedCount), status.Consulted)
+			assert.Equal(t, status.Consulted, status.HandedOff)
+
+			// Rate limits migrated are no longer consulted
+			for i := 0; i < keys; i++ {
+				hit(i, 0)
+			}
+			for _, instance := range instances {
+				s, err := instance.GetMigrationStatus(context.Background(), &guber.GetMigrationStatusReq{})
+				require.Nil(t, err)
+				status.Consulted -= s.Consulted
+			}
+			assert.Equal(t, int64(0), status.Consulted)
+
+			// Once the window ends the previous owners are no longer consulted
+			clock.Sleep(2 * time.Minute)
+			for i := 0; i < keys; i++ {
+				hit(keys+i, 1)
+			}
+			for _, instance := range instances {
+				s, err := instance.GetMigrationStatus(context.Background(), &guber.GetMigrationStatusReq{})
+				require.Nil(t, err)
+				assert.False(t, s.Active)
+				assert.Equal(t, float64(0), s.OldOwnerFraction)
+			}
+		})
+	}
+}
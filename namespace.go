@@ -0,0 +1,377 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NamespaceConfig isolates the rate limits of a namespace from those of the other namespaces; IE: the
+// products which co-tenant a cluster. A rate limit belongs to the namespace whose Prefix its name starts
+// with, the longest prefix wins. The rate limits outside any namespace are not isolated. See Config.Namespaces
+type NamespaceConfig struct {
+	// The name of the namespace, which labels its metrics
+	Name string
+	// The prefix of the names of the rate limits in the namespace; IE: "billing_"
+	Prefix string
+	// The max number of rate limits of the namespace held by the instance. The rate limits are held in a
+	// partition of the cache of their own, such that the rate limits of other namespaces can't evict them.
+	// Zero shares the cache of the rate limits outside any namespace
+	CacheSize int
+	// The max number of rate limits of the namespace waiting on a batch to a peer, those beyond are answered
+	// with RESOURCE_EXHAUSTED. Zero means unbounded
+	MaxQueued int
+	// The max number of rate limits of the namespace received from clients in flight on the instance, those
+	// beyond are answered with RESOURCE_EXHAUSTED. Zero means unbounded
+	MaxInFlight int
+}
+
+func validateNamespaces(confs []NamespaceConfig) error {
+	names := make(map[string]bool, len(confs))
+	prefixes := make(map[string]bool, len(confs))
+	for _, ns := range confs {
+		if ns.Name == "" {
+			return fmt.Errorf("Namespaces name cannot be empty")
+		}
+		if names[ns.Name] {
+			return fmt.Errorf("Namespaces name '%s' is not unique", ns.Name)
+		}
+		if ns.Prefix == "" {
+			return fmt.Errorf("Namespaces prefix of namespace '%s' cannot be empty", ns.Name)
+		}
+		if prefixes[ns.Prefix] {
+			return fmt.Errorf("Namespaces prefix '%s' of namespace '%s' is not unique", ns.Prefix, ns.Name)
+		}
+		if ns.CacheSize < 0 || ns.MaxQueued < 0 || ns.MaxInFlight < 0 {
+			return fmt.Errorf("Namespaces limits of namespace '%s' cannot be negative", ns.Name)
+		}
+		names[ns.Name], prefixes[ns.Prefix] = true, true
+	}
+	return nil
+}
+
+// namespaceCounters is the usage of a namespace, which outlives the reloads of its config
+type namespaceCounters struct {
+	requests         atomic.Int64
+	inFlight         atomic.Int64
+	queued           atomic.Int64
+	rejectedInFlight atomic.Int64
+	rejectedQueued   atomic.Int64
+}
+
+// namespace is a namespace as configured, its config is immutable
+type namespace struct {
+	conf     NamespaceConfig
+	counters *namespaceCounters
+}
+
+// acquire counts a rate limit of the namespace received from a client. Returns a RESOURCE_EXHAUSTED error
+// if the namespace has MaxInFlight rate limits in flight, else the caller must call release() once the
+// rate limit is answered.
+func (n *namespace) acquire() error {
+	n.counters.requests.Add(1)
+	if inFlight := n.counters.inFlight.Add(1); n.conf.MaxInFlight > 0 && inFlight > int64(n.conf.MaxInFlight) {
+		n.counters.inFlight.Add(-1)
+		n.counters.rejectedInFlight.Add(1)
+		return status.Errorf(codes.ResourceExhausted, "namespace '%s' has too many rate limits in flight; max is '%d'",
+			n.conf.Name, n.conf.MaxInFlight)
+	}
+	return nil
+}
+
+func (n *namespace) release() {
+	n.counters.inFlight.Add(-1)
+}
+
+// enqueue counts a rate limit of the namespace waiting on a batch to a peer. Returns a RESOURCE_EXHAUSTED
+// error if the namespace has MaxQueued rate limits waiting, else the caller must call dequeue() once the
+// batch is answered.
+func (n *namespace) enqueue() error {
+	if queued := n.counters.queued.Add(1); n.conf.MaxQueued > 0 && queued > int64(n.conf.MaxQueued) {
+		n.counters.queued.Add(-1)
+		n.counters.rejectedQueued.Add(1)
+		return status.Errorf(codes.ResourceExhausted, "namespace '%s' has too many rate limits queued; max is '%d'",
+			n.conf.Name, n.conf.MaxQueued)
+	}
+	return nil
+}
+
+func (n *namespace) dequeue() {
+	n.counters.queued.Add(-1)
+}
+
+// namespaceSet is the namespaces configured, which is replaced as a whole by Instance.SetNamespaces(). A nil
+// set has no namespaces.
+type namespaceSet struct {
+	// Sorted by the length of their prefix, longest first
+	namespaces []*namespace
+}
+
+// newNamespaceSet returns the set of namespaces configured, nil if there are none. The namespaces of the
+// previous set keep their counters.
+func newNamespaceSet(confs []NamespaceConfig, previous *namespaceSet) *namespaceSet {
+	if len(confs) == 0 {
+		return nil
+	}
+
+	set := namespaceSet{namespaces: make([]*namespace, len(confs))}
+	for i, conf := range confs {
+		ns := &namespace{conf: conf, counters: &namespaceCounters{}}
+		if old := previous.byName(conf.Name); old != nil {
+			ns.counters = old.counters
+		}
+		set.namespaces[i] = ns
+	}
+	sort.SliceStable(set.namespaces, func(i, j int) bool {
+		return len(set.namespaces[i].conf.Prefix) > len(set.namespaces[j].conf.Prefix)
+	})
+	return &set
+}
+
+// lookup returns the namespace of the rate limit name, nil if it is in none
+func (s *namespaceSet) lookup(name string) *namespace {
+	if s == nil {
+		return nil
+	}
+	for _, ns := range s.namespaces {
+		if strings.HasPrefix(name, ns.conf.Prefix) {
+			return ns
+		}
+	}
+	return nil
+}
+
+// forKey returns the namespace of the rate limit a key of RateLimitReq.HashKey() is for, nil if it is in none
+func (s *namespaceSet) forKey(key cache.Key) *namespace {
+	if s == nil {
+		return nil
+	}
+	name, ok := keyName(key)
+	if !ok {
+		return nil
+	}
+	return s.lookup(name)
+}
+
+func (s *namespaceSet) byName(name string) *namespace {
+	if s == nil {
+		return nil
+	}
+	for _, ns := range s.namespaces {
+		if ns.conf.Name == name {
+			return ns
+		}
+	}
+	return nil
+}
+
+// partitions is the cache partition of each namespace with a CacheSize, each created on first use. When the
+// worker pool is enabled each worker has partitions of its own, such that the CacheSize of a namespace is
+// divided across the workers like Config.CacheSize.
+type partitions struct {
+	shards int
+	clock  holster.Clock
+	budget *cache.Budget
+
+	mutex  sync.Mutex
+	caches map[string]*partition // protected by mutex
+}
+
+type partition struct {
+	cache *cache.LRUCache
+	size  int
+}
+
+func newPartitions(shards int, clock holster.Clock, budget *cache.Budget) *partitions {
+	return &partitions{
+		shards: shards,
+		clock:  clock,
+		budget: budget,
+		caches: make(map[string]*partition),
+	}
+}
+
+// forKey returns the partition which holds the rate limit for `key`, nil if its namespace has no
+// partition and the rate limit is held by the shared cache
+func (p *partitions) forKey(set *namespaceSet, key cache.Key) *cache.LRUCache {
+	ns := set.forKey(key)
+	if ns == nil || ns.conf.CacheSize == 0 {
+		return nil
+	}
+	return p.get(ns)
+}
+
+// get returns the partition of the namespace. A partition resized by a reload of the config keeps the
+// rate limits which fit.
+func (p *partitions) get(ns *namespace) *cache.LRUCache {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	size := shardSize(ns.conf.CacheSize, p.shards)
+	part, ok := p.caches[ns.conf.Name]
+	if ok && part.size == size {
+		return part.cache
+	}
+
+	c := cache.NewLRUCache(size)
+	c.SetClock(p.clock)
+	if p.budget != nil {
+		c.SetBudget(p.budget)
+	}
+	if ok {
+		c.ReplaceContents(part.cache, false)
+	}
+	p.caches[ns.conf.Name] = &partition{cache: c, size: size}
+	return c
+}
+
+// prune drops the partitions of the namespaces no longer in the set, or no longer with a CacheSize. The rate
+// limits they held start over in the shared cache.
+func (p *partitions) prune(set *namespaceSet) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for name := range p.caches {
+		if ns := set.byName(name); ns == nil || ns.conf.CacheSize == 0 {
+			delete(p.caches, name)
+		}
+	}
+}
+
+// each calls `fn` with every partition and the name of its namespace, without holding the mutex
+func (p *partitions) each(fn func(name string, c *cache.LRUCache)) {
+	p.mutex.Lock()
+	parts := make(map[string]*cache.LRUCache, len(p.caches))
+	for name, part := range p.caches {
+		parts[name] = part.cache
+	}
+	p.mutex.Unlock()
+
+	for name, c := range parts {
+		fn(name, c)
+	}
+}
+
+// SetNamespaces replaces the namespaces of Config.Namespaces, IE: when the config is reloaded. The namespaces
+// which remain keep their counters, and their cache partition keeps the rate limits which fit its CacheSize.
+// The rate limits of a namespace removed or without a CacheSize start over in the shared cache.
+func (s *Instance) SetNamespaces(confs []NamespaceConfig) error {
+	if err := validateNamespaces(confs); err != nil {
+		return err
+	}
+
+	set := newNamespaceSet(confs, s.namespaces.Load())
+	s.namespaces.Store(set)
+	if s.pool != nil {
+		s.pool.prune(set)
+	} else {
+		s.conf.Cache.Lock()
+		s.partitions.prune(set)
+		s.conf.Cache.Unlock()
+	}
+	log.WithField("namespaces", confs).Info("Namespaces updated")
+	return nil
+}
+
+// eachPartition calls `fn` with every cache partition of the namespaces, and the name of its namespace
+func (s *Instance) eachPartition(fn func(name string, c *cache.LRUCache)) {
+	if s.pool != nil {
+		s.pool.eachPartition(fn)
+		return
+	}
+	s.partitions.each(fn)
+}
+
+// namespaceMetrics exports the usage of each namespace to prometheus
+type namespaceMetrics struct {
+	requests     *prometheus.Desc
+	rejected     *prometheus.Desc
+	inFlight     *prometheus.Desc
+	queued       *prometheus.Desc
+	cacheSize    *prometheus.Desc
+	cacheAccess  *prometheus.Desc
+	cacheRemoval *prometheus.Desc
+}
+
+func newNamespaceMetrics() *namespaceMetrics {
+	return &namespaceMetrics{
+		requests: prometheus.NewDesc("namespace_requests",
+			"The number of rate limits received from clients, by namespace.", []string{"namespace"}, nil),
+		rejected: prometheus.NewDesc("namespace_rejected",
+			"The number of rate limits rejected by the bounds of their namespace, by namespace and bound.",
+			[]string{"namespace", "reason"}, nil),
+		inFlight: prometheus.NewDesc("namespace_in_flight",
+			"The number of rate limits received from clients in flight, by namespace.", []string{"namespace"}, nil),
+		queued: prometheus.NewDesc("namespace_queued",
+			"The number of rate limits waiting on a batch to a peer, by namespace.", []string{"namespace"}, nil),
+		cacheSize: prometheus.NewDesc("namespace_cache_size",
+			"Size of the cache partition which holds the rate limits, by namespace.", []string{"namespace"}, nil),
+		cacheAccess: prometheus.NewDesc("namespace_cache_access_count",
+			"Cache partition access counts, by namespace.", []string{"namespace", "type"}, nil),
+		cacheRemoval: prometheus.NewDesc("namespace_cache_removals_total",
+			"The number of entries removed from the cache partition by reason, by namespace.",
+			[]string{"namespace", "reason"}, nil),
+	}
+}
+
+func (m *namespaceMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.requests
+	ch <- m.rejected
+	ch <- m.inFlight
+	ch <- m.queued
+	ch <- m.cacheSize
+	ch <- m.cacheAccess
+	ch <- m.cacheRemoval
+}
+
+// collect exports the counters of each namespace of the set, and the stats of the cache partitions by
+// the name of their namespace
+func (m *namespaceMetrics) collect(ch chan<- prometheus.Metric, set *namespaceSet, caches map[string]cache.Stats) {
+	if set == nil {
+		return
+	}
+	for _, ns := range set.namespaces {
+		name, c := ns.conf.Name, ns.counters
+		ch <- prometheus.MustNewConstMetric(m.requests, prometheus.CounterValue, float64(c.requests.Load()), name)
+		ch <- prometheus.MustNewConstMetric(m.rejected, prometheus.CounterValue, float64(c.rejectedInFlight.Load()), name, "in_flight")
+		ch <- prometheus.MustNewConstMetric(m.rejected, prometheus.CounterValue, float64(c.rejectedQueued.Load()), name, "queued")
+		ch <- prometheus.MustNewConstMetric(m.inFlight, prometheus.GaugeValue, float64(c.inFlight.Load()), name)
+		ch <- prometheus.MustNewConstMetric(m.queued, prometheus.GaugeValue, float64(c.queued.Load()), name)
+
+		stats, ok := caches[name]
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(m.cacheSize, prometheus.GaugeValue, float64(stats.Size), name)
+		ch <- prometheus.MustNewConstMetric(m.cacheAccess, prometheus.CounterValue, float64(stats.Hit), name, "hit")
+		ch <- prometheus.MustNewConstMetric(m.cacheAccess, prometheus.CounterValue, float64(stats.Miss), name, "miss")
+		for i, n := range stats.Removals {
+			ch <- prometheus.MustNewConstMetric(m.cacheRemoval, prometheus.CounterValue, float64(n), name,
+				cache.RemovalReason(i).String())
+		}
+	}
+}
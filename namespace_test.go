@@ -0,0 +1,267 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// namespaceMetric returns the value of the metric of the namespace with the labels provided, false if the
+// instance doesn't export it
+func namespaceMetric(t *testing.T, instance *guber.Instance, name, namespace string, labels ...string) (float64, bool) {
+	reg := prometheus.NewRegistry()
+	require.Nil(t, reg.Register(instance))
+	metrics, err := reg.Gather()
+	require.Nil(t, err)
+	for _, m := range metrics {
+		if m.GetName() != name {
+			continue
+		}
+	next:
+		for _, metric := range m.Metric {
+			if labelValue(metric, "namespace") != namespace {
+				continue
+			}
+			for i := 0; i+1 < len(labels); i += 2 {
+				if labelValue(metric, labels[i]) != labels[i+1] {
+					continue next
+				}
+			}
+			return metric.GetCounter().GetValue() + metric.GetGauge().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func newNamespaceInstance(t *testing.T, namespaces []guber.NamespaceConfig, peers []guber.PeerInfo) *guber.Instance {
+	instance, err := guber.New(guber.Config{
+		GRPCServer: grpc.NewServer(),
+		PoolSize:   4,
+		CacheSize:  1000,
+		Namespaces: namespaces,
+	})
+	require.Nil(t, err)
+	instance.SetPeers(peers)
+	return instance
+}
+
+// A namespace flooded with unique keys neither evicts the rate limits of another namespace, nor delays them
+func TestNamespaceIsolation(t *testing.T) {
+	instance := newNamespaceInstance(t, []guber.NamespaceConfig{
+		{Name: "a", Prefix: "a_", CacheSize: 100, MaxInFlight: 8},
+		{Name: "b", Prefix: "b_", CacheSize: 1000},
+	}, []guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+	defer instance.Close()
+
+	const bKeys = 50
+	hitB := func() time.Duration {
+		var requests []*guber.RateLimitReq
+		for i := 0; i < bKeys; i++ {
+			requests = append(requests, &guber.RateLimitReq{
+				Name:      "b_requests",
+				UniqueKey: fmt.Sprintf("account:%d", i),
+				Duration:  guber.Minute,
+				Limit:     1000,
+				Hits:      1,
+			})
+		}
+		start := time.Now()
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{Requests: requests})
+		require.Nil(t, err)
+		for _, rl := range resp.Responses {
+			require.Empty(t, rl.Error)
+		}
+		return time.Since(start)
+	}
+	hitB()
+
+	// Flood namespace a with unique keys, ten times the size of its partition
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for batch := 0; batch < 60; batch++ {
+				var requests []*guber.RateLimitReq
+				for i := 0; i < 10; i++ {
+					requests = append(requests, &guber.RateLimitReq{
+						Name:      "a_requests",
+						UniqueKey: fmt.Sprintf("flood:%d:%d:%d", g, batch, i),
+						Duration:  guber.Minute,
+						Limit:     10,
+						Hits:      1,
+					})
+				}
+				_, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{Requests: requests})
+				assert.Nil(t, err)
+			}
+		}(g)
+	}
+
+	const rounds = 20
+	var maxLatency time.Duration
+	for round := 0; round < rounds; round++ {
+		if latency := hitB(); latency > maxLatency {
+			maxLatency = latency
+		}
+	}
+	wg.Wait()
+
+	// Each batch of namespace a held more rate limits than its MaxInFlight
+	rejected, ok := namespaceMetric(t, instance, "namespace_rejected", "a", "reason", "in_flight")
+	require.True(t, ok)
+	assert.True(t, rejected >= 8*60*2, "rejected '%v' rate limits of namespace a", rejected)
+	size, _ := namespaceMetric(t, instance, "namespace_cache_size", "a")
+	assert.True(t, size <= 100, "namespace a holds '%v' rate limits", size)
+
+	// Namespace b missed only when warmed, and kept the hits of every round
+	hit, _ := namespaceMetric(t, instance, "namespace_cache_access_count", "b", "type", "hit")
+	miss, _ := namespaceMetric(t, instance, "namespace_cache_access_count", "b", "type", "miss")
+	assert.True(t, hit/(hit+miss) >= 0.85, "namespace b hit ratio is '%v'", hit/(hit+miss))
+	assert.True(t, maxLatency < time.Second, "namespace b max latency is '%s'", maxLatency)
+
+	resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+		Requests: []*guber.RateLimitReq{
+			{Name: "b_requests", UniqueKey: "account:1", Duration: guber.Minute, Limit: 1000, Hits: 0},
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, int64(1000-rounds-1), resp.Responses[0].Remaining)
+
+	requests, _ := namespaceMetric(t, instance, "namespace_requests", "b")
+	assert.Equal(t, float64((rounds+1)*bKeys+1), requests)
+}
+
+// The rate limits of a namespace waiting on a slow peer are bounded, the other namespaces are not delayed
+func TestNamespaceMaxQueued(t *testing.T) {
+	addr, stop := startSlowPeer(t, 200*time.Millisecond)
+	defer stop()
+	instance := newNamespaceInstance(t, []guber.NamespaceConfig{
+		{Name: "a", Prefix: "a_", MaxQueued: 5},
+		{Name: "b", Prefix: "b_"},
+	}, []guber.PeerInfo{{Address: addr}})
+	defer instance.Close()
+
+	send := func(name string, i int) string {
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:      name,
+					UniqueKey: fmt.Sprintf("account:%d", i),
+					Duration:  guber.Minute,
+					Limit:     10,
+					Hits:      1,
+					Behavior:  guber.Behavior_BATCHING,
+				},
+			},
+		})
+		require.Nil(t, err)
+		return resp.Responses[0].Error
+	}
+
+	var mutex sync.Mutex
+	var queued int
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := send("a_requests", i); err != "" {
+				assert.Contains(t, err, "too many rate limits queued")
+				mutex.Lock()
+				queued++
+				mutex.Unlock()
+			}
+		}(i)
+	}
+
+	// Give the requests of namespace a time to queue up behind the slow peer
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, send("b_requests", 1))
+	wg.Wait()
+
+	assert.Equal(t, 15, queued)
+	rejected, _ := namespaceMetric(t, instance, "namespace_rejected", "a", "reason", "queued")
+	assert.Equal(t, float64(15), rejected)
+	waiting, _ := namespaceMetric(t, instance, "namespace_queued", "a")
+	assert.Equal(t, float64(0), waiting)
+}
+
+func TestSetNamespaces(t *testing.T) {
+	instance := newNamespaceInstance(t, []guber.NamespaceConfig{
+		{Name: "a", Prefix: "a_", CacheSize: 100},
+		{Name: "b", Prefix: "b_", CacheSize: 1000},
+	}, []guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+	defer instance.Close()
+
+	hit := func(name string) {
+		var requests []*guber.RateLimitReq
+		for i := 0; i < 50; i++ {
+			requests = append(requests, &guber.RateLimitReq{
+				Name:      name,
+				UniqueKey: fmt.Sprintf("account:%d", i),
+				Duration:  guber.Minute,
+				Limit:     10,
+				Hits:      1,
+			})
+		}
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{Requests: requests})
+		require.Nil(t, err)
+		for _, rl := range resp.Responses {
+			require.Empty(t, rl.Error)
+		}
+	}
+	hit("a_requests")
+	hit("b_requests")
+
+	size, _ := namespaceMetric(t, instance, "namespace_cache_size", "b")
+	assert.Equal(t, float64(50), size)
+
+	// Shrink the partition of namespace b, and drop namespace a
+	require.Nil(t, instance.SetNamespaces([]guber.NamespaceConfig{
+		{Name: "b", Prefix: "b_", CacheSize: 40},
+	}))
+	hit("b_requests")
+
+	size, _ = namespaceMetric(t, instance, "namespace_cache_size", "b")
+	assert.True(t, size <= 40, "namespace b holds '%v' rate limits", size)
+	requests, _ := namespaceMetric(t, instance, "namespace_requests", "b")
+	assert.Equal(t, float64(100), requests)
+	_, ok := namespaceMetric(t, instance, "namespace_requests", "a")
+	assert.False(t, ok)
+
+	// An invalid config leaves the namespaces in use
+	err := instance.SetNamespaces([]guber.NamespaceConfig{
+		{Name: "b", Prefix: "b_"},
+		{Name: "c", Prefix: "b_"},
+	})
+	require.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "is not unique"), err.Error())
+	size, _ = namespaceMetric(t, instance, "namespace_cache_size", "b")
+	assert.True(t, size <= 40 && size > 0, "namespace b holds '%v' rate limits", size)
+}
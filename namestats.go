@@ -0,0 +1,272 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherName labels the metrics of the names not in Config.NameStatsMetrics, such that the number of names a
+// metric is labelled by is bounded
+const otherName = "other"
+
+// nameSlot counts the usage of a single rate limit name
+type nameSlot struct {
+	name      string // protected by nameStats.mutex
+	requests  int64  // atomic
+	overLimit int64  // atomic
+	forwarded int64  // atomic
+	// The requests inherited from the name the slot was taken from, see nameStats.replace()
+	overcount int64 // protected by nameStats.mutex
+}
+
+// add counts a request of the name; the caller must hold a lock of nameStats.mutex unless the slot is
+// of an allowed name, whose slots are never replaced.
+func (n *nameSlot) add(forwarded bool, rl *RateLimitResp) {
+	atomic.AddInt64(&n.requests, 1)
+	if forwarded {
+		atomic.AddInt64(&n.forwarded, 1)
+	}
+	if rl != nil && rl.Status == Status_OVER_LIMIT {
+		atomic.AddInt64(&n.overLimit, 1)
+	}
+}
+
+func (n *nameSlot) stats() *NameStats {
+	stats := NameStats{
+		Name:          n.name,
+		Requests:      atomic.LoadInt64(&n.requests),
+		RequestsError: n.overcount,
+		OverLimit:     atomic.LoadInt64(&n.overLimit),
+		Forwarded:     atomic.LoadInt64(&n.forwarded),
+	}
+	if counted := stats.Requests - stats.RequestsError; counted > 0 {
+		stats.ForwardedFraction = float64(stats.Forwarded) / float64(counted)
+	}
+	return &stats
+}
+
+// nameStats counts the usage of the rate limit names with the most requests by the space-saving algorithm;
+// at most `size` names are tracked, and a name not tracked takes the slot of the name with the fewest
+// requests. The names which receive more than 1/size of the requests are never replaced, such that the
+// names tracked are those with the most requests. The names of Config.NameStatsMetrics are counted exactly
+// instead, without taking a slot.
+//
+// Counting a request of a name tracked only takes a read lock and atomic adds, and never allocates.
+type nameStats struct {
+	size int
+	// The names of Config.NameStatsMetrics, immutable
+	allow map[string]*nameSlot
+
+	mutex sync.RWMutex
+	slots map[string]*nameSlot // protected by mutex
+}
+
+func newNameStats(size int, allow []string) *nameStats {
+	n := nameStats{
+		size:  size,
+		allow: make(map[string]*nameSlot, len(allow)),
+		slots: make(map[string]*nameSlot, size),
+	}
+	for _, name := range allow {
+		n.allow[name] = &nameSlot{name: name}
+	}
+	return &n
+}
+
+// observe counts a request of the rate limit name, and the response it was answered with
+func (n *nameStats) observe(name string, forwarded bool, rl *RateLimitResp) {
+	if name == "" {
+		return
+	}
+	if slot, ok := n.allow[name]; ok {
+		slot.add(forwarded, rl)
+		return
+	}
+
+	n.mutex.RLock()
+	slot, ok := n.slots[name]
+	if ok {
+		slot.add(forwarded, rl)
+	}
+	n.mutex.RUnlock()
+	if ok {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if slot, ok = n.slots[name]; !ok {
+		slot = n.replace(name)
+	}
+	slot.add(forwarded, rl)
+}
+
+// replace returns the slot of a name not tracked; a new slot until `size` names are tracked, then the slot
+// of the name with the fewest requests. The name inherits the requests of the slot as its overcount, as
+// the requests of the name before it was tracked are unknown. The caller must hold the mutex.
+func (n *nameStats) replace(name string) *nameSlot {
+	if len(n.slots) < n.size {
+		slot := &nameSlot{name: name}
+		n.slots[name] = slot
+		return slot
+	}
+
+	var min *nameSlot
+	for _, slot := range n.slots {
+		if min == nil || slot.requests < min.requests {
+			min = slot
+		}
+	}
+	delete(n.slots, min.name)
+	*min = nameSlot{name: name, requests: min.requests, overcount: min.requests}
+	n.slots[name] = min
+	return min
+}
+
+// metricName returns the name label of a metric of the rate limit name; the name if it is in
+// Config.NameStatsMetrics, else otherName
+func (n *nameStats) metricName(name string) string {
+	if _, ok := n.allow[name]; ok {
+		return name
+	}
+	return otherName
+}
+
+// stats returns the stats of the names tracked, including the names allowed if `tracked` is true
+func (n *nameStats) stats(tracked bool) []*NameStats {
+	var stats []*NameStats
+	for _, slot := range n.allow {
+		stats = append(stats, slot.stats())
+	}
+	if !tracked {
+		return stats
+	}
+
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	for _, slot := range n.slots {
+		stats = append(stats, slot.stats())
+	}
+	return stats
+}
+
+// keyName returns the name of the rate limit a key of RateLimitReq.HashKey() is for, without allocating
+func keyName(key cache.Key) (string, bool) {
+	key = strings.TrimPrefix(key, dryRunKeyPrefix)
+	i := strings.IndexByte(key, ':')
+	if i <= 0 {
+		return "", false
+	}
+	size, err := strconv.Atoi(key[:i])
+	if err != nil || size < 0 || i+1+size > len(key) {
+		return "", false
+	}
+	return key[i+1 : i+1+size], true
+}
+
+// countCacheEntries fills in the cache entries of the stats by walking the caches of the instance. Walking
+// a cache holds its lock, as such it is only done when the stats are asked for.
+func (s *Instance) countCacheEntries(stats []*NameStats) {
+	byName := make(map[string]*NameStats, len(stats))
+	for _, ns := range stats {
+		byName[ns.Name] = ns
+	}
+	count := func(key cache.Key, _ interface{}) {
+		if name, ok := keyName(key); ok {
+			if ns, ok := byName[name]; ok {
+				ns.CacheEntries++
+			}
+		}
+	}
+
+	if s.pool != nil {
+		s.pool.each(func(c *cache.LRUCache) {
+			c.ReadOnly().Each(count)
+		})
+		return
+	}
+	if c, ok := s.conf.Cache.(interface{ ReadOnly() cache.ReadOnlyCache }); ok {
+		c.ReadOnly().Each(count)
+	}
+	s.eachPartition(func(_ string, c *cache.LRUCache) {
+		c.ReadOnly().Each(count)
+	})
+}
+
+// GetNameStats reports the usage of the rate limit names with the most requests received by the instance,
+// see Config.NameStatsSize
+func (s *Instance) GetNameStats(ctx context.Context, r *GetNameStatsReq) (*GetNameStatsResp, error) {
+	stats := s.names.stats(true)
+	s.countCacheEntries(stats)
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Requests != stats[j].Requests {
+			return stats[i].Requests > stats[j].Requests
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	if r.Limit > 0 && int(r.Limit) < len(stats) {
+		stats = stats[:r.Limit]
+	}
+	return &GetNameStatsResp{Names: stats}, nil
+}
+
+// nameMetrics exports the usage of the names of Config.NameStatsMetrics to prometheus
+type nameMetrics struct {
+	requests     *prometheus.Desc
+	overLimit    *prometheus.Desc
+	forwarded    *prometheus.Desc
+	cacheEntries *prometheus.Desc
+}
+
+func newNameMetrics() *nameMetrics {
+	return &nameMetrics{
+		requests: prometheus.NewDesc("name_requests",
+			"The number of rate limits received from clients, by name.", []string{"name"}, nil),
+		overLimit: prometheus.NewDesc("name_over_limit",
+			"The number of rate limits answered with OVER_LIMIT, by name.", []string{"name"}, nil),
+		forwarded: prometheus.NewDesc("name_forwarded",
+			"The number of rate limits forwarded to the peer which owns them, by name.", []string{"name"}, nil),
+		cacheEntries: prometheus.NewDesc("name_cache_entries",
+			"The number of rate limits held by the cache, by name.", []string{"name"}, nil),
+	}
+}
+
+func (m *nameMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.requests
+	ch <- m.overLimit
+	ch <- m.forwarded
+	ch <- m.cacheEntries
+}
+
+func (m *nameMetrics) collect(ch chan<- prometheus.Metric, stats []*NameStats) {
+	for _, ns := range stats {
+		ch <- prometheus.MustNewConstMetric(m.requests, prometheus.CounterValue, float64(ns.Requests), ns.Name)
+		ch <- prometheus.MustNewConstMetric(m.overLimit, prometheus.CounterValue, float64(ns.OverLimit), ns.Name)
+		ch <- prometheus.MustNewConstMetric(m.forwarded, prometheus.CounterValue, float64(ns.Forwarded), ns.Name)
+		ch <- prometheus.MustNewConstMetric(m.cacheEntries, prometheus.GaugeValue, float64(ns.CacheEntries), ns.Name)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/mailgun/gubernator/cluster"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func newNameStatsInstance(t *testing.T, conf guber.Config) *guber.Instance {
+	conf.GRPCServer = grpc.NewServer()
+	instance, err := guber.New(conf)
+	require.Nil(t, err)
+	instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}})
+	return instance
+}
+
+// The names with the most requests are tracked among a far larger number of distinct names
+func TestNameStatsTopK(t *testing.T) {
+	const size = 10
+	instance := newNameStatsInstance(t, guber.Config{NameStatsSize: size})
+	defer instance.Close()
+
+	heavy := []string{"heavy_a", "heavy_b", "heavy_c"}
+	var noise int
+	for round := 0; round < 200; round++ {
+		var requests []*guber.RateLimitReq
+		for _, name := range heavy {
+			for i := 0; i < 2; i++ {
+				requests = append(requests, &guber.RateLimitReq{
+					Name:      name,
+					UniqueKey: fmt.Sprintf("account:%d", round%4),
+					Duration:  guber.Minute,
+					Limit:     50,
+					Hits:      1,
+				})
+			}
+		}
+		// Each noise name is requested only once
+		for i := 0; i < 5; i++ {
+			noise++
+			requests = append(requests, &guber.RateLimitReq{
+				Name:      fmt.Sprintf("noise_%d", noise),
+				UniqueKey: "account:1",
+				Duration:  guber.Minute,
+				Limit:     50,
+				Hits:      1,
+			})
+		}
+
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{Requests: requests})
+		require.Nil(t, err)
+		for _, rl := range resp.Responses {
+			require.Empty(t, rl.Error)
+		}
+	}
+
+	resp, err := instance.GetNameStats(context.Background(), &guber.GetNameStatsReq{})
+	require.Nil(t, err)
+	assert.Equal(t, size, len(resp.Names))
+
+	// The heavy names were never replaced by the noise, as such they are counted exactly
+	for i, name := range heavy {
+		var stats *guber.NameStats
+		for _, ns := range resp.Names {
+			if ns.Name == name {
+				stats = ns
+			}
+		}
+		require.NotNil(t, stats, "name '%s' is not tracked", name)
+		assert.Equal(t, int64(400), stats.Requests)
+		assert.Equal(t, int64(0), stats.RequestsError)
+		// Each of the 4 unique keys received 100 hits with a limit of 50
+		assert.Equal(t, int64(200), stats.OverLimit)
+		assert.Equal(t, int64(4), stats.CacheEntries)
+		assert.Equal(t, int64(0), stats.Forwarded)
+		assert.Equal(t, float64(0), stats.ForwardedFraction)
+
+		// The names with the most requests are reported first
+		assert.Contains(t, heavy, resp.Names[i].Name)
+	}
+
+	// The noise names tracked inherited the requests of the names they replaced
+	for _, ns := range resp.Names[len(heavy):] {
+		assert.True(t, ns.Requests-ns.RequestsError <= 1, "name '%s' has '%d' requests, '%d' inherited",
+			ns.Name, ns.Requests, ns.RequestsError)
+		assert.True(t, ns.Requests < 400)
+	}
+
+	resp, err = instance.GetNameStats(context.Background(), &guber.GetNameStatsReq{Limit: 2})
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(resp.Names))
+}
+
+// Each rate limit is sent via both instances, one of which forwards it to the other which owns it
+func TestNameStatsForwarded(t *testing.T) {
+	c, err := cluster.Start(2)
+	require.Nil(t, err)
+	defer c.Stop()
+
+	var forwarded [2]int64
+	const requests = 200
+	for i := 0; i < requests; i++ {
+		for idx := 0; idx < 2; idx++ {
+			resp, err := c.InstanceAt(idx).GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+				Requests: []*guber.RateLimitReq{
+					{
+						Name:      "test_name_stats_forwarded",
+						UniqueKey: fmt.Sprintf("account:%d", i),
+						Duration:  guber.Minute,
+						Limit:     10,
+						Hits:      1,
+					},
+				},
+			})
+			require.Nil(t, err)
+			require.Empty(t, resp.Responses[0].Error)
+			if resp.Responses[0].Metadata["owner"] != "" {
+				forwarded[idx]++
+			}
+		}
+	}
+	require.Equal(t, int64(requests), forwarded[0]+forwarded[1])
+
+	// The rate limits forwarded by a peer are not received from clients, as such not counted by the owner
+	for idx := 0; idx < 2; idx++ {
+		resp, err := c.InstanceAt(idx).GetNameStats(context.Background(), &guber.GetNameStatsReq{})
+		require.Nil(t, err)
+		require.Equal(t, 1, len(resp.Names), idx)
+		stats := resp.Names[0]
+		assert.Equal(t, int64(requests), stats.Requests, idx)
+		assert.Equal(t, forwarded[idx], stats.Forwarded, idx)
+		assert.Equal(t, float64(forwarded[idx])/requests, stats.ForwardedFraction, idx)
+		assert.Equal(t, requests-forwarded[idx], stats.CacheEntries, idx)
+	}
+}
+
+// The names allowed are counted exactly and exported as metrics
+func TestNameStatsMetrics(t *testing.T) {
+	instance := newNameStatsInstance(t, guber.Config{
+		NameStatsSize:    1,
+		NameStatsMetrics: []string{"allowed"},
+	})
+	defer instance.Close()
+
+	hit := func(name string) {
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{Name: name, UniqueKey: "account:1", Duration: guber.Minute, Limit: 2, Hits: 1},
+			},
+		})
+		require.Nil(t, err)
+		require.Empty(t, resp.Responses[0].Error)
+	}
+	for i := 0; i < 50; i++ {
+		hit(fmt.Sprintf("other_%d", i))
+		if i%10 == 0 {
+			hit("allowed")
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	require.Nil(t, reg.Register(instance))
+	metrics, err := reg.Gather()
+	require.Nil(t, err)
+
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		for _, metric := range m.Metric {
+			for _, label := range metric.Label {
+				if label.GetName() == "name" {
+					assert.Equal(t, "allowed", label.GetValue())
+					values[m.GetName()] = metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"name_requests":      5,
+		"name_over_limit":    3,
+		"name_forwarded":     0,
+		"name_cache_entries": 1,
+	}, values)
+
+	// The name allowed doesn't take the single slot of the names tracked
+	resp, err := instance.GetNameStats(context.Background(), &guber.GetNameStatsReq{})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(resp.Names))
+	assert.Equal(t, "allowed", resp.Names[1].Name)
+	assert.Equal(t, int64(5), resp.Names[1].Requests)
+	assert.Equal(t, "other_49", resp.Names[0].Name)
+	assert.Equal(t, int64(50), resp.Names[0].Requests)
+	assert.Equal(t, int64(49), resp.Names[0].RequestsError)
+}
@@ -18,11 +18,34 @@ package gubernator
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/gubernator/cache"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
-	"sync"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
 )
 
+// The estimated bytes held by a queued request in addition to its name and unique key
+const estimatedRequestBytes = 128
+
+// errBudgetExhausted is returned when a request can not be queued without exceeding the memory budget
+var errBudgetExhausted = status.Error(codes.ResourceExhausted, "memory budget exhausted; request was not queued")
+
+// errPeerShutdown is returned by a PeerClient once Shutdown() was called; IE: the peer left the cluster
+var errPeerShutdown = status.Error(codes.Unavailable, "peer client is shutdown; the peer left the cluster")
+
+// requestWeight returns the estimated bytes held by a queued request
+func requestWeight(r *RateLimitReq) int64 {
+	return estimatedRequestBytes + int64(len(r.Name)+len(r.UniqueKey))
+}
+
 type PeerPicker interface {
 	GetPeerByHost(host string) *PeerClient
 	Peers() []*PeerClient
@@ -33,35 +56,117 @@ type PeerPicker interface {
 }
 
 type PeerClient struct {
-	client  PeersV1Client
-	conn    *grpc.ClientConn
-	conf    BehaviorConfig
-	queue   chan *request
-	mutex   sync.Mutex
-	host    string
-	isOwner bool // true if this peer refers to this server instance
+	client   PeersV1Client    // protected by mutex
+	conn     *grpc.ClientConn // protected by mutex
+	conf     BehaviorConfig
+	flush    chan *batch
+	interval *Interval
+	mutex    sync.Mutex
+	pending  *batch // protected by mutex
+	closed   bool   // protected by mutex
+	inflight sync.WaitGroup
+	done     chan struct{}
+	stopped  chan struct{}
+	budget   *cache.Budget
+	skew     *skewTracker
+	host     string
+	isOwner  bool // true if this peer refers to this server instance
+	log      *logrus.Entry
+
+	// The number of consecutive connection errors, see reconnect()
+	failures atomic.Int64
+	// When the connection was first seen in TRANSIENT_FAILURE, zero if it was not
+	failingSince time.Time // protected by mutex
+
+	// The capabilitySet the peer advertised in its last response, without capKnown until the peer responds
+	capabilities atomic.Uint32
+	// Counts the rate limits downgraded for the peer, nil unless set by the instance
+	downgraded prometheus.Counter
+
+	// Optional, hedges the requests the peer is slow to respond to; see hedged()
+	hedger      *hedger
+	hedgeClient PeersV1Client    // protected by mutex
+	hedgeConn   *grpc.ClientConn // protected by mutex
+
+	// The namespaces of the instance, which bound the rate limits queued; nil unless set by the instance
+	namespaces *atomic.Pointer[namespaceSet]
 }
 
-type response struct {
-	rl  *RateLimitResp
-	err error
+// batch is a set of rate limits sent to a peer in a single request. Each waiting go routine is
+// assigned a slot by position when it joins the batch; once the response arrives every slot is
+// filled and `done` is closed, which wakes all the waiters at once instead of one send per item.
+//
+// Batches are pooled. The sender and each waiter hold a reference, the last to release() it returns
+// the batch to the pool; as such a waiter whose context is cancelled releases it without waiting.
+type batch struct {
+	requests  []*RateLimitReq
+	responses []*RateLimitResp
+	err       error
+	done      chan struct{}
+	// The bytes reserved from the memory budget by the requests
+	reserved int64
+	// The request sent to the peer, reused along with the requests slice it holds
+	req GetPeerRateLimitsReq
+	// The number of references held; the sender and each waiter
+	refs atomic.Int32
+	// True if the request might still be read once the batch is sent, IE: by a hedge which lost
+	shared bool
 }
 
-type request struct {
-	request *RateLimitReq
-	resp    chan *response
+var batchPool = sync.Pool{
+	New: func() interface{} {
+		// Most batches are flushed by the interval long before reaching the batch limit
+		return &batch{requests: make([]*RateLimitReq, 0, 64)}
+	},
+}
+
+// newBatch returns a batch from the pool, referenced by the sender
+func newBatch() *batch {
+	b := batchPool.Get().(*batch)
+	b.done = make(chan struct{})
+	b.refs.Store(1)
+	return b
+}
+
+// release drops a reference to the batch, the last reference returns it to the pool unless the
+// request is shared with a hedge
+func (b *batch) release() {
+	if b.refs.Add(-1) != 0 || b.shared {
+		return
+	}
+	b.reset()
+	batchPool.Put(b)
+}
+
+// reset clears the batch such that no stale request or response leaks into the next use
+func (b *batch) reset() {
+	for i := range b.requests {
+		b.requests[i] = nil
+	}
+	b.requests = b.requests[:0]
+	b.responses = nil
+	b.err = nil
+	b.done = nil
+	b.reserved = 0
+	b.req.Reset()
 }
 
 func NewPeerClient(conf BehaviorConfig, host string) (*PeerClient, error) {
 	c := &PeerClient{
-		queue: make(chan *request, 1000),
-		host:  host,
-		conf:  conf,
+		flush:    make(chan *batch, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		interval: NewInterval(conf.BatchWait),
+		host:     host,
+		conf:     conf,
+		log:      logrus.WithField("category", "peer-client").WithField("peer", host),
 	}
 
-	if err := c.dialPeer(); err != nil {
+	var err error
+	if c.conn, err = c.dialPeer(); err != nil {
 		return nil, err
 	}
+	c.client = NewPeersV1Client(c.conn)
 
 	go c.run()
 
@@ -74,8 +179,8 @@ func (c *PeerClient) GetPeerRateLimit(ctx context.Context, r *RateLimitReq) (*Ra
 
 	// TODO: remove batching for global if we end up implementing a HIT aggregator
 	// If config asked for batching or is global rate limit
-	if r.Behavior == Behavior_BATCHING ||
-		r.Behavior == Behavior_GLOBAL {
+	if !HasBehavior(r.Behavior, Behavior_NO_BATCHING) ||
+		HasBehavior(r.Behavior, Behavior_GLOBAL) {
 		return c.getPeerRateLimitsBatch(ctx, r)
 	}
 
@@ -91,117 +196,428 @@ func (c *PeerClient) GetPeerRateLimit(ctx context.Context, r *RateLimitReq) (*Ra
 
 // GetPeerRateLimits requests a list of rate limit statuses from a peer
 func (c *PeerClient) GetPeerRateLimits(ctx context.Context, r *GetPeerRateLimitsReq) (*GetPeerRateLimitsResp, error) {
-	resp, err := c.client.GetPeerRateLimits(ctx, r)
+	if err := c.begin(); err != nil {
+		return nil, err
+	}
+	defer c.inflight.Done()
+
+	resp, err := c.getPeerRateLimits(ctx, r)
 	if err != nil {
 		return nil, err
 	}
 
 	// Unlikely, but this avoids a panic if something wonky happens
 	if len(resp.RateLimits) != len(r.Requests) {
-		return nil, errors.New("number of rate limits in peer response does not match request")
+		return nil, status.Error(codes.Internal, "number of rate limits in peer response does not match request")
+	}
+	return resp, nil
+}
+
+// getPeerRateLimits sends the request to the peer, hedged if the peer dedupes the rate limits of the request
+// by their token; see hedged()
+func (c *PeerClient) getPeerRateLimits(ctx context.Context, r *GetPeerRateLimitsReq) (*GetPeerRateLimitsResp, error) {
+	r = c.downgrade(ctx, r)
+	if c.hedger != nil && c.hasCapability(capRequestToken) {
+		if h, ok := hedgeable(r); ok {
+			return c.hedged(ctx, h)
+		}
+	}
+
+	client, conn := c.connection()
+	resp, err := c.send(ctx, client, r)
+	c.observe(conn, err)
+	return resp, err
+}
+
+// send sends the request to the peer via `client`. The request is stamped with the local time such that
+// the peer can measure the clock skew, and the reset times in the response are converted to the local clock.
+func (c *PeerClient) send(ctx context.Context, client PeersV1Client, r *GetPeerRateLimitsReq) (*GetPeerRateLimitsResp, error) {
+	if c.skew == nil {
+		resp, err := client.GetPeerRateLimits(ctx, r)
+		if err == nil {
+			c.capabilities.Store(uint32(parseCapabilities(resp.Capabilities)))
+		}
+		return resp, err
+	}
+
+	// The request may be sent again as a hedge, stamp a copy
+	start := c.skew.now()
+	cpy := *r
+	cpy.Sender, cpy.SenderTime = c.skew.sender(), start
+	resp, err := client.GetPeerRateLimits(ctx, &cpy)
+	if err != nil {
+		return nil, err
+	}
+	c.capabilities.Store(uint32(parseCapabilities(resp.Capabilities)))
+
+	// The peer read its clock at some point while we waited, assume it was half way
+	offset := c.skew.observe(c.host, resp.SenderTime, (start+c.skew.now())/2)
+	if offset != 0 {
+		for _, rl := range resp.RateLimits {
+			rl.ResetTime = toLocal(rl.ResetTime, offset)
+		}
+		c.skew.checkDurations(c.host, offset, r.Requests)
 	}
 	return resp, nil
 }
 
 // UpdatePeerGlobals sends global rate limit status updates to a peer
 func (c *PeerClient) UpdatePeerGlobals(ctx context.Context, r *UpdatePeerGlobalsReq) (*UpdatePeerGlobalsResp, error) {
-	return c.client.UpdatePeerGlobals(ctx, r)
+	if err := c.begin(); err != nil {
+		return nil, err
+	}
+	defer c.inflight.Done()
+
+	client, conn := c.connection()
+	resp, err := client.UpdatePeerGlobals(ctx, r)
+	c.observe(conn, err)
+	if err == nil {
+		c.capabilities.Store(uint32(parseCapabilities(resp.Capabilities)))
+	}
+	return resp, err
+}
+
+// negotiate asks the peer for its capabilities with a request for no rate limits, which peers older than
+// the capabilities answer without any. If the peer can't be reached it is assumed to have no capabilities.
+func (c *PeerClient) negotiate(ctx context.Context) capabilitySet {
+	client, conn := c.connection()
+	resp, err := client.GetPeerRateLimits(ctx, &GetPeerRateLimitsReq{})
+	c.observe(conn, err)
+	if err != nil {
+		return 0
+	}
+	caps := parseCapabilities(resp.Capabilities)
+	c.capabilities.Store(uint32(caps))
+	return caps
+}
+
+// handoff asks the peer to hand off the state it holds for the rate limits, see Instance.handOff(). Returns
+// errNoHandoff if the peer is older than the handoff capability or could not be asked for its capabilities.
+func (c *PeerClient) handoff(ctx context.Context, requests []*RateLimitReq) (*GetPeerRateLimitsResp, error) {
+	if err := c.begin(); err != nil {
+		return nil, err
+	}
+	defer c.inflight.Done()
+
+	caps := capabilitySet(c.capabilities.Load())
+	if !caps.has(capKnown) {
+		caps = c.negotiate(ctx)
+	}
+	if !caps.has(capHandoff) {
+		return nil, errNoHandoff
+	}
+
+	resp, err := c.getPeerRateLimits(ctx, &GetPeerRateLimitsReq{Requests: requests, Handoff: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.RateLimits) != len(requests) || len(resp.HandoffDurations) != len(requests) {
+		return nil, status.Error(codes.Internal, "number of rate limits in peer handoff does not match request")
+	}
+	return resp, nil
+}
+
+// Capabilities returns the capabilities the peer advertised in its last response. Empty until the peer
+// responds, or if the peer is older than the capabilities.
+func (c *PeerClient) Capabilities() []string {
+	return capabilitySet(c.capabilities.Load()).names()
+}
+
+// hasCapability returns true if the peer advertised the capability in its last response
+func (c *PeerClient) hasCapability(capability capabilitySet) bool {
+	return capabilitySet(c.capabilities.Load()).has(capKnown | capability)
+}
+
+// downgrade returns the request as the peer can honor it according to the capabilities it advertised.
+// The rate limits which need a downgrade are copied, as the caller may still be using them. If a rate
+// limit requires a capability before the peer ever responded, the peer is asked for its capabilities.
+func (c *PeerClient) downgrade(ctx context.Context, r *GetPeerRateLimitsReq) *GetPeerRateLimitsReq {
+	caps := capabilitySet(c.capabilities.Load())
+	if !caps.has(capKnown) {
+		var required capabilitySet
+		for _, req := range r.Requests {
+			required |= requires(req)
+		}
+		if required == 0 {
+			return r
+		}
+		caps = c.negotiate(ctx)
+	}
+
+	var requests []*RateLimitReq
+	for i, req := range r.Requests {
+		d := downgradeRequest(req, caps)
+		if d == nil {
+			continue
+		}
+		if requests == nil {
+			requests = make([]*RateLimitReq, len(r.Requests))
+			copy(requests, r.Requests)
+		}
+		requests[i] = d
+		if c.downgraded != nil {
+			c.downgraded.Inc()
+		}
+	}
+
+	if requests == nil {
+		return r
+	}
+	cpy := *r
+	cpy.Requests = requests
+	return &cpy
+}
+
+// connection returns the client and the connection it uses, which reconnect() replaces
+func (c *PeerClient) connection() (PeersV1Client, *grpc.ClientConn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.client, c.conn
+}
+
+// isConnError returns true if the error indicates the connection to the peer is broken, rather than
+// the peer rejecting the request; Unimplemented means the address now belongs to some other service.
+func isConnError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Unimplemented:
+		return true
+	}
+	return false
+}
+
+// observe records the outcome of a request sent on `conn` and reconnects to the peer once the
+// connection looks persistently broken, see reconnect()
+func (c *PeerClient) observe(conn *grpc.ClientConn, err error) {
+	if !isConnError(err) {
+		if c.failures.Load() != 0 {
+			c.failures.Store(0)
+			c.mutex.Lock()
+			c.failingSince = time.Time{}
+			c.mutex.Unlock()
+		}
+		return
+	}
+	failures := c.failures.Add(1)
+	state := conn.GetState()
+
+	c.mutex.Lock()
+	// The connection was already replaced, or the client is shutting down and must not reconnect
+	if c.closed || c.conn != conn {
+		c.mutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	if state != connectivity.TransientFailure {
+		c.failingSince = time.Time{}
+	} else if c.failingSince.IsZero() {
+		c.failingSince = now
+	}
+	failing := !c.failingSince.IsZero() && now.Sub(c.failingSince) >= c.conf.PeerReconnectTimeout
+	if failures < int64(c.conf.PeerReconnectErrors) && !failing {
+		c.mutex.Unlock()
+		return
+	}
+	c.reconnect(err)
+}
+
+// reconnect tears down the connection to the peer and dials it again. A peer which was replaced can
+// leave the connection stuck; IE: retrying an address which is gone or now belongs to something else.
+// The new connection resolves the host again, such that a hostname follows the peer to its new address.
+// Requests in flight on the old connection fail like any other peer error. The caller must hold the
+// mutex, which is released.
+func (c *PeerClient) reconnect(cause error) {
+	old := c.conn
+	conn, err := c.dialPeer()
+	if err != nil {
+		c.mutex.Unlock()
+		c.log.WithError(err).Error("while reconnecting to peer")
+		return
+	}
+	c.conn, c.client = conn, NewPeersV1Client(conn)
+	c.failures.Store(0)
+	c.failingSince = time.Time{}
+	c.mutex.Unlock()
+
+	c.log.WithError(cause).Warn("connection to peer is failing; reconnected")
+	old.Close()
+}
+
+// begin registers a request in flight, such that Shutdown() waits for it before closing the
+// connection. Returns errPeerShutdown if the client is shutdown. The caller must call
+// c.inflight.Done() once the request completes.
+func (c *PeerClient) begin() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return errPeerShutdown
+	}
+	c.inflight.Add(1)
+	return nil
+}
+
+// Shutdown stops the client once the requests in flight and the batches already queued are sent, then
+// closes the connection to the peer. Requests made after Shutdown fail with an Unavailable error.
+func (c *PeerClient) Shutdown() {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return
+	}
+	c.closed = true
+	c.mutex.Unlock()
+
+	// Full batches are handed to run() by the requests in flight, wait for run() to send them
+	c.inflight.Wait()
+	close(c.done)
+	<-c.stopped
+
+	// No request can join a batch once closed, send the last partial batch ourselves
+	c.mutex.Lock()
+	b := c.pending
+	c.pending = nil
+	c.mutex.Unlock()
+	if b != nil {
+		c.sendBatch(b)
+	}
+
+	c.interval.Stop()
+	c.mutex.Lock()
+	conn, hedge := c.conn, c.hedgeConn
+	c.mutex.Unlock()
+	conn.Close()
+	if hedge != nil {
+		hedge.Close()
+	}
 }
 
 func (c *PeerClient) getPeerRateLimitsBatch(ctx context.Context, r *RateLimitReq) (*RateLimitResp, error) {
-	req := request{request: r, resp: make(chan *response, 1)}
+	if c.namespaces != nil {
+		if ns := c.namespaces.Load().lookup(r.Name); ns != nil {
+			if err := ns.enqueue(); err != nil {
+				return nil, err
+			}
+			defer ns.dequeue()
+		}
+	}
 
-	// Enqueue the request to be sent
-	c.queue <- &req
+	// The request is held by the batch until it is sent, reject it if that would exceed the budget
+	var weight int64
+	if c.budget != nil {
+		weight = requestWeight(r)
+		if !c.budget.Reserve(weight) {
+			return nil, errBudgetExhausted
+		}
+	}
+
+	// Join the pending batch
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		if c.budget != nil {
+			c.budget.Release(weight)
+		}
+		return nil, errPeerShutdown
+	}
+	c.inflight.Add(1)
+	defer c.inflight.Done()
+	b := c.pending
+	if b == nil {
+		b = newBatch()
+		c.pending = b
+	}
+	idx := len(b.requests)
+	b.requests = append(b.requests, r)
+	b.reserved += weight
+	b.refs.Add(1)
+	defer b.release()
+	full := len(b.requests) == c.conf.BatchLimit
+	if full {
+		c.pending = nil
+	}
+	c.mutex.Unlock()
+
+	// Send the batch if we reached our batch limit, else if this is the
+	// first request in the batch queue the next interval
+	if full {
+		c.flush <- b
+	} else if idx == 0 {
+		c.interval.Next()
+	}
 
 	// Wait for a response or context cancel
 	select {
-	case resp := <-req.resp:
-		if resp.err != nil {
-			return nil, resp.err
+	case <-b.done:
+		if b.err != nil {
+			return nil, b.err
 		}
-		return resp.rl, nil
+		return b.responses[idx], nil
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		// The batch is returned to the pool once sent, as the sender still holds a reference
+		return nil, status.FromContextError(ctx.Err()).Err()
 	}
 }
 
-// dialPeer dials a peer and initializes the GRPC client
-func (c *PeerClient) dialPeer() error {
-	var err error
-	c.conn, err = grpc.Dial(c.host, grpc.WithInsecure())
+// dialPeer dials a new connection to the peer
+func (c *PeerClient) dialPeer() (*grpc.ClientConn, error) {
+	conn, err := grpc.Dial(c.host, grpc.WithInsecure())
 	if err != nil {
-		return errors.Wrapf(err, "failed to dial peer %s", c.host)
+		return nil, errors.Wrapf(err, "failed to dial peer %s", c.host)
 	}
-
-	c.client = NewPeersV1Client(c.conn)
-	return nil
+	return conn, nil
 }
 
-// run waits for requests to be queued, when either c.batchWait time
-// has elapsed or the queue reaches c.batchLimit. Send what is in the queue.
+// run sends each batch when either it reaches c.conf.BatchLimit or
+// c.conf.BatchWait time has elapsed since the first request joined
 func (c *PeerClient) run() {
-	var interval = NewInterval(c.conf.BatchWait)
-	var queue []*request
-
+	defer close(c.stopped)
 	for {
 		select {
-		case r := <-c.queue:
-			queue = append(queue, r)
-
-			// Send the queue if we reached our batch limit
-			if len(queue) == c.conf.BatchLimit {
-				c.sendQueue(queue)
-				queue = nil
-				continue
-			}
+		case <-c.done:
+			return
 
-			// If this is our first queued item since last send
-			// queue the next interval
-			if len(queue) == 1 {
-				interval.Next()
-			}
+		case b := <-c.flush:
+			c.sendBatch(b)
+
+		case <-c.interval.C:
+			c.mutex.Lock()
+			b := c.pending
+			c.pending = nil
+			c.mutex.Unlock()
 
-		case <-interval.C:
-			if len(queue) != 0 {
-				c.sendQueue(queue)
-				queue = nil
+			if b != nil {
+				c.sendBatch(b)
 			}
 		}
 	}
 }
 
-// sendQueue sends the queue provided and returns the responses to
-// waiting go routines
-func (c *PeerClient) sendQueue(queue []*request) {
-	var req GetPeerRateLimitsReq
-	for _, r := range queue {
-		req.Requests = append(req.Requests, r.request)
+// sendBatch sends the batch provided, wakes the go routines waiting on it and releases the reference
+// of the sender
+func (c *PeerClient) sendBatch(b *batch) {
+	defer b.release()
+	defer close(b.done)
+	if c.budget != nil {
+		defer c.budget.Release(b.reserved)
 	}
 
+	// A hedge which lost may still be sending the request once we return, it can not be pooled
+	b.shared = c.hedger != nil
+	b.req.Requests = b.requests
 	ctx, cancel := context.WithTimeout(context.Background(), c.conf.BatchTimeout)
-	resp, err := c.client.GetPeerRateLimits(ctx, &req)
+	resp, err := c.getPeerRateLimits(ctx, &b.req)
 	cancel()
 
 	// An error here indicates the entire request failed
 	if err != nil {
-		for _, r := range queue {
-			r.resp <- &response{err: err}
-		}
+		b.err = err
 		return
 	}
 
 	// Unlikely, but this avoids a panic if something wonky happens
-	if len(resp.RateLimits) != len(queue) {
-		err = errors.New("server responded with incorrect rate limit list size")
-		for _, r := range queue {
-			r.resp <- &response{err: err}
-		}
+	if len(resp.RateLimits) != len(b.requests) {
+		b.err = status.Error(codes.Internal, "server responded with incorrect rate limit list size")
 		return
 	}
-
-	// Provide responses to channels waiting in the queue
-	for i, r := range queue {
-		r.resp <- &response{rl: resp.RateLimits[i]}
-	}
+	b.responses = resp.RateLimits
 }
@@ -21,6 +21,23 @@ type GetPeerRateLimitsReq struct {
 	// Must specify at least one RateLimit. The peer that recives this request MUST be authoritative for
 	// each rate_limit[x].unique_key provided, as the peer will not forward the request to any other peers
 	Requests []*RateLimitReq `protobuf:"bytes,1,rep,name=requests" json:"requests,omitempty"`
+	// The advertised address of the peer which sent the request
+	Sender string `protobuf:"bytes,2,opt,name=sender" json:"sender,omitempty"`
+	// The time in milliseconds since the epoch according to the clock of the sender, used to
+	// measure the clock skew between peers. Zero if the sender does not report its time.
+	SenderTime int64 `protobuf:"varint,3,opt,name=sender_time,json=senderTime" json:"sender_time,omitempty"`
+	// Non zero if the requests are the GLOBAL hits of the sender. The sender numbers each request of hits
+	// to the peer by the next sequence and retransmits it until acknowledged, the peer applies a sequence once.
+	Sequence uint64 `protobuf:"varint,4,opt,name=sequence" json:"sequence,omitempty"`
+	// Identifies the run of the sender which numbered the sequence, as a sender which restarts numbers
+	// its requests from the first sequence again
+	Epoch int64 `protobuf:"varint,5,opt,name=epoch" json:"epoch,omitempty"`
+	// The generation of the rate limit each of the GLOBAL hits were counted against, in the same order as
+	// the requests. The peer discards the hits of a generation which has ended. See UpdatePeerGlobal.generation
+	Generations []int64 `protobuf:"varint,6,rep,packed,name=generations" json:"generations,omitempty"`
+	// Set by the owner of the rate limits under a new hash configuration during a migration. Rather than
+	// apply the rate limits, the peer hands off the state it holds for each and forgets it.
+	Handoff bool `protobuf:"varint,7,opt,name=handoff" json:"handoff,omitempty"`
 }
 
 func (m *GetPeerRateLimitsReq) Reset()                    { *m = GetPeerRateLimitsReq{} }
@@ -35,9 +52,61 @@ func (m *GetPeerRateLimitsReq) GetRequests() []*RateLimitReq {
 	return nil
 }
 
+func (m *GetPeerRateLimitsReq) GetSender() string {
+	if m != nil {
+		return m.Sender
+	}
+	return ""
+}
+
+func (m *GetPeerRateLimitsReq) GetSenderTime() int64 {
+	if m != nil {
+		return m.SenderTime
+	}
+	return 0
+}
+
+func (m *GetPeerRateLimitsReq) GetSequence() uint64 {
+	if m != nil {
+		return m.Sequence
+	}
+	return 0
+}
+
+func (m *GetPeerRateLimitsReq) GetEpoch() int64 {
+	if m != nil {
+		return m.Epoch
+	}
+	return 0
+}
+
+func (m *GetPeerRateLimitsReq) GetGenerations() []int64 {
+	if m != nil {
+		return m.Generations
+	}
+	return nil
+}
+
+func (m *GetPeerRateLimitsReq) GetHandoff() bool {
+	if m != nil {
+		return m.Handoff
+	}
+	return false
+}
+
 type GetPeerRateLimitsResp struct {
 	// Responses are in the same order as they appeared in the PeerRateLimitRequests
 	RateLimits []*RateLimitResp `protobuf:"bytes,1,rep,name=rate_limits,json=rateLimits" json:"rate_limits,omitempty"`
+	// The time in milliseconds since the epoch according to the clock of the responding peer
+	SenderTime int64 `protobuf:"varint,2,opt,name=sender_time,json=senderTime" json:"sender_time,omitempty"`
+	// The capabilities of the responding peer, such that newer peers avoid sending it requests it
+	// can't honor during a rolling upgrade. Empty if the peer is older than the capabilities.
+	Capabilities []string `protobuf:"bytes,3,rep,name=capabilities" json:"capabilities,omitempty"`
+	// The last sequence of GLOBAL hits from the sender the peer applied
+	AckedSequence uint64 `protobuf:"varint,4,opt,name=acked_sequence,json=ackedSequence" json:"acked_sequence,omitempty"`
+	// Of each rate limit handed off, the duration of the state the peer held or -1 if it held none. The
+	// state itself is the status of the rate limit in rate_limits. See GetPeerRateLimitsReq.handoff
+	HandoffDurations []int64 `protobuf:"varint,5,rep,packed,name=handoff_durations,json=handoffDurations" json:"handoff_durations,omitempty"`
 }
 
 func (m *GetPeerRateLimitsResp) Reset()                    { *m = GetPeerRateLimitsResp{} }
@@ -52,9 +121,42 @@ func (m *GetPeerRateLimitsResp) GetRateLimits() []*RateLimitResp {
 	return nil
 }
 
+func (m *GetPeerRateLimitsResp) GetSenderTime() int64 {
+	if m != nil {
+		return m.SenderTime
+	}
+	return 0
+}
+
+func (m *GetPeerRateLimitsResp) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
+func (m *GetPeerRateLimitsResp) GetAckedSequence() uint64 {
+	if m != nil {
+		return m.AckedSequence
+	}
+	return 0
+}
+
+func (m *GetPeerRateLimitsResp) GetHandoffDurations() []int64 {
+	if m != nil {
+		return m.HandoffDurations
+	}
+	return nil
+}
+
 type UpdatePeerGlobalsReq struct {
 	// Must specify at least one RateLimit
 	Globals []*UpdatePeerGlobal `protobuf:"bytes,1,rep,name=globals" json:"globals,omitempty"`
+	// The advertised address of the peer which sent the updates
+	Sender string `protobuf:"bytes,2,opt,name=sender" json:"sender,omitempty"`
+	// The time in milliseconds since the epoch according to the clock of the sender, the reset
+	// time of each status is adjusted by the clock skew between the peers before it is cached.
+	SenderTime int64 `protobuf:"varint,3,opt,name=sender_time,json=senderTime" json:"sender_time,omitempty"`
 }
 
 func (m *UpdatePeerGlobalsReq) Reset()                    { *m = UpdatePeerGlobalsReq{} }
@@ -69,9 +171,26 @@ func (m *UpdatePeerGlobalsReq) GetGlobals() []*UpdatePeerGlobal {
 	return nil
 }
 
+func (m *UpdatePeerGlobalsReq) GetSender() string {
+	if m != nil {
+		return m.Sender
+	}
+	return ""
+}
+
+func (m *UpdatePeerGlobalsReq) GetSenderTime() int64 {
+	if m != nil {
+		return m.SenderTime
+	}
+	return 0
+}
+
 type UpdatePeerGlobal struct {
 	Key    string         `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
 	Status *RateLimitResp `protobuf:"bytes,2,opt,name=status" json:"status,omitempty"`
+	// Identifies the window of the rate limit; the time the window started according to the clock of the
+	// owner. Zero if the algorithm has no windows; IE: LEAKY_BUCKET
+	Generation int64 `protobuf:"varint,3,opt,name=generation" json:"generation,omitempty"`
 }
 
 func (m *UpdatePeerGlobal) Reset()                    { *m = UpdatePeerGlobal{} }
@@ -93,7 +212,16 @@ func (m *UpdatePeerGlobal) GetStatus() *RateLimitResp {
 	return nil
 }
 
+func (m *UpdatePeerGlobal) GetGeneration() int64 {
+	if m != nil {
+		return m.Generation
+	}
+	return 0
+}
+
 type UpdatePeerGlobalsResp struct {
+	// The capabilities of the responding peer, see GetPeerRateLimitsResp.capabilities
+	Capabilities []string `protobuf:"bytes,1,rep,name=capabilities" json:"capabilities,omitempty"`
 }
 
 func (m *UpdatePeerGlobalsResp) Reset()                    { *m = UpdatePeerGlobalsResp{} }
@@ -101,6 +229,13 @@ func (m *UpdatePeerGlobalsResp) String() string            { return proto.Compac
 func (*UpdatePeerGlobalsResp) ProtoMessage()               {}
 func (*UpdatePeerGlobalsResp) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{4} }
 
+func (m *UpdatePeerGlobalsResp) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*GetPeerRateLimitsReq)(nil), "pb.gubernator.GetPeerRateLimitsReq")
 	proto.RegisterType((*GetPeerRateLimitsResp)(nil), "pb.gubernator.GetPeerRateLimitsResp")
@@ -221,24 +356,35 @@ var _PeersV1_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("peers.proto", fileDescriptor1) }
 
 var fileDescriptor1 = []byte{
-	// 290 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x92, 0xc1, 0x4a, 0xc3, 0x40,
-	0x10, 0x86, 0xbb, 0x16, 0x5a, 0x9d, 0x20, 0xc6, 0xa5, 0xc5, 0x50, 0x05, 0xc3, 0xea, 0xa1, 0xa7,
-	0x80, 0x55, 0x10, 0x0f, 0x5e, 0xbc, 0xf4, 0x22, 0xa8, 0x0b, 0xf6, 0xd0, 0x8b, 0x6e, 0x70, 0x28,
-	0xc5, 0x68, 0x36, 0x3b, 0x9b, 0x83, 0x37, 0x5f, 0xd0, 0x77, 0x92, 0xa4, 0x31, 0xc5, 0x64, 0x4b,
-	0x6f, 0x93, 0xc9, 0x97, 0x6f, 0xfe, 0xcc, 0x2e, 0x78, 0x1a, 0xd1, 0x50, 0xa4, 0x4d, 0x6a, 0x53,
-	0xbe, 0xaf, 0xe3, 0x68, 0x91, 0xc7, 0x68, 0x3e, 0x95, 0x4d, 0xcd, 0xc8, 0x5f, 0xd7, 0x2b, 0x40,
-	0x3c, 0xc0, 0x60, 0x8a, 0xf6, 0x11, 0xd1, 0x48, 0x65, 0xf1, 0x7e, 0xf9, 0xb1, 0xb4, 0x24, 0x31,
-	0xe3, 0xd7, 0xb0, 0x6b, 0x30, 0xcb, 0x91, 0x2c, 0x05, 0x2c, 0xec, 0x8e, 0xbd, 0xc9, 0x71, 0xf4,
-	0xcf, 0x15, 0xd5, 0xbc, 0xc4, 0x4c, 0xd6, 0xb0, 0x98, 0xc1, 0xd0, 0x21, 0x24, 0xcd, 0x6f, 0xc1,
-	0x33, 0xca, 0xe2, 0x4b, 0x52, 0xb6, 0x2a, 0xe9, 0xc9, 0x66, 0x29, 0x69, 0x09, 0xa6, 0x56, 0x88,
-	0x27, 0x18, 0x3c, 0xeb, 0x37, 0x65, 0xb1, 0x50, 0x4f, 0x93, 0x34, 0x56, 0x49, 0x19, 0xf4, 0x06,
-	0xfa, 0x8b, 0xd5, 0x53, 0xa5, 0x3c, 0x6d, 0x28, 0x9b, 0x5f, 0xc9, 0x3f, 0x5e, 0xcc, 0xc1, 0x6f,
-	0xbe, 0xe4, 0x3e, 0x74, 0xdf, 0xf1, 0x2b, 0x60, 0x21, 0x1b, 0xef, 0xc9, 0xa2, 0xe4, 0x57, 0xd0,
-	0x23, 0xab, 0x6c, 0x4e, 0xc1, 0x4e, 0xc8, 0xb6, 0x46, 0xae, 0x58, 0x71, 0x04, 0x43, 0x47, 0x5c,
-	0xd2, 0x93, 0x1f, 0x06, 0xfd, 0xa2, 0x47, 0xb3, 0x0b, 0xfe, 0x0a, 0x87, 0xad, 0x5d, 0xf1, 0xb3,
-	0x86, 0xdf, 0x75, 0x3c, 0xa3, 0xf3, 0xed, 0x10, 0x69, 0xd1, 0x29, 0x26, 0xb4, 0x62, 0xb4, 0x26,
-	0xb8, 0xf6, 0xda, 0x9a, 0xe0, 0xfc, 0x1b, 0xd1, 0xb9, 0x3b, 0x98, 0xc3, 0x9a, 0xfa, 0x66, 0x2c,
-	0xee, 0x95, 0x17, 0xeb, 0xf2, 0x37, 0x00, 0x00, 0xff, 0xff, 0x19, 0x46, 0x07, 0x4d, 0x88, 0x02,
-	0x00, 0x00,
+	// 469 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x54, 0xcf, 0x6f, 0xd3, 0x30,
+	0x14, 0xc6, 0xcb, 0xfa, 0x63, 0x2f, 0x0c, 0x3a, 0xab, 0x43, 0x56, 0x41, 0xcc, 0x0a, 0x43, 0x8a,
+	0x84, 0x54, 0x89, 0x81, 0x84, 0x10, 0xe2, 0x82, 0x90, 0x76, 0xe1, 0x80, 0xcc, 0x8f, 0x03, 0x97,
+	0xe2, 0x34, 0x6f, 0x9d, 0xb5, 0x36, 0x71, 0x6d, 0xf7, 0x00, 0x27, 0xce, 0xfc, 0x6f, 0xfc, 0x2d,
+	0xdc, 0x38, 0xa3, 0x38, 0x49, 0xcb, 0x92, 0xa2, 0x4a, 0xbb, 0xf9, 0x7d, 0xfd, 0xde, 0xf7, 0xfc,
+	0xbd, 0xcf, 0x0d, 0x84, 0x1a, 0xd1, 0xd8, 0xb1, 0x36, 0xb9, 0xcb, 0xe9, 0xa1, 0x4e, 0xc6, 0xb3,
+	0x55, 0x82, 0x26, 0x93, 0x2e, 0x37, 0xa3, 0xc1, 0xe6, 0x5c, 0x12, 0xa2, 0x3f, 0x04, 0x86, 0xe7,
+	0xe8, 0xde, 0x23, 0x1a, 0x21, 0x1d, 0xbe, 0x53, 0x0b, 0xe5, 0xac, 0xc0, 0x25, 0x7d, 0x01, 0x7d,
+	0x83, 0xcb, 0x15, 0x5a, 0x67, 0x19, 0xe1, 0x41, 0x1c, 0x9e, 0xdd, 0x1f, 0x5f, 0x13, 0x1b, 0xaf,
+	0xf9, 0x02, 0x97, 0x62, 0x4d, 0xa6, 0xf7, 0xa0, 0x6b, 0x31, 0x4b, 0xd1, 0xb0, 0x3d, 0x4e, 0xe2,
+	0x03, 0x51, 0x55, 0xf4, 0x04, 0xc2, 0xf2, 0x34, 0x71, 0x6a, 0x81, 0x2c, 0xe0, 0x24, 0x0e, 0x04,
+	0x94, 0xd0, 0x47, 0xb5, 0x40, 0x3a, 0x82, 0xbe, 0x2d, 0x44, 0xb2, 0x29, 0xb2, 0x7d, 0x4e, 0xe2,
+	0x7d, 0xb1, 0xae, 0xe9, 0x10, 0x3a, 0xa8, 0xf3, 0xe9, 0x25, 0xeb, 0xf8, 0xb6, 0xb2, 0xa0, 0x1c,
+	0xc2, 0x19, 0x66, 0x68, 0xa4, 0x53, 0x79, 0x66, 0x59, 0x97, 0x07, 0x71, 0x20, 0xfe, 0x85, 0x28,
+	0x83, 0xde, 0xa5, 0xcc, 0xd2, 0xfc, 0xe2, 0x82, 0xf5, 0x38, 0x89, 0xfb, 0xa2, 0x2e, 0xa3, 0xdf,
+	0x04, 0x8e, 0xb7, 0x18, 0xb7, 0x9a, 0xbe, 0x86, 0xd0, 0x48, 0x87, 0x93, 0xb9, 0x87, 0x2a, 0xf3,
+	0x0f, 0xfe, 0x6f, 0xde, 0x6a, 0x01, 0x66, 0x2d, 0xd1, 0xf4, 0xb9, 0xd7, 0xf2, 0x19, 0xc1, 0xed,
+	0xa9, 0xd4, 0x32, 0x51, 0x73, 0xe5, 0x14, 0x5a, 0x16, 0xf0, 0x20, 0x3e, 0x10, 0xd7, 0x30, 0xfa,
+	0x18, 0xee, 0xc8, 0xe9, 0x15, 0xa6, 0x93, 0xc6, 0x46, 0x0e, 0x3d, 0xfa, 0xa1, 0x5e, 0xcb, 0x13,
+	0x38, 0xaa, 0xfc, 0x4c, 0xd2, 0x55, 0xbd, 0x86, 0x8e, 0x5f, 0xc3, 0xa0, 0xfa, 0xe1, 0x6d, 0x8d,
+	0x47, 0x3f, 0x09, 0x0c, 0x3f, 0xe9, 0x54, 0x3a, 0x2c, 0x4c, 0x9f, 0xcf, 0xf3, 0x44, 0xce, 0x7d,
+	0xd4, 0x2f, 0xa1, 0x37, 0x2b, 0xab, 0xca, 0xec, 0x49, 0xc3, 0x6c, 0xb3, 0x4b, 0xd4, 0xfc, 0x1b,
+	0x87, 0x1d, 0x7d, 0x87, 0x41, 0x53, 0x95, 0x0e, 0x20, 0xb8, 0xc2, 0x6f, 0x8c, 0x78, 0xa5, 0xe2,
+	0x48, 0x9f, 0x43, 0xd7, 0x3a, 0xe9, 0x56, 0xd6, 0xcb, 0xef, 0x4a, 0xa1, 0xe2, 0xd2, 0x87, 0x00,
+	0x9b, 0x37, 0x50, 0xcf, 0xde, 0x20, 0xd1, 0x2b, 0x38, 0xde, 0xb2, 0x07, 0xab, 0x5b, 0xc9, 0x90,
+	0x76, 0x32, 0x67, 0xbf, 0x08, 0xf4, 0x8a, 0x3e, 0xfb, 0xf9, 0x29, 0xfd, 0x0a, 0x47, 0xad, 0x27,
+	0x44, 0x1f, 0x35, 0xee, 0xb8, 0xed, 0xdf, 0x35, 0x3a, 0xdd, 0x4d, 0xb2, 0x3a, 0xba, 0x55, 0x4c,
+	0x68, 0x5d, 0xb5, 0x35, 0x61, 0x5b, 0xa8, 0xa3, 0xd3, 0xdd, 0xa4, 0x62, 0xc2, 0x9b, 0xbb, 0x5f,
+	0x60, 0xc3, 0xfa, 0x41, 0x48, 0xd2, 0xf5, 0x1f, 0x86, 0x67, 0x7f, 0x07, 0x00, 0xf4, 0xcd, 0x45,
+	0xf7, 0x48, 0x04, 0x00, 0x00,
 }
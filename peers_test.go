@@ -0,0 +1,347 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	guber "github.com/mailgun/gubernator"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+)
+
+const hostsScheme = "test-peer-hosts"
+
+func init() {
+	resolver.Register(hosts)
+}
+
+// hosts resolves hostnames to the address currently assigned to them. Like a DNS answer cached for the
+// life of the connection, a hostname is only resolved once when the connection is dialed.
+var hosts = &hostsResolver{addrs: make(map[string]string)}
+
+type hostsResolver struct {
+	mutex sync.Mutex
+	addrs map[string]string
+}
+
+func (h *hostsResolver) set(host, addr string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.addrs[host] = addr
+}
+
+func (h *hostsResolver) Scheme() string {
+	return hostsScheme
+}
+
+func (h *hostsResolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	h.mutex.Lock()
+	addr := h.addrs[target.Endpoint]
+	h.mutex.Unlock()
+	cc.NewAddress([]resolver.Address{{Addr: addr}})
+	return h, nil
+}
+
+func (h *hostsResolver) ResolveNow(resolver.ResolveNowOption) {}
+
+func (h *hostsResolver) Close() {}
+
+// fakePeer answers every rate limit as under the limit
+type fakePeer struct {
+	server   *grpc.Server
+	address  string
+	requests int64
+	// The capabilities advertised by the peer, none like a peer older than the capabilities
+	capabilities []string
+	// If true, the requests for rate limits sent on the first connection to the peer stall until cancelled
+	stall bool
+
+	mutex     sync.Mutex
+	received  []*guber.RateLimitReq
+	firstConn string
+}
+
+func startFakePeer(t *testing.T) *fakePeer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	p := &fakePeer{server: grpc.NewServer(), address: listener.Addr().String()}
+	guber.RegisterPeersV1Server(p.server, p)
+	go p.server.Serve(listener)
+	return p
+}
+
+func (p *fakePeer) GetPeerRateLimits(ctx context.Context, r *guber.GetPeerRateLimitsReq) (*guber.GetPeerRateLimitsResp, error) {
+	atomic.AddInt64(&p.requests, 1)
+	p.mutex.Lock()
+	p.received = append(p.received, r.Requests...)
+	from, _ := peer.FromContext(ctx)
+	if p.firstConn == "" {
+		p.firstConn = from.Addr.String()
+	}
+	stall := p.stall && len(r.Requests) != 0 && p.firstConn == from.Addr.String()
+	p.mutex.Unlock()
+
+	if stall {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	resp := guber.GetPeerRateLimitsResp{Capabilities: p.capabilities}
+	for _, req := range r.Requests {
+		resp.RateLimits = append(resp.RateLimits, &guber.RateLimitResp{
+			Status:    guber.Status_UNDER_LIMIT,
+			Limit:     req.Limit,
+			Remaining: req.Limit - req.Hits,
+		})
+	}
+	return &resp, nil
+}
+
+func (p *fakePeer) UpdatePeerGlobals(ctx context.Context, r *guber.UpdatePeerGlobalsReq) (*guber.UpdatePeerGlobalsResp, error) {
+	return &guber.UpdatePeerGlobalsResp{}, nil
+}
+
+// A peer replaced by one on a new address is only reachable by dialing the hostname of the peer again
+func TestPeerClientReconnect(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Behaviors guber.BehaviorConfig
+		Behavior  guber.Behavior
+	}{
+		{
+			Name:      "consecutive errors",
+			Behaviors: guber.BehaviorConfig{PeerReconnectErrors: 3, PeerReconnectTimeout: time.Hour},
+			Behavior:  guber.Behavior_NO_BATCHING,
+		},
+		{
+			Name:      "transient failure",
+			Behaviors: guber.BehaviorConfig{PeerReconnectErrors: 1000000, PeerReconnectTimeout: 100 * time.Millisecond},
+			Behavior:  guber.Behavior_BATCHING,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			conf := guber.Config{Behaviors: test.Behaviors}
+			require.Nil(t, conf.SetDefaults())
+
+			old := startFakePeer(t)
+			hosts.set("peer", old.address)
+
+			client, err := guber.NewPeerClient(conf.Behaviors, hostsScheme+":///peer")
+			require.Nil(t, err)
+			defer client.Shutdown()
+
+			hit := func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				_, err := client.GetPeerRateLimit(ctx, &guber.RateLimitReq{
+					Name:      "test_peer_client_reconnect",
+					UniqueKey: "account:1234",
+					Behavior:  test.Behavior,
+					Duration:  guber.Minute,
+					Limit:     10,
+					Hits:      1,
+				})
+				return err
+			}
+			require.Nil(t, hit())
+
+			// The peer is replaced by one on a new address
+			old.server.Stop()
+			replacement := startFakePeer(t)
+			defer replacement.server.Stop()
+			hosts.set("peer", replacement.address)
+
+			// Requests fail with the peer error until the client reconnects, rather than hang
+			var errs int
+			deadline := time.Now().Add(10 * time.Second)
+			for err = hit(); err != nil && time.Now().Before(deadline); err = hit() {
+				errs++
+				time.Sleep(10 * time.Millisecond)
+			}
+			require.Nil(t, err, "client did not reconnect to the replacement peer")
+			assert.NotZero(t, errs)
+			assert.Equal(t, int64(1), atomic.LoadInt64(&replacement.requests))
+		})
+	}
+}
+
+// A newer instance downgrades the rate limits it sends to a peer which doesn't advertise the capabilities
+// they require, as an older peer would silently drop the fields it doesn't know
+func TestPeerCapabilities(t *testing.T) {
+	v1 := startFakePeer(t)
+	defer v1.server.Stop()
+	v2 := startFakePeer(t)
+	v2.capabilities = []string{guber.CapabilityRequestToken, guber.CapabilityBehaviorFlags}
+	defer v2.server.Stop()
+
+	instance, err := guber.New(guber.Config{GRPCServer: grpc.NewServer(), Picker: &modPicker{}})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: "127.0.0.1:0", IsOwner: true}, {Address: v1.address}, {Address: v2.address}})
+
+	// Rate limits are owned by the peer at the index of the number at the end of their unique key
+	hit := func(key string) {
+		resp, err := instance.GetRateLimits(context.Background(), &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:         "test_peer_capabilities",
+					UniqueKey:    key,
+					Behavior:     guber.Behavior_NO_BATCHING | guber.Behavior_REBASE_DURATION,
+					RequestToken: "token",
+					Duration:     guber.Minute,
+					Limit:        10,
+					Hits:         1,
+				},
+			},
+		})
+		require.Nil(t, err)
+		require.Empty(t, resp.Responses[0].Error)
+	}
+	for i := 0; i < 2; i++ {
+		hit("account:1")
+		hit("account:2")
+	}
+
+	// The older peer never receives the fields it doesn't know
+	require.Len(t, v1.received, 2)
+	for _, r := range v1.received {
+		assert.Equal(t, guber.Behavior_NO_BATCHING, r.Behavior)
+		assert.Empty(t, r.RequestToken)
+	}
+
+	// The newer peer is asked for its capabilities before the first rate limit, which is never downgraded
+	require.Len(t, v2.received, 2)
+	for _, r := range v2.received {
+		assert.Equal(t, guber.Behavior_NO_BATCHING|guber.Behavior_REBASE_DURATION, r.Behavior)
+		assert.Equal(t, "token", r.RequestToken)
+	}
+
+	reg := prometheus.NewRegistry()
+	require.Nil(t, reg.Register(instance))
+	metrics, err := reg.Gather()
+	require.Nil(t, err)
+	var downgraded float64
+	for _, m := range metrics {
+		if m.GetName() == "peer_downgraded_requests" {
+			downgraded = m.Metric[0].Counter.GetValue()
+		}
+	}
+	assert.Equal(t, float64(2), downgraded)
+
+	health, err := instance.HealthCheck(context.Background(), &guber.HealthCheckReq{})
+	require.Nil(t, err)
+	caps := make(map[string][]string)
+	for _, p := range health.Peers {
+		caps[p.Address] = p.Capabilities
+	}
+	assert.Equal(t, map[string][]string{
+		"127.0.0.1:0": {guber.CapabilityRequestToken, guber.CapabilityBehaviorFlags, guber.CapabilityGlobalSequences,
+			guber.CapabilityHandoff, guber.CapabilityDryRun},
+		v1.address: nil,
+		v2.address: {guber.CapabilityRequestToken, guber.CapabilityBehaviorFlags},
+	}, caps)
+}
+
+// A request the peer is slow to respond to is hedged on a second connection, within the budget of hedges
+func TestPeerHedging(t *testing.T) {
+	slow := startFakePeer(t)
+	slow.capabilities = []string{guber.CapabilityRequestToken}
+	slow.stall = true
+	defer slow.server.Stop()
+
+	instance, err := guber.New(guber.Config{
+		GRPCServer: grpc.NewServer(),
+		Behaviors: guber.BehaviorConfig{
+			HedgeDelay:  20 * time.Millisecond,
+			HedgeBudget: 0.01,
+		},
+	})
+	require.Nil(t, err)
+	defer instance.Close()
+	instance.SetPeers([]guber.PeerInfo{{Address: slow.address}})
+
+	hit := func(token string) *guber.RateLimitResp {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		resp, err := instance.GetRateLimits(ctx, &guber.GetRateLimitsReq{
+			Requests: []*guber.RateLimitReq{
+				{
+					Name:         "test_peer_hedging",
+					UniqueKey:    "account:1234",
+					Behavior:     guber.Behavior_NO_BATCHING,
+					RequestToken: token,
+					Duration:     guber.Minute,
+					Limit:        10,
+					Hits:         1,
+				},
+			},
+		})
+		require.Nil(t, err)
+		return resp.Responses[0]
+	}
+
+	// The peer is asked for its capabilities before the first rate limit with a token, which isn't stalled
+	rl := hit("token")
+	require.Empty(t, rl.Error)
+	for i := 1; i < 10; i++ {
+		rl := hit("")
+		require.Empty(t, rl.Error)
+	}
+
+	// The budget of hedges is spent, the requests wait for the stalled connection
+	for i := 0; i < 2; i++ {
+		rl := hit("")
+		assert.Contains(t, rl.Error, "DeadlineExceeded")
+	}
+
+	// Each rate limit hedged was sent twice with the same token, such that the peer applies it once
+	slow.mutex.Lock()
+	received := slow.received
+	slow.mutex.Unlock()
+	require.Len(t, received, 22)
+	assert.Equal(t, "token", received[0].RequestToken)
+	assert.Equal(t, "token", received[1].RequestToken)
+	for i := 0; i < 20; i += 2 {
+		assert.NotEmpty(t, received[i].RequestToken)
+		assert.Equal(t, received[i].RequestToken, received[i+1].RequestToken)
+	}
+
+	reg := prometheus.NewRegistry()
+	require.Nil(t, reg.Register(instance))
+	metrics, err := reg.Gather()
+	require.Nil(t, err)
+	counters := make(map[string]float64)
+	for _, m := range metrics {
+		if m.GetName() == "peer_hedges_issued" || m.GetName() == "peer_hedges_won" {
+			counters[m.GetName()] = m.Metric[0].Counter.GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{"peer_hedges_issued": 10, "peer_hedges_won": 10}, counters)
+}
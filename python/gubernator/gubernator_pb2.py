@@ -21,7 +21,7 @@ DESCRIPTOR = _descriptor.FileDescriptor(
   package='pb.gubernator',
   syntax='proto3',
   serialized_options=_b('Z\ngubernator\200\001\001'),
-  serialized_pb=_b('\n\x10gubernator.proto\x12\rpb.gubernator\x1a\x1cgoogle/api/annotations.proto\"A\n\x10GetRateLimitsReq\x12-\n\x08requests\x18\x01 \x03(\x0b\x32\x1b.pb.gubernator.RateLimitReq\"D\n\x11GetRateLimitsResp\x12/\n\tresponses\x18\x01 \x03(\x0b\x32\x1c.pb.gubernator.RateLimitResp\"\xb7\x01\n\x0cRateLimitReq\x12\x0c\n\x04name\x18\x01 \x01(\t\x12\x12\n\nunique_key\x18\x02 \x01(\t\x12\x0c\n\x04hits\x18\x03 \x01(\x03\x12\r\n\x05limit\x18\x04 \x01(\x03\x12\x10\n\x08\x64uration\x18\x05 \x01(\x03\x12+\n\talgorithm\x18\x06 \x01(\x0e\x32\x18.pb.gubernator.Algorithm\x12)\n\x08\x62\x65havior\x18\x07 \x01(\x0e\x32\x17.pb.gubernator.Behavior\"\xea\x01\n\rRateLimitResp\x12%\n\x06status\x18\x01 \x01(\x0e\x32\x15.pb.gubernator.Status\x12\r\n\x05limit\x18\x02 \x01(\x03\x12\x11\n\tremaining\x18\x03 \x01(\x03\x12\x12\n\nreset_time\x18\x04 \x01(\x03\x12\r\n\x05\x65rror\x18\x05 \x01(\t\x12<\n\x08metadata\x18\x06 \x03(\x0b\x32*.pb.gubernator.RateLimitResp.MetadataEntry\x1a/\n\rMetadataEntry\x12\x0b\n\x03key\x18\x01 \x01(\t\x12\r\n\x05value\x18\x02 \x01(\t:\x02\x38\x01\"\x10\n\x0eHealthCheckReq\"F\n\x0fHealthCheckResp\x12\x0e\n\x06status\x18\x01 \x01(\t\x12\x0f\n\x07message\x18\x02 \x01(\t\x12\x12\n\npeer_count\x18\x03 \x01(\x05*/\n\tAlgorithm\x12\x10\n\x0cTOKEN_BUCKET\x10\x00\x12\x10\n\x0cLEAKY_BUCKET\x10\x01*5\n\x08\x42\x65havior\x12\x0c\n\x08\x42\x41TCHING\x10\x00\x12\x0f\n\x0bNO_BATCHING\x10\x01\x12\n\n\x06GLOBAL\x10\x02*)\n\x06Status\x12\x0f\n\x0bUNDER_LIMIT\x10\x00\x12\x0e\n\nOVER_LIMIT\x10\x01\x32\xdd\x01\n\x02V1\x12p\n\rGetRateLimits\x12\x1f.pb.gubernator.GetRateLimitsReq\x1a .pb.gubernator.GetRateLimitsResp\"\x1c\x82\xd3\xe4\x93\x02\x16\"\x11/v1/GetRateLimits:\x01*\x12\x65\n\x0bHealthCheck\x12\x1d.pb.gubernator.HealthCheckReq\x1a\x1e.pb.gubernator.HealthCheckResp\"\x17\x82\xd3\xe4\x93\x02\x11\x12\x0f/v1/HealthCheckB\x0fZ\ngubernator\x80\x01\x01\x62\x06proto3')
+  serialized_pb=_b('\n\x10gubernator.proto\x12\rpb.gubernator\x1a\x1cgoogle/api/annotations.proto\"A\n\x10GetRateLimitsReq\x12-\n\x08requests\x18\x01 \x03(\x0b\x32\x1b.pb.gubernator.RateLimitReq\"D\n\x11GetRateLimitsResp\x12/\n\tresponses\x18\x01 \x03(\x0b\x32\x1c.pb.gubernator.RateLimitResp\"\xce\x01\n\x0cRateLimitReq\x12\x0c\n\x04name\x18\x01 \x01(\t\x12\x12\n\nunique_key\x18\x02 \x01(\t\x12\x0c\n\x04hits\x18\x03 \x01(\x03\x12\r\n\x05limit\x18\x04 \x01(\x03\x12\x10\n\x08\x64uration\x18\x05 \x01(\x03\x12+\n\talgorithm\x18\x06 \x01(\x0e\x32\x18.pb.gubernator.Algorithm\x12)\n\x08\x62\x65havior\x18\x07 \x01(\x0e\x32\x17.pb.gubernator.Behavior\x12\x15\n\rrequest_token\x18\x08 \x01(\t\"\xea\x01\n\rRateLimitResp\x12%\n\x06status\x18\x01 \x01(\x0e\x32\x15.pb.gubernator.Status\x12\r\n\x05limit\x18\x02 \x01(\x03\x12\x11\n\tremaining\x18\x03 \x01(\x03\x12\x12\n\nreset_time\x18\x04 \x01(\x03\x12\r\n\x05\x65rror\x18\x05 \x01(\t\x12<\n\x08metadata\x18\x06 \x03(\x0b\x32*.pb.gubernator.RateLimitResp.MetadataEntry\x1a/\n\rMetadataEntry\x12\x0b\n\x03key\x18\x01 \x01(\t\x12\r\n\x05value\x18\x02 \x01(\t:\x02\x38\x01\"\x10\n\x0eHealthCheckReq\"v\n\x0fHealthCheckResp\x12\x0e\n\x06status\x18\x01 \x01(\t\x12\x0f\n\x07message\x18\x02 \x01(\t\x12\x12\n\npeer_count\x18\x03 \x01(\x05\x12.\n\x05peers\x18\x04 \x03(\x0b\x32\x1f.pb.gubernator.PeerCapabilities\"9\n\x10PeerCapabilities\x12\x0f\n\x07\x61\x64\x64ress\x18\x01 \x01(\t\x12\x14\n\x0c\x63\x61pabilities\x18\x02 \x03(\t*/\n\tAlgorithm\x12\x10\n\x0cTOKEN_BUCKET\x10\x00\x12\x10\n\x0cLEAKY_BUCKET\x10\x01*l\n\x08\x42\x65havior\x12\x0c\n\x08\x42\x41TCHING\x10\x00\x12\x0f\n\x0bNO_BATCHING\x10\x01\x12\n\n\x06GLOBAL\x10\x02\x12\x13\n\x0fREBASE_DURATION\x10\x04\x12\x0b\n\x07\x44RY_RUN\x10\x08\x12\x13\n\x0fNO_CLIENT_CACHE\x10\x10*)\n\x06Status\x12\x0f\n\x0bUNDER_LIMIT\x10\x00\x12\x0e\n\nOVER_LIMIT\x10\x01\x32\xdd\x01\n\x02V1\x12p\n\rGetRateLimits\x12\x1f.pb.gubernator.GetRateLimitsReq\x1a .pb.gubernator.GetRateLimitsResp\"\x1c\x82\xd3\xe4\x93\x02\x16\"\x11/v1/GetRateLimits:\x01*\x12\x65\n\x0bHealthCheck\x12\x1d.pb.gubernator.HealthCheckReq\x1a\x1e.pb.gubernator.HealthCheckResp\"\x17\x82\xd3\xe4\x93\x02\x11\x12\x0f/v1/HealthCheckB\x0fZ\ngubernator\x80\x01\x01\x62\x06proto3')
   ,
   dependencies=[google_dot_api_dot_annotations__pb2.DESCRIPTOR,])
 
@@ -42,8 +42,8 @@ _ALGORITHM = _descriptor.EnumDescriptor(
   ],
   containing_type=None,
   serialized_options=None,
-  serialized_start=715,
-  serialized_end=762,
+  serialized_start=845,
+  serialized_end=892,
 )
 _sym_db.RegisterEnumDescriptor(_ALGORITHM)
 
@@ -66,11 +66,23 @@ _BEHAVIOR = _descriptor.EnumDescriptor(
       name='GLOBAL', index=2, number=2,
       serialized_options=None,
       type=None),
+    _descriptor.EnumValueDescriptor(
+      name='REBASE_DURATION', index=3, number=4,
+      serialized_options=None,
+      type=None),
+    _descriptor.EnumValueDescriptor(
+      name='DRY_RUN', index=4, number=8,
+      serialized_options=None,
+      type=None),
+    _descriptor.EnumValueDescriptor(
+      name='NO_CLIENT_CACHE', index=5, number=16,
+      serialized_options=None,
+      type=None),
   ],
   containing_type=None,
   serialized_options=None,
-  serialized_start=764,
-  serialized_end=817,
+  serialized_start=894,
+  serialized_end=1002,
 )
 _sym_db.RegisterEnumDescriptor(_BEHAVIOR)
 
@@ -92,8 +104,8 @@ _STATUS = _descriptor.EnumDescriptor(
   ],
   containing_type=None,
   serialized_options=None,
-  serialized_start=819,
-  serialized_end=860,
+  serialized_start=1004,
+  serialized_end=1045,
 )
 _sym_db.RegisterEnumDescriptor(_STATUS)
 
@@ -103,6 +115,9 @@ LEAKY_BUCKET = 1
 BATCHING = 0
 NO_BATCHING = 1
 GLOBAL = 2
+REBASE_DURATION = 4
+DRY_RUN = 8
+NO_CLIENT_CACHE = 16
 UNDER_LIMIT = 0
 OVER_LIMIT = 1
 
@@ -226,6 +241,13 @@ _RATELIMITREQ = _descriptor.Descriptor(
       message_type=None, enum_type=None, containing_type=None,
       is_extension=False, extension_scope=None,
       serialized_options=None, file=DESCRIPTOR),
+    _descriptor.FieldDescriptor(
+      name='request_token', full_name='pb.gubernator.RateLimitReq.request_token', index=7,
+      number=8, type=9, cpp_type=9, label=1,
+      has_default_value=False, default_value=_b("").decode('utf-8'),
+      message_type=None, enum_type=None, containing_type=None,
+      is_extension=False, extension_scope=None,
+      serialized_options=None, file=DESCRIPTOR),
   ],
   extensions=[
   ],
@@ -239,7 +261,7 @@ _RATELIMITREQ = _descriptor.Descriptor(
   oneofs=[
   ],
   serialized_start=203,
-  serialized_end=386,
+  serialized_end=409,
 )
 
 
@@ -276,8 +298,8 @@ _RATELIMITRESP_METADATAENTRY = _descriptor.Descriptor(
   extension_ranges=[],
   oneofs=[
   ],
-  serialized_start=576,
-  serialized_end=623,
+  serialized_start=599,
+  serialized_end=646,
 )
 
 _RATELIMITRESP = _descriptor.Descriptor(
@@ -341,8 +363,8 @@ _RATELIMITRESP = _descriptor.Descriptor(
   extension_ranges=[],
   oneofs=[
   ],
-  serialized_start=389,
-  serialized_end=623,
+  serialized_start=412,
+  serialized_end=646,
 )
 
 
@@ -365,8 +387,8 @@ _HEALTHCHECKREQ = _descriptor.Descriptor(
   extension_ranges=[],
   oneofs=[
   ],
-  serialized_start=625,
-  serialized_end=641,
+  serialized_start=648,
+  serialized_end=664,
 )
 
 
@@ -398,6 +420,51 @@ _HEALTHCHECKRESP = _descriptor.Descriptor(
       message_type=None, enum_type=None, containing_type=None,
       is_extension=False, extension_scope=None,
       serialized_options=None, file=DESCRIPTOR),
+    _descriptor.FieldDescriptor(
+      name='peers', full_name='pb.gubernator.HealthCheckResp.peers', index=3,
+      number=4, type=11, cpp_type=10, label=3,
+      has_default_value=False, default_value=[],
+      message_type=None, enum_type=None, containing_type=None,
+      is_extension=False, extension_scope=None,
+      serialized_options=None, file=DESCRIPTOR),
+  ],
+  extensions=[
+  ],
+  nested_types=[],
+  enum_types=[
+  ],
+  serialized_options=None,
+  is_extendable=False,
+  syntax='proto3',
+  extension_ranges=[],
+  oneofs=[
+  ],
+  serialized_start=666,
+  serialized_end=784,
+)
+
+
+_PEERCAPABILITIES = _descriptor.Descriptor(
+  name='PeerCapabilities',
+  full_name='pb.gubernator.PeerCapabilities',
+  filename=None,
+  file=DESCRIPTOR,
+  containing_type=None,
+  fields=[
+    _descriptor.FieldDescriptor(
+      name='address', full_name='pb.gubernator.PeerCapabilities.address', index=0,
+      number=1, type=9, cpp_type=9, label=1,
+      has_default_value=False, default_value=_b("").decode('utf-8'),
+      message_type=None, enum_type=None, containing_type=None,
+      is_extension=False, extension_scope=None,
+      serialized_options=None, file=DESCRIPTOR),
+    _descriptor.FieldDescriptor(
+      name='capabilities', full_name='pb.gubernator.PeerCapabilities.capabilities', index=1,
+      number=2, type=9, cpp_type=9, label=3,
+      has_default_value=False, default_value=[],
+      message_type=None, enum_type=None, containing_type=None,
+      is_extension=False, extension_scope=None,
+      serialized_options=None, file=DESCRIPTOR),
   ],
   extensions=[
   ],
@@ -410,8 +477,8 @@ _HEALTHCHECKRESP = _descriptor.Descriptor(
   extension_ranges=[],
   oneofs=[
   ],
-  serialized_start=643,
-  serialized_end=713,
+  serialized_start=786,
+  serialized_end=843,
 )
 
 _GETRATELIMITSREQ.fields_by_name['requests'].message_type = _RATELIMITREQ
@@ -421,12 +488,14 @@ _RATELIMITREQ.fields_by_name['behavior'].enum_type = _BEHAVIOR
 _RATELIMITRESP_METADATAENTRY.containing_type = _RATELIMITRESP
 _RATELIMITRESP.fields_by_name['status'].enum_type = _STATUS
 _RATELIMITRESP.fields_by_name['metadata'].message_type = _RATELIMITRESP_METADATAENTRY
+_HEALTHCHECKRESP.fields_by_name['peers'].message_type = _PEERCAPABILITIES
 DESCRIPTOR.message_types_by_name['GetRateLimitsReq'] = _GETRATELIMITSREQ
 DESCRIPTOR.message_types_by_name['GetRateLimitsResp'] = _GETRATELIMITSRESP
 DESCRIPTOR.message_types_by_name['RateLimitReq'] = _RATELIMITREQ
 DESCRIPTOR.message_types_by_name['RateLimitResp'] = _RATELIMITRESP
 DESCRIPTOR.message_types_by_name['HealthCheckReq'] = _HEALTHCHECKREQ
 DESCRIPTOR.message_types_by_name['HealthCheckResp'] = _HEALTHCHECKRESP
+DESCRIPTOR.message_types_by_name['PeerCapabilities'] = _PEERCAPABILITIES
 DESCRIPTOR.enum_types_by_name['Algorithm'] = _ALGORITHM
 DESCRIPTOR.enum_types_by_name['Behavior'] = _BEHAVIOR
 DESCRIPTOR.enum_types_by_name['Status'] = _STATUS
@@ -482,6 +551,13 @@ HealthCheckResp = _reflection.GeneratedProtocolMessageType('HealthCheckResp', (_
   ))
 _sym_db.RegisterMessage(HealthCheckResp)
 
+PeerCapabilities = _reflection.GeneratedProtocolMessageType('PeerCapabilities', (_message.Message,), dict(
+  DESCRIPTOR = _PEERCAPABILITIES,
+  __module__ = 'gubernator_pb2'
+  # @@protoc_insertion_point(class_scope:pb.gubernator.PeerCapabilities)
+  ))
+_sym_db.RegisterMessage(PeerCapabilities)
+
 
 DESCRIPTOR._options = None
 _RATELIMITRESP_METADATAENTRY._options = None
@@ -492,8 +568,8 @@ _V1 = _descriptor.ServiceDescriptor(
   file=DESCRIPTOR,
   index=0,
   serialized_options=None,
-  serialized_start=863,
-  serialized_end=1084,
+  serialized_start=1048,
+  serialized_end=1269,
   methods=[
   _descriptor.MethodDescriptor(
     name='GetRateLimits',
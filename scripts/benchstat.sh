@@ -0,0 +1,51 @@
+#! /bin/sh
+
+# Copyright 2018-2019 Mailgun Technologies Inc
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+# http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+
+# Runs the micro benchmarks of the bench package against the base branch and the
+# current checkout, then compares the results with benchstat. IE: in CI
+#
+#   BASE=origin/master ./scripts/benchstat.sh
+#
+# Requires benchstat; go install golang.org/x/perf/cmd/benchstat@latest
+
+# Make sure the script fails fast.
+set -e
+set -u
+
+BASE=${BASE:-master}
+COUNT=${COUNT:-10}
+BENCH=${BENCH:-.}
+OUT=$(mktemp -d)
+
+cleanup() {
+    git worktree remove --force $OUT/base > /dev/null 2>&1 || true
+    rm -rf $OUT
+}
+trap cleanup EXIT
+
+git worktree add --detach $OUT/base $BASE > /dev/null
+
+# The bench package may not exist on the base branch yet
+if [ ! -d $OUT/base/bench ]; then
+    echo "base '$BASE' has no bench package; nothing to compare" >&2
+    exit 0
+fi
+
+(cd $OUT/base && go test -run XXX -bench "$BENCH" -benchmem -count $COUNT ./bench/) | tee $OUT/base.txt
+go test -run XXX -bench "$BENCH" -benchmem -count $COUNT ./bench/ | tee $OUT/head.txt
+
+benchstat $OUT/base.txt $OUT/head.txt
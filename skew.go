@@ -0,0 +1,180 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mailgun/holster"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// The weight of each new sample in the moving average of the clock offset of a peer
+const skewWeight = 0.2
+
+// Offsets smaller than this many milliseconds can not be told apart from network latency,
+// as such they are not applied to the times received from a peer.
+const skewTolerance = 20
+
+// The min time between warnings about rate limits which are shorter than the skew with a peer
+const skewWarnInterval = time.Minute
+
+// skewTracker estimates the offset between the local clock and the clock of each peer from the times
+// the peers report in their messages, such that the reset times computed by a peer can be converted to
+// the local clock. Without it, the statuses sent by a peer whose clock is behind by more than the
+// duration of a rate limit are already expired when they arrive, which silently resets the rate limit.
+//
+// skewTracker is safe for concurrent use.
+type skewTracker struct {
+	clock  holster.Clock
+	log    *logrus.Entry
+	metric *prometheus.Desc
+
+	mutex sync.Mutex
+	self  string               // protected by mutex
+	peers map[string]*peerSkew // protected by mutex
+}
+
+type peerSkew struct {
+	// The moving average of the milliseconds the clock of the peer is ahead of the local clock
+	offset float64
+	// When a rate limit shorter than the skew was last reported
+	warned time.Time
+}
+
+func newSkewTracker(clock holster.Clock) *skewTracker {
+	return &skewTracker{
+		clock: clock,
+		log:   log.WithField("category", "clock-skew"),
+		metric: prometheus.NewDesc("peer_clock_skew_seconds",
+			"The estimated seconds the clock of each peer is ahead of the local clock.", []string{"peer"}, nil),
+		peers: make(map[string]*peerSkew),
+	}
+}
+
+// now returns the time of the local clock in milliseconds since the epoch
+func (s *skewTracker) now() int64 {
+	return s.clock.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// sender returns the advertised address of this instance, which identifies it to its peers
+func (s *skewTracker) sender() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.self
+}
+
+// setPeers records the address of this instance and forgets the offsets of peers which left the cluster
+func (s *skewTracker) setPeers(peers []PeerInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.self = ""
+	current := make(map[string]struct{}, len(peers))
+	for _, peer := range peers {
+		if peer.IsOwner {
+			s.self = peer.Address
+		}
+		current[peer.Address] = struct{}{}
+	}
+	for addr := range s.peers {
+		if _, ok := current[addr]; !ok {
+			delete(s.peers, addr)
+		}
+	}
+}
+
+// observe records that the clock of `peer` read `peerTime` when the local clock read `localTime` and
+// returns the milliseconds to subtract from the times sent by the peer to convert them to the local clock.
+// Returns zero if the peer did not report its time or the offset is within the skewTolerance.
+func (s *skewTracker) observe(peer string, peerTime, localTime int64) int64 {
+	if peer == "" || peerTime == 0 {
+		return 0
+	}
+	sample := float64(peerTime - localTime)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, ok := s.peers[peer]
+	if !ok {
+		p = &peerSkew{offset: sample}
+		s.peers[peer] = p
+	} else {
+		p.offset += skewWeight * (sample - p.offset)
+	}
+
+	offset := int64(math.Round(p.offset))
+	if offset > -skewTolerance && offset < skewTolerance {
+		return 0
+	}
+	return offset
+}
+
+// checkDurations logs a warning if any of the rate limits sent to `peer` is shorter than the offset with
+// the clock of the peer, as any error in the estimate of the offset could expire such rate limits early.
+func (s *skewTracker) checkDurations(peer string, offset int64, reqs []*RateLimitReq) {
+	skew := offset
+	if skew < 0 {
+		skew = -skew
+	}
+
+	for _, r := range reqs {
+		if r.Duration >= skew {
+			continue
+		}
+
+		s.mutex.Lock()
+		p, ok := s.peers[peer]
+		now := s.clock.Now()
+		if !ok || now.Sub(p.warned) < skewWarnInterval {
+			s.mutex.Unlock()
+			return
+		}
+		p.warned = now
+		s.mutex.Unlock()
+
+		s.log.WithField("peer", peer).Warnf("rate limit '%s' has a duration of '%s' which is shorter "+
+			"than the '%s' clock skew with the peer; check the clocks of the peers are synchronized",
+			r.Name, time.Duration(r.Duration)*time.Millisecond, time.Duration(skew)*time.Millisecond)
+		return
+	}
+}
+
+// toLocal converts a time sent by a peer to the local clock, zero is not a time and is returned unchanged
+func toLocal(t, offset int64) int64 {
+	if t == 0 {
+		return 0
+	}
+	return addTime(t, -offset)
+}
+
+func (s *skewTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.metric
+}
+
+func (s *skewTracker) Collect(ch chan<- prometheus.Metric) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for addr, p := range s.peers {
+		ch <- prometheus.MustNewConstMetric(s.metric, prometheus.GaugeValue, p.offset/1000, addr)
+	}
+}
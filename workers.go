@@ -0,0 +1,332 @@
+/*
+Copyright 2018-2019 Mailgun Technologies Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gubernator
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mailgun/gubernator/cache"
+	"github.com/mailgun/holster"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errPoolClosed is returned by the worker pool and the global manager once closed; IE: a request received
+// after Instance.Close()
+var errPoolClosed = status.Error(codes.Unavailable, "instance is closed; no longer accepting rate limits")
+
+// workerPool partitions rate limits across workers by the hash of the rate limit key. Each
+// worker owns a private shard of the cache which only the worker goroutine accesses, as
+// such requests for different shards never contend. The worker still takes the lock of
+// the shard for each job, as Unlock() calls the eviction listeners, the capacity callback
+// and the write through queued by the job. Walking the shards and collecting metrics
+// don't queue behind the jobs of the workers; they take the lock or read atomic counts.
+type workerPool struct {
+	workers []*worker
+	seed    maphash.Seed
+	// Held for reading while a job is sent to a worker and runs, such that close() waits for the jobs in flight
+	mutex  sync.RWMutex
+	closed bool // protected by mutex
+
+	sizeMetric    *prometheus.Desc
+	accessMetric  *prometheus.Desc
+	removalMetric *prometheus.Desc
+}
+
+type worker struct {
+	cache  *cache.LRUCache
+	dedupe *cache.LRUCache
+	jobs   chan workerJob
+	apply  applyFunc
+	// The namespaces of the instance, and the cache partitions of the worker for them
+	namespaces *atomic.Pointer[namespaceSet]
+	partitions *partitions
+}
+
+type workerJob struct {
+	fn func(c cache.Cache, dedupe *cache.LRUCache)
+	// Runs instead of `fn` without holding the lock of a cache, IE: to access several caches of the worker
+	worker func(w *worker)
+	// Applies a rate limit instead of `fn`, see workerPool.apply()
+	apply *applyJob
+	done  chan struct{}
+	// The key of the rate limit `fn` accesses, which picks the cache partition of its namespace
+	key string
+}
+
+// applyFunc applies the rate limit held by `key` with the caches provided, see Instance.applyRateLimit()
+type applyFunc func(c cache.Cache, dedupe *cache.LRUCache, key string, r *RateLimitReq) (*RateLimitResp, error)
+
+// applyJob is the rate limit applied by a worker and its result. Unlike the closure passed to do() it is
+// pooled along with the channel which signals it is done, as a job is sent for every rate limit we own.
+type applyJob struct {
+	req  *RateLimitReq
+	resp *RateLimitResp
+	err  error
+	done chan struct{}
+}
+
+var applyJobPool = sync.Pool{
+	New: func() interface{} {
+		return &applyJob{done: make(chan struct{}, 1)}
+	},
+}
+
+func newWorkerPool(size, cacheSize, dedupeSize int, clock holster.Clock, budget *cache.Budget,
+	namespaces *atomic.Pointer[namespaceSet], apply applyFunc) *workerPool {
+	p := &workerPool{
+		workers: make([]*worker, size),
+		seed:    maphash.MakeSeed(),
+		sizeMetric: prometheus.NewDesc("cache_size",
+			"Size of the LRU Cache which holds the rate limits.", nil, nil),
+		accessMetric: prometheus.NewDesc("cache_access_count",
+			"Cache access counts.", []string{"type"}, nil),
+		removalMetric: prometheus.NewDesc("cache_removals_total",
+			"The number of entries removed from the cache by reason.", []string{"reason"}, nil),
+	}
+
+	for i := range p.workers {
+		w := &worker{
+			cache:  cache.NewLRUCache(shardSize(cacheSize, size)),
+			dedupe: cache.NewLRUCache(shardSize(dedupeSize, size)),
+			jobs:   make(chan workerJob, 1000),
+			apply:  apply,
+
+			namespaces: namespaces,
+			partitions: newPartitions(size, clock, budget),
+		}
+		w.cache.SetClock(clock)
+		w.dedupe.SetClock(clock)
+		if budget != nil {
+			w.cache.SetBudget(budget)
+			w.dedupe.SetBudget(budget)
+		}
+		go w.run()
+		p.workers[i] = w
+	}
+	return p
+}
+
+// shardSize divides the total size across shards, never returning zero which means unbounded
+func shardSize(total, shards int) int {
+	if size := total / shards; size > 0 {
+		return size
+	}
+	return 1
+}
+
+func (w *worker) run() {
+	for job := range w.jobs {
+		if job.worker != nil {
+			job.worker(w)
+			close(job.done)
+			continue
+		}
+
+		c := w.cacheFor(job.key)
+		c.Lock()
+		w.dedupe.Lock()
+		if job.apply != nil {
+			job.apply.resp, job.apply.err = w.apply(c, w.dedupe, job.key, job.apply.req)
+		} else {
+			job.fn(c, w.dedupe)
+		}
+		w.dedupe.Unlock()
+		c.Unlock()
+		if job.apply != nil {
+			job.apply.done <- struct{}{}
+			continue
+		}
+		close(job.done)
+	}
+}
+
+// cacheFor returns the cache which holds the rate limit for `key`, the partition of its namespace if it has one
+func (w *worker) cacheFor(key string) *cache.LRUCache {
+	if key != "" {
+		if c := w.partitions.forKey(w.namespaces.Load(), key); c != nil {
+			return c
+		}
+	}
+	return w.cache
+}
+
+// index returns the index of the worker which owns `key`
+func (p *workerPool) index(key string) int {
+	return int(maphash.String(p.seed, key) % uint64(len(p.workers)))
+}
+
+// do runs `fn` on the worker which owns `key` and waits for it to complete. Returns errPoolClosed without
+// running `fn` if the pool is closed.
+func (p *workerPool) do(key string, fn func(c cache.Cache, dedupe *cache.LRUCache)) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.closed {
+		return errPoolClosed
+	}
+
+	w := p.workers[p.index(key)]
+	done := make(chan struct{})
+	w.jobs <- workerJob{fn: fn, done: done, key: key}
+	<-done
+	return nil
+}
+
+// apply applies the rate limit `r` held by `key` by the worker which owns it, like do() without allocating
+// per request. Returns errPoolClosed if the pool is closed.
+func (p *workerPool) apply(key string, r *RateLimitReq) (*RateLimitResp, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.closed {
+		return nil, errPoolClosed
+	}
+
+	job := applyJobPool.Get().(*applyJob)
+	job.req = r
+	p.workers[p.index(key)].jobs <- workerJob{apply: job, key: key}
+	<-job.done
+	rl, err := job.resp, job.err
+	job.req, job.resp, job.err = nil, nil, nil
+	applyJobPool.Put(job)
+	return rl, err
+}
+
+// addAll adds the items to the caches of the workers which own them. Each worker is sent a single
+// job with all of its items, and the jobs run concurrently. Returns errPoolClosed if the pool is closed.
+func (p *workerPool) addAll(items []cache.Item) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.closed {
+		return errPoolClosed
+	}
+
+	shards := make([][]cache.Item, len(p.workers))
+	for _, item := range items {
+		i := p.index(item.Key)
+		shards[i] = append(shards[i], item)
+	}
+
+	dones := make([]chan struct{}, 0, len(p.workers))
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		w, shard := p.workers[i], shard
+		done := make(chan struct{})
+		w.jobs <- workerJob{worker: func(w *worker) { w.addAll(shard) }, done: done}
+		dones = append(dones, done)
+	}
+
+	for _, done := range dones {
+		<-done
+	}
+	return nil
+}
+
+// addAll adds the items to the caches which hold them, the caller must be the worker
+func (w *worker) addAll(items []cache.Item) {
+	if w.namespaces.Load() == nil {
+		w.cache.Lock()
+		w.cache.MAdd(items)
+		w.cache.Unlock()
+		return
+	}
+	for _, item := range items {
+		c := w.cacheFor(item.Key)
+		c.Lock()
+		c.Add(item.Key, item.Value, item.ExpireAt)
+		c.Unlock()
+	}
+}
+
+// each runs `fn` with the cache of every worker and each of its partitions. `fn` runs on the caller, as such
+// it must take the lock of the cache or only read its atomic counts.
+func (p *workerPool) each(fn func(c *cache.LRUCache)) {
+	for _, w := range p.workers {
+		fn(w.cache)
+		w.partitions.each(func(_ string, c *cache.LRUCache) { fn(c) })
+	}
+}
+
+// eachPartition runs `fn` with each partition of every worker and the name of its namespace, like each()
+func (p *workerPool) eachPartition(fn func(name string, c *cache.LRUCache)) {
+	for _, w := range p.workers {
+		w.partitions.each(fn)
+	}
+}
+
+// prune drops the partitions of the namespaces no longer in the set, see partitions.prune()
+func (p *workerPool) prune(set *namespaceSet) {
+	for _, w := range p.workers {
+		w.partitions.prune(set)
+	}
+}
+
+func (p *workerPool) consistencyCheck() error {
+	var err error
+	p.each(func(c *cache.LRUCache) {
+		if err == nil {
+			err = c.ConsistencyCheck()
+		}
+	})
+	return err
+}
+
+// close stops the workers once the jobs in flight complete, later jobs fail with errPoolClosed
+func (p *workerPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	for _, w := range p.workers {
+		close(w.jobs)
+	}
+}
+
+// Describe fetches prometheus metrics to be registered
+func (p *workerPool) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.sizeMetric
+	ch <- p.accessMetric
+	ch <- p.removalMetric
+}
+
+// Collect fetches the cache metrics summed across all the workers, by reading the atomic counts of the caches
+func (p *workerPool) Collect(ch chan<- prometheus.Metric) {
+	var total cache.Stats
+	p.each(func(c *cache.LRUCache) {
+		stats := c.LiveStats()
+		total.Size += stats.Size
+		total.Hit += stats.Hit
+		total.Miss += stats.Miss
+		for i, n := range stats.Removals {
+			total.Removals[i] += n
+		}
+	})
+
+	ch <- prometheus.MustNewConstMetric(p.accessMetric, prometheus.CounterValue, float64(total.Hit), "hit")
+	ch <- prometheus.MustNewConstMetric(p.accessMetric, prometheus.CounterValue, float64(total.Miss), "miss")
+	ch <- prometheus.MustNewConstMetric(p.sizeMetric, prometheus.GaugeValue, float64(total.Size))
+	for i, n := range total.Removals {
+		ch <- prometheus.MustNewConstMetric(p.removalMetric, prometheus.CounterValue, float64(n),
+			cache.RemovalReason(i).String())
+	}
+}